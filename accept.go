@@ -0,0 +1,50 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"strconv"
+)
+
+// AcceptPriorityFunc returns the priority, from 0 (highest) to 7, in
+// which a stream received from the remote is queued for the stream
+// handler.
+type AcceptPriorityFunc func(stream *Stream) uint8
+
+// SetAcceptPriority sets the function ordering the streams received
+// from the remote while they wait for the stream handler, replacing the
+// priority sent by the remote.  Frames are queued per frame worker, so
+// the pending streams of the same worker are handled in priority order,
+// and in arrival order for equal priorities.  The priority applies to
+// all later frames of the stream, keeping them behind the stream itself.
+// Must be called before Serve.
+func (s *Connection) SetAcceptPriority(f AcceptPriorityFunc) {
+	s.acceptPriority = f
+}
+
+// HeaderAcceptPriority returns an AcceptPriorityFunc taking the priority
+// of streams from the header name, falling back to the priority sent by
+// the remote when the header is missing or invalid.
+func HeaderAcceptPriority(name string) AcceptPriorityFunc {
+	return func(stream *Stream) uint8 {
+		priority, err := strconv.ParseUint(stream.headers.Get(name), 10, 8)
+		if err != nil || priority > 7 {
+			return stream.priority
+		}
+		return uint8(priority)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+// AcceptedStream is a stream opened by the remote together with the
+// metadata of its creation, see AcceptedStreamHandler.
+type AcceptedStream struct {
+	// Stream is the accepted stream, to be replied to as usual.
+	Stream *Stream
+	// Headers are the headers the stream was created with.
+	Headers http.Header
+	// Parent is the stream the stream is associated to, nil if none or
+	// if the parent was already gone when the stream arrived.
+	Parent *Stream
+	// Priority is the priority of the stream once accepted, which may
+	// have been changed from the requested one by SetAcceptPriority.
+	Priority uint8
+	// Unidirectional is set when the remote created the stream without
+	// expecting data back, the local side is then already finished.
+	Unidirectional bool
+	// RemoteAddr is the address of the remote of the connection.
+	RemoteAddr net.Addr
+	// TLS is the state of the TLS connection underlying the connection,
+	// nil if it does not use TLS.
+	TLS *tls.ConnectionState
+	// Arrived is when the frame creating the stream was received.
+	Arrived time.Time
+}
+
+// AcceptedStreamHandler returns a stream handler passing the streams
+// opened by the remote to handler along with their metadata, for
+// servers which would otherwise derive it from the stream and its
+// connection.  As with any stream handler, handler runs in the frame
+// worker of the stream.
+func AcceptedStreamHandler(handler func(*AcceptedStream)) StreamHandler {
+	return func(stream *Stream) {
+		handler(newAcceptedStream(stream))
+	}
+}
+
+func newAcceptedStream(stream *Stream) *AcceptedStream {
+	accepted := &AcceptedStream{
+		Stream:         stream,
+		Headers:        stream.headers,
+		Parent:         stream.parent,
+		Priority:       stream.priority,
+		Unidirectional: stream.unidirectional,
+		RemoteAddr:     stream.RemoteAddr(),
+		Arrived:        stream.arrived,
+	}
+	if state, ok := stream.TLSConnectionState(); ok {
+		accepted.TLS = &state
+	}
+	return accepted
+}
@@ -0,0 +1,112 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+func TestAcceptedStreamHandler(t *testing.T) {
+	clientConn, serverConn := Loopback(0)
+	server, err := NewConnection(serverConn, true)
+	if err != nil {
+		t.Fatalf("Error creating server connection: %s", err)
+	}
+	server.SetAcceptPriority(func(stream *Stream) uint8 {
+		if stream.Headers().Get("Class") == "bulk" {
+			return 7
+		}
+		return 8
+	})
+	accepted := make(chan *AcceptedStream, 2)
+	go server.Serve(AcceptedStreamHandler(func(stream *AcceptedStream) {
+		accepted <- stream
+	}))
+	defer server.Close()
+
+	framer, err := spdy.NewFramer(clientConn, clientConn)
+	if err != nil {
+		t.Fatalf("Error creating framer: %s", err)
+	}
+	go func() {
+		for {
+			if _, err := framer.ReadFrame(); err != nil {
+				return
+			}
+		}
+	}()
+
+	before := time.Now()
+	frames := []*spdy.SynStreamFrame{
+		{StreamId: 1, Priority: 2, Headers: http.Header{"Name": []string{"parent"}}},
+		{
+			StreamId:             3,
+			AssociatedToStreamId: 1,
+			Priority:             1,
+			Headers:              http.Header{"Name": []string{"child"}, "Class": []string{"bulk"}},
+			CFHeader:             spdy.ControlFrameHeader{Flags: spdy.ControlFlagUnidirectional},
+		},
+	}
+	for _, frame := range frames {
+		if err := framer.WriteFrame(frame); err != nil {
+			t.Fatalf("Error writing stream frame: %s", err)
+		}
+	}
+
+	streams := map[string]*AcceptedStream{}
+	for i := 0; i < 2; i++ {
+		select {
+		case stream := <-accepted:
+			streams[stream.Headers.Get("Name")] = stream
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for stream")
+		}
+	}
+	after := time.Now()
+
+	parent, child := streams["parent"], streams["child"]
+	if parent == nil || child == nil {
+		t.Fatalf("Unexpected streams: %v", streams)
+	}
+	if parent.Parent != nil || child.Parent != parent.Stream {
+		t.Fatalf("Unexpected parents: %v, %v", parent.Parent, child.Parent)
+	}
+	if parent.Priority != 2 || child.Priority != 7 {
+		t.Fatalf("Unexpected priorities:\nActual: %d, %d\nExpected: %d, %d", parent.Priority, child.Priority, 2, 7)
+	}
+	if parent.Unidirectional || !child.Unidirectional {
+		t.Fatalf("Unexpected unidirectional flags:\nActual: %t, %t\nExpected: %t, %t", parent.Unidirectional, child.Unidirectional, false, true)
+	}
+	if !child.Stream.IsFinished() {
+		t.Fatal("Unidirectional stream not finished locally")
+	}
+	for _, stream := range []*AcceptedStream{parent, child} {
+		if stream.Arrived.Before(before) || stream.Arrived.After(after) {
+			t.Fatalf("Unexpected arrival time %v, not between %v and %v", stream.Arrived, before, after)
+		}
+		if stream.RemoteAddr == nil || stream.RemoteAddr.Network() != "loopback" {
+			t.Fatalf("Unexpected remote address: %v", stream.RemoteAddr)
+		}
+		if stream.TLS != nil {
+			t.Fatalf("Unexpected TLS state without TLS: %+v", stream.TLS)
+		}
+	}
+}
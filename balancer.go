@@ -0,0 +1,123 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+)
+
+// PoolConn describes an endpoint of a Pool to a Balancer.
+type PoolConn struct {
+	// Addr is the network address of the endpoint.
+	Addr string
+	// Conn is the connection to the endpoint, nil if not connected.
+	Conn *Connection
+	// RTT is the last measured round trip time of the connection, zero
+	// if not measured, see Pool.PingInterval.
+	RTT time.Duration
+}
+
+// Balancer picks the endpoint of a pool a new stream is placed on.
+type Balancer interface {
+	// Pick returns the index in conns of the endpoint to use for a
+	// stream with the given key, which is empty unless the stream was
+	// created with a key.  Conns is never empty and sorted by address.
+	// The pool connects to the endpoint if it has no connection.
+	Pick(conns []PoolConn, key string) int
+}
+
+// BalancerFunc adapts a function to the Balancer interface.
+type BalancerFunc func(conns []PoolConn, key string) int
+
+// Pick calls f(conns, key).
+func (f BalancerFunc) Pick(conns []PoolConn, key string) int {
+	return f(conns, key)
+}
+
+// LeastStreamsBalancer picks the connection with the fewest active
+// streams, connecting to an endpoint only if there is no connection.
+var LeastStreamsBalancer Balancer = BalancerFunc(leastStreams)
+
+func leastStreams(conns []PoolConn, key string) int {
+	picked, pickedStreams := 0, -1
+	for i, conn := range conns {
+		if conn.Conn == nil {
+			continue
+		}
+		if streams := conn.Conn.NumActiveStreams(); pickedStreams < 0 || streams < pickedStreams {
+			picked, pickedStreams = i, streams
+		}
+	}
+	return picked
+}
+
+// LowestRTTBalancer picks the connection with the lowest measured round
+// trip time, falling back to LeastStreamsBalancer until round trip times
+// are measured.
+var LowestRTTBalancer Balancer = BalancerFunc(lowestRTT)
+
+func lowestRTT(conns []PoolConn, key string) int {
+	picked := -1
+	for i, conn := range conns {
+		if conn.Conn == nil || conn.RTT == 0 {
+			continue
+		}
+		if picked < 0 || conn.RTT < conns[picked].RTT {
+			picked = i
+		}
+	}
+	if picked < 0 {
+		return leastStreams(conns, key)
+	}
+	return picked
+}
+
+// ConsistentHashBalancer picks the endpoint for a stream key by
+// rendezvous hashing, so streams with the same key are placed on the same
+// endpoint while the set of endpoints is unchanged, and only the keys of
+// a removed endpoint move.  Streams without key are placed as by
+// LeastStreamsBalancer.
+var ConsistentHashBalancer Balancer = BalancerFunc(consistentHash)
+
+func consistentHash(conns []PoolConn, key string) int {
+	if key == "" {
+		return leastStreams(conns, key)
+	}
+	picked := 0
+	var pickedWeight uint64
+	for i, conn := range conns {
+		h := fnv.New64a()
+		h.Write([]byte(conn.Addr))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if weight := h.Sum64(); i == 0 || weight > pickedWeight {
+			picked, pickedWeight = i, weight
+		}
+	}
+	return picked
+}
+
+// NewRoundRobinBalancer returns a balancer cycling through the endpoints,
+// connecting to each in turn.
+func NewRoundRobinBalancer() Balancer {
+	var next uint32
+	return BalancerFunc(func(conns []PoolConn, key string) int {
+		return int((atomic.AddUint32(&next, 1) - 1) % uint32(len(conns)))
+	})
+}
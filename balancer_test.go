@@ -0,0 +1,150 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+// newBalancerTestConn returns a connection with the given number of
+// active streams, usable only for balancing.
+func newBalancerTestConn(streams int) *Connection {
+	conn := &Connection{streams: newStreamTable()}
+	for i := 0; i < streams; i++ {
+		conn.streams.add(&Stream{streamId: spdy.StreamId(2*i + 1)})
+	}
+	return conn
+}
+
+func TestLeastStreamsBalancer(t *testing.T) {
+	conns := []PoolConn{
+		{Addr: "a", Conn: newBalancerTestConn(3)},
+		{Addr: "b"},
+		{Addr: "c", Conn: newBalancerTestConn(1)},
+		{Addr: "d", Conn: newBalancerTestConn(2)},
+	}
+	if picked := LeastStreamsBalancer.Pick(conns, ""); picked != 2 {
+		t.Fatalf("Unexpected pick:\nActual: %d\nExpected: 2", picked)
+	}
+	if picked := LeastStreamsBalancer.Pick([]PoolConn{{Addr: "a"}, {Addr: "b"}}, ""); picked != 0 {
+		t.Fatalf("Unexpected pick without connections:\nActual: %d\nExpected: 0", picked)
+	}
+}
+
+func TestLowestRTTBalancer(t *testing.T) {
+	conns := []PoolConn{
+		{Addr: "a", Conn: newBalancerTestConn(0), RTT: 30 * time.Millisecond},
+		{Addr: "b", Conn: newBalancerTestConn(5), RTT: 10 * time.Millisecond},
+		{Addr: "c", Conn: newBalancerTestConn(0)},
+	}
+	if picked := LowestRTTBalancer.Pick(conns, ""); picked != 1 {
+		t.Fatalf("Unexpected pick:\nActual: %d\nExpected: 1", picked)
+	}
+	conns[0].RTT, conns[1].RTT = 0, 0
+	if picked := LowestRTTBalancer.Pick(conns, ""); picked != 0 {
+		t.Fatalf("Unexpected pick without round trip times:\nActual: %d\nExpected: 0", picked)
+	}
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	var conns []PoolConn
+	for i := 0; i < 5; i++ {
+		conns = append(conns, PoolConn{Addr: fmt.Sprintf("10.0.0.%d:443", i)})
+	}
+	picks := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		picks[key] = conns[ConsistentHashBalancer.Pick(conns, key)].Addr
+		if again := conns[ConsistentHashBalancer.Pick(conns, key)].Addr; again != picks[key] {
+			t.Fatalf("Unstable pick for %s:\nActual: %s\nExpected: %s", key, again, picks[key])
+		}
+	}
+
+	// removing an endpoint only moves the keys placed on it
+	removed := conns[2].Addr
+	remaining := append(append([]PoolConn{}, conns[:2]...), conns[3:]...)
+	for key, addr := range picks {
+		picked := remaining[ConsistentHashBalancer.Pick(remaining, key)].Addr
+		if addr != removed && picked != addr {
+			t.Fatalf("Key %s moved from %s to %s", key, addr, picked)
+		}
+	}
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	serverA := newPoolTestServer(t)
+	defer serverA.Close()
+	serverB := newPoolTestServer(t)
+	defer serverB.Close()
+
+	pool := &Pool{
+		URL:         "http://spdy.invalid",
+		Balancer:    NewRoundRobinBalancer(),
+		LookupAddrs: staticAddrs(serverA.addr(t), serverB.addr(t)),
+	}
+	defer pool.Close()
+
+	var conns []*Connection
+	for i := 0; i < 4; i++ {
+		stream, err := pool.CreateStream(http.Header{}, false)
+		if err != nil {
+			t.Fatalf("Error creating stream: %s", err)
+		}
+		if err := stream.Wait(); err != nil {
+			t.Fatalf("Error waiting for stream: %s", err)
+		}
+		conns = append(conns, stream.conn)
+	}
+	if conns[0] == conns[1] || conns[0] != conns[2] || conns[1] != conns[3] {
+		t.Fatalf("Streams not placed round robin: %v", conns)
+	}
+}
+
+func TestPoolPingInterval(t *testing.T) {
+	server := newPoolTestServer(t)
+	defer server.Close()
+
+	pool := &Pool{
+		URL:          server.URL,
+		Balancer:     LowestRTTBalancer,
+		PingInterval: 10 * time.Millisecond,
+	}
+	defer pool.Close()
+	testPoolEcho(t, pool)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		pool.lock.Lock()
+		var rtt time.Duration
+		for _, endpoint := range pool.endpoints {
+			rtt = endpoint.rtt
+		}
+		pool.lock.Unlock()
+		if rtt > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for round trip time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"sort"
+	"time"
+)
+
+// BreakerState is the state of the circuit breaker of a pool endpoint.
+type BreakerState int
+
+const (
+	// BreakerClosed allows connecting to the endpoint.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen stops connecting to the endpoint and placing streams
+	// on it until the cooldown passed.
+	BreakerOpen
+	// BreakerHalfOpen allows a trial connection after the cooldown, a
+	// failure opens the breaker again.
+	BreakerHalfOpen
+)
+
+func (b BreakerState) String() string {
+	switch b {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// EndpointStats describes an endpoint of a pool.
+type EndpointStats struct {
+	Addr      string
+	Connected bool
+	RTT       time.Duration
+	// Failures is the number of consecutive connection or ping failures.
+	Failures int
+	Breaker  BreakerState
+}
+
+// PoolStats holds the state of the endpoints of a pool.
+type PoolStats struct {
+	Endpoints []EndpointStats
+}
+
+// Stats returns the state of the pool endpoints, sorted by address.
+func (p *Pool) Stats() PoolStats {
+	p.init()
+
+	now := time.Now()
+	p.lock.Lock()
+	stats := PoolStats{Endpoints: make([]EndpointStats, 0, len(p.endpoints))}
+	for _, endpoint := range p.endpoints {
+		stats.Endpoints = append(stats.Endpoints, EndpointStats{
+			Addr:      endpoint.addr,
+			Connected: endpoint.conn != nil,
+			RTT:       endpoint.rtt,
+			Failures:  endpoint.failures,
+			Breaker:   p.breakerState(endpoint, now),
+		})
+	}
+	p.lock.Unlock()
+	sort.Slice(stats.Endpoints, func(i, j int) bool {
+		return stats.Endpoints[i].Addr < stats.Endpoints[j].Addr
+	})
+	return stats
+}
+
+// breakerState returns the breaker state of endpoint, called with the
+// pool lock held.
+func (p *Pool) breakerState(endpoint *poolEndpoint, now time.Time) BreakerState {
+	if p.BreakerThreshold <= 0 || endpoint.failures < p.BreakerThreshold {
+		return BreakerClosed
+	}
+	if now.Before(endpoint.openUntil) {
+		return BreakerOpen
+	}
+	return BreakerHalfOpen
+}
+
+// recordFailure counts a failed connection attempt or ping of endpoint,
+// opening its breaker once the threshold is reached.
+func (p *Pool) recordFailure(endpoint *poolEndpoint) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	endpoint.failures++
+	if p.BreakerThreshold > 0 && endpoint.failures >= p.BreakerThreshold {
+		cooldown := p.BreakerCooldown
+		if cooldown <= 0 {
+			cooldown = 30 * time.Second
+		}
+		endpoint.openUntil = time.Now().Add(cooldown)
+		debugMessage("(%p) Breaker opened for %s after %d failures", p, endpoint.addr, endpoint.failures)
+	}
+}
+
+// recordSuccess resets the failures of endpoint, closing its breaker.
+func (p *Pool) recordSuccess(endpoint *poolEndpoint) {
+	p.lock.Lock()
+	endpoint.failures = 0
+	endpoint.openUntil = time.Time{}
+	p.lock.Unlock()
+}
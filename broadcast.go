@@ -0,0 +1,59 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"fmt"
+	"sync"
+)
+
+// BroadcastError is returned by Broadcast when the data could not be
+// written to some of the streams, holding the error of each of them.
+type BroadcastError struct {
+	Errors map[*Stream]error
+}
+
+func (e *BroadcastError) Error() string {
+	return fmt.Sprintf("broadcast failed on %d streams", len(e.Errors))
+}
+
+// Broadcast writes data to every stream, concurrently so that a slow
+// connection does not delay the streams of the others.  The same buffer
+// is written to each stream without being copied, it must not be
+// modified until Broadcast returns.  A *BroadcastError is returned if
+// the write failed on any stream, the other streams received the data.
+func Broadcast(streams []*Stream, data []byte) error {
+	var wg sync.WaitGroup
+	var errLock sync.Mutex
+	errs := map[*Stream]error{}
+	for _, stream := range streams {
+		wg.Add(1)
+		go func(stream *Stream) {
+			defer wg.Done()
+			if err := stream.WriteData(data, false); err != nil {
+				errLock.Lock()
+				errs[stream] = err
+				errLock.Unlock()
+			}
+		}(stream)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return &BroadcastError{Errors: errs}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package capture records the traffic of a connection as a pcapng file.
+//
+// The data read and written is wrapped in synthesized IPv4 and TCP
+// headers so that tools such as Wireshark can reassemble the stream and
+// decode it with their SPDY dissector.  Wrapping the connection inside
+// TLS, before passing it to spdystream.NewConnection, records the
+// decrypted frames.
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	blockTypeSectionHeader  = 0x0A0D0D0A
+	blockTypeInterface      = 0x00000001
+	blockTypeEnhancedPacket = 0x00000006
+	byteOrderMagic          = 0x1A2B3C4D
+
+	// linkTypeRaw is LINKTYPE_RAW, packets start with an IP header.
+	linkTypeRaw = 101
+
+	ipHeaderLen  = 20
+	tcpHeaderLen = 20
+	maxPayload   = 65535 - ipHeaderLen - tcpHeaderLen
+
+	tcpFlagPsh = 0x08
+	tcpFlagAck = 0x10
+)
+
+// endpoint is one side of the synthesized TCP connection.
+type endpoint struct {
+	ip   [4]byte
+	port uint16
+	seq  uint32
+}
+
+// Conn is a net.Conn recording its traffic as pcapng.
+type Conn struct {
+	net.Conn
+
+	lock   sync.Mutex
+	w      io.Writer
+	err    error
+	local  endpoint
+	remote endpoint
+}
+
+// NewConn returns a connection recording all data read from and written
+// to conn into w.  The pcapng section and interface headers are written
+// before NewConn returns.  Errors writing the capture do not affect the
+// connection, they stop the capture and are reported by Err.
+func NewConn(conn net.Conn, w io.Writer) (*Conn, error) {
+	c := &Conn{
+		Conn:   conn,
+		w:      w,
+		local:  newEndpoint(conn.LocalAddr(), [4]byte{127, 0, 0, 1}, 1),
+		remote: newEndpoint(conn.RemoteAddr(), [4]byte{127, 0, 0, 2}, 2),
+	}
+	if err := c.writeHeaders(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newEndpoint(addr net.Addr, defaultIP [4]byte, defaultPort uint16) endpoint {
+	e := endpoint{ip: defaultIP, port: defaultPort, seq: 1}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+			copy(e.ip[:], ip4)
+		}
+		e.port = uint16(tcpAddr.Port)
+	}
+	return e
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.record(&c.remote, &c.local, b[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.record(&c.local, &c.remote, b[:n])
+	}
+	return n, err
+}
+
+// Err returns the error which stopped the capture, if any.
+func (c *Conn) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+func (c *Conn) record(src, dst *endpoint, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return
+	}
+	now := time.Now()
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxPayload {
+			n = maxPayload
+		}
+		if err := c.writePacket(now, src, dst, data[:n]); err != nil {
+			c.err = err
+			return
+		}
+		src.seq += uint32(n)
+		data = data[n:]
+	}
+}
+
+func (c *Conn) writeHeaders() error {
+	shb := make([]byte, 28)
+	binary.LittleEndian.PutUint32(shb[0:], blockTypeSectionHeader)
+	binary.LittleEndian.PutUint32(shb[4:], 28)
+	binary.LittleEndian.PutUint32(shb[8:], byteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[12:], 1)
+	binary.LittleEndian.PutUint16(shb[14:], 0)
+	binary.LittleEndian.PutUint64(shb[16:], 0xFFFFFFFFFFFFFFFF)
+	binary.LittleEndian.PutUint32(shb[24:], 28)
+	if _, err := c.w.Write(shb); err != nil {
+		return err
+	}
+
+	idb := make([]byte, 20)
+	binary.LittleEndian.PutUint32(idb[0:], blockTypeInterface)
+	binary.LittleEndian.PutUint32(idb[4:], 20)
+	binary.LittleEndian.PutUint16(idb[8:], linkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[12:], 0)
+	binary.LittleEndian.PutUint32(idb[16:], 20)
+	_, err := c.w.Write(idb)
+	return err
+}
+
+func (c *Conn) writePacket(t time.Time, src, dst *endpoint, payload []byte) error {
+	packetLen := ipHeaderLen + tcpHeaderLen + len(payload)
+	padded := (packetLen + 3) &^ 3
+	blockLen := 28 + padded + 4
+
+	block := make([]byte, blockLen)
+	micros := uint64(t.UnixNano() / int64(time.Microsecond))
+	binary.LittleEndian.PutUint32(block[0:], blockTypeEnhancedPacket)
+	binary.LittleEndian.PutUint32(block[4:], uint32(blockLen))
+	binary.LittleEndian.PutUint32(block[8:], 0)
+	binary.LittleEndian.PutUint32(block[12:], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(block[16:], uint32(micros))
+	binary.LittleEndian.PutUint32(block[20:], uint32(packetLen))
+	binary.LittleEndian.PutUint32(block[24:], uint32(packetLen))
+	binary.LittleEndian.PutUint32(block[blockLen-4:], uint32(blockLen))
+
+	packet := block[28 : 28+packetLen]
+	ip := packet[:ipHeaderLen]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(packetLen))
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:16], src.ip[:])
+	copy(ip[16:20], dst.ip[:])
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+	tcp := packet[ipHeaderLen : ipHeaderLen+tcpHeaderLen]
+	binary.BigEndian.PutUint16(tcp[0:], src.port)
+	binary.BigEndian.PutUint16(tcp[2:], dst.port)
+	binary.BigEndian.PutUint32(tcp[4:], src.seq)
+	binary.BigEndian.PutUint32(tcp[8:], dst.seq)
+	tcp[12] = (tcpHeaderLen / 4) << 4
+	tcp[13] = tcpFlagPsh | tcpFlagAck
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff)
+	copy(packet[ipHeaderLen+tcpHeaderLen:], payload)
+
+	segment := packet[ipHeaderLen:]
+	pseudo := uint32(src.ip[0])<<8 | uint32(src.ip[1])
+	pseudo += uint32(src.ip[2])<<8 | uint32(src.ip[3])
+	pseudo += uint32(dst.ip[0])<<8 | uint32(dst.ip[1])
+	pseudo += uint32(dst.ip[2])<<8 | uint32(dst.ip[3])
+	pseudo += 6 + uint32(len(segment))
+	binary.BigEndian.PutUint16(tcp[16:], checksum(segment, pseudo))
+
+	_, err := c.w.Write(block)
+	return err
+}
+
+// checksum returns the internet checksum of b, starting from sum.
+func checksum(b []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
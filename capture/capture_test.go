@@ -0,0 +1,141 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/moby/spdystream"
+	"github.com/moby/spdystream/spdy"
+)
+
+func TestCaptureSpdySession(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		spdyConn, err := spdystream.NewConnection(conn, true)
+		if err != nil {
+			t.Errorf("Error creating server connection: %v", err)
+			return
+		}
+		go spdyConn.Serve(spdystream.MirrorStreamHandler)
+	}()
+
+	netConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	var buf bytes.Buffer
+	conn, err := NewConn(netConn, &buf)
+	if err != nil {
+		t.Fatalf("Error creating capture: %v", err)
+	}
+	spdyConn, err := spdystream.NewConnection(conn, false)
+	if err != nil {
+		t.Fatalf("Error creating spdy connection: %v", err)
+	}
+	go spdyConn.Serve(spdystream.NoOpStreamHandler)
+
+	stream, err := spdyConn.CreateStream(http.Header{"Test": {"capture"}}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %v", err)
+	}
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if _, err := stream.ReadData(); err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	spdyConn.Close()
+	<-spdyConn.CloseChan()
+	if err := conn.Err(); err != nil {
+		t.Fatalf("Capture error: %v", err)
+	}
+
+	conn.lock.Lock()
+	captured := append([]byte(nil), buf.Bytes()...)
+	conn.lock.Unlock()
+
+	localPort := uint16(netConn.LocalAddr().(*net.TCPAddr).Port)
+	sent, received := parseCapture(t, captured, localPort)
+
+	framer, err := spdy.NewFramer(nil, bytes.NewReader(sent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatalf("Error reading captured frame: %v", err)
+	}
+	synStream, ok := frame.(*spdy.SynStreamFrame)
+	if !ok {
+		t.Fatalf("Expected SYN_STREAM frame, got %T", frame)
+	}
+	if v := synStream.Headers.Get("Test"); v != "capture" {
+		t.Fatalf("Unexpected header value:\nActual: %q\nExpected: %q", v, "capture")
+	}
+	if !bytes.Contains(received, []byte("hello")) {
+		t.Fatalf("Echoed data missing from capture")
+	}
+}
+
+// parseCapture validates the pcapng blocks in data and returns the
+// reassembled payload sent from and received by localPort.
+func parseCapture(t *testing.T, data []byte, localPort uint16) (sent, received []byte) {
+	le := binary.LittleEndian
+	if le.Uint32(data[0:]) != blockTypeSectionHeader || le.Uint32(data[8:]) != byteOrderMagic {
+		t.Fatalf("Missing section header block")
+	}
+	data = data[le.Uint32(data[4:]):]
+	if le.Uint32(data[0:]) != blockTypeInterface || le.Uint16(data[8:]) != linkTypeRaw {
+		t.Fatalf("Missing interface description block")
+	}
+	data = data[le.Uint32(data[4:]):]
+
+	for len(data) > 0 {
+		blockLen := le.Uint32(data[4:])
+		if le.Uint32(data[0:]) != blockTypeEnhancedPacket || le.Uint32(data[blockLen-4:]) != blockLen {
+			t.Fatalf("Invalid enhanced packet block")
+		}
+		packet := data[28 : 28+le.Uint32(data[20:])]
+		if checksum(packet[:ipHeaderLen], 0) != 0 {
+			t.Fatalf("Invalid IP header checksum")
+		}
+		payload := packet[ipHeaderLen+tcpHeaderLen:]
+		if binary.BigEndian.Uint16(packet[ipHeaderLen:]) == localPort {
+			sent = append(sent, payload...)
+		} else {
+			received = append(received, payload...)
+		}
+		data = data[blockLen:]
+	}
+	return sent, received
+}
@@ -0,0 +1,90 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+var (
+	ErrChecksumMismatch = errors.New("data frame checksum mismatch")
+)
+
+// checksumSize is the size of the CRC-32C trailer of data frames.
+const checksumSize = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// SetDataChecksums sets whether data frames carry a CRC-32C of their
+// data in a 4 byte big endian trailer, verified and removed on receipt.
+// A data frame failing verification resets its stream, reads and writes
+// on which then return ErrChecksumMismatch.  The trailer is not part of
+// the protocol, both peers must enable checksums.  Must be called before
+// Serve.
+func (s *Connection) SetDataChecksums(enabled bool) {
+	s.dataChecksums = enabled
+}
+
+// appendChecksum returns data followed by its checksum, without
+// modifying data.
+func appendChecksum(data []byte) []byte {
+	framed := make([]byte, len(data)+checksumSize)
+	copy(framed, data)
+	binary.BigEndian.PutUint32(framed[len(data):], crc32.Checksum(data, castagnoli))
+	return framed
+}
+
+// verifyChecksum returns the data of frame without its checksum
+// trailer, and whether the checksum matched.
+func verifyChecksum(frame *spdy.DataFrame) ([]byte, bool) {
+	if len(frame.Data) < checksumSize {
+		return nil, false
+	}
+	data := frame.Data[:len(frame.Data)-checksumSize]
+	sum := binary.BigEndian.Uint32(frame.Data[len(data):])
+	return data, crc32.Checksum(data, castagnoli) == sum
+}
+
+// checkDataFrame verifies and strips the checksum of a data frame
+// received on stream, resetting the stream if it does not match.
+func (s *Connection) checkDataFrame(stream *Stream, frame *spdy.DataFrame) bool {
+	data, ok := verifyChecksum(frame)
+	s.statsLock.Lock()
+	if ok {
+		s.stats.DataFramesVerified++
+	} else {
+		s.stats.DataFramesCorrupt++
+	}
+	s.statsLock.Unlock()
+	if !ok {
+		debugMessage("(%p) (%d) Data frame checksum mismatch", stream, stream.streamId)
+		stream.closeLock.Lock()
+		if stream.abortErr == nil {
+			stream.abortErr = ErrChecksumMismatch
+		}
+		stream.closeLock.Unlock()
+		s.removeStream(stream)
+		stream.resetWithStatus(spdy.ProtocolError)
+		return false
+	}
+	frame.Data = data
+	return true
+}
@@ -0,0 +1,120 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"net/http"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+const (
+	// StreamTypeCloseReason flags the stream sent by CloseWithReason
+	// ahead of the go away frame.  The stream is finished and
+	// unidirectional, it only carries the reason in its headers and is
+	// not passed to the stream handler.
+	StreamTypeCloseReason = "close-reason"
+
+	// CloseCodeHeader and CloseMessageHeader carry the code and message
+	// of a close reason.
+	CloseCodeHeader    = "Spdystream-Close-Code"
+	CloseMessageHeader = "Spdystream-Close-Message"
+
+	// Close codes with a meaning common to most applications, other
+	// codes may be used by agreement between the peers.
+	CloseCodeMaintenance = "maintenance"
+	CloseCodeAuthExpired = "auth-expired"
+	CloseCodeShutdown    = "shutdown"
+)
+
+// CloseReason is the machine-readable reason sent by a peer closing the
+// connection, so that the remote can react to it, for example by
+// reconnecting later for maintenance or by refreshing its credentials.
+type CloseReason struct {
+	// Code identifies the reason, such as CloseCodeMaintenance.
+	Code string
+	// Message describes the reason to humans.
+	Message string
+}
+
+// CloseWithReason closes the connection like Close, sending reason to
+// the remote ahead of the go away frame.  The reason is not sent if the
+// connection has already gone away.
+func (s *Connection) CloseWithReason(reason CloseReason) error {
+	s.receiveIdLock.Lock()
+	goneAway := s.goneAway
+	s.receiveIdLock.Unlock()
+	if !goneAway {
+		if err := s.sendCloseReason(reason); err != nil {
+			debugMessage("(%p) Error sending close reason: %s", s, err)
+		}
+	}
+	return s.Close()
+}
+
+// CloseReason returns the reason sent by the remote with
+// CloseWithReason, ok is false if the remote closed the connection
+// without a reason or has not closed it.  The reason is received ahead
+// of the go away frame, so it is set once CloseChan is closed.
+func (s *Connection) CloseReason() (reason CloseReason, ok bool) {
+	s.closedLock.Lock()
+	defer s.closedLock.Unlock()
+	if s.closeReason == nil {
+		return CloseReason{}, false
+	}
+	return *s.closeReason, true
+}
+
+// sendCloseReason sends reason on a new finished, unidirectional stream.
+func (s *Connection) sendCloseReason(reason CloseReason) error {
+	headers := http.Header{}
+	headers.Set(StreamTypeHeader, StreamTypeCloseReason)
+	headers.Set(CloseCodeHeader, reason.Code)
+	if reason.Message != "" {
+		headers.Set(CloseMessageHeader, reason.Message)
+	}
+
+	// hold the lock while writing, as stream ids must increase
+	s.nextIdLock.Lock()
+	defer s.nextIdLock.Unlock()
+	streamId, err := s.getNextStreamId(headers)
+	if err != nil {
+		return err
+	}
+	return s.framer.WriteFrame(&spdy.SynStreamFrame{
+		StreamId: streamId,
+		Headers:  headers,
+		CFHeader: spdy.ControlFrameHeader{Flags: spdy.ControlFlagFin | spdy.ControlFlagUnidirectional},
+	})
+}
+
+// isCloseReasonFrame returns whether frame opens a close reason stream.
+func isCloseReasonFrame(frame *spdy.SynStreamFrame) bool {
+	return frame.AssociatedToStreamId == 0 && frame.Headers.Get(StreamTypeHeader) == StreamTypeCloseReason
+}
+
+// receiveCloseReason records the close reason carried by frame.
+func (s *Connection) receiveCloseReason(frame *spdy.SynStreamFrame) {
+	reason := &CloseReason{
+		Code:    frame.Headers.Get(CloseCodeHeader),
+		Message: frame.Headers.Get(CloseMessageHeader),
+	}
+	debugMessage("(%p) Close reason received: %s %q", s, reason.Code, reason.Message)
+	s.closedLock.Lock()
+	s.closeReason = reason
+	s.closedLock.Unlock()
+}
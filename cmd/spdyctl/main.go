@@ -0,0 +1,206 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Command spdyctl is a debugging client for spdy endpoints.  It dials an
+// endpoint, either a raw spdy server (host:port or unix:///path) or an
+// http or https URL upgraded to spdy, and runs one command:
+//
+//	spdyctl [flags] ping ADDR        measure round trips
+//	spdyctl [flags] stream ADDR      pipe stdin and stdout through a stream
+//	spdyctl [flags] stats ADDR       print the session counters as JSON
+//
+// Stream headers are set with -H "Name: value", which may be repeated.
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/moby/spdystream"
+)
+
+// headerFlags collects repeated -H flags.
+type headerFlags http.Header
+
+func (h headerFlags) String() string {
+	var headers []string
+	for name, values := range h {
+		for _, value := range values {
+			headers = append(headers, name+": "+value)
+		}
+	}
+	return strings.Join(headers, ", ")
+}
+
+func (h headerFlags) Set(value string) error {
+	i := strings.Index(value, ":")
+	if i <= 0 {
+		return fmt.Errorf("invalid header %q, expected \"Name: value\"", value)
+	}
+	http.Header(h).Add(strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:]))
+	return nil
+}
+
+func main() {
+	headers := headerFlags{}
+	flag.Var(headers, "H", "stream `header` as \"Name: value\", may be repeated")
+	useTLS := flag.Bool("tls", false, "use TLS when dialing a raw spdy address")
+	insecure := flag.Bool("insecure", false, "skip TLS certificate verification")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout for dialing and the upgrade handshake")
+	count := flag.Int("count", 3, "number of pings")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] ping|stream|stats ADDR\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: *insecure}
+	conn, err := dial(flag.Arg(1), *useTLS, tlsConfig, *timeout)
+	if err != nil {
+		fatalf("dial %s: %s", flag.Arg(1), err)
+	}
+	defer conn.Close()
+
+	switch flag.Arg(0) {
+	case "ping":
+		err = ping(conn, *count)
+	case "stream":
+		err = pipe(conn, http.Header(headers))
+	case "stats":
+		err = stats(conn, flag.Arg(1))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatalf("%s: %s", flag.Arg(0), err)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "spdyctl: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// dial connects to addr, upgrading http and https URLs with the default
+// dialer and starting a spdy session directly on other addresses.
+func dial(addr string, useTLS bool, tlsConfig *tls.Config, timeout time.Duration) (*spdystream.Connection, error) {
+	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
+		dialer := &spdystream.Dialer{TLSClientConfig: tlsConfig, HandshakeTimeout: timeout}
+		conn, _, err := dialer.Dial(addr, nil, spdystream.NoOpStreamHandler)
+		return conn, err
+	}
+
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix://") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix://")
+	}
+	netConn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if useTLS {
+		if tlsConfig.ServerName == "" && network == "tcp" {
+			host, _, _ := net.SplitHostPort(addr)
+			tlsConfig.ServerName = host
+		}
+		tlsConn := tls.Client(netConn, tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+		if err := tlsConn.Handshake(); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		netConn = tlsConn
+	}
+	conn, err := spdystream.NewConnection(netConn, false)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	go conn.Serve(spdystream.NoOpStreamHandler)
+	return conn, nil
+}
+
+func ping(conn *spdystream.Connection, count int) error {
+	for i := 0; i < count; i++ {
+		rtt, err := conn.Ping()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("ping %d: %s\n", i+1, rtt)
+	}
+	return nil
+}
+
+// pipe copies stdin to a new stream, closing it at the end of stdin, and
+// the stream to stdout until the remote closes it.
+func pipe(conn *spdystream.Connection, headers http.Header) error {
+	stream, err := conn.CreateStream(headers, nil, false)
+	if err != nil {
+		return err
+	}
+	if err := stream.Wait(); err != nil {
+		return err
+	}
+	go func() {
+		if _, err := io.Copy(stream, os.Stdin); err != nil {
+			fmt.Fprintf(os.Stderr, "spdyctl: stream: %s\n", err)
+		}
+		stream.Close()
+	}()
+	if _, err := io.Copy(os.Stdout, stream); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// stats pings the remote so the counters cover a round trip, and prints
+// them.
+func stats(conn *spdystream.Connection, addr string) error {
+	rtt, err := conn.Ping()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		RemoteAddr    string
+		RoundTrip     string
+		ActiveStreams int
+		Stats         spdystream.ConnectionStats
+		Memory        spdystream.MemoryUsage
+	}{
+		RemoteAddr:    addr,
+		RoundTrip:     rtt.String(),
+		ActiveStreams: conn.NumActiveStreams(),
+		Stats:         conn.Stats(),
+		Memory:        conn.MemoryUsage(),
+	})
+}
@@ -0,0 +1,169 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Command spdyload generates stream traffic against a spdy server, such
+// as spdyserve, and reports latency percentiles and error rates.  The mix
+// of streams is given with -mix as comma separated profiles of the form
+// name:weight:size[:priority], for example
+//
+//	spdyload -mix small:9:1024,bulk:1:1048576:7 -rate 200 -duration 1m 127.0.0.1:8555
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/moby/spdystream"
+	"github.com/moby/spdystream/loadgen"
+)
+
+// parseMix parses the profiles of the -mix flag.
+func parseMix(mix string, headers http.Header) ([]loadgen.Profile, error) {
+	var profiles []loadgen.Profile
+	for _, spec := range strings.Split(mix, ",") {
+		fields := strings.Split(spec, ":")
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, fmt.Errorf("invalid profile %q, expected name:weight:size[:priority]", spec)
+		}
+		weight, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight in profile %q: %s", spec, err)
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid size in profile %q: %s", spec, err)
+		}
+		var priority uint64
+		if len(fields) == 4 {
+			if priority, err = strconv.ParseUint(fields[3], 10, 3); err != nil {
+				return nil, fmt.Errorf("invalid priority in profile %q: %s", spec, err)
+			}
+		}
+		profiles = append(profiles, loadgen.Profile{
+			Name:     fields[0],
+			Weight:   weight,
+			Size:     size,
+			Priority: uint8(priority),
+			Headers:  headers,
+		})
+	}
+	return profiles, nil
+}
+
+// headerFlags collects repeated -H flags.
+type headerFlags http.Header
+
+func (h headerFlags) String() string {
+	return fmt.Sprint(http.Header(h))
+}
+
+func (h headerFlags) Set(value string) error {
+	i := strings.Index(value, ":")
+	if i <= 0 {
+		return fmt.Errorf("invalid header %q, expected \"Name: value\"", value)
+	}
+	http.Header(h).Add(strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:]))
+	return nil
+}
+
+func main() {
+	headers := headerFlags{}
+	flag.Var(headers, "H", "stream `header` as \"Name: value\", may be repeated")
+	mix := flag.String("mix", "default:1:1024", "stream profiles as name:weight:size[:priority],...")
+	rate := flag.Float64("rate", 0, "streams opened per second, 0 for as fast as -concurrency allows")
+	concurrency := flag.Int("concurrency", 16, "maximum streams in progress")
+	duration := flag.Duration("duration", 10*time.Second, "duration of the test")
+	streams := flag.Int("streams", 0, "stop after that many streams, if set")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] ADDR\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	profiles, err := parseMix(*mix, http.Header(headers))
+	if err != nil {
+		fatalf("%s", err)
+	}
+
+	addr, network := flag.Arg(0), "tcp"
+	if strings.HasPrefix(addr, "unix://") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix://")
+	}
+	netConn, err := net.Dial(network, addr)
+	if err != nil {
+		fatalf("dial %s: %s", flag.Arg(0), err)
+	}
+	conn, err := spdystream.NewConnection(netConn, false)
+	if err != nil {
+		fatalf("%s", err)
+	}
+	conn.SetContextPriority(loadgen.ContextPriority)
+	go conn.Serve(spdystream.NoOpStreamHandler)
+	defer conn.Close()
+
+	// stop opening streams on interrupt, still reporting
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	report, err := loadgen.Run(ctx, conn, loadgen.Config{
+		Profiles:    profiles,
+		Rate:        *rate,
+		Concurrency: *concurrency,
+		Duration:    *duration,
+		Streams:     *streams,
+		Seed:        time.Now().UnixNano(),
+	})
+	if err != nil {
+		fatalf("%s", err)
+	}
+
+	names := make([]string, 0, len(report.Profiles))
+	for name := range report.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PROFILE\tSTREAMS\tERRORS\tERROR RATE\tSTREAMS/S\tP50\tP90\tP99\tMAX")
+	for _, name := range names {
+		r := report.Profiles[name]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.2f%%\t%.1f\t%s\t%s\t%s\t%s\n", name, r.Streams, r.Errors, r.ErrorRate()*100,
+			float64(r.Streams)/report.Elapsed.Seconds(), r.P50, r.P90, r.P99, r.Max)
+	}
+	w.Flush()
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "spdyload: "+format+"\n", args...)
+	os.Exit(1)
+}
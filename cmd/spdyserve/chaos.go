@@ -0,0 +1,89 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"math/rand"
+	"time"
+
+	"github.com/moby/spdystream"
+)
+
+// resetWindow is the time after the reply delay during which streams may
+// be reset.
+const resetWindow = 10 * time.Millisecond
+
+// chaos injects faults into the served connections, to exercise the
+// retry and failover logic of clients.
+type chaos struct {
+	delay        time.Duration
+	resetPercent float64
+	goAway       time.Duration
+	stall        time.Duration
+}
+
+func (c *chaos) registerFlags() {
+	flag.DurationVar(&c.delay, "chaos-delay", 0, "delay replies by a random duration up to `d`")
+	flag.Float64Var(&c.resetPercent, "chaos-reset", 0, "reset `percent` of the streams, before the reply or within 10ms after it")
+	flag.DurationVar(&c.goAway, "chaos-goaway", 0, "send GOAWAY and close each connection after `d`")
+	flag.DurationVar(&c.stall, "chaos-stall", 0, "stop reading each stream for a random duration up to `d`, stalling its sender")
+}
+
+func (c *chaos) enabled() bool {
+	return c.delay > 0 || c.resetPercent > 0 || c.goAway > 0 || c.stall > 0
+}
+
+// randomDuration returns a random duration in [0, d).
+func randomDuration(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// configureConn schedules the GOAWAY of conn.
+func (c *chaos) configureConn(conn *spdystream.Connection) {
+	if c.goAway > 0 {
+		time.AfterFunc(c.goAway, func() {
+			conn.Close()
+		})
+	}
+}
+
+// wrap returns handler with the faults applied to each stream.
+func (c *chaos) wrap(handler spdystream.StreamHandler) spdystream.StreamHandler {
+	return func(stream *spdystream.Stream) {
+		if c.stall > 0 {
+			stream.PauseReading()
+			time.AfterFunc(randomDuration(c.stall), stream.ResumeReading)
+		}
+		if c.resetPercent > 0 && rand.Float64()*100 < c.resetPercent {
+			time.AfterFunc(randomDuration(c.delay+resetWindow), func() {
+				stream.Reset()
+			})
+		}
+		if c.delay > 0 {
+			// handlers must not block, delay from another goroutine
+			time.AfterFunc(randomDuration(c.delay), func() {
+				handler(stream)
+			})
+			return
+		}
+		handler(stream)
+	}
+}
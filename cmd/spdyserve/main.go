@@ -0,0 +1,225 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Command spdyserve is a reference spdy server to validate deployments
+// and benchmark links end-to-end.  It serves streams in one of three
+// modes, chosen with -mode or per stream with the Spdyserve-Mode header:
+//
+//	echo     send back the data received
+//	discard  drop the data received
+//	chargen  send a repeating character pattern until the stream is closed
+//
+// The -chaos flags inject faults, delaying replies, resetting streams,
+// closing connections with GOAWAY and stalling reads, to exercise the
+// retry and failover logic of clients.
+//
+// With -throughput ADDR it runs as a client instead, measuring the
+// throughput to a spdyserve listening on ADDR by writing to discard
+// streams, or with -download by reading from chargen streams.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/moby/spdystream"
+)
+
+// modeHeader selects the mode of a stream, overriding -mode.
+const modeHeader = "Spdyserve-Mode"
+
+var handlers = map[string]spdystream.StreamHandler{
+	"echo":    spdystream.MirrorStreamHandler,
+	"discard": discardHandler,
+	"chargen": chargenHandler,
+}
+
+func discardHandler(stream *spdystream.Stream) {
+	if err := stream.SendReply(http.Header{}, false); err != nil {
+		return
+	}
+	go func() {
+		io.Copy(ioutil.Discard, stream)
+		stream.Close()
+	}()
+}
+
+// chargenLine is a line of the RFC 864 character generator pattern.
+var chargenLine = func() []byte {
+	var line []byte
+	for c := byte(' '); c <= '~'; c++ {
+		line = append(line, c)
+	}
+	return append(line, '\r', '\n')
+}()
+
+func chargenHandler(stream *spdystream.Stream) {
+	if err := stream.SendReply(http.Header{}, false); err != nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, stream)
+		close(done)
+	}()
+	go func() {
+		chunk := make([]byte, 0, 32*1024)
+		for len(chunk)+len(chargenLine) <= cap(chunk) {
+			chunk = append(chunk, chargenLine...)
+		}
+		for {
+			select {
+			case <-done:
+				stream.Close()
+				return
+			default:
+			}
+			if _, err := stream.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:8555", "`address` to listen on, host:port or unix:///path")
+	mode := flag.String("mode", "echo", "default stream mode: echo, discard or chargen")
+	throughput := flag.String("throughput", "", "measure the throughput to the spdyserve at `address` instead of serving")
+	download := flag.Bool("download", false, "measure the download rather than upload throughput")
+	duration := flag.Duration("duration", 10*time.Second, "duration of the throughput test")
+	streams := flag.Int("streams", 1, "number of concurrent streams of the throughput test")
+	size := flag.Int("size", 32*1024, "size of the writes of the throughput test")
+	var faults chaos
+	faults.registerFlags()
+	flag.Parse()
+
+	if *throughput != "" {
+		if err := measure(*throughput, *download, *duration, *streams, *size); err != nil {
+			fmt.Fprintf(os.Stderr, "spdyserve: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	defaultHandler, ok := handlers[*mode]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "spdyserve: unknown mode %q\n", *mode)
+		os.Exit(2)
+	}
+	serve := func(stream *spdystream.Stream) {
+		handler := defaultHandler
+		if m := stream.Headers().Get(modeHeader); m != "" {
+			var ok bool
+			if handler, ok = handlers[m]; !ok {
+				stream.Refuse()
+				return
+			}
+		}
+		handler(stream)
+	}
+	srv := &spdystream.Server{Handler: serve}
+	if faults.enabled() {
+		rand.Seed(time.Now().UnixNano())
+		srv.Handler = faults.wrap(serve)
+		srv.ConfigureConn = faults.configureConn
+		log.Printf("chaos: %+v", faults)
+	}
+	log.Printf("serving %s streams on %s", *mode, *listen)
+	log.Fatal(srv.ListenAndServe(*listen))
+}
+
+// measure opens streams to addr and reports the bytes transferred on all
+// of them over duration.
+func measure(addr string, download bool, duration time.Duration, streams, size int) error {
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix://") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix://")
+	}
+	netConn, err := net.Dial(network, addr)
+	if err != nil {
+		return err
+	}
+	conn, err := spdystream.NewConnection(netConn, false)
+	if err != nil {
+		netConn.Close()
+		return err
+	}
+	go conn.Serve(spdystream.NoOpStreamHandler)
+	defer conn.Close()
+
+	mode := "discard"
+	if download {
+		mode = "chargen"
+	}
+	var total int64
+	var wg sync.WaitGroup
+	errs := make(chan error, streams)
+	deadline := time.Now().Add(duration)
+	start := time.Now()
+	for i := 0; i < streams; i++ {
+		stream, err := conn.CreateStream(http.Header{modeHeader: {mode}}, nil, false)
+		if err != nil {
+			return err
+		}
+		if err := stream.Wait(); err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer stream.Close()
+			buf := make([]byte, size)
+			for time.Now().Before(deadline) {
+				var n int
+				var err error
+				if download {
+					n, err = stream.Read(buf)
+				} else {
+					n, err = stream.Write(buf)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				atomic.AddInt64(&total, int64(n))
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	direction := "upload"
+	if download {
+		direction = "download"
+	}
+	fmt.Printf("%s: %d bytes in %s over %d streams, %.2f MB/s\n", direction, total, elapsed.Round(time.Millisecond), streams, float64(total)/elapsed.Seconds()/1e6)
+	return nil
+}
@@ -17,12 +17,16 @@
 package spdystream
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/moby/spdystream/spdy"
@@ -33,25 +37,99 @@ var (
 	ErrTimeout           = errors.New("Timeout occurred")
 	ErrReset             = errors.New("Stream reset")
 	ErrWriteClosedStream = errors.New("Write on closed stream")
+	ErrReplyPending      = errors.New("Write before reply on accepted stream")
+	ErrStreamIdExhausted = errors.New("Stream ids exhausted")
+	ErrGoAway            = errors.New("Connection going away")
+	ErrConnectionClosed  = errors.New("Connection closed")
 )
 
 const (
 	FRAME_WORKERS = 5
 	QUEUE_SIZE    = 50
+
+	// DefaultCloseFlushTimeout is the default time closing the network
+	// connection waits for a frame write in progress.
+	DefaultCloseFlushTimeout = 500 * time.Millisecond
 )
 
 type StreamHandler func(stream *Stream)
 
+// ConnectionClosedError is returned by writes on a stream whose
+// connection is closed or whose transport failed, with the transport
+// error, if any.  It matches ErrConnectionClosed with errors.Is.
+type ConnectionClosedError struct {
+	Err error
+}
+
+func (e *ConnectionClosedError) Error() string {
+	if e.Err == nil {
+		return ErrConnectionClosed.Error()
+	}
+	return ErrConnectionClosed.Error() + ": " + e.Err.Error()
+}
+
+func (e *ConnectionClosedError) Is(target error) bool {
+	return target == ErrConnectionClosed
+}
+
+func (e *ConnectionClosedError) Unwrap() error {
+	return e.Err
+}
+
+// HeaderOverflowPolicy determines how a header frame is handled when
+// the header queue of its stream is full.
+type HeaderOverflowPolicy int
+
+const (
+	// HeaderOverflowBlock blocks frame handling for the stream until
+	// the application receives a header.  This is the default.
+	HeaderOverflowBlock HeaderOverflowPolicy = iota
+	// HeaderOverflowDropOldest discards the oldest queued header.
+	HeaderOverflowDropOldest
+	// HeaderOverflowCoalesce merges all queued headers and the new
+	// header into a single header, keeping values in arrival order.
+	HeaderOverflowCoalesce
+	// HeaderOverflowReset resets the stream with an internal error.
+	HeaderOverflowReset
+)
+
+// UnknownFramePolicy determines how a control frame of a type not
+// defined by spdy/3 is handled.
+type UnknownFramePolicy int
+
+const (
+	// UnknownFrameIgnore silently discards the frame as required by
+	// the specification.  This is the default.
+	UnknownFrameIgnore UnknownFramePolicy = iota
+	// UnknownFrameLog discards the frame after logging its type with
+	// the debug messages, enabled by the DEBUG environment variable.
+	UnknownFrameLog
+	// UnknownFrameCallback passes the frame to the registered callback.
+	UnknownFrameCallback
+	// UnknownFrameFail closes the connection with a protocol error.
+	UnknownFrameFail
+)
+
 type AuthHandler func(header http.Header, slot uint8, parent uint32) bool
 
+// StreamAuthorizer decides whether a stream opened by the remote peer is
+// passed to the stream handler or refused.  Peer is the leaf certificate
+// presented by the remote peer, nil if the connection does not use TLS or
+// no certificate was presented.
+type StreamAuthorizer func(stream *Stream, peer *x509.Certificate) bool
+
 type idleAwareFramer struct {
-	f              *spdy.Framer
-	conn           *Connection
-	writeLock      sync.Mutex
-	resetChan      chan struct{}
-	setTimeoutLock sync.Mutex
-	setTimeoutChan chan time.Duration
-	timeout        time.Duration
+	f         *spdy.Framer
+	conn      *Connection
+	writeLock sync.Mutex
+	resetChan chan struct{}
+	// writes in progress and the callbacks armed with OnWritable
+	writableLock    sync.Mutex
+	writers         int
+	writableWaiters []func()
+	setTimeoutLock  sync.Mutex
+	setTimeoutChan  chan time.Duration
+	timeout         time.Duration
 }
 
 func newIdleAwareFramer(framer *spdy.Framer) *idleAwareFramer {
@@ -94,17 +172,7 @@ Loop:
 				timer.Reset(i.timeout)
 			}
 		case <-expired:
-			i.conn.streamCond.L.Lock()
-			streams := i.conn.streams
-			i.conn.streams = make(map[spdy.StreamId]*Stream)
-			i.conn.streamCond.Broadcast()
-			i.conn.streamCond.L.Unlock()
-			go func() {
-				for _, stream := range streams {
-					stream.resetStream()
-				}
-				i.conn.Close()
-			}()
+			i.conn.resetStreamsAndClose()
 		case <-i.conn.closeChan:
 			if timer != nil {
 				timer.Stop()
@@ -118,15 +186,15 @@ Loop:
 			// deadlock.
 			//
 			// See https://github.com/moby/spdystream/issues/49 for more details.
-			go func() {
+			i.conn.spawn(func() {
 				for range resetChan {
 				}
-			}()
+			})
 
-			go func() {
+			i.conn.spawn(func() {
 				for range setTimeoutChan {
 				}
-			}()
+			})
 
 			i.writeLock.Lock()
 			close(resetChan)
@@ -148,15 +216,23 @@ Loop:
 }
 
 func (i *idleAwareFramer) WriteFrame(frame spdy.Frame) error {
+	i.startWrite()
+	defer i.finishWrite()
+	start := time.Now()
 	i.writeLock.Lock()
 	defer i.writeLock.Unlock()
+	wait := time.Since(start)
 	if i.resetChan == nil {
-		return io.EOF
+		return i.conn.writeError(io.EOF)
 	}
 	err := i.f.WriteFrame(frame)
+	i.conn.updateSentHeaderStats(i.f.SentHeaderStats())
+	i.conn.updateWriteStats(wait, err == nil)
 	if err != nil {
-		return err
+		return i.conn.writeError(err)
 	}
+	i.conn.recordFrame(frame, true)
+	i.conn.observeFrame(frame, true)
 
 	i.resetChan <- struct{}{}
 
@@ -165,9 +241,11 @@ func (i *idleAwareFramer) WriteFrame(frame spdy.Frame) error {
 
 func (i *idleAwareFramer) ReadFrame() (spdy.Frame, error) {
 	frame, err := i.f.ReadFrame()
+	i.conn.updateHeaderStats(i.f.HeaderStats())
 	if err != nil {
 		return nil, err
 	}
+	i.conn.recordFrame(frame, false)
 
 	// resetChan should never be closed since it is only closed
 	// when the connection has closed its closeChan. This closure
@@ -195,18 +273,25 @@ type Connection struct {
 
 	closeChan      chan bool
 	goneAway       bool
+	remoteGoneAway bool
 	lastStreamChan chan<- *Stream
 	goAwayTimeout  time.Duration
 	closeTimeout   time.Duration
+	flushTimeout   time.Duration
 
-	streamLock *sync.RWMutex
-	streamCond *sync.Cond
-	streams    map[spdy.StreamId]*Stream
+	streams *streamTable
 
 	nextIdLock       sync.Mutex
 	receiveIdLock    sync.Mutex
 	nextStreamId     spdy.StreamId
-	receivedStreamId spdy.StreamId
+	receivedStreamId spdy.StreamId // see loadReceivedStreamId
+
+	streamIdAllocator StreamIdAllocator
+
+	idsLowChan      chan<- uint32
+	idsLowThreshold uint32
+	idsLowGoAway    bool
+	idsLowNotified  bool
 
 	pingIdLock sync.Mutex
 	pingId     uint32
@@ -216,12 +301,111 @@ type Connection struct {
 	shutdownChan chan error
 	hasShutdown  bool
 
+	// set once the transport is closed or failed, see closedError
+	closedLock sync.Mutex
+	closed     bool
+	closedErr  error
+	// sent by the remote ahead of its go away, see CloseReason
+	closeReason *CloseReason
+
+	headerQueueSize      int
+	headerOverflowPolicy HeaderOverflowPolicy
+	dataQueueSize        int
+
+	settingsLock             sync.Mutex
+	peerMaxConcurrentStreams uint32
+
+	historyLock sync.Mutex
+	history     *frameHistory
+
+	statsLock sync.Mutex
+	stats     ConnectionStats
+	// frame queues of Serve, for MemoryUsage
+	frameQueues []*PriorityFrameQueue
+
+	streamAuthorizer StreamAuthorizer
+
+	markLock    sync.Mutex
+	markMapping func(priority uint8) int
+	markDSCP    int
+
+	halfCloseTimeout time.Duration
+	halfClosePolicy  HalfClosePolicy
+
+	windowUpdatePolicy    WindowUpdatePolicy
+	windowUpdateThreshold uint32
+	memoryPressure        MemoryPressureFunc
+	strictness            Strictness
+	signalHandler         SignalHandler
+	headerBlockSplit      int
+	headerReassembly      bool
+	headerBlockMaxSize    int64
+
+	// streams holding back window updates under memory pressure, and
+	// the timer checking for the end of the pressure
+	pressureLock      sync.Mutex
+	heldWindowUpdates map[*Stream]struct{}
+	pressureTimer     *time.Timer
+
+	replyEcho       []string
+	replyHeaderFunc ReplyHeaderFunc
+	traceIDs        bool
+
+	goroutineLock     sync.Mutex
+	goroutines        int
+	limitedGoroutines int
+	goroutineLimit    int
+	goroutineQueue    []func()
+	goroutineChanged  chan struct{}
+	serving           bool
+	served            bool
+	shutdownDone      bool
+
+	streamQuota    *StreamQuota
+	quotaHandler   QuotaHandler
+	acceptPriority AcceptPriorityFunc
+
+	propagateDeadlines bool
+	contextPriority    func(ctx context.Context) (uint8, bool)
+	dataChecksums      bool
+
+	frameObserver FrameObserver
+	observeFrames bool
+	framePolicy   FramePolicy
+
+	sendHeaderFilter    *headerFilter
+	receiveHeaderFilter *headerFilter
+
+	handshake        *Capabilities
+	peerCapsLock     sync.Mutex
+	peerCaps         Capabilities
+	peerCapsReceived bool
+	peerCapsChan     chan struct{}
+
+	control           *ControlChannel
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+	heartbeatPayload  func() []byte
+	// for heartbeat one-way delays, see SetHeartbeatTimestamps
+	heartbeatTimestamps   bool
+	minHeartbeatRoundTrip time.Duration
+	// for credential refreshes, see RequestCredentials
+	credentialRefresh  CredentialsFunc
+	credentialVerifier func(credentials []byte) error
+
+	unknownFramePolicy   UnknownFramePolicy
+	unknownFrameCallback func(*spdy.UnknownControlFrame)
+
 	// for testing https://github.com/moby/spdystream/pull/56
 	dataFrameHandler func(*spdy.DataFrame) error
 }
 
 // NewConnection creates a new spdy connection from an existing
-// network connection.
+// network connection.  A *Stream can be used as the network connection
+// to nest a connection inside a stream of another one: the accepting
+// side must reply to the stream first, and since stream handlers must
+// not block, serve the nested connection from another goroutine.
+// Closing the nested connection closes the stream.
 func NewConnection(conn net.Conn, server bool) (*Connection, error) {
 	framer, framerErr := spdy.NewFramer(conn, conn)
 	if framerErr != nil {
@@ -241,9 +425,6 @@ func NewConnection(conn net.Conn, server bool) (*Connection, error) {
 		pid = 1
 	}
 
-	streamLock := new(sync.RWMutex)
-	streamCond := sync.NewCond(streamLock)
-
 	session := &Connection{
 		conn:   conn,
 		framer: idleAwareFramer,
@@ -251,13 +432,14 @@ func NewConnection(conn net.Conn, server bool) (*Connection, error) {
 		closeChan:     make(chan bool),
 		goAwayTimeout: time.Duration(0),
 		closeTimeout:  time.Duration(0),
+		flushTimeout:  DefaultCloseFlushTimeout,
 
-		streamLock:       streamLock,
-		streamCond:       streamCond,
-		streams:          make(map[spdy.StreamId]*Stream),
+		streams:          newStreamTable(),
 		nextStreamId:     sid,
 		receivedStreamId: rid,
 
+		streamIdAllocator: SequentialStreamIds,
+
 		pingId:    pid,
 		pingChans: make(map[uint32]chan error),
 
@@ -265,7 +447,7 @@ func NewConnection(conn net.Conn, server bool) (*Connection, error) {
 	}
 	session.dataFrameHandler = session.handleDataFrame
 	idleAwareFramer.conn = session
-	go idleAwareFramer.monitor()
+	session.spawn(idleAwareFramer.monitor)
 
 	return session, nil
 }
@@ -273,17 +455,21 @@ func NewConnection(conn net.Conn, server bool) (*Connection, error) {
 // Ping sends a ping frame across the connection and
 // returns the response time
 func (s *Connection) Ping() (time.Duration, error) {
-	pid := s.pingId
 	s.pingIdLock.Lock()
+	pid := s.pingId
 	if s.pingId > 0x7ffffffe {
 		s.pingId = s.pingId - 0x7ffffffe
 	} else {
 		s.pingId = s.pingId + 2
 	}
-	s.pingIdLock.Unlock()
 	pingChan := make(chan error)
 	s.pingChans[pid] = pingChan
-	defer delete(s.pingChans, pid)
+	s.pingIdLock.Unlock()
+	defer func() {
+		s.pingIdLock.Lock()
+		delete(s.pingChans, pid)
+		s.pingIdLock.Unlock()
+	}()
 
 	frame := &spdy.PingFrame{Id: pid}
 	startTime := time.Now()
@@ -293,7 +479,8 @@ func (s *Connection) Ping() (time.Duration, error) {
 	}
 	select {
 	case <-s.closeChan:
-		return time.Duration(0), errors.New("connection closed")
+		s.markClosed(nil)
+		return time.Duration(0), s.closedError()
 	case err, ok := <-pingChan:
 		if ok && err != nil {
 			return time.Duration(0), err
@@ -306,7 +493,24 @@ func (s *Connection) Ping() (time.Duration, error) {
 // Serve handles frames sent from the server, including reply frames
 // which are needed to fully initiate connections.  Both clients and servers
 // should call Serve in a separate goroutine before creating streams.
+// Serve may only be called once, later calls return immediately.
 func (s *Connection) Serve(newHandler StreamHandler) {
+	if !s.startServing() {
+		debugMessage("(%p) Serve called more than once", s)
+		return
+	}
+	defer s.stopServing()
+
+	if s.handshake != nil {
+		s.spawn(s.sendHandshake)
+	}
+	if s.control != nil {
+		s.spawn(s.control.open)
+		if s.heartbeatInterval > 0 {
+			s.spawn(s.heartbeatLoop)
+		}
+	}
+
 	// use a WaitGroup to wait for all frames to be drained after receiving
 	// go-away.
 	var wg sync.WaitGroup
@@ -318,19 +522,23 @@ func (s *Connection) Serve(newHandler StreamHandler) {
 		frameQueues[i] = NewPriorityFrameQueue(QUEUE_SIZE)
 
 		// Ensure frame queue is drained when connection is closed
-		go func(frameQueue *PriorityFrameQueue) {
+		frameQueue := frameQueues[i]
+		s.spawn(func() {
 			<-s.closeChan
 			frameQueue.Drain()
-		}(frameQueues[i])
+		})
 
 		wg.Add(1)
-		go func(frameQueue *PriorityFrameQueue) {
+		s.spawn(func() {
 			// let the WaitGroup know this worker is done
 			defer wg.Done()
 
 			s.frameHandler(frameQueue, newHandler)
-		}(frameQueues[i])
+		})
 	}
+	s.statsLock.Lock()
+	s.frameQueues = frameQueues
+	s.statsLock.Unlock()
 
 	var (
 		partitionRoundRobin int
@@ -339,23 +547,63 @@ func (s *Connection) Serve(newHandler StreamHandler) {
 Loop:
 	for {
 		readFrame, err := s.framer.ReadFrame()
+		received := time.Now()
 		if err != nil {
+			s.markClosed(err)
 			if err != io.EOF {
 				debugMessage("frame read error: %s", err)
 			} else {
 				debugMessage("(%p) EOF received", s)
 			}
+			s.receiveIdLock.Lock()
+			goneAway := s.goneAway
+			s.receiveIdLock.Unlock()
+			if !goneAway {
+				s.dumpFrameHistory(err)
+			}
+			if spdyErr, ok := err.(*spdy.Error); ok {
+				switch spdyErr.Err {
+				case spdy.FrameLengthExceeded, spdy.HeaderBlockTooLarge:
+					s.closeWithError(spdy.GoAwayProtocolError)
+				}
+			}
+			break
+		}
+		if err := s.observeFrame(readFrame, false); err != nil {
+			debugMessage("(%p) Frame rejected by observer: %s", s, err)
+			s.closeWithError(spdy.GoAwayProtocolError)
 			break
 		}
+		if s.receiveHeaderFilter != nil && !s.filterReceivedFrame(readFrame) {
+			debugMessage("(%p) Frame headers rejected by filter, resetting stream", s)
+			s.resetRejectedFrame(readFrame)
+			continue
+		}
+		if s.framePolicy != nil {
+			switch s.framePolicy.CheckFrame(newFrameInfo(readFrame, false)) {
+			case FrameReset:
+				debugMessage("(%p) Frame rejected by policy, resetting stream", s)
+				s.resetRejectedFrame(readFrame)
+				continue
+			case FrameGoAway:
+				debugMessage("(%p) Frame rejected by policy, going away", s)
+				s.closeWithError(spdy.GoAwayProtocolError)
+				break Loop
+			}
+		}
 		var priority uint8
 		var partition int
 		switch frame := readFrame.(type) {
 		case *spdy.SynStreamFrame:
+			if isCloseReasonFrame(frame) {
+				// recorded ahead of the go away frame which follows
+				s.receiveCloseReason(frame)
+				continue
+			}
 			if s.checkStreamFrame(frame) {
-				priority = frame.Priority
 				partition = int(frame.StreamId % FRAME_WORKERS)
 				debugMessage("(%p) Add stream frame: %d ", s, frame.StreamId)
-				s.addStreamFrame(frame)
+				priority = s.addStreamFrame(frame).priority
 			} else {
 				debugMessage("(%p) Rejected stream frame: %d ", s, frame.StreamId)
 				continue
@@ -380,12 +628,26 @@ Loop:
 			// hold on to the go away frame and exit the loop
 			goAwayFrame = frame
 			break Loop
+		case *spdy.UnknownControlFrame:
+			switch s.unknownFramePolicy {
+			case UnknownFrameLog:
+				debugMessage("(%p) Ignoring unknown control frame type %d from %s", s, frame.Type, s.conn.RemoteAddr())
+			case UnknownFrameCallback:
+				if s.unknownFrameCallback != nil {
+					s.unknownFrameCallback(frame)
+				}
+			case UnknownFrameFail:
+				debugMessage("(%p) Unknown control frame type %d", s, frame.Type)
+				s.closeWithError(spdy.GoAwayProtocolError)
+				break Loop
+			}
+			continue
 		default:
 			priority = 7
 			partition = partitionRoundRobin
 			partitionRoundRobin = (partitionRoundRobin + 1) % FRAME_WORKERS
 		}
-		frameQueues[partition].Push(readFrame, priority)
+		frameQueues[partition].pushReceived(readFrame, priority, received)
 	}
 	close(s.closeChan)
 
@@ -397,24 +659,19 @@ Loop:
 		s.handleGoAwayFrame(goAwayFrame)
 	}
 
-	// now it's safe to close remote channels and empty s.streams
-	s.streamCond.L.Lock()
-	// notify streams that they're now closed, which will
+	// now it's safe to close remote channels and empty s.streams,
+	// notifying streams that they're now closed, which will
 	// unblock any stream Read() calls
-	for _, stream := range s.streams {
-		stream.closeRemoteChannels()
-	}
-	s.streams = make(map[spdy.StreamId]*Stream)
-	s.streamCond.Broadcast()
-	s.streamCond.L.Unlock()
+	s.streams.removeAll((*Stream).closeRemoteChannels)
 }
 
 func (s *Connection) frameHandler(frameQueue *PriorityFrameQueue, newHandler StreamHandler) {
 	for {
-		popFrame := frameQueue.Pop()
+		popFrame, received := frameQueue.popReceived()
 		if popFrame == nil {
 			return
 		}
+		s.observeQueueDelay(time.Since(received))
 
 		var frameErr error
 		switch frame := popFrame.(type) {
@@ -424,14 +681,22 @@ func (s *Connection) frameHandler(frameQueue *PriorityFrameQueue, newHandler Str
 			frameErr = s.handleReplyFrame(frame)
 		case *spdy.DataFrame:
 			frameErr = s.dataFrameHandler(frame)
+			// the handler returns once the data is read by the stream
+			s.observeDeliveryDelay(time.Since(received))
 		case *spdy.RstStreamFrame:
 			frameErr = s.handleResetFrame(frame)
 		case *spdy.HeadersFrame:
-			frameErr = s.handleHeaderFrame(frame)
+			if continued, err := s.handleContinuationFrame(frame, newHandler); continued {
+				frameErr = err
+			} else {
+				frameErr = s.handleHeaderFrame(frame)
+			}
 		case *spdy.PingFrame:
 			frameErr = s.handlePingFrame(frame)
 		case *spdy.GoAwayFrame:
 			frameErr = s.handleGoAwayFrame(frame)
+		case *spdy.SettingsFrame:
+			frameErr = s.handleSettingsFrame(frame)
 		default:
 			frameErr = fmt.Errorf("unhandled frame type: %T", frame)
 		}
@@ -450,30 +715,47 @@ func (s *Connection) getStreamPriority(streamId spdy.StreamId) uint8 {
 	return stream.priority
 }
 
-func (s *Connection) addStreamFrame(frame *spdy.SynStreamFrame) {
+func (s *Connection) addStreamFrame(frame *spdy.SynStreamFrame) *Stream {
 	var parent *Stream
 	if frame.AssociatedToStreamId != spdy.StreamId(0) {
 		parent, _ = s.getStream(frame.AssociatedToStreamId)
 	}
 
+	now := time.Now()
+	unidirectional := frame.CFHeader.Flags&spdy.ControlFlagUnidirectional != 0x00
 	stream := &Stream{
 		streamId:   frame.StreamId,
 		parent:     parent,
 		conn:       s,
-		startChan:  make(chan error),
+		startChan:  make(chan error, 1),
 		headers:    frame.Headers,
-		finished:   (frame.CFHeader.Flags & spdy.ControlFlagUnidirectional) != 0x00,
+		finished:   unidirectional,
 		replyCond:  sync.NewCond(new(sync.Mutex)),
-		dataChan:   make(chan []byte),
-		headerChan: make(chan http.Header),
+		dataChan:   make(chan []byte, s.dataQueueSize),
+		headerChan: make(chan http.Header, s.headerQueueSize),
 		closeChan:  make(chan bool),
 		priority:   frame.Priority,
+		deadline:   parseDeadlineHeader(frame.Headers, now),
+		traceID:    s.acceptedTraceID(frame.Headers),
+
+		arrived:        now,
+		unidirectional: unidirectional,
 	}
+	debugMessage("(%p) (%p) Accept stream %d, trace id %q", s, stream, stream.streamId, stream.traceID)
 	if frame.CFHeader.Flags&spdy.ControlFlagFin != 0x00 {
-		stream.closeRemoteChannels()
+		stream.finishHeaderOnly()
+	}
+	if parent != nil && frame.Headers.Get(StreamTypeHeader) == StreamTypeError {
+		parent.setErrorStream(stream)
+	}
+	if s.acceptPriority != nil {
+		if priority := s.acceptPriority(stream); priority <= 7 {
+			stream.priority = priority
+		}
 	}
 
 	s.addStream(stream)
+	return stream
 }
 
 // checkStreamFrame checks to see if a stream frame is allowed.
@@ -487,12 +769,12 @@ func (s *Connection) checkStreamFrame(frame *spdy.SynStreamFrame) bool {
 	}
 	validationErr := s.validateStreamId(frame.StreamId)
 	if validationErr != nil {
-		go func() {
+		s.Go(func() {
 			resetErr := s.sendResetFrame(spdy.ProtocolError, frame.StreamId)
 			if resetErr != nil {
 				debugMessage("reset error: %s", resetErr)
 			}
-		}()
+		})
 		return false
 	}
 	return true
@@ -501,7 +783,40 @@ func (s *Connection) checkStreamFrame(frame *spdy.SynStreamFrame) bool {
 func (s *Connection) handleStreamFrame(frame *spdy.SynStreamFrame, newHandler StreamHandler) error {
 	stream, ok := s.getStream(frame.StreamId)
 	if !ok {
-		return fmt.Errorf("Missing stream: %d", frame.StreamId)
+		// reset by the read loop, by a frame policy or filter, while
+		// the frame was queued
+		debugMessage("(%p) Stream %d reset before being accepted", s, frame.StreamId)
+		return nil
+	}
+	if s.continueStreamHeaders(stream) {
+		return nil
+	}
+	return s.acceptStream(stream, newHandler)
+}
+
+// acceptStream passes a stream opened by the remote to newHandler, once
+// its headers are complete.
+func (s *Connection) acceptStream(stream *Stream, newHandler StreamHandler) error {
+	if s.isHandshakeStream(stream) {
+		return s.handleHandshakeStream(stream)
+	}
+	if s.isControlStream(stream) {
+		return s.handleControlStream(stream)
+	}
+
+	if s.underMemoryPressure() {
+		debugMessage("(%p) Stream %d refused under memory pressure", s, stream.streamId)
+		return stream.Refuse()
+	}
+	if s.streamAuthorizer != nil && !s.streamAuthorizer(stream, s.peerCertificate()) {
+		debugMessage("(%p) Stream %d not authorized", s, stream.streamId)
+		return stream.Refuse()
+	}
+	if isSignalStream(stream) {
+		return s.handleSignal(stream)
+	}
+	if s.streamQuota != nil {
+		stream.SetQuota(*s.streamQuota, s.quotaHandler)
 	}
 
 	newHandler(stream)
@@ -521,16 +836,28 @@ func (s *Connection) handleReplyFrame(frame *spdy.SynReplyFrame) error {
 		// Stream has already received reply
 		return nil
 	}
+	if s.continueReplyHeaders(stream, frame.Headers) {
+		return nil
+	}
+	s.completeReply(stream, frame.Headers, (frame.CFHeader.Flags&spdy.ControlFlagFin) != 0x00)
+	return nil
+}
+
+// completeReply marks stream replied with headers, once they are
+// complete.
+func (s *Connection) completeReply(stream *Stream, headers http.Header, fin bool) {
 	stream.replied = true
+	stream.closeLock.Lock()
+	stream.replyHeaders = headers
+	stream.closeLock.Unlock()
+	stream.protocol = headers.Get(ProtocolHeader)
 
 	// TODO Check for error
-	if (frame.CFHeader.Flags & spdy.ControlFlagFin) != 0x00 {
+	if fin {
 		s.remoteStreamFinish(stream)
 	}
 
 	close(stream.startChan)
-
-	return nil
 }
 
 func (s *Connection) handleResetFrame(frame *spdy.RstStreamFrame) error {
@@ -540,13 +867,23 @@ func (s *Connection) handleResetFrame(frame *spdy.RstStreamFrame) error {
 		return nil
 	}
 	s.removeStream(stream)
-	stream.closeRemoteChannels()
 
+	// signal the reset before closing the stream, startChan is buffered
+	// so this does not wait for the stream to be waited on
 	if !stream.replied {
 		stream.replied = true
+		stream.resetStatus = frame.Status
 		stream.startChan <- ErrReset
 		close(stream.startChan)
 	}
+	if frame.Status == spdy.Cancel {
+		stream.closeLock.Lock()
+		if stream.cancelReason != "" && stream.abortErr == nil {
+			stream.abortErr = &CancelError{Reason: stream.cancelReason}
+		}
+		stream.closeLock.Unlock()
+	}
+	stream.closeRemoteChannels()
 
 	stream.finishLock.Lock()
 	stream.finished = true
@@ -561,16 +898,21 @@ func (s *Connection) handleHeaderFrame(frame *spdy.HeadersFrame) error {
 		// Stream has already gone away
 		return nil
 	}
-	if !stream.replied {
+	if reason := frame.Headers.Get(CancelReasonHeader); reason != "" {
+		// kept for the reset following it
+		stream.closeLock.Lock()
+		stream.cancelReason = reason
+		stream.closeLock.Unlock()
+		return nil
+	}
+	if !stream.isReplied() {
 		// No reply received...Protocol error?
 		return nil
 	}
 
-	// TODO limit headers while not blocking (use buffered chan or goroutine?)
-	select {
-	case <-stream.closeChan:
+	stream.touchHalfCloseTimer()
+	if !s.queueHeader(stream, frame.Headers) {
 		return nil
-	case stream.headerChan <- frame.Headers:
 	}
 
 	if (frame.CFHeader.Flags & spdy.ControlFlagFin) != 0x00 {
@@ -580,6 +922,74 @@ func (s *Connection) handleHeaderFrame(frame *spdy.HeadersFrame) error {
 	return nil
 }
 
+// queueHeader queues a received header on the stream, applying the
+// header overflow policy when the queue is full.  Returns false if the
+// header was not queued because the stream closed or was reset.
+func (s *Connection) queueHeader(stream *Stream, header http.Header) bool {
+	select {
+	case <-stream.closeChan:
+		return false
+	case stream.headerChan <- header:
+		return true
+	default:
+	}
+
+	switch s.headerOverflowPolicy {
+	case HeaderOverflowDropOldest:
+		for {
+			select {
+			case <-stream.headerChan:
+				debugMessage("(%p) (%d) Header queue full, dropped oldest header", stream, stream.streamId)
+			default:
+			}
+			select {
+			case <-stream.closeChan:
+				return false
+			case stream.headerChan <- header:
+				return true
+			default:
+			}
+		}
+	case HeaderOverflowCoalesce:
+		coalesced := http.Header{}
+	Drain:
+		for {
+			select {
+			case queued := <-stream.headerChan:
+				for k, v := range queued {
+					coalesced[k] = append(coalesced[k], v...)
+				}
+			default:
+				break Drain
+			}
+		}
+		for k, v := range header {
+			coalesced[k] = append(coalesced[k], v...)
+		}
+		debugMessage("(%p) (%d) Header queue full, coalesced headers", stream, stream.streamId)
+		select {
+		case <-stream.closeChan:
+			return false
+		case stream.headerChan <- coalesced:
+			return true
+		}
+	case HeaderOverflowReset:
+		debugMessage("(%p) (%d) Header queue full, resetting stream", stream, stream.streamId)
+		s.removeStream(stream)
+		if err := stream.resetWithStatus(spdy.InternalError); err != nil {
+			debugMessage("reset error: %s", err)
+		}
+		return false
+	}
+
+	select {
+	case <-stream.closeChan:
+		return false
+	case stream.headerChan <- header:
+		return true
+	}
+}
+
 func (s *Connection) handleDataFrame(frame *spdy.DataFrame) error {
 	debugMessage("(%p) Data frame received for %d", s, frame.StreamId)
 	stream, streamOk := s.getStream(frame.StreamId)
@@ -588,22 +998,36 @@ func (s *Connection) handleDataFrame(frame *spdy.DataFrame) error {
 		// Stream has already gone away
 		return nil
 	}
-	if !stream.replied {
+	if !stream.isReplied() {
 		debugMessage("(%p) Data frame not replied %d", s, frame.StreamId)
 		// No reply received...Protocol error?
 		return nil
 	}
+	if s.dataChecksums && !s.checkDataFrame(stream, frame) {
+		return nil
+	}
 
 	debugMessage("(%p) (%d) Data frame handling", stream, stream.streamId)
-	if len(frame.Data) > 0 {
+	stream.touchHalfCloseTimer()
+	if len(frame.Data) > 0 && !stream.chargeQuota(len(frame.Data), false) {
+		return nil
+	}
+	if len(frame.Data) > 0 && stream.dataChan == nil {
+		debugMessage("(%p) (%d) Data frame dropped on header only stream", stream, stream.streamId)
+	} else if len(frame.Data) > 0 {
+		stream.offerData()
 		stream.dataLock.RLock()
+		// counted before the send, the frame may be read at once
+		atomic.AddInt32(&stream.queuedBytes, int32(len(frame.Data)))
 		select {
 		case <-stream.closeChan:
+			atomic.AddInt32(&stream.queuedBytes, -int32(len(frame.Data)))
 			debugMessage("(%p) (%d) Data frame not sent (stream shut down)", stream, stream.streamId)
 		case stream.dataChan <- frame.Data:
 			debugMessage("(%p) (%d) Data frame sent", stream, stream.streamId)
 		}
 		stream.dataLock.RUnlock()
+		stream.dataDelivered()
 	}
 	if (frame.Flags & spdy.DataFlagFin) != 0x00 {
 		s.remoteStreamFinish(stream)
@@ -612,10 +1036,17 @@ func (s *Connection) handleDataFrame(frame *spdy.DataFrame) error {
 }
 
 func (s *Connection) handlePingFrame(frame *spdy.PingFrame) error {
+	s.pingIdLock.Lock()
 	if s.pingId&0x01 != frame.Id&0x01 {
+		s.pingIdLock.Unlock()
 		return s.framer.WriteFrame(frame)
 	}
 	pingChan, pingOk := s.pingChans[frame.Id]
+	if pingOk {
+		// a repeated reply must not close the channel again
+		delete(s.pingChans, frame.Id)
+	}
+	s.pingIdLock.Unlock()
 	if pingOk {
 		close(pingChan)
 	}
@@ -625,6 +1056,7 @@ func (s *Connection) handlePingFrame(frame *spdy.PingFrame) error {
 func (s *Connection) handleGoAwayFrame(frame *spdy.GoAwayFrame) error {
 	debugMessage("(%p) Go away received", s)
 	s.receiveIdLock.Lock()
+	s.remoteGoneAway = true
 	if s.goneAway {
 		s.receiveIdLock.Unlock()
 		return nil
@@ -632,21 +1064,73 @@ func (s *Connection) handleGoAwayFrame(frame *spdy.GoAwayFrame) error {
 	s.goneAway = true
 	s.receiveIdLock.Unlock()
 
+	s.failUnprocessedStreams(frame.LastGoodStreamId)
+
 	if s.lastStreamChan != nil {
 		stream, _ := s.getStream(frame.LastGoodStreamId)
+		// not counted, the send waits on the user draining the channel
 		go func() {
 			s.lastStreamChan <- stream
 		}()
 	}
 
 	// Do not block frame handler waiting for closure
-	go s.shutdown(s.goAwayTimeout)
+	s.spawn(func() { s.shutdown(s.goAwayTimeout) })
 
 	return nil
 }
 
+// failUnprocessedStreams fails the streams created locally after the last
+// stream processed by the remote, as announced in its go away frame.  The
+// remote ignores them, so they would never be replied to; failing them
+// with ErrGoAway lets callers retry them on another connection.
+func (s *Connection) failUnprocessedStreams(lastGoodStreamId spdy.StreamId) {
+	s.nextIdLock.Lock()
+	parity := s.nextStreamId & 0x01
+	s.nextIdLock.Unlock()
+	for _, stream := range s.streamsSnapshot() {
+		if stream.streamId&0x01 != parity || stream.streamId <= lastGoodStreamId {
+			continue
+		}
+		debugMessage("(%p) (%d) Stream not processed before go away", s, stream.streamId)
+		s.removeStream(stream)
+		stream.closeLock.Lock()
+		if stream.abortErr == nil {
+			stream.abortErr = ErrGoAway
+		}
+		stream.closeLock.Unlock()
+		// like a reset, the wait for the reply ends for good
+		if !stream.replied {
+			stream.replied = true
+			stream.startChan <- ErrGoAway
+			close(stream.startChan)
+		}
+		stream.closeRemoteChannels()
+	}
+}
+
+func (s *Connection) handleSettingsFrame(frame *spdy.SettingsFrame) error {
+	s.settingsLock.Lock()
+	defer s.settingsLock.Unlock()
+	for _, setting := range frame.FlagIdValues {
+		if setting.Id == spdy.SettingsMaxConcurrentStreams {
+			s.peerMaxConcurrentStreams = setting.Value
+		}
+	}
+	return nil
+}
+
 func (s *Connection) remoteStreamFinish(stream *Stream) {
-	stream.closeRemoteChannels()
+	stream.closeLock.Lock()
+	select {
+	case <-stream.closeChan:
+	default:
+		stream.remoteFinished = true
+		close(stream.closeChan)
+	}
+	stream.closeLock.Unlock()
+	stream.stopHalfCloseTimer()
+	stream.notifyClosed()
 
 	stream.finishLock.Lock()
 	if stream.finished {
@@ -663,34 +1147,73 @@ func (s *Connection) remoteStreamFinish(stream *Stream) {
 // the stream Wait or WaitTimeout function on the stream returned
 // by this function.
 func (s *Connection) CreateStream(headers http.Header, parent *Stream, fin bool) (*Stream, error) {
+	return s.createStream(headers, parent, fin, 0)
+}
+
+func (s *Connection) createStream(headers http.Header, parent *Stream, fin bool, priority uint8) (*Stream, error) {
+	headers, err := s.filterSentHeaders(headers)
+	if err != nil {
+		return nil, err
+	}
+
 	// MUST synchronize stream creation (all the way to writing the frame)
 	// as stream IDs **MUST** increase monotonically.
 	s.nextIdLock.Lock()
 	defer s.nextIdLock.Unlock()
 
-	streamId := s.getNextStreamId()
-	if streamId == 0 {
-		return nil, fmt.Errorf("Unable to get new stream id")
+	s.receiveIdLock.Lock()
+	remoteGoneAway := s.remoteGoneAway
+	s.receiveIdLock.Unlock()
+	if remoteGoneAway {
+		return nil, ErrGoAway
+	}
+
+	streamId, err := s.getNextStreamId(headers)
+	if err != nil {
+		return nil, err
 	}
+	s.checkStreamIdsLow()
 
+	headers = s.withTraceID(headers)
 	stream := &Stream{
 		streamId:   streamId,
 		parent:     parent,
 		conn:       s,
-		startChan:  make(chan error),
+		startChan:  make(chan error, 1),
+		priority:   priority,
 		headers:    headers,
-		dataChan:   make(chan []byte),
-		headerChan: make(chan http.Header),
+		traceID:    headers.Get(TraceIDHeader),
+		headerChan: make(chan http.Header, s.headerQueueSize),
 		closeChan:  make(chan bool),
 	}
+	if !fin || headers.Get(StreamTypeHeader) != StreamTypeSignal {
+		// signals are answered by a reply without data
+		stream.dataChan = make(chan []byte, s.dataQueueSize)
+	}
 
-	debugMessage("(%p) (%p) Create stream", s, stream)
+	debugMessage("(%p) (%p) Create stream %d, trace id %q", s, stream, streamId, stream.traceID)
 
 	s.addStream(stream)
 
 	return stream, s.sendStream(stream, fin)
 }
 
+// resetStreamsAndClose resets every stream and closes the connection
+// without waiting for the streams to finish, for an idle or unresponsive
+// remote.
+func (s *Connection) resetStreamsAndClose() {
+	var streams []*Stream
+	s.streams.removeAll(func(stream *Stream) {
+		streams = append(streams, stream)
+	})
+	s.spawn(func() {
+		for _, stream := range streams {
+			stream.resetStream()
+		}
+		s.Close()
+	})
+}
+
 func (s *Connection) shutdown(closeTimeout time.Duration) {
 	// TODO Ensure this isn't called multiple times
 	s.shutdownLock.Lock()
@@ -701,30 +1224,33 @@ func (s *Connection) shutdown(closeTimeout time.Duration) {
 	s.hasShutdown = true
 	s.shutdownLock.Unlock()
 
+	if s.control != nil {
+		// the control streams stay open for the life of the connection
+		s.control.close()
+	}
+
 	var timeout <-chan time.Time
 	if closeTimeout > time.Duration(0) {
 		timeout = time.After(closeTimeout)
 	}
 	streamsClosed := make(chan bool)
 
-	go func() {
-		s.streamCond.L.Lock()
-		for len(s.streams) > 0 {
-			debugMessage("Streams opened: %d, %#v", len(s.streams), s.streams)
-			s.streamCond.Wait()
-		}
-		s.streamCond.L.Unlock()
+	s.spawn(func() {
+		s.streams.waitFor(func() bool {
+			debugMessage("Streams opened: %d", s.streams.len())
+			return s.streams.len() == 0
+		})
 		close(streamsClosed)
-	}()
+	})
 
 	var err error
 	select {
 	case <-streamsClosed:
 		// No active streams, close should be safe
-		err = s.conn.Close()
+		err = s.closeConn()
 	case <-timeout:
 		// Force ungraceful close
-		err = s.conn.Close()
+		err = s.closeConn()
 		// Wait for cleanup to clear active streams
 		<-streamsClosed
 	}
@@ -742,9 +1268,87 @@ func (s *Connection) shutdown(closeTimeout time.Duration) {
 		})
 		s.shutdownChan <- err
 	}
+	s.setShutdown()
 	close(s.shutdownChan)
 }
 
+// markClosed records the transport as closed, with the transport error
+// which caused it if any.  Only the first call is recorded.
+func (s *Connection) markClosed(err error) {
+	s.closedLock.Lock()
+	defer s.closedLock.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.closedErr = err
+	}
+}
+
+// closedError returns a *ConnectionClosedError once the transport is
+// closed, nil before.
+func (s *Connection) closedError() error {
+	s.closedLock.Lock()
+	defer s.closedLock.Unlock()
+	if !s.closed {
+		return nil
+	}
+	return &ConnectionClosedError{Err: s.closedErr}
+}
+
+// writeError returns the error for a failed frame write.  Write timeouts
+// and invalid frames are returned as is, other failures mean the
+// transport is unusable and are recorded and returned as a
+// *ConnectionClosedError.
+func (s *Connection) writeError(err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return err
+	}
+	if _, ok := err.(*spdy.Error); ok {
+		// the frame was invalid and not written
+		return err
+	}
+	if err == io.EOF {
+		// the framer refuses writes once the connection is closed
+		s.markClosed(nil)
+	} else {
+		s.markClosed(err)
+	}
+	return s.closedError()
+}
+
+// closeConn closes the network connection once the frame being written,
+// if any, has been written, so frames accepted by a write are not
+// truncated.  Waiting is bounded by the flush timeout, after which the
+// network connection is closed regardless.
+func (s *Connection) closeConn() error {
+	s.markClosed(nil)
+	if s.flushTimeout <= time.Duration(0) {
+		return s.conn.Close()
+	}
+	locked := make(chan struct{})
+	s.spawn(func() {
+		s.framer.writeLock.Lock()
+		close(locked)
+	})
+	timer := time.NewTimer(s.flushTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-locked:
+		err := s.conn.Close()
+		s.framer.writeLock.Unlock()
+		return err
+	case <-timer.C:
+		debugMessage("(%p) Timed out flushing writes, closing connection", s)
+		err := s.conn.Close()
+		s.spawn(func() {
+			// the pending write fails with the connection closed
+			<-locked
+			s.framer.writeLock.Unlock()
+		})
+		return err
+	}
+}
+
 // Closes spdy connection by sending GoAway frame and initiating shutdown
 func (s *Connection) Close() error {
 	s.receiveIdLock.Lock()
@@ -756,8 +1360,8 @@ func (s *Connection) Close() error {
 	s.receiveIdLock.Unlock()
 
 	var lastStreamId spdy.StreamId
-	if s.receivedStreamId > 2 {
-		lastStreamId = s.receivedStreamId - 2
+	if receivedStreamId := s.loadReceivedStreamId(); receivedStreamId > 2 {
+		lastStreamId = receivedStreamId - 2
 	}
 
 	goAwayFrame := &spdy.GoAwayFrame{
@@ -766,7 +1370,7 @@ func (s *Connection) Close() error {
 	}
 
 	err := s.framer.WriteFrame(goAwayFrame)
-	go s.shutdown(s.closeTimeout)
+	s.spawn(func() { s.shutdown(s.closeTimeout) })
 	if err != nil {
 		return err
 	}
@@ -774,6 +1378,33 @@ func (s *Connection) Close() error {
 	return nil
 }
 
+// closeWithError sends a go away frame with the given status and
+// shuts down the connection, used when the remote peer violates the
+// protocol.  The caller is expected to stop reading frames.
+func (s *Connection) closeWithError(status spdy.GoAwayStatus) {
+	s.receiveIdLock.Lock()
+	if s.goneAway {
+		s.receiveIdLock.Unlock()
+		return
+	}
+	s.goneAway = true
+	s.receiveIdLock.Unlock()
+
+	var lastStreamId spdy.StreamId
+	if receivedStreamId := s.loadReceivedStreamId(); receivedStreamId > 2 {
+		lastStreamId = receivedStreamId - 2
+	}
+
+	goAwayFrame := &spdy.GoAwayFrame{
+		LastGoodStreamId: lastStreamId,
+		Status:           status,
+	}
+	if err := s.framer.WriteFrame(goAwayFrame); err != nil {
+		debugMessage("(%p) Error writing go away frame: %s", s, err)
+	}
+	s.spawn(func() { s.shutdown(s.closeTimeout) })
+}
+
 // CloseWait closes the connection and waits for shutdown
 // to finish.  Note the underlying network Connection
 // is not closed until the end of shutdown.
@@ -795,22 +1426,30 @@ func (s *Connection) CloseWait() error {
 // has been received.  If the wait timeout is 0, this function
 // will block until shutdown finishes.  If wait is never called
 // and a shutdown error occurs, that error will be logged as an
-// unhandled error.
+// unhandled error.  Once shutdown finished, Wait also waits for the
+// teardown of the connection: for Serve to return, closing all streams,
+// and for all goroutines counted by Goroutines to exit, so callers can
+// check no goroutines are leaked.  Goroutines started with Go must
+// return once their streams are closed for Wait to return.
 func (s *Connection) Wait(waitTimeout time.Duration) error {
 	var timeout <-chan time.Time
 	if waitTimeout > time.Duration(0) {
 		timeout = time.After(waitTimeout)
 	}
 
+	var err error
 	select {
-	case err, ok := <-s.shutdownChan:
+	case shutdownErr, ok := <-s.shutdownChan:
 		if ok {
-			return err
+			err = shutdownErr
 		}
 	case <-timeout:
 		return ErrTimeout
 	}
-	return nil
+	if teardownErr := s.waitTeardown(timeout); teardownErr != nil {
+		return teardownErr
+	}
+	return err
 }
 
 // NotifyClose registers a channel to be called when the remote
@@ -831,6 +1470,111 @@ func (s *Connection) SetCloseTimeout(timeout time.Duration) {
 	s.closeTimeout = timeout
 }
 
+// SetCloseFlushTimeout sets how long closing the network connection
+// waits for a frame write in progress to complete.  Setting the timeout
+// to 0 closes the network connection without waiting.  The default is
+// DefaultCloseFlushTimeout.
+func (s *Connection) SetCloseFlushTimeout(timeout time.Duration) {
+	s.flushTimeout = timeout
+}
+
+// SetHeaderQueue sets how many received header frames are queued per
+// stream until the application calls ReceiveHeader, and the policy
+// applied once the queue is full.  The default queue size of 0 with
+// HeaderOverflowBlock makes a stream that is not receiving headers
+// block frame handling for other streams sharing its frame worker.
+// The other policies need a queue to apply to, a size of 0 is raised
+// to 1 for them.  Only streams created after the call are affected.
+func (s *Connection) SetHeaderQueue(size int, policy HeaderOverflowPolicy) {
+	if size < 0 {
+		size = 0
+	}
+	if size == 0 && policy != HeaderOverflowBlock {
+		size = 1
+	}
+	s.headerQueueSize = size
+	s.headerOverflowPolicy = policy
+}
+
+// SetDataQueue sets how many received data frames are queued per stream
+// ahead of Read.  With the default of 0 a data frame is handed to the
+// stream only once it is read, holding back the frame worker, while
+// queued frames let the frame worker move on and are read together by
+// ReadFrames.  Queued frames count in BufferedRecvBytes and are not
+// acknowledged by window updates until read.  Must be called before
+// Serve.
+func (s *Connection) SetDataQueue(frames int) {
+	if frames < 0 {
+		frames = 0
+	}
+	s.dataQueueSize = frames
+}
+
+// SetMaxFrameSize limits the length of received frames.  A frame
+// declaring a longer length is rejected before its payload is read and
+// the connection is closed with a protocol error.  It must be called
+// before Serve, a size of 0 means no limit other than the protocol
+// maximum of spdy.MaxDataLength.
+func (s *Connection) SetMaxFrameSize(size uint32) {
+	s.framer.f.SetMaxFrameSize(size)
+}
+
+// SetHeaderBlockLimits bounds the decompressed size of received header
+// blocks, absolutely by maxSize bytes and relative to the compressed size
+// by maxRatio.  A header block exceeding a limit closes the connection
+// with a protocol error since the shared decompression context can not
+// be recovered.  Zero disables a limit, which is the default.  It must be
+// called before Serve.
+func (s *Connection) SetHeaderBlockLimits(maxSize int64, maxRatio int) {
+	s.headerBlockMaxSize = maxSize
+	s.framer.f.SetHeaderBlockLimits(maxSize, maxRatio)
+}
+
+// SetUnknownFramePolicy sets how control frames of unknown types are
+// handled.  The callback is only used with UnknownFrameCallback and is
+// called from the frame reading goroutine, it must not block.
+func (s *Connection) SetUnknownFramePolicy(policy UnknownFramePolicy, callback func(*spdy.UnknownControlFrame)) {
+	s.unknownFramePolicy = policy
+	s.unknownFrameCallback = callback
+}
+
+// SetStreamAuthorizer sets a callback run for every stream opened by the
+// remote peer before the stream handler, refusing the stream if it
+// returns false.  It must be called before Serve.
+func (s *Connection) SetStreamAuthorizer(authorizer StreamAuthorizer) {
+	s.streamAuthorizer = authorizer
+}
+
+// TLSConnectionState returns the state of the TLS connection underlying
+// the connection, ok is false if the connection does not use TLS.
+func (s *Connection) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+	tlsConn, ok := s.tlsConn()
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return tlsConn.ConnectionState(), true
+}
+
+// peerCertificate returns the leaf certificate of the remote peer, or nil.
+func (s *Connection) peerCertificate() *x509.Certificate {
+	state, ok := s.TLSConnectionState()
+	if !ok || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
+
+// tlsConn returns the TLS connection underlying the connection, looking
+// through the buffering added by Upgrade and Dial.
+func (s *Connection) tlsConn() (*tls.Conn, bool) {
+	conn := s.conn
+	if buffered, ok := conn.(*bufferedConn); ok {
+		conn = buffered.Conn
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	return tlsConn, ok
+}
+
 // SetIdleTimeout sets the amount of time the connection may sit idle before
 // it is forcefully terminated.
 func (s *Connection) SetIdleTimeout(timeout time.Duration) {
@@ -838,6 +1582,10 @@ func (s *Connection) SetIdleTimeout(timeout time.Duration) {
 }
 
 func (s *Connection) sendHeaders(headers http.Header, stream *Stream, fin bool) error {
+	headers, err := s.filterSentHeaders(headers)
+	if err != nil {
+		return err
+	}
 	var flags spdy.ControlFlags
 	if fin {
 		flags = spdy.ControlFlagFin
@@ -858,13 +1606,28 @@ func (s *Connection) sendReply(headers http.Header, stream *Stream, fin bool) er
 		flags = spdy.ControlFlagFin
 	}
 
+	headers, err := s.filterSentHeaders(s.replyHeaders(headers, stream))
+	if err != nil {
+		return err
+	}
+	blocks := s.splitHeaderBlock(headers)
+	if blocks != nil {
+		headers = blocks[0]
+		flags = 0
+	}
 	replyFrame := &spdy.SynReplyFrame{
 		StreamId: stream.streamId,
 		Headers:  headers,
 		CFHeader: spdy.ControlFrameHeader{Flags: flags},
 	}
 
-	return s.framer.WriteFrame(replyFrame)
+	if err := s.framer.WriteFrame(replyFrame); err != nil {
+		return err
+	}
+	if blocks != nil {
+		return s.sendContinuation(stream, blocks[1:], fin)
+	}
+	return nil
 }
 
 func (s *Connection) sendResetFrame(status spdy.RstStreamStatus, streamId spdy.StreamId) error {
@@ -892,62 +1655,196 @@ func (s *Connection) sendStream(stream *Stream, fin bool) error {
 		parentId = stream.parent.streamId
 	}
 
+	headers := stream.headers
+	blocks := s.splitHeaderBlock(headers)
+	if blocks != nil {
+		headers = blocks[0]
+		flags = 0
+	}
 	streamFrame := &spdy.SynStreamFrame{
 		StreamId:             spdy.StreamId(stream.streamId),
 		AssociatedToStreamId: spdy.StreamId(parentId),
-		Headers:              stream.headers,
+		Priority:             stream.priority,
+		Headers:              headers,
 		CFHeader:             spdy.ControlFrameHeader{Flags: flags},
 	}
 
-	return s.framer.WriteFrame(streamFrame)
+	if err := s.framer.WriteFrame(streamFrame); err != nil {
+		return err
+	}
+	if blocks != nil {
+		if err := s.sendContinuation(stream, blocks[1:], fin); err != nil {
+			return err
+		}
+	}
+	if fin {
+		stream.startHalfCloseTimer()
+	}
+	return nil
 }
 
-// getNextStreamId returns the next sequential id
-// every call should produce a unique value or an error
-func (s *Connection) getNextStreamId() spdy.StreamId {
-	sid := s.nextStreamId
-	if sid > 0x7fffffff {
+// NumActiveStreams returns the number of streams, created locally or
+// by the remote, which have not been fully closed or reset.
+func (s *Connection) NumActiveStreams() int {
+	return s.streams.len()
+}
+
+// NumPendingAccepts returns the number of streams received from the
+// remote which have not been replied to or refused yet.
+func (s *Connection) NumPendingAccepts() int {
+	var pending int
+	for _, stream := range s.streamsSnapshot() {
+		if stream.replyCond == nil {
+			continue
+		}
+		stream.replyCond.L.Lock()
+		if !stream.replied {
+			pending++
+		}
+		stream.replyCond.L.Unlock()
+	}
+	return pending
+}
+
+// RemainingStreamCapacity returns how many more streams may be created
+// locally.  This is bounded by the stream ids left and, if the remote
+// sent a SETTINGS frame limiting concurrent streams, by that limit less
+// the active locally created streams.
+func (s *Connection) RemainingStreamCapacity() uint32 {
+	s.nextIdLock.Lock()
+	remaining := s.remainingStreamIds()
+	parity := s.nextStreamId & 0x01
+	s.nextIdLock.Unlock()
+
+	s.settingsLock.Lock()
+	maxConcurrent := s.peerMaxConcurrentStreams
+	s.settingsLock.Unlock()
+	if maxConcurrent == 0 {
+		return remaining
+	}
+
+	var local uint32
+	for _, stream := range s.streams.streams() {
+		if stream.streamId&0x01 == parity {
+			local++
+		}
+	}
+
+	if local >= maxConcurrent {
 		return 0
 	}
-	s.nextStreamId = s.nextStreamId + 2
-	return sid
+	if maxConcurrent-local < remaining {
+		return maxConcurrent - local
+	}
+	return remaining
+}
+
+// remainingStreamIds returns the number of stream ids left to create
+// streams with.  Callers must hold nextIdLock.
+func (s *Connection) remainingStreamIds() uint32 {
+	if s.nextStreamId > 0x7fffffff {
+		return 0
+	}
+	return uint32(0x7fffffff-s.nextStreamId)/2 + 1
+}
+
+// checkStreamIdsLow notifies once the remaining stream ids drop to the
+// threshold set by NotifyStreamIdsLow.  Callers must hold nextIdLock.
+func (s *Connection) checkStreamIdsLow() {
+	if s.idsLowNotified || (s.idsLowChan == nil && !s.idsLowGoAway) {
+		return
+	}
+	remaining := s.remainingStreamIds()
+	if remaining > s.idsLowThreshold {
+		return
+	}
+	s.idsLowNotified = true
+	debugMessage("(%p) Stream ids low: %d remaining", s, remaining)
+
+	if s.idsLowChan != nil {
+		c := s.idsLowChan
+		// not counted, the send waits on the user draining the channel
+		go func() {
+			c <- remaining
+		}()
+	}
+	if s.idsLowGoAway {
+		s.spawn(func() {
+			if err := s.Close(); err != nil {
+				debugMessage("(%p) go away error: %s", s, err)
+			}
+		})
+	}
 }
 
-// PeekNextStreamId returns the next sequential id and keeps the next id untouched
+// NotifyStreamIdsLow registers a channel to be sent the number of
+// stream ids left once creating streams brings it down to threshold.
+// Stream ids are never reused, CreateStream returns ErrStreamIdExhausted
+// after the last one.  If goAway is set, the connection is also closed
+// gracefully when the threshold is reached, so that pools can replace
+// it before streams fail.  The channel may be nil.
+func (s *Connection) NotifyStreamIdsLow(c chan<- uint32, threshold uint32, goAway bool) {
+	s.nextIdLock.Lock()
+	defer s.nextIdLock.Unlock()
+	s.idsLowChan = c
+	s.idsLowThreshold = threshold
+	s.idsLowGoAway = goAway
+	s.idsLowNotified = false
+	s.checkStreamIdsLow()
+}
+
+// PeekNextStreamId returns the next sequential id, the lowest id the next
+// stream may be allocated, and keeps the next id untouched
 func (s *Connection) PeekNextStreamId() spdy.StreamId {
 	sid := s.nextStreamId
 	return sid
 }
 
+// validateStreamId checks that a stream id received from the remote has
+// the parity of the remote and is greater than the ids it already used.
 func (s *Connection) validateStreamId(rid spdy.StreamId) error {
-	if rid > 0x7fffffff || rid < s.receivedStreamId {
+	// receivedStreamId keeps the parity of the remote ids
+	receivedStreamId := s.loadReceivedStreamId()
+	if rid > 0x7fffffff || rid < receivedStreamId || rid&1 != receivedStreamId&1 {
 		return ErrInvalidStreamId
 	}
-	s.receivedStreamId = rid + 2
+	atomic.StoreUint32((*uint32)(&s.receivedStreamId), uint32(rid+2))
 	return nil
 }
 
+// loadReceivedStreamId returns the id following the last stream id
+// received from the remote.  The id is only accessed atomically, as it
+// is read without holding receiveIdLock.
+func (s *Connection) loadReceivedStreamId() spdy.StreamId {
+	return spdy.StreamId(atomic.LoadUint32((*uint32)(&s.receivedStreamId)))
+}
+
 func (s *Connection) addStream(stream *Stream) {
-	s.streamCond.L.Lock()
-	s.streams[stream.streamId] = stream
-	debugMessage("(%p) (%p) Stream added, broadcasting: %d", s, stream, stream.streamId)
-	s.streamCond.Broadcast()
-	s.streamCond.L.Unlock()
+	displaced := s.streams.add(stream)
+	debugMessage("(%p) (%p) Stream added: %d", s, stream, stream.streamId)
+	s.updatePriorityMark()
+	if displaced != nil && displaced != stream {
+		// stream ids are validated or allocated in increasing order
+		s.invariantViolated(displaced, "stream %d added twice", stream.streamId)
+	}
 }
 
 func (s *Connection) removeStream(stream *Stream) {
-	s.streamCond.L.Lock()
-	delete(s.streams, stream.streamId)
-	debugMessage("(%p) (%p) Stream removed, broadcasting: %d", s, stream, stream.streamId)
-	s.streamCond.Broadcast()
-	s.streamCond.L.Unlock()
+	s.streams.remove(stream)
+	debugMessage("(%p) (%p) Stream removed: %d", s, stream, stream.streamId)
+	s.updatePriorityMark()
+	stream.stopQuota()
+}
+
+// streamsSnapshot returns the streams in the stream table, so they can
+// be iterated without holding the stream table while locking each
+// stream.  The slice is shared and must not be modified.
+func (s *Connection) streamsSnapshot() []*Stream {
+	return s.streams.streams()
 }
 
 func (s *Connection) getStream(streamId spdy.StreamId) (stream *Stream, ok bool) {
-	s.streamLock.RLock()
-	stream, ok = s.streams[streamId]
-	s.streamLock.RUnlock()
-	return
+	return s.streams.get(streamId)
 }
 
 // FindStream looks up the given stream id and either waits for the
@@ -955,15 +1852,12 @@ func (s *Connection) getStream(streamId spdy.StreamId) (stream *Stream, ok bool)
 // valid.
 func (s *Connection) FindStream(streamId uint32) *Stream {
 	var stream *Stream
-	var ok bool
-	s.streamCond.L.Lock()
-	stream, ok = s.streams[spdy.StreamId(streamId)]
-	debugMessage("(%p) Found stream %d? %t", s, spdy.StreamId(streamId), ok)
-	for !ok && streamId >= uint32(s.receivedStreamId) {
-		s.streamCond.Wait()
-		stream, ok = s.streams[spdy.StreamId(streamId)]
-	}
-	s.streamCond.L.Unlock()
+	s.streams.waitFor(func() bool {
+		var ok bool
+		stream, ok = s.streams.get(spdy.StreamId(streamId))
+		debugMessage("(%p) Found stream %d? %t", s, spdy.StreamId(streamId), ok)
+		return ok || spdy.StreamId(streamId) < s.loadReceivedStreamId()
+	})
 	return stream
 }
 
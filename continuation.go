@@ -0,0 +1,272 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+var (
+	ErrHeaderContinuationLimit = errors.New("continued headers exceed limits")
+)
+
+const (
+	// HeaderContinuationHeader flags a header block continued in the
+	// next HEADERS frame of the stream, see SetHeaderContinuation.
+	HeaderContinuationHeader = "Spdystream-Header-Continues"
+
+	// MaxHeaderContinuationFrames bounds the HEADERS frames continuing
+	// the headers of a stream or of a reply.
+	MaxHeaderContinuationFrames = 64
+
+	// DefaultMaxContinuedHeaderSize bounds the size of reassembled
+	// headers unless SetHeaderBlockLimits sets a maximum size.
+	DefaultMaxContinuedHeaderSize = 1024 * 1024
+)
+
+// headerContinuation is the header block being continued on a stream.
+type headerContinuation int
+
+const (
+	continuationNone headerContinuation = iota
+	continuationStream
+	continuationReply
+)
+
+// SetHeaderContinuation splits the headers of created streams and of
+// replies larger than maxBlockSize bytes, counting the names and values
+// before compression, across the stream or reply frame and HEADERS
+// frames following it, for headers exceeding the frame size accepted by
+// the remote, such as large signed tokens.  Headers are packed from the
+// smallest, so the headers used on arrival of the first frame, such as
+// the stream type, trace id and deadline, stay in it; a single value is
+// never split and may still exceed maxBlockSize.  0 disables splitting,
+// which is the default.
+//
+// Calling it also enables reassembling the headers continued by the
+// remote before passing the stream to its handler or completing the
+// reply, so both sides must call it; with maxBlockSize 0 headers are
+// only reassembled.  Reassembled headers are limited to
+// MaxHeaderContinuationFrames frames and to the maximum size set with
+// SetHeaderBlockLimits, or DefaultMaxContinuedHeaderSize, the stream
+// being reset with a protocol error beyond.  A stream whose headers are
+// never completed is only removed by a reset or with the connection.
+// Must be called before Serve.
+func (s *Connection) SetHeaderContinuation(maxBlockSize int) {
+	s.headerBlockSplit = maxBlockSize
+	s.headerReassembly = true
+}
+
+// maxContinuedHeaderSize returns the size reassembled headers are
+// limited to.
+func (s *Connection) maxContinuedHeaderSize() uint64 {
+	if s.headerBlockMaxSize > 0 {
+		return uint64(s.headerBlockMaxSize)
+	}
+	return DefaultMaxContinuedHeaderSize
+}
+
+// splitHeaderBlock splits headers in blocks of at most the size set with
+// SetHeaderContinuation, flagging all blocks but the last one with
+// HeaderContinuationHeader.  It returns nil if the headers need no
+// splitting.
+func (s *Connection) splitHeaderBlock(headers http.Header) []http.Header {
+	limit := uint64(s.headerBlockSplit)
+	if limit == 0 || headerBytes(headers) <= limit {
+		return nil
+	}
+	names := make([]string, 0, len(headers))
+	sizes := make(map[string]uint64, len(headers))
+	for name, values := range headers {
+		names = append(names, name)
+		sizes[name] = headerBytes(http.Header{name: values})
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if sizes[names[i]] == sizes[names[j]] {
+			return names[i] < names[j]
+		}
+		return sizes[names[i]] < sizes[names[j]]
+	})
+
+	var blocks []http.Header
+	block := http.Header{}
+	var size uint64
+	for _, name := range names {
+		values := headers[name]
+		for len(values) > 0 {
+			// as many values as fit, at least one in an empty block
+			n := 0
+			var valuesSize uint64
+			for n < len(values) {
+				valueSize := uint64(len(name) + len(values[n]))
+				if size+valuesSize+valueSize > limit && (size > 0 || n > 0) {
+					break
+				}
+				valuesSize += valueSize
+				n++
+			}
+			if n > 0 {
+				block[name] = append(block[name], values[:n]...)
+				size += valuesSize
+				values = values[n:]
+			}
+			if len(values) > 0 {
+				blocks = append(blocks, block)
+				block = http.Header{}
+				size = 0
+			}
+		}
+	}
+	blocks = append(blocks, block)
+	if len(blocks) == 1 {
+		return nil
+	}
+	for _, block := range blocks[:len(blocks)-1] {
+		block.Set(HeaderContinuationHeader, "1")
+	}
+	return blocks
+}
+
+// sendContinuation writes the HEADERS frames continuing the header block
+// of stream, the last one finishing the stream if fin.
+func (s *Connection) sendContinuation(stream *Stream, blocks []http.Header, fin bool) error {
+	for i, block := range blocks {
+		var flags spdy.ControlFlags
+		if fin && i == len(blocks)-1 {
+			flags = spdy.ControlFlagFin
+		}
+		headerFrame := &spdy.HeadersFrame{
+			StreamId: stream.streamId,
+			Headers:  block,
+			CFHeader: spdy.ControlFrameHeader{Flags: flags},
+		}
+		if err := s.framer.WriteFrame(headerFrame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// continueStreamHeaders returns whether the headers of a stream opened
+// by the remote are continued, in which case the stream is accepted once
+// they are complete.
+func (s *Connection) continueStreamHeaders(stream *Stream) bool {
+	if !s.headerReassembly || stream.headers.Get(HeaderContinuationHeader) == "" {
+		return false
+	}
+	stream.closeLock.Lock()
+	stream.headers.Del(HeaderContinuationHeader)
+	stream.continuedBytes = headerBytes(stream.headers)
+	stream.closeLock.Unlock()
+	stream.continuing = continuationStream
+	return true
+}
+
+// continueReplyHeaders returns whether the headers of a reply are
+// continued, in which case the reply is completed once they are
+// complete.
+func (s *Connection) continueReplyHeaders(stream *Stream, headers http.Header) bool {
+	if !s.headerReassembly || headers.Get(HeaderContinuationHeader) == "" {
+		return false
+	}
+	headers.Del(HeaderContinuationHeader)
+	stream.closeLock.Lock()
+	stream.replyHeaders = headers
+	stream.closeLock.Unlock()
+	stream.continuing = continuationReply
+	stream.continuedBytes = headerBytes(headers)
+	return true
+}
+
+// handleContinuationFrame merges a HEADERS frame continuing the headers
+// of a stream or of its reply, accepting the stream or completing the
+// reply on the last frame.  It returns false if the frame does not
+// continue headers.
+func (s *Connection) handleContinuationFrame(frame *spdy.HeadersFrame, newHandler StreamHandler) (bool, error) {
+	stream, streamOk := s.getStream(frame.StreamId)
+	if !streamOk || stream.continuing == continuationNone {
+		return false, nil
+	}
+	last := frame.Headers.Get(HeaderContinuationHeader) == ""
+	frame.Headers.Del(HeaderContinuationHeader)
+	fin := (frame.CFHeader.Flags & spdy.ControlFlagFin) != 0x00
+
+	stream.continuedFrames++
+	stream.continuedBytes += headerBytes(frame.Headers)
+	if stream.continuedFrames > MaxHeaderContinuationFrames || stream.continuedBytes > s.maxContinuedHeaderSize() {
+		return true, s.rejectContinuation(stream)
+	}
+
+	switch stream.continuing {
+	case continuationStream:
+		stream.closeLock.Lock()
+		for name, values := range frame.Headers {
+			stream.headers[name] = append(stream.headers[name], values...)
+		}
+		stream.closeLock.Unlock()
+		if !last {
+			return true, nil
+		}
+		stream.continuing = continuationNone
+		if fin {
+			stream.finishHeaderOnly()
+		}
+		return true, s.acceptStream(stream, newHandler)
+	default:
+		stream.closeLock.Lock()
+		headers := stream.replyHeaders
+		for name, values := range frame.Headers {
+			headers[name] = append(headers[name], values...)
+		}
+		stream.closeLock.Unlock()
+		if !last {
+			return true, nil
+		}
+		stream.continuing = continuationNone
+		s.completeReply(stream, headers, fin)
+		return true, nil
+	}
+}
+
+// rejectContinuation resets a stream whose continued headers exceed the
+// limits with a protocol error, failing the wait for a reply.
+func (s *Connection) rejectContinuation(stream *Stream) error {
+	debugMessage("(%p) (%d) Continued headers exceed limits: %d frames, %d bytes", s, stream.streamId, stream.continuedFrames, stream.continuedBytes)
+	if stream.continuing == continuationReply {
+		stream.replied = true
+		stream.startChan <- ErrHeaderContinuationLimit
+		close(stream.startChan)
+	}
+	stream.continuing = continuationNone
+	return stream.abortWithStatus(ErrHeaderContinuationLimit, spdy.ProtocolError)
+}
+
+// finishHeaderOnly finishes the remote side of a stream opened with
+// headers only: the remote sends neither data nor headers, so no channel
+// is needed for them.
+func (s *Stream) finishHeaderOnly() {
+	s.dataChan = nil
+	s.headerChan = nil
+	s.closeLock.Lock()
+	s.remoteFinished = true
+	s.closeLock.Unlock()
+	s.closeRemoteChannels()
+}
@@ -0,0 +1,233 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+func TestHeaderContinuation(t *testing.T) {
+	// random tokens, which compression can not bring under the frame size
+	tokens := make([]string, 2)
+	for i := range tokens {
+		random := make([]byte, 6*1024)
+		if _, err := rand.Read(random); err != nil {
+			t.Fatalf("Error generating token: %v", err)
+		}
+		tokens[i] = hex.EncodeToString(random)
+	}
+	streams := make(chan *Stream, 1)
+	configure := func(conn *Connection) {
+		conn.SetMaxFrameSize(8 * 1024)
+		conn.SetHeaderContinuation(4 * 1024)
+	}
+	client, server := newTestConnections(t, configure, func(stream *Stream) {
+		reply := http.Header{}
+		reply.Set("Reply-Token", stream.Headers().Get("Token-A")+stream.Headers().Get("Token-B"))
+		stream.SendReply(reply, false)
+		streams <- stream
+	})
+	defer client.Close()
+	defer server.Close()
+	client.SetHeaderContinuation(4 * 1024)
+
+	headers := http.Header{}
+	headers.Set("Token-A", tokens[0])
+	headers.Set("Token-B", tokens[1])
+	headers.Set("Small", "value")
+	stream, err := client.CreateStream(headers, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	if err := stream.WaitTimeout(5 * time.Second); err != nil {
+		t.Fatalf("Error waiting for reply: %v", err)
+	}
+	remote := <-streams
+
+	for i, name := range []string{"Token-A", "Token-B"} {
+		if values := remote.Headers()[name]; len(values) != 1 || values[0] != tokens[i] {
+			t.Fatalf("Unexpected %s header of %d values", name, len(values))
+		}
+	}
+	if value := remote.Headers().Get("Small"); value != "value" {
+		t.Fatalf("Unexpected header:\nActual: %q\nExpected: %q", value, "value")
+	}
+	if remote.Headers().Get(HeaderContinuationHeader) != "" {
+		t.Fatal("Continuation header not removed")
+	}
+	if reply := stream.ReplyHeaders().Get("Reply-Token"); reply != tokens[0]+tokens[1] {
+		t.Fatalf("Unexpected reply header length:\nActual: %d\nExpected: %d", len(reply), len(tokens[0])+len(tokens[1]))
+	}
+
+	// Data follows the continued headers
+	go stream.Write([]byte("data"))
+	data, err := remote.ReadData()
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if string(data) != "data" {
+		t.Fatalf("Unexpected data:\nActual: %q\nExpected: %q", data, "data")
+	}
+
+	// Header only streams are finished by the last frame
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.SendSignal(ctx, headers); err != ErrSignalRefused {
+		t.Fatalf("Unexpected signal error:\nActual: %v\nExpected: %v", err, ErrSignalRefused)
+	}
+}
+
+func TestHeaderContinuationLimits(t *testing.T) {
+	clientConn, serverConn := Loopback(0)
+	server, err := NewConnection(serverConn, true)
+	if err != nil {
+		t.Fatalf("Error creating server connection: %v", err)
+	}
+	server.SetHeaderContinuation(0)
+	server.SetHeaderBlockLimits(4*1024, 0)
+	accepted := make(chan *Stream, 2)
+	go server.Serve(func(stream *Stream) {
+		accepted <- stream
+	})
+	defer server.Close()
+
+	framer, err := spdy.NewFramer(clientConn, clientConn)
+	if err != nil {
+		t.Fatalf("Error creating framer: %v", err)
+	}
+	resets := make(chan *spdy.RstStreamFrame, 2)
+	go func() {
+		for {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			if reset, ok := frame.(*spdy.RstStreamFrame); ok {
+				resets <- reset
+			}
+		}
+	}()
+	continued := func() http.Header {
+		return http.Header{HeaderContinuationHeader: []string{"1"}}
+	}
+
+	// stream 1 continues headers beyond the header block limit, stream
+	// 3 in more frames than allowed
+	for _, id := range []spdy.StreamId{1, 3} {
+		if err := framer.WriteFrame(&spdy.SynStreamFrame{StreamId: id, Headers: continued()}); err != nil {
+			t.Fatalf("Error writing stream frame: %v", err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		headers := continued()
+		headers.Set(fmt.Sprintf("Large-%d", i), strings.Repeat("x", 1024))
+		if err := framer.WriteFrame(&spdy.HeadersFrame{StreamId: 1, Headers: headers}); err != nil {
+			t.Fatalf("Error writing headers frame: %v", err)
+		}
+	}
+	for i := 0; i <= MaxHeaderContinuationFrames; i++ {
+		headers := continued()
+		headers.Set("Small", "value")
+		if err := framer.WriteFrame(&spdy.HeadersFrame{StreamId: 3, Headers: headers}); err != nil {
+			t.Fatalf("Error writing headers frame: %v", err)
+		}
+	}
+
+	rejected := map[spdy.StreamId]spdy.RstStreamStatus{}
+	for len(rejected) < 2 {
+		select {
+		case reset := <-resets:
+			rejected[reset.StreamId] = reset.Status
+		case stream := <-accepted:
+			t.Fatalf("Unexpected stream %d accepted", stream.Identifier())
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for resets, got %v", rejected)
+		}
+	}
+	if rejected[1] != spdy.ProtocolError || rejected[3] != spdy.ProtocolError {
+		t.Fatalf("Unexpected reset statuses: %v", rejected)
+	}
+	if n := server.NumActiveStreams(); n != 0 {
+		t.Fatalf("Unexpected active streams:\nActual: %d\nExpected: %d", n, 0)
+	}
+}
+
+func TestHeaderContinuationOptIn(t *testing.T) {
+	streams := make(chan *Stream, 1)
+	client, server := newTestConnections(t, nil, func(stream *Stream) {
+		stream.SendReply(http.Header{}, false)
+		streams <- stream
+	})
+	defer client.Close()
+	defer server.Close()
+	client.SetHeaderContinuation(1024)
+
+	headers := http.Header{}
+	headers.Set("Large-A", strings.Repeat("a", 1024))
+	headers.Set("Large-B", strings.Repeat("b", 1024))
+	if _, err := client.CreateStream(headers, nil, false); err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+
+	// without SetHeaderContinuation the remote does not reassemble the
+	// headers, the stream is accepted with its first frame
+	select {
+	case remote := <-streams:
+		if remote.Headers().Get(HeaderContinuationHeader) == "" {
+			t.Fatal("Continued headers reassembled without opting in")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for stream")
+	}
+}
+
+func TestSplitHeaderBlock(t *testing.T) {
+	conn := &Connection{headerBlockSplit: 10}
+	headers := http.Header{
+		"A":    {"1", "2", "3"},
+		"Long": {"0123456789012"},
+	}
+	blocks := conn.splitHeaderBlock(headers)
+	merged := http.Header{}
+	for i, block := range blocks {
+		if last := i == len(blocks)-1; (block.Get(HeaderContinuationHeader) == "") != last {
+			t.Fatalf("Unexpected continuation flag on block %d of %d", i, len(blocks))
+		}
+		block.Del(HeaderContinuationHeader)
+		for name, values := range block {
+			merged[name] = append(merged[name], values...)
+		}
+	}
+	if len(blocks) != 2 {
+		t.Fatalf("Unexpected block count:\nActual: %d\nExpected: %d", len(blocks), 2)
+	}
+	if strings.Join(merged["A"], ",") != "1,2,3" || merged.Get("Long") != "0123456789012" {
+		t.Fatalf("Unexpected merged headers: %v", merged)
+	}
+	if conn.splitHeaderBlock(http.Header{"A": {"1"}}) != nil {
+		t.Fatal("Unexpected split of small headers")
+	}
+}
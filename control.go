@@ -0,0 +1,239 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+const (
+	// StreamTypeControl flags the streams carrying control messages, see
+	// SetControlChannel.
+	StreamTypeControl = "control"
+
+	maxControlTypeLength = 0xffff
+)
+
+var (
+	ErrNoControlChannel      = errors.New("control channel not enabled")
+	ErrInvalidControlMessage = errors.New("invalid control message")
+)
+
+// ControlMessage is an application-level control message, such as a
+// rekey request or a configuration push.
+type ControlMessage struct {
+	// Type identifies the message, for example "rekey".
+	Type string
+	// Payload is the message body, encoded by the application.
+	Payload []byte
+}
+
+// ControlHandler handles the control messages received from the remote.
+// Messages are handled one at a time, in the order they were sent.
+type ControlHandler func(ControlMessage)
+
+// ControlChannel sends control messages to the remote over a reserved
+// stream, out of band of the application streams.
+type ControlChannel struct {
+	conn    *Connection
+	handler ControlHandler
+
+	ready  chan struct{}
+	stream *Stream
+	err    error
+
+	receiveLock sync.Mutex
+	receiving   bool
+	remote      *Stream
+
+	heartbeatLock sync.Mutex
+	heartbeatSeq  uint64
+	heartbeats    map[uint64]chan heartbeatEcho
+
+	credentialsLock    sync.Mutex
+	credentialsSeq     uint64
+	credentialRequests map[uint64]chan error
+}
+
+// SetControlChannel enables the control channel: once Serve is called, a
+// control stream is opened to the remote, and messages received on the
+// control stream of the remote are passed to handler.  Control streams
+// are handled by the connection and not passed to the stream handler.
+// Both peers must enable the control channel.  Must be called before
+// Serve.
+func (s *Connection) SetControlChannel(handler ControlHandler) {
+	s.control = &ControlChannel{
+		conn:    s,
+		handler: handler,
+		ready:   make(chan struct{}),
+	}
+}
+
+// ControlChannel returns the control channel, or nil if it is not
+// enabled.
+func (s *Connection) ControlChannel() *ControlChannel {
+	return s.control
+}
+
+// Send sends a control message to the remote, waiting for the control
+// stream to be opened if needed.
+func (c *ControlChannel) Send(ctx context.Context, msg ControlMessage) error {
+	if c == nil {
+		return ErrNoControlChannel
+	}
+	data, err := marshalControlMessage(msg)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-c.ready:
+	case <-c.conn.closeChan:
+		return ErrWriteClosedStream
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if c.err != nil {
+		return c.err
+	}
+	return c.stream.WriteData(data, false)
+}
+
+func (c *ControlChannel) open() {
+	headers := http.Header{}
+	headers.Set(StreamTypeHeader, StreamTypeControl)
+	stream, err := c.conn.CreateStream(headers, nil, false)
+	if err == nil {
+		err = stream.Wait()
+	}
+	if err != nil {
+		debugMessage("(%p) Error opening control channel: %s", c.conn, err)
+	}
+	c.stream, c.err = stream, err
+	close(c.ready)
+
+	c.conn.shutdownLock.Lock()
+	shutdown := c.conn.hasShutdown
+	c.conn.shutdownLock.Unlock()
+	if shutdown && err == nil {
+		// opened after close, see close
+		stream.Close()
+	}
+}
+
+// close finishes the control streams so they do not hold back the
+// shutdown of the connection.
+func (c *ControlChannel) close() {
+	select {
+	case <-c.ready:
+		if c.err == nil {
+			c.stream.Close()
+		}
+	default:
+	}
+	c.receiveLock.Lock()
+	remote := c.remote
+	c.receiveLock.Unlock()
+	if remote != nil {
+		remote.Close()
+	}
+}
+
+// isControlStream returns whether stream is the control stream of the
+// remote, to be handled by handleControlStream.
+func (s *Connection) isControlStream(stream *Stream) bool {
+	return s.control != nil && stream.parent == nil && stream.headers.Get(StreamTypeHeader) == StreamTypeControl
+}
+
+func (s *Connection) handleControlStream(stream *Stream) error {
+	c := s.control
+	c.receiveLock.Lock()
+	if c.receiving {
+		c.receiveLock.Unlock()
+		debugMessage("(%p) Duplicate control channel on stream %d", s, stream.streamId)
+		return stream.Refuse()
+	}
+	c.receiving = true
+	c.remote = stream
+	c.receiveLock.Unlock()
+
+	if err := stream.SendReply(http.Header{}, false); err != nil {
+		return err
+	}
+	c.conn.spawn(func() { c.receive(stream) })
+	return nil
+}
+
+func (c *ControlChannel) receive(stream *Stream) {
+	for {
+		data, err := stream.ReadData()
+		if err != nil {
+			return
+		}
+		msg, err := unmarshalControlMessage(data)
+		if err != nil {
+			debugMessage("(%p) Invalid control message on stream %d", c.conn, stream.streamId)
+			if err := c.conn.sendResetFrame(spdy.ProtocolError, stream.streamId); err != nil {
+				debugMessage("reset error: %s", err)
+			}
+			return
+		}
+		switch msg.Type {
+		case ControlTypeHeartbeat, ControlTypeTimedHeartbeat:
+			c.echoHeartbeat(msg)
+		case ControlTypeHeartbeatAck, ControlTypeTimedHeartbeatAck:
+			c.ackHeartbeat(msg)
+		case ControlTypeCredentialsExpired:
+			c.refreshCredentials(msg)
+		case ControlTypeCredentials, ControlTypeCredentialsError:
+			c.receiveCredentials(msg)
+		default:
+			if c.handler != nil {
+				c.handler(msg)
+			}
+		}
+	}
+}
+
+// marshalControlMessage encodes msg as the length of its type, as a
+// 16-bit big endian integer, the type and the payload.
+func marshalControlMessage(msg ControlMessage) ([]byte, error) {
+	if len(msg.Type) > maxControlTypeLength || 2+len(msg.Type)+len(msg.Payload) > spdy.MaxDataLength {
+		return nil, ErrInvalidControlMessage
+	}
+	data := make([]byte, 2+len(msg.Type)+len(msg.Payload))
+	binary.BigEndian.PutUint16(data, uint16(len(msg.Type)))
+	copy(data[2:], msg.Type)
+	copy(data[2+len(msg.Type):], msg.Payload)
+	return data, nil
+}
+
+func unmarshalControlMessage(data []byte) (ControlMessage, error) {
+	if len(data) < 2 {
+		return ControlMessage{}, ErrInvalidControlMessage
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+n {
+		return ControlMessage{}, ErrInvalidControlMessage
+	}
+	return ControlMessage{Type: string(data[2 : 2+n]), Payload: data[2+n:]}, nil
+}
@@ -0,0 +1,184 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// CopyBufferSize is the size of the buffers used by CopyStream, each read
+// being written as one data frame when the destination is a stream.
+const CopyBufferSize = 32 * 1024
+
+var (
+	ErrCopyAborted = errors.New("copy aborted by the other direction")
+)
+
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, CopyBufferSize)
+		return &buf
+	},
+}
+
+// CopyResult reports one direction of CopyStream.
+type CopyResult struct {
+	// Bytes is the number of bytes written to the destination.
+	Bytes int64
+	// Err is the cause ending the copy: nil when the source reached its
+	// end, the error of ctx when it was done, ErrCopyAborted when the
+	// other direction failed, or the read or write error.
+	Err error
+}
+
+// CopyStream copies from src to dst and from dst to src until both
+// directions reach the end of their source, returning the result of each
+// direction.  Each direction reads only once the previous write
+// completed, so a slow writer holds back its source.  At the end of a
+// source, the write side of the destination is closed, with Close for
+// streams and CloseWrite for connections supporting it, while the other
+// direction goes on.
+//
+// When a direction fails the other one is aborted, and when ctx is done
+// both are; the pending reads are interrupted by setting their read
+// deadline in the past, and on connections other than streams their
+// write deadline, so both ends are to be closed or reset by the caller.
+// CopyStream blocks until both directions end, stream handlers are to
+// run it in their own goroutine.
+func CopyStream(ctx context.Context, dst, src io.ReadWriter) (forward, backward CopyResult) {
+	abort := make(chan struct{})
+	var abortOnce sync.Once
+	abortCopy := func() {
+		abortOnce.Do(func() { close(abort) })
+	}
+
+	done := make(chan struct{})
+	interrupted := make(chan struct{})
+	go func() {
+		defer close(interrupted)
+		select {
+		case <-ctx.Done():
+		case <-abort:
+		case <-done:
+			return
+		}
+		interruptCopy(dst)
+		interruptCopy(src)
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		backward = copyDirection(src, dst)
+		if backward.Err != nil {
+			abortCopy()
+		}
+	}()
+	forward = copyDirection(dst, src)
+	if forward.Err != nil {
+		abortCopy()
+	}
+	wg.Wait()
+	close(done)
+	<-interrupted
+
+	forward.Err = copyCause(ctx, forward.Err, backward.Err)
+	backward.Err = copyCause(ctx, backward.Err, forward.Err)
+	return forward, backward
+}
+
+// copyDirection copies src to dst, closing the write side of dst at the
+// end of src.
+func copyDirection(dst io.Writer, src io.Reader) CopyResult {
+	bufp := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(bufp)
+	buf := *bufp
+
+	var result CopyResult
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			written, werr := dst.Write(buf[:n])
+			result.Bytes += int64(written)
+			if werr == nil && written != n {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				result.Err = werr
+				return result
+			}
+		}
+		if err == io.EOF {
+			result.Err = closeWrite(dst)
+			return result
+		} else if err != nil {
+			result.Err = err
+			return result
+		}
+	}
+}
+
+// closeWrite closes the write side of w, if it can be closed alone.
+func closeWrite(w io.Writer) error {
+	switch c := w.(type) {
+	case *Stream:
+		if err := c.Close(); err != ErrWriteClosedStream {
+			return err
+		}
+	case interface{ CloseWrite() error }:
+		return c.CloseWrite()
+	}
+	return nil
+}
+
+// interruptCopy interrupts the reads and writes pending on rw.  Stream
+// write deadlines apply to the whole connection and are left alone.
+func interruptCopy(rw io.ReadWriter) {
+	past := time.Unix(1, 0)
+	switch c := rw.(type) {
+	case *Stream:
+		c.SetReadDeadline(past)
+	case interface{ SetDeadline(time.Time) error }:
+		c.SetDeadline(past)
+	}
+}
+
+// copyCause returns the cause ending a direction failed with err, the
+// other direction having failed with other.
+func copyCause(ctx context.Context, err, other error) error {
+	if err == nil {
+		return nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if other != nil && isTimeout(err) && !isTimeout(other) {
+		return ErrCopyAborted
+	}
+	return err
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
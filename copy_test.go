@@ -0,0 +1,168 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCopyStream(t *testing.T) {
+	echo, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+
+	results := make(chan [2]CopyResult, 1)
+	handler := func(stream *Stream) {
+		stream.SendReply(http.Header{}, false)
+		go func() {
+			conn, err := net.Dial("tcp", echo.Addr().String())
+			if err != nil {
+				stream.Reset()
+				return
+			}
+			defer conn.Close()
+			forward, backward := CopyStream(context.Background(), conn, stream)
+			results <- [2]CopyResult{forward, backward}
+		}()
+	}
+	client, server := newTestConnections(t, nil, handler)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for reply: %v", err)
+	}
+
+	data := bytes.Repeat([]byte("copy"), 3*CopyBufferSize/4+1)
+	go func() {
+		stream.Write(data)
+		stream.Close()
+	}()
+	echoed, err := ioutil.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("Error reading echo: %v", err)
+	}
+	if !bytes.Equal(echoed, data) {
+		t.Fatalf("Unexpected echo length:\nActual: %d\nExpected: %d", len(echoed), len(data))
+	}
+
+	select {
+	case r := <-results:
+		for _, result := range r {
+			if result.Err != nil {
+				t.Fatalf("Unexpected copy error: %v", result.Err)
+			}
+			if result.Bytes != int64(len(data)) {
+				t.Fatalf("Unexpected byte count:\nActual: %d\nExpected: %d", result.Bytes, len(data))
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for copy to end")
+	}
+}
+
+func TestCopyStreamCancel(t *testing.T) {
+	a, aPeer := Loopback(0)
+	b, bPeer := Loopback(0)
+	defer aPeer.Close()
+	defer bPeer.Close()
+
+	if _, err := aPeer.Write([]byte("hello")); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	type copyResults struct{ forward, backward CopyResult }
+	done := make(chan copyResults, 1)
+	go func() {
+		forward, backward := CopyStream(ctx, b, a)
+		done <- copyResults{forward, backward}
+	}()
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(bPeer, buf); err != nil {
+		t.Fatalf("Error reading copied data: %v", err)
+	}
+	cancel()
+
+	select {
+	case r := <-done:
+		if r.forward.Bytes != 5 {
+			t.Fatalf("Unexpected byte count:\nActual: %d\nExpected: %d", r.forward.Bytes, 5)
+		}
+		if r.forward.Err != context.Canceled {
+			t.Fatalf("Unexpected forward error:\nActual: %v\nExpected: %v", r.forward.Err, context.Canceled)
+		}
+		if r.backward.Err != context.Canceled {
+			t.Fatalf("Unexpected backward error:\nActual: %v\nExpected: %v", r.backward.Err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for canceled copy")
+	}
+}
+
+func TestCopyStreamAbort(t *testing.T) {
+	a, aPeer := Loopback(0)
+	b, bPeer := Loopback(0)
+	defer aPeer.Close()
+	defer bPeer.Close()
+
+	type copyResults struct{ forward, backward CopyResult }
+	done := make(chan copyResults, 1)
+	go func() {
+		forward, backward := CopyStream(context.Background(), b, a)
+		done <- copyResults{forward, backward}
+	}()
+
+	// Closing b makes the backward direction fail reading it, the forward
+	// direction blocked reading a is aborted.
+	b.Close()
+
+	select {
+	case r := <-done:
+		if r.backward.Err != io.ErrClosedPipe {
+			t.Fatalf("Unexpected backward error:\nActual: %v\nExpected: %v", r.backward.Err, io.ErrClosedPipe)
+		}
+		if r.forward.Err != ErrCopyAborted {
+			t.Fatalf("Unexpected forward error:\nActual: %v\nExpected: %v", r.forward.Err, ErrCopyAborted)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for aborted copy")
+	}
+}
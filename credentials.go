@@ -0,0 +1,206 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// ControlTypeCredentialsExpired is the type of the control messages
+	// sent by RequestCredentials, asking the remote for fresh credentials
+	// returned in a ControlTypeCredentials message, or a
+	// ControlTypeCredentialsError message if none could be obtained.
+	// Credential messages are handled by the control channel and not
+	// passed to the control handler.
+	ControlTypeCredentialsExpired = "spdystream.credentials-expired"
+	ControlTypeCredentials        = "spdystream.credentials"
+	ControlTypeCredentialsError   = "spdystream.credentials-error"
+
+	credentialsSeqSize = 8
+)
+
+var (
+	ErrNoCredentialVerifier   = errors.New("no credential verifier set")
+	ErrCredentialsUnavailable = errors.New("remote has no fresh credentials")
+)
+
+// CredentialsFunc returns fresh credentials when the remote reports the
+// current ones expired, reason being the reason it gave.  ctx is done
+// when the connection closes.
+type CredentialsFunc func(ctx context.Context, reason string) ([]byte, error)
+
+// SetCredentialRefresh sets the function supplying fresh credentials
+// when the remote asks for them with RequestCredentials.  Without it,
+// requests are answered with ErrCredentialsUnavailable.  The control
+// channel must be enabled with SetControlChannel.  Must be called before
+// Serve.
+func (s *Connection) SetCredentialRefresh(refresh CredentialsFunc) {
+	s.credentialRefresh = refresh
+}
+
+// SetCredentialVerifier sets the function checking the credentials
+// received in answer to RequestCredentials.  Must be called before
+// Serve.
+func (s *Connection) SetCredentialVerifier(verify func(credentials []byte) error) {
+	s.credentialVerifier = verify
+}
+
+// CredentialsError is returned by RequestCredentials when the remote
+// could not supply credentials or the credentials it supplied were
+// rejected by the verifier.
+type CredentialsError struct {
+	// Err is the error of the verifier, or ErrCredentialsUnavailable
+	// with the message of the remote.
+	Err     error
+	Message string
+}
+
+func (e *CredentialsError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("credentials refresh failed: %s: %s", e.Err, e.Message)
+	}
+	return fmt.Sprintf("credentials refresh failed: %s", e.Err)
+}
+
+func (e *CredentialsError) Unwrap() error {
+	return e.Err
+}
+
+// RequestCredentials tells the remote its credentials expired, giving
+// reason, and waits for fresh credentials, checked with the verifier set
+// with SetCredentialVerifier.  The streams of the connection are left
+// open whatever the outcome, it is up to the caller to close the
+// connection on failure, for example with CloseWithReason and
+// CloseCodeAuthExpired.  A *CredentialsError is returned if the remote
+// supplied no credentials or they were rejected.
+func (c *ControlChannel) RequestCredentials(ctx context.Context, reason string) error {
+	if c == nil {
+		return ErrNoControlChannel
+	}
+	if c.conn.credentialVerifier == nil {
+		return ErrNoCredentialVerifier
+	}
+	result := make(chan error, 1)
+	c.credentialsLock.Lock()
+	c.credentialsSeq++
+	seq := c.credentialsSeq
+	if c.credentialRequests == nil {
+		c.credentialRequests = make(map[uint64]chan error)
+	}
+	c.credentialRequests[seq] = result
+	c.credentialsLock.Unlock()
+	defer func() {
+		c.credentialsLock.Lock()
+		delete(c.credentialRequests, seq)
+		c.credentialsLock.Unlock()
+	}()
+
+	payload := make([]byte, credentialsSeqSize+len(reason))
+	binary.BigEndian.PutUint64(payload, seq)
+	copy(payload[credentialsSeqSize:], reason)
+	if err := c.Send(ctx, ControlMessage{Type: ControlTypeCredentialsExpired, Payload: payload}); err != nil {
+		return err
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-c.conn.closeChan:
+		return ErrWriteClosedStream
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// refreshCredentials answers a credentials request of the remote with
+// the credentials returned by the refresh function, outside of the
+// control channel goroutine as obtaining them may take a while.
+func (c *ControlChannel) refreshCredentials(msg ControlMessage) {
+	if len(msg.Payload) < credentialsSeqSize {
+		debugMessage("(%p) Invalid credentials request", c.conn)
+		return
+	}
+	seq := msg.Payload[:credentialsSeqSize]
+	reason := string(msg.Payload[credentialsSeqSize:])
+	c.conn.Go(func() {
+		answer := ControlMessage{Type: ControlTypeCredentials}
+		var credentials []byte
+		err := ErrCredentialsUnavailable
+		if refresh := c.conn.credentialRefresh; refresh != nil {
+			ctx, cancel := context.WithCancel(context.Background())
+			c.conn.Go(func() {
+				select {
+				case <-c.conn.closeChan:
+					cancel()
+				case <-ctx.Done():
+				}
+			})
+			credentials, err = refresh(ctx, reason)
+			cancel()
+		}
+		if err != nil {
+			debugMessage("(%p) Error refreshing credentials: %s", c.conn, err)
+			answer.Type = ControlTypeCredentialsError
+			credentials = []byte(err.Error())
+		}
+		answer.Payload = append(append([]byte{}, seq...), credentials...)
+		if err := c.Send(context.Background(), answer); err != nil {
+			debugMessage("(%p) Error sending credentials: %s", c.conn, err)
+		}
+	})
+}
+
+// receiveCredentials checks the credentials, or the error, sent by the
+// remote in answer to RequestCredentials.
+func (c *ControlChannel) receiveCredentials(msg ControlMessage) {
+	if len(msg.Payload) < credentialsSeqSize {
+		debugMessage("(%p) Invalid credentials answer", c.conn)
+		return
+	}
+	seq := binary.BigEndian.Uint64(msg.Payload)
+	c.credentialsLock.Lock()
+	result, ok := c.credentialRequests[seq]
+	c.credentialsLock.Unlock()
+	if !ok {
+		return
+	}
+
+	data := msg.Payload[credentialsSeqSize:]
+	if msg.Type == ControlTypeCredentialsError {
+		deliverCredentialsResult(result, &CredentialsError{Err: ErrCredentialsUnavailable, Message: string(data)})
+		return
+	}
+	c.conn.Go(func() {
+		if err := c.conn.credentialVerifier(data); err != nil {
+			deliverCredentialsResult(result, &CredentialsError{Err: err})
+			return
+		}
+		deliverCredentialsResult(result, nil)
+	})
+}
+
+// deliverCredentialsResult passes err to the request waiting on result,
+// dropping it if the remote answered the request more than once.
+func deliverCredentialsResult(result chan error, err error) {
+	select {
+	case result <- err:
+	default:
+	}
+}
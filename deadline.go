@@ -0,0 +1,191 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DeadlineHeader is the reserved header carrying the time budget, in
+// milliseconds, left to a stream created with CreateStreamContext when
+// deadline propagation is enabled.  A budget rather than an absolute time
+// keeps the deadline independent of clock skew between the peers.
+const DeadlineHeader = "Spdystream-Timeout"
+
+// SetDeadlinePropagation sets whether CreateStreamContext encodes the
+// deadline of its context into the DeadlineHeader of the stream.  Must be
+// called before Serve.
+func (s *Connection) SetDeadlinePropagation(enabled bool) {
+	s.propagateDeadlines = enabled
+}
+
+// SetContextPriority sets the function deriving the priority of the
+// streams created with CreateStreamContext from their context, so the
+// priority assigned to a request higher in the stack applies to its
+// streams.  When priority returns false, the stream has the default
+// priority.  Valid priorities are 0 through 7, 0 being the highest.  Must
+// be called before Serve.
+func (s *Connection) SetContextPriority(priority func(ctx context.Context) (uint8, bool)) {
+	s.contextPriority = priority
+}
+
+// CreateStreamContext is like CreateStream but ties the stream to ctx: an
+// error is returned if ctx is already done, and the stream is reset when
+// ctx is done before the stream is closed.  With deadline propagation
+// enabled, the remaining time before the deadline of ctx is sent in the
+// DeadlineHeader so the remote can stop working on the stream once the
+// caller has given up, see Stream.Deadline.  The priority of the stream
+// is derived from ctx as set with SetContextPriority.
+func (s *Connection) CreateStreamContext(ctx context.Context, headers http.Header, parent *Stream, fin bool) (*Stream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok && s.propagateDeadlines {
+		budget := time.Until(deadline) / time.Millisecond
+		if budget <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		withDeadline := make(http.Header, len(headers)+1)
+		for name, values := range headers {
+			withDeadline[name] = values
+		}
+		withDeadline.Set(DeadlineHeader, strconv.FormatInt(int64(budget), 10))
+		headers = withDeadline
+	}
+
+	var priority uint8
+	if s.contextPriority != nil {
+		if p, ok := s.contextPriority(ctx); ok && p <= 7 {
+			priority = p
+		}
+	}
+
+	stream, err := s.createStream(headers, parent, fin, priority)
+	if err != nil {
+		return stream, err
+	}
+	if ctx.Done() != nil {
+		s.Go(func() {
+			select {
+			case <-ctx.Done():
+				debugMessage("(%p) (%p) Context done, resetting stream: %s", s, stream, ctx.Err())
+				stream.Reset()
+			case <-stream.closeChan:
+			}
+		})
+	}
+	return stream, nil
+}
+
+// Deadline returns the deadline of a stream accepted with a DeadlineHeader,
+// computed from the budget sent by the remote and the time the stream was
+// received.  ok is false when the remote sent no deadline.
+func (s *Stream) Deadline() (deadline time.Time, ok bool) {
+	return s.deadline, !s.deadline.IsZero()
+}
+
+// parseDeadlineHeader returns the deadline encoded in the DeadlineHeader
+// of headers relative to received, or the zero time if there is none.
+func parseDeadlineHeader(headers http.Header, received time.Time) time.Time {
+	value := headers.Get(DeadlineHeader)
+	if value == "" {
+		return time.Time{}
+	}
+	budget, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || budget < 0 || budget > int64(time.Duration(1<<63-1)/time.Millisecond) {
+		debugMessage("Invalid %s header: %q", DeadlineHeader, value)
+		return time.Time{}
+	}
+	return received.Add(time.Duration(budget) * time.Millisecond)
+}
+
+// timeoutError is returned by operations exceeding a deadline.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// ioDeadline is a deadline which wakes waiting operations when it is
+// changed.
+type ioDeadline struct {
+	lock    sync.Mutex
+	t       time.Time
+	changed chan struct{}
+}
+
+func (d *ioDeadline) set(t time.Time) {
+	d.lock.Lock()
+	d.t = t
+	if d.changed != nil {
+		close(d.changed)
+	}
+	d.changed = make(chan struct{})
+	d.lock.Unlock()
+}
+
+// arm returns channels receiving when the deadline passes, nil without a
+// deadline, and when the deadline is changed, along with a function to
+// release the timer.  A timeoutError is returned if the deadline passed.
+func (d *ioDeadline) arm() (timeout <-chan time.Time, changed <-chan struct{}, stop func(), err error) {
+	d.lock.Lock()
+	t := d.t
+	if d.changed == nil {
+		d.changed = make(chan struct{})
+	}
+	changed = d.changed
+	d.lock.Unlock()
+
+	stop = func() {}
+	if !t.IsZero() {
+		remaining := time.Until(t)
+		if remaining <= 0 {
+			return nil, nil, stop, timeoutError{}
+		}
+		timer := time.NewTimer(remaining)
+		timeout, stop = timer.C, func() { timer.Stop() }
+	}
+	return timeout, changed, stop, nil
+}
+
+// wait waits for ch to be closed, the deadline to be changed or
+// exceeded.
+func (d *ioDeadline) wait(ch <-chan struct{}) error {
+	timeout, changed, stop, err := d.arm()
+	if err != nil {
+		return err
+	}
+	defer stop()
+	select {
+	case <-ch:
+	case <-changed:
+	case <-timeout:
+		return timeoutError{}
+	}
+	return nil
+}
+
+// exceeded returns whether the deadline has passed.
+func (d *ioDeadline) exceeded() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return !d.t.IsZero() && !time.Now().Before(d.t)
+}
@@ -0,0 +1,193 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DebugHandler is an http.Handler rendering the state of the registered
+// connections: their streams, counters, memory usage and recent frames
+// if SetFrameHistory is enabled.  Only the names of the stream headers
+// are rendered, as their values may carry credentials.  It serves HTML, or JSON when requested
+// with the format=json query parameter or an Accept header preferring
+// JSON.  It is typically mounted under /debug/spdystream:
+//
+//	debug := spdystream.NewDebugHandler()
+//	http.Handle("/debug/spdystream", debug)
+//	debug.Register("upstream", conn)
+type DebugHandler struct {
+	lock  sync.Mutex
+	conns map[*Connection]string
+}
+
+// NewDebugHandler returns a debug handler without connections.
+func NewDebugHandler() *DebugHandler {
+	return &DebugHandler{conns: make(map[*Connection]string)}
+}
+
+// Register adds conn to the rendered connections under name.  The
+// connection is removed once closed.
+func (h *DebugHandler) Register(name string, conn *Connection) {
+	h.lock.Lock()
+	h.conns[conn] = name
+	h.lock.Unlock()
+	go func() {
+		<-conn.CloseChan()
+		h.Unregister(conn)
+	}()
+}
+
+// Unregister removes conn from the rendered connections.
+func (h *DebugHandler) Unregister(conn *Connection) {
+	h.lock.Lock()
+	delete(h.conns, conn)
+	h.lock.Unlock()
+}
+
+type debugConnection struct {
+	Name           string
+	LocalAddr      string
+	RemoteAddr     string
+	ActiveStreams  int
+	PendingAccepts int
+	Goroutines     int
+	Stats          ConnectionStats
+	Memory         MemoryUsage
+	Streams        []debugStream
+	RecentFrames   []FrameRecord
+}
+
+type debugStream struct {
+	Id                uint32
+	Parent            uint32
+	Priority          uint8
+	TraceID           string
+	HeaderNames       []string
+	Finished          bool
+	RemoteClosed      bool
+	BufferedRecvBytes int
+}
+
+func (h *DebugHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.lock.Lock()
+	conns := make([]debugConnection, 0, len(h.conns))
+	for conn, name := range h.conns {
+		conns = append(conns, newDebugConnection(name, conn))
+	}
+	h.lock.Unlock()
+	sort.Slice(conns, func(i, j int) bool {
+		if conns[i].Name == conns[j].Name {
+			return conns[i].RemoteAddr < conns[j].RemoteAddr
+		}
+		return conns[i].Name < conns[j].Name
+	})
+
+	if r.URL.Query().Get("format") == "json" || strings.HasPrefix(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(conns); err != nil {
+			debugMessage("Error rendering debug page: %s", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := debugTemplate.Execute(w, conns); err != nil {
+		debugMessage("Error rendering debug page: %s", err)
+	}
+}
+
+func newDebugConnection(name string, conn *Connection) debugConnection {
+	c := debugConnection{
+		Name:           name,
+		LocalAddr:      conn.conn.LocalAddr().String(),
+		RemoteAddr:     conn.conn.RemoteAddr().String(),
+		ActiveStreams:  conn.NumActiveStreams(),
+		PendingAccepts: conn.NumPendingAccepts(),
+		Goroutines:     conn.Goroutines(),
+		Stats:          conn.Stats(),
+		Memory:         conn.MemoryUsage(),
+		RecentFrames:   conn.FrameHistory(),
+	}
+	for _, stream := range conn.streamsSnapshot() {
+		ds := debugStream{
+			Id:                uint32(stream.streamId),
+			Priority:          stream.priority,
+			TraceID:           stream.traceID,
+			HeaderNames:       stream.headerNames(),
+			BufferedRecvBytes: stream.BufferedRecvBytes(),
+		}
+		if stream.parent != nil {
+			ds.Parent = uint32(stream.parent.streamId)
+		}
+		stream.finishLock.Lock()
+		ds.Finished = stream.finished
+		stream.finishLock.Unlock()
+		select {
+		case <-stream.closeChan:
+			ds.RemoteClosed = true
+		default:
+		}
+		c.Streams = append(c.Streams, ds)
+	}
+	sort.Slice(c.Streams, func(i, j int) bool { return c.Streams[i].Id < c.Streams[j].Id })
+	return c
+}
+
+// headerNames returns the sorted names of the headers of stream, which
+// are merged by continued header frames under closeLock.
+func (s *Stream) headerNames() []string {
+	s.closeLock.Lock()
+	names := make([]string, 0, len(s.headers))
+	for name := range s.headers {
+		names = append(names, name)
+	}
+	s.closeLock.Unlock()
+	sort.Strings(names)
+	return names
+}
+
+var debugTemplate = template.Must(template.New("debug").Parse(`<!DOCTYPE html>
+<html>
+<head><title>spdystream</title></head>
+<body>
+<h1>spdystream connections</h1>
+{{range .}}
+<h2>{{.Name}} {{.LocalAddr}} &rarr; {{.RemoteAddr}}</h2>
+<p>{{.ActiveStreams}} active streams, {{.PendingAccepts}} pending accepts, {{.Goroutines}} goroutines,
+{{.Memory.Total}} bytes held ({{.Memory.ReceiveBufferBytes}} receive buffers,
+{{.Memory.FrameQueueBytes}} queued frames)</p>
+<pre>{{printf "%+v" .Stats}}</pre>
+<table border="1">
+<tr><th>Stream</th><th>Parent</th><th>Priority</th><th>Trace id</th><th>Finished</th><th>Remote closed</th><th>Buffered</th><th>Headers</th></tr>
+{{range .Streams}}<tr><td>{{.Id}}</td><td>{{.Parent}}</td><td>{{.Priority}}</td><td>{{.TraceID}}</td><td>{{.Finished}}</td><td>{{.RemoteClosed}}</td><td>{{.BufferedRecvBytes}}</td><td>{{range .HeaderNames}}{{.}}<br>{{end}}</td></tr>
+{{end}}</table>
+{{with .RecentFrames}}<h3>Recent frames</h3>
+<pre>{{range .}}{{.}}
+{{end}}</pre>{{end}}
+{{else}}
+<p>No connections registered.</p>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,92 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebugHandler(t *testing.T) {
+	client, server := newTestConnections(t, nil, MirrorStreamHandler)
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.CreateStream(http.Header{"Job": {"render"}, "Authorization": {"secret"}}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+
+	debug := NewDebugHandler()
+	debug.Register("upstream", client)
+	httpServer := httptest.NewServer(debug)
+	defer httpServer.Close()
+
+	resp, err := http.Get(httpServer.URL + "?format=json")
+	if err != nil {
+		t.Fatalf("Error getting debug page: %s", err)
+	}
+	var conns []debugConnection
+	err = json.NewDecoder(resp.Body).Decode(&conns)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Error decoding debug page: %s", err)
+	}
+	if len(conns) != 1 || conns[0].Name != "upstream" || conns[0].ActiveStreams != 1 {
+		t.Fatalf("Unexpected connections: %+v", conns)
+	}
+	if len(conns[0].Streams) != 1 || conns[0].Streams[0].Id != stream.Identifier() || !reflect.DeepEqual(conns[0].Streams[0].HeaderNames, []string{"Authorization", "Job"}) {
+		t.Fatalf("Unexpected streams: %+v", conns[0].Streams)
+	}
+
+	resp, err = http.Get(httpServer.URL)
+	if err != nil {
+		t.Fatalf("Error getting debug page: %s", err)
+	}
+	page, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Error reading debug page: %s", err)
+	}
+	if !strings.Contains(string(page), "upstream") || !strings.Contains(string(page), "Job") || strings.Contains(string(page), "secret") {
+		t.Fatalf("Unexpected debug page: %s", page)
+	}
+
+	client.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		debug.lock.Lock()
+		registered := len(debug.conns)
+		debug.lock.Unlock()
+		if registered == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for closed connection to be unregistered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
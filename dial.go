@@ -0,0 +1,371 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBadHandshake = errors.New("bad spdy upgrade handshake")
+)
+
+// Dialer contains options for connecting to a spdy server through
+// an HTTP/1.1 upgrade, see Upgrade for the server side.
+type Dialer struct {
+	// NetDial specifies the dial function for creating network
+	// connections. If NetDial is nil, a net.Dialer is used. A custom
+	// NetDial can connect over transports such as Windows named pipes.
+	NetDial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// TLSClientConfig specifies the TLS configuration used for https
+	// URLs. If nil, the default configuration is used.
+	TLSClientConfig *tls.Config
+
+	// HandshakeTimeout bounds the TLS and upgrade handshake. Zero
+	// means no timeout other than the one of the dial context.
+	HandshakeTimeout time.Duration
+
+	// Addrs, if set, lists the network addresses to dial in place of
+	// the URL host, which is still used for the upgrade request and TLS
+	// server name. Addresses of the form unix:///path are dialed as
+	// Unix domain sockets. If Addrs is empty and NetDial is nil, the
+	// addresses of the URL host are resolved and IPv6 and IPv4 addresses
+	// are tried alternately. With NetDial set, the URL host is passed
+	// unresolved.
+	Addrs []string
+
+	// FallbackDelay is the time to wait for a connection attempt before
+	// racing it with an attempt to the next address, as described in
+	// RFC 8305. The first attempt completing the upgrade handshake is
+	// used. Zero means a delay of 250ms, negative values try addresses
+	// one after the other.
+	FallbackDelay time.Duration
+}
+
+// DefaultDialer is a Dialer with all fields set to the default values.
+var DefaultDialer = &Dialer{}
+
+// Dial connects to the http or https URL, upgrades the connection to
+// spdy and returns a client Connection serving new streams with
+// newHandler. Header is sent with the upgrade request and user
+// information in the URL is sent as basic authentication. If the server
+// does not switch protocols, ErrBadHandshake is returned along with the
+// server response.
+func (d *Dialer) Dial(urlStr string, header http.Header, newHandler StreamHandler) (*Connection, *http.Response, error) {
+	return d.DialContext(context.Background(), urlStr, header, newHandler)
+}
+
+// DialContext is like Dial but uses ctx to bound connecting and the
+// upgrade handshake.
+func (d *Dialer) DialContext(ctx context.Context, urlStr string, header http.Header, newHandler StreamHandler) (*Connection, *http.Response, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var useTLS bool
+	switch u.Scheme {
+	case "http":
+	case "https":
+		useTLS = true
+	default:
+		return nil, nil, fmt.Errorf("unsupported url scheme %q", u.Scheme)
+	}
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set(HeaderConnection, "Upgrade")
+	req.Header.Set(HeaderUpgrade, UpgradeProtocol)
+	if u.User != nil {
+		password, _ := u.User.Password()
+		req.SetBasicAuth(u.User.Username(), password)
+	}
+
+	if d.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.HandshakeTimeout)
+		defer cancel()
+	}
+
+	addrs := d.Addrs
+	if len(addrs) == 0 {
+		if d.NetDial != nil {
+			addrs = []string{hostPort(u)}
+		} else if addrs, err = resolveAddrs(ctx, u); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	conn, resp, err := d.dialAddrs(ctx, addrs, req, useTLS)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	spdyConn, err := NewConnection(conn, false)
+	if err != nil {
+		conn.Close()
+		return nil, resp, err
+	}
+	go spdyConn.Serve(newHandler)
+
+	return spdyConn, resp, nil
+}
+
+// dialResult is the outcome of a connection attempt to one address.
+type dialResult struct {
+	conn net.Conn
+	resp *http.Response
+	err  error
+}
+
+// dialAddrs races connection attempts to addrs, starting the next attempt
+// when the previous one failed or did not complete within the fallback
+// delay. The first connection to complete the handshake is returned and
+// the others are closed.
+func (d *Dialer) dialAddrs(ctx context.Context, addrs []string, req *http.Request, useTLS bool) (net.Conn, *http.Response, error) {
+	if len(addrs) == 1 {
+		result := d.dialAddr(ctx, addrs[0], req, useTLS)
+		return result.conn, result.resp, result.err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	delay := d.FallbackDelay
+	if delay == 0 {
+		delay = 250 * time.Millisecond
+	}
+
+	results := make(chan dialResult, len(addrs))
+	var (
+		next     int
+		pending  int
+		fallback <-chan time.Time
+		firstErr error
+	)
+	start := func() {
+		go func(addr string) {
+			results <- d.dialAddr(ctx, addr, req, useTLS)
+		}(addrs[next])
+		next++
+		pending++
+		if delay > 0 && next < len(addrs) {
+			fallback = time.After(delay)
+		} else {
+			fallback = nil
+		}
+	}
+	// closeRemaining closes connections of attempts still running
+	closeRemaining := func() {
+		go func(pending int) {
+			for i := 0; i < pending; i++ {
+				if result := <-results; result.err == nil {
+					result.conn.Close()
+				}
+			}
+		}(pending)
+	}
+
+	start()
+	for pending > 0 {
+		select {
+		case <-fallback:
+			start()
+		case result := <-results:
+			pending--
+			if result.err == nil || result.err == ErrBadHandshake {
+				// a server answering the upgrade decides the outcome
+				cancel()
+				closeRemaining()
+				return result.conn, result.resp, result.err
+			}
+			debugMessage("Dial attempt failed: %s", result.err)
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			if next < len(addrs) {
+				start()
+			}
+		}
+	}
+	return nil, nil, firstErr
+}
+
+// dialAddr connects to addr and runs the handshake, aborting the
+// handshake when ctx is done.
+func (d *Dialer) dialAddr(ctx context.Context, addr string, req *http.Request, useTLS bool) dialResult {
+	netDial := d.NetDial
+	if netDial == nil {
+		netDial = (&net.Dialer{}).DialContext
+	}
+	network, address := splitAddr(addr)
+	netConn, err := netDial(ctx, network, address)
+	if err != nil {
+		return dialResult{err: err}
+	}
+
+	// unblock the handshake if the attempt is abandoned
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			netConn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	conn, resp, err := d.handshake(ctx, netConn, req, useTLS)
+	close(stop)
+	<-stopped
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		netConn.Close()
+		return dialResult{resp: resp, err: err}
+	}
+	return dialResult{conn: conn, resp: resp}
+}
+
+// resolveAddrs returns the addresses to dial for u, alternating between
+// IPv6 and IPv4 addresses starting with IPv6 as recommended by RFC 8305.
+func resolveAddrs(ctx context.Context, u *url.URL) ([]string, error) {
+	hostport := hostPort(u)
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{hostport}, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var ipv6, ipv4 []string
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), port)
+		if ip.IP.To4() != nil {
+			ipv4 = append(ipv4, addr)
+		} else {
+			ipv6 = append(ipv6, addr)
+		}
+	}
+	addrs := make([]string, 0, len(ips))
+	for len(ipv6) > 0 || len(ipv4) > 0 {
+		if len(ipv6) > 0 {
+			addrs = append(addrs, ipv6[0])
+			ipv6 = ipv6[1:]
+		}
+		if len(ipv4) > 0 {
+			addrs = append(addrs, ipv4[0])
+			ipv4 = ipv4[1:]
+		}
+	}
+	return addrs, nil
+}
+
+// handshake runs the optional TLS handshake and the upgrade request on
+// conn, returning the connection to run spdy over.
+func (d *Dialer) handshake(ctx context.Context, conn net.Conn, req *http.Request, useTLS bool) (net.Conn, *http.Response, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if useTLS {
+		cfg := d.TLSClientConfig
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg = cfg.Clone()
+			cfg.ServerName = req.URL.Hostname()
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, nil, err
+		}
+		conn = tlsConn
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!headerContainsToken(resp.Header, HeaderConnection, "upgrade") ||
+		!headerContainsToken(resp.Header, HeaderUpgrade, UpgradeProtocol) {
+		resp.Body.Close()
+		return nil, resp, ErrBadHandshake
+	}
+
+	if br.Buffered() > 0 {
+		conn = &bufferedConn{Conn: conn, r: br}
+	}
+	return conn, resp, nil
+}
+
+// unixAddrPrefix marks Unix domain socket paths in addresses.
+const unixAddrPrefix = "unix://"
+
+// splitAddr returns the network and address to dial or listen on for
+// addr: "unix" and the path for addresses with the unix:// prefix, "tcp"
+// and addr otherwise.
+func splitAddr(addr string) (network, address string) {
+	if strings.HasPrefix(addr, unixAddrPrefix) {
+		return "unix", addr[len(unixAddrPrefix):]
+	}
+	return "tcp", addr
+}
+
+// hostPort returns the host and port to dial for u, defaulting the port
+// from the scheme.
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
@@ -0,0 +1,194 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newUpgradeServer(t *testing.T, start func(handler http.Handler) *httptest.Server) *httptest.Server {
+	return start(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user, password, ok := req.BasicAuth()
+		if !ok || user != "user" || password != "secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if req.Header.Get("X-Test") != "value" {
+			http.Error(w, "missing header", http.StatusBadRequest)
+			return
+		}
+		if _, err := Upgrade(w, req, MirrorStreamHandler); err != nil {
+			t.Errorf("Error upgrading connection: %s", err)
+		}
+	}))
+}
+
+func testDialEcho(t *testing.T, dialer *Dialer, rawurl string) {
+	rawurl = strings.Replace(rawurl, "://", "://user:secret@", 1)
+	conn, resp, err := dialer.Dial(rawurl, http.Header{"X-Test": {"value"}}, NoOpStreamHandler)
+	if err != nil {
+		t.Fatalf("Error dialing: %s", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Unexpected status:\nActual: %d\nExpected: %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	stream, err := conn.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatalf("Error writing to stream: %s", err)
+	}
+	data, err := stream.ReadData()
+	if err != nil {
+		t.Fatalf("Error reading from stream: %s", err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Unexpected data:\nActual: %q\nExpected: %q", data, "hello")
+	}
+
+	stream.Reset()
+	conn.Close()
+}
+
+func TestDial(t *testing.T) {
+	server := newUpgradeServer(t, httptest.NewServer)
+	defer server.Close()
+
+	testDialEcho(t, DefaultDialer, server.URL)
+}
+
+func TestDialTLS(t *testing.T) {
+	server := newUpgradeServer(t, httptest.NewTLSServer)
+	defer server.Close()
+
+	dialer := &Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	testDialEcho(t, dialer, server.URL)
+}
+
+func TestDialBadHandshake(t *testing.T) {
+	server := newUpgradeServer(t, httptest.NewServer)
+	defer server.Close()
+
+	_, resp, err := DefaultDialer.Dial(server.URL, nil, NoOpStreamHandler)
+	if err != ErrBadHandshake {
+		t.Fatalf("Unexpected dial error: %v", err)
+	}
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected unauthorized response, got %#v", resp)
+	}
+}
+
+func TestDialAddrs(t *testing.T) {
+	server := newUpgradeServer(t, httptest.NewServer)
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an address refusing connections
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	refusedAddr := refused.Addr().String()
+	refused.Close()
+
+	// an address accepting connections without ever answering
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	dialer := &Dialer{
+		Addrs:         []string{refusedAddr, silent.Addr().String(), u.Host},
+		FallbackDelay: 50 * time.Millisecond,
+	}
+	testDialEcho(t, dialer, "http://example.invalid")
+
+	dialer = &Dialer{
+		Addrs:         []string{refusedAddr},
+		FallbackDelay: 50 * time.Millisecond,
+	}
+	if _, _, err := dialer.Dial("http://example.invalid", nil, NoOpStreamHandler); err == nil {
+		t.Fatal("Expected error dialing refused address")
+	}
+}
+
+func TestResolveAddrs(t *testing.T) {
+	u, err := url.Parse("https://[::1]/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := resolveAddrs(context.Background(), u)
+	if err != nil {
+		t.Fatalf("Error resolving addresses: %s", err)
+	}
+	if len(addrs) != 1 || addrs[0] != "[::1]:443" {
+		t.Fatalf("Unexpected addresses:\nActual: %v\nExpected: [[::1]:443]", addrs)
+	}
+}
+
+func TestDialUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spdystream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spdy.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("Unix domain sockets unsupported: %s", err)
+	}
+	server := newUpgradeServer(t, func(handler http.Handler) *httptest.Server {
+		server := httptest.NewUnstartedServer(handler)
+		server.Listener.Close()
+		server.Listener = listener
+		server.Start()
+		return server
+	})
+	defer server.Close()
+
+	dialer := &Dialer{Addrs: []string{"unix://" + path}}
+	testDialEcho(t, dialer, "http://localhost")
+}
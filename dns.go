@@ -0,0 +1,81 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+)
+
+// StreamTypeDNS flags the streams created by DialDNS, which carry DNS
+// messages framed as over TCP, so handlers shared with other streams can
+// route them to DNSStreamHandler.
+const StreamTypeDNS = "dns"
+
+// DialDNS creates a stream flagged with StreamTypeDNS and waits for its
+// reply, returning the stream as a net.Conn to the DNS server of the
+// remote.  The network and address asked by the resolver are ignored, the
+// remote forwards the queries to the server given to DNSStreamHandler.
+// It is meant as the Dial hook of a net.Resolver, see NewRemoteResolver.
+func (s *Connection) DialDNS(ctx context.Context, network, address string) (net.Conn, error) {
+	stream, err := s.dialStream(ctx, StreamTypeDNS)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// NewRemoteResolver returns a resolver sending its queries over streams
+// of conn, resolving names as seen from the network of the remote, which
+// serves them with DNSStreamHandler.  As the stream is not a
+// net.PacketConn, the resolver frames the messages as over TCP.
+func NewRemoteResolver(conn *Connection) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial:     conn.DialDNS,
+	}
+}
+
+// DNSStreamHandler returns a stream handler forwarding the DNS messages
+// sent on every stream to server, a host:port reached over TCP.  The
+// server is dialed outside of the frame handling goroutines and streams
+// are reset when it cannot be reached.
+func DNSStreamHandler(server string) StreamHandler {
+	return func(stream *Stream) {
+		stream.conn.Go(func() {
+			dnsConn, err := net.Dial("tcp", server)
+			if err != nil {
+				debugMessage("(%p) (%d) Error dialing dns server %s: %s", stream, stream.streamId, server, err)
+				stream.Reset()
+				return
+			}
+			if err := stream.SendReply(http.Header{}, false); err != nil {
+				dnsConn.Close()
+				return
+			}
+
+			stream.conn.Go(func() {
+				io.Copy(dnsConn, stream)
+				dnsConn.Close()
+			})
+			io.Copy(stream, dnsConn)
+			stream.Close()
+		})
+	}
+}
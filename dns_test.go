@@ -0,0 +1,111 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveTestDNS answers the A queries read on conn with 192.0.2.1 and the
+// other queries with no records.
+func serveTestDNS(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		query := make([]byte, length)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		end := 12
+		for query[end] != 0 {
+			end += int(query[end]) + 1
+		}
+		end += 5
+		qtype := binary.BigEndian.Uint16(query[end-4:])
+
+		resp := append([]byte{}, query[:end]...)
+		resp[2], resp[3] = 0x81, 0x80
+		binary.BigEndian.PutUint16(resp[4:], 1)
+		binary.BigEndian.PutUint16(resp[6:], 0)
+		binary.BigEndian.PutUint16(resp[8:], 0)
+		binary.BigEndian.PutUint16(resp[10:], 0)
+		if qtype == 1 {
+			binary.BigEndian.PutUint16(resp[6:], 1)
+			resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 192, 0, 2, 1)
+		}
+		binary.Write(conn, binary.BigEndian, uint16(len(resp)))
+		if _, err := conn.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+func TestRemoteResolver(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestDNS(conn)
+		}
+	}()
+
+	client, server := newTestConnections(t, nil, DNSStreamHandler(listener.Addr().String()))
+	defer server.Close()
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addrs, err := NewRemoteResolver(client).LookupHost(ctx, "agent.example.")
+	if err != nil {
+		t.Fatalf("Error resolving: %s", err)
+	}
+	if len(addrs) != 1 || addrs[0] != "192.0.2.1" {
+		t.Fatalf("Unexpected addresses:\nActual: %v\nExpected: [192.0.2.1]", addrs)
+	}
+}
+
+func TestRemoteResolverUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	client, server := newTestConnections(t, nil, DNSStreamHandler(addr))
+	defer server.Close()
+	defer client.Close()
+
+	if _, err := client.DialDNS(context.Background(), "udp", "127.0.0.53:53"); err != ErrReset {
+		t.Fatalf("Unexpected dial error:\nActual: %v\nExpected: %v", err, ErrReset)
+	}
+}
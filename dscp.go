@@ -0,0 +1,132 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+)
+
+var (
+	ErrDSCPUnsupported = errors.New("dscp marking not supported on connection")
+)
+
+// priorityDSCP maps spdy priorities, 0 being the highest, to
+// differentiated services code points.  The lowest priorities use the
+// lower effort class CS1.
+var priorityDSCP = [8]int{
+	46, // EF
+	34, // AF41
+	26, // AF31
+	18, // AF21
+	10, // AF11
+	0,  // best effort
+	8,  // CS1
+	8,  // CS1
+}
+
+// DSCPForPriority returns the differentiated services code point used for
+// a spdy priority by default.
+func DSCPForPriority(priority uint8) int {
+	if int(priority) >= len(priorityDSCP) {
+		return priorityDSCP[len(priorityDSCP)-1]
+	}
+	return priorityDSCP[priority]
+}
+
+// SetDSCP marks packets sent on the connection with the differentiated
+// services code point dscp.  Since all streams share one network
+// connection, the mark applies to all of them.  ErrDSCPUnsupported is
+// returned if the connection is not a TCP connection, such as a TLS
+// connection, or the platform does not support marking.
+func (s *Connection) SetDSCP(dscp int) error {
+	conn := s.conn
+	if buffered, ok := conn.(*bufferedConn); ok {
+		conn = buffered.Conn
+	}
+	if proxied, ok := conn.(*proxyConn); ok {
+		conn = proxied.Conn
+	}
+	if _, ok := conn.(*tls.Conn); ok {
+		return ErrDSCPUnsupported
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return ErrDSCPUnsupported
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	ipv6 := false
+	if addr, ok := tcpConn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		ipv6 = true
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = setTOS(fd, ipv6, dscp<<2)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// SetPriorityMarking marks the connection using mapping with the highest
+// priority of its open streams, updated as streams open and close.  This
+// suits connections carrying streams of a single priority, or
+// applications using one connection per priority.  DSCPForPriority may be
+// used as mapping, a nil mapping disables marking updates.
+func (s *Connection) SetPriorityMarking(mapping func(priority uint8) int) {
+	s.markLock.Lock()
+	s.markMapping = mapping
+	s.markDSCP = -1
+	s.markLock.Unlock()
+	s.updatePriorityMark()
+}
+
+// updatePriorityMark applies the mark for the highest priority open
+// stream if it changed.
+func (s *Connection) updatePriorityMark() {
+	s.markLock.Lock()
+	defer s.markLock.Unlock()
+	if s.markMapping == nil {
+		return
+	}
+
+	streams := s.streamsSnapshot()
+	if len(streams) == 0 {
+		return
+	}
+	priority := uint8(7)
+	for _, stream := range streams {
+		if stream.priority < priority {
+			priority = stream.priority
+		}
+	}
+
+	dscp := s.markMapping(priority)
+	if dscp == s.markDSCP {
+		return
+	}
+	if err := s.SetDSCP(dscp); err != nil {
+		debugMessage("(%p) Error marking connection with dscp %d: %s", s, dscp, err)
+		return
+	}
+	s.markDSCP = dscp
+}
@@ -0,0 +1,90 @@
+//go:build linux
+// +build linux
+
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+)
+
+func getTOS(t *testing.T, conn *Connection) int {
+	rawConn, err := conn.conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("Error getting raw connection: %s", err)
+	}
+	var tos int
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		tos, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+	}); err != nil {
+		t.Fatalf("Error controlling raw connection: %s", err)
+	}
+	if sockErr != nil {
+		t.Fatalf("Error reading tos: %s", sockErr)
+	}
+	return tos
+}
+
+func TestSetDSCP(t *testing.T) {
+	client, _ := newTestConnections(t, nil, MirrorStreamHandler)
+	defer client.Close()
+
+	if err := client.SetDSCP(26); err != nil {
+		t.Fatalf("Error setting dscp: %s", err)
+	}
+	if tos := getTOS(t, client); tos != 26<<2 {
+		t.Fatalf("Unexpected tos:\nActual: %#x\nExpected: %#x", tos, 26<<2)
+	}
+}
+
+func TestPriorityMarking(t *testing.T) {
+	client, _ := newTestConnections(t, nil, MirrorStreamHandler)
+	defer client.Close()
+	client.SetPriorityMarking(DSCPForPriority)
+
+	low, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := low.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	low.SetPriority(7)
+	if tos := getTOS(t, client); tos != DSCPForPriority(7)<<2 {
+		t.Fatalf("Unexpected tos:\nActual: %#x\nExpected: %#x", tos, DSCPForPriority(7)<<2)
+	}
+
+	// the highest priority of the open streams determines the mark
+	high, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if tos := getTOS(t, client); tos != DSCPForPriority(0)<<2 {
+		t.Fatalf("Unexpected tos:\nActual: %#x\nExpected: %#x", tos, DSCPForPriority(0)<<2)
+	}
+	if err := high.Reset(); err != nil {
+		t.Fatalf("Error resetting stream: %s", err)
+	}
+	if tos := getTOS(t, client); tos != DSCPForPriority(7)<<2 {
+		t.Fatalf("Unexpected tos:\nActual: %#x\nExpected: %#x", tos, DSCPForPriority(7)<<2)
+	}
+}
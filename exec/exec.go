@@ -0,0 +1,326 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package exec runs commands on the remote of a spdy connection, as a
+// reference use of the stream API.
+//
+// The client opens a stream flagged with StreamTypeExec carrying the
+// command, its arguments and environment in headers.  The agent, serving
+// the streams with Handler, replies with an error stream of its own and
+// runs the command: the stream carries the standard input and output of
+// the command, the error stream its standard error.  Once the command
+// exits, the agent finishes the stream with a HEADERS control frame
+// carrying the exit status.  The status is not sent on the control
+// channel of the connection: that channel has a single handler owned by
+// the application, must be enabled by both peers, and its messages are
+// not ordered with the output of the stream, whereas the HEADERS frame
+// ties the status to its stream and follows the output.  Resetting
+// either stream kills the command.
+package exec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	osexec "os/exec"
+	"strconv"
+
+	"github.com/moby/spdystream"
+)
+
+const (
+	// StreamTypeExec flags the streams running a command.
+	StreamTypeExec = "exec"
+
+	// PathHeader carries the command to run.
+	PathHeader = "Exec-Path"
+	// ArgHeader carries the arguments of the command, one value each.
+	ArgHeader = "Exec-Arg"
+	// EnvHeader carries the environment of the command, one key=value
+	// pair per value.
+	EnvHeader = "Exec-Env"
+
+	// ExitCodeHeader carries the exit code of the command, sent by the
+	// agent once it exits.
+	ExitCodeHeader = "Exec-Exit-Code"
+	// ErrorHeader carries the error of a command which could not be
+	// started or waited for, sent by the agent instead of the exit code.
+	ErrorHeader = "Exec-Error"
+)
+
+var (
+	ErrNoExitStatus  = errors.New("exec: stream finished without exit status")
+	ErrNoErrorStream = errors.New("exec: no error stream")
+)
+
+// ExitError is returned by Run for commands exiting with a non-zero exit
+// code.  The code is -1 for commands terminated by a signal.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exec: exit status %d", e.Code)
+}
+
+// RemoteError is returned by Run when the agent could not run the
+// command.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "exec: remote: " + e.Message
+}
+
+// Cmd is a command run on the remote.
+type Cmd struct {
+	// Path is the command to run, looked up in the PATH of the agent
+	// if it contains no path separator.
+	Path string
+	// Args are the arguments of the command, not including the command
+	// itself.  Arguments must not contain NUL bytes.
+	Args []string
+	// Env is added to the environment of the agent for the command, as
+	// key=value pairs.
+	Env []string
+
+	// Stdin is sent to the standard input of the command, which is
+	// closed at the end of Stdin.  If nil, the standard input is closed
+	// at once.
+	Stdin io.Reader
+	// Stdout and Stderr receive the standard output and error of the
+	// command.  If nil, the output is discarded.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Command returns the Cmd running name with the given arguments.
+func Command(name string, arg ...string) *Cmd {
+	return &Cmd{Path: name, Args: arg}
+}
+
+// Run runs cmd on the remote of conn and waits for it to exit, returning
+// nil if it exits with a zero exit code, an *ExitError with the exit code
+// otherwise.  When ctx is done the stream is reset, which kills the
+// command.  Like os/exec, Run does not wait for the end of Stdin once the
+// command exits.  The error stream opened by the agent is passed to the
+// stream handler of conn, which may reply to it, as NoOpStreamHandler
+// does, but must leave it to Run to read.
+func Run(ctx context.Context, conn *spdystream.Connection, cmd *Cmd) error {
+	headers := http.Header{}
+	headers.Set(spdystream.StreamTypeHeader, StreamTypeExec)
+	headers.Set(PathHeader, cmd.Path)
+	for _, arg := range cmd.Args {
+		headers.Add(ArgHeader, arg)
+	}
+	for _, env := range cmd.Env {
+		headers.Add(EnvHeader, env)
+	}
+	stream, err := conn.CreateStreamContext(ctx, headers, nil, false)
+	if err != nil {
+		return err
+	}
+	if err := stream.Wait(); err != nil {
+		return err
+	}
+
+	// the error stream is received ahead of the reply of the stream, the
+	// agent waits for its reply before running the command
+	errStream := stream.ErrorStream()
+	if errStream == nil {
+		stream.Reset()
+		return ErrNoErrorStream
+	}
+	if err := errStream.SendReply(http.Header{}, false); err != nil {
+		stream.Reset()
+		return err
+	}
+
+	go func() {
+		if cmd.Stdin != nil {
+			io.Copy(stream, cmd.Stdin)
+		}
+		stream.Close()
+	}()
+	// the exit status is received while reading the output, as the
+	// header frame carrying it is delivered ahead of the end of the
+	// output
+	statusDone := make(chan http.Header, 1)
+	go func() {
+		status, err := stream.ReceiveHeader()
+		if err != nil {
+			status = nil
+		}
+		statusDone <- status
+	}()
+	stderrDone := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(writerOrDiscard(cmd.Stderr), errStream)
+		errStream.Close()
+		stderrDone <- err
+	}()
+
+	_, err = io.Copy(writerOrDiscard(cmd.Stdout), stream)
+	if err == nil {
+		// reads on the stream reset by the context end as at its end
+		err = ctx.Err()
+	}
+	if err != nil {
+		// the agent may no longer read the stream, it is told of the
+		// reset by the error stream
+		stream.Reset()
+		errStream.Reset()
+		return err
+	}
+	if err := <-stderrDone; err != nil {
+		return err
+	}
+	status := <-statusDone
+	if status == nil {
+		return ErrNoExitStatus
+	}
+	return exitError(status)
+}
+
+// exitError returns the error for the exit status sent by the agent.
+func exitError(status http.Header) error {
+	if msg := status.Get(ErrorHeader); msg != "" {
+		return &RemoteError{Message: msg}
+	}
+	code, err := strconv.Atoi(status.Get(ExitCodeHeader))
+	if err != nil {
+		return ErrNoExitStatus
+	}
+	if code != 0 {
+		return &ExitError{Code: code}
+	}
+	return nil
+}
+
+func writerOrDiscard(w io.Writer) io.Writer {
+	if w == nil {
+		return ioutil.Discard
+	}
+	return w
+}
+
+// AllowAll allows any command to be run, for Handler on connections
+// whose remote is trusted to run any command as the agent.
+func AllowAll(path string, args []string) bool {
+	return true
+}
+
+// Handler returns a stream handler running the commands sent with Run.
+// Only the commands allow returns true for are run, the other streams
+// are refused, as are all streams if allow is nil.  Streams which are
+// not flagged with StreamTypeExec are refused.
+func Handler(allow func(path string, args []string) bool) spdystream.StreamHandler {
+	return func(stream *spdystream.Stream) {
+		headers := stream.Headers()
+		if headers.Get(spdystream.StreamTypeHeader) != StreamTypeExec {
+			stream.Refuse()
+			return
+		}
+		path, args := headers.Get(PathHeader), headers[ArgHeader]
+		if path == "" || allow == nil || !allow(path, args) {
+			stream.Refuse()
+			return
+		}
+		go run(stream, path, args, headers[EnvHeader])
+	}
+}
+
+// run runs the command of stream and sends its exit status.
+func run(stream *spdystream.Stream, path string, args, env []string) {
+	errStream, err := stream.CreateErrorStream(false)
+	if err != nil {
+		stream.Reset()
+		return
+	}
+	if err := stream.SendReply(http.Header{}, false); err != nil {
+		errStream.Reset()
+		return
+	}
+	if err := errStream.Wait(); err != nil {
+		stream.Reset()
+		return
+	}
+
+	cmd := osexec.Command(path, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdout = stream
+	cmd.Stderr = errStream
+	stdin, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		errStream.Close()
+		stream.SendHeader(http.Header{ErrorHeader: []string{err.Error()}}, true)
+		return
+	}
+
+	go func() {
+		// the stream is read to its end even if the command does not read
+		// its input, a reset kills the command
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := stream.Read(buf)
+			if n > 0 && stdin != nil {
+				if _, werr := stdin.Write(buf[:n]); werr != nil {
+					stdin.Close()
+					stdin = nil
+				}
+			}
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				cmd.Process.Kill()
+				break
+			}
+		}
+		if stdin != nil {
+			stdin.Close()
+		}
+	}()
+	go func() {
+		// nothing is sent on the error stream, reading it only tells of
+		// a reset once the input is finished
+		if _, err := io.Copy(ioutil.Discard, errStream); err != nil {
+			cmd.Process.Kill()
+		}
+	}()
+
+	status := http.Header{}
+	if err := cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*osexec.ExitError); ok {
+			status.Set(ExitCodeHeader, strconv.Itoa(exitErr.ExitCode()))
+		} else {
+			status.Set(ErrorHeader, err.Error())
+		}
+	} else {
+		status.Set(ExitCodeHeader, "0")
+	}
+	errStream.Close()
+	stream.SendHeader(status, true)
+}
@@ -0,0 +1,111 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package exec
+
+import (
+	"bytes"
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moby/spdystream"
+)
+
+func newExecConnections(t *testing.T, allow func(path string, args []string) bool) (*spdystream.Connection, *spdystream.Connection) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands run with sh")
+	}
+	clientConn, serverConn := spdystream.Loopback(0)
+	server, err := spdystream.NewConnection(serverConn, true)
+	if err != nil {
+		t.Fatalf("Error creating server connection: %s", err)
+	}
+	go server.Serve(Handler(allow))
+	client, err := spdystream.NewConnection(clientConn, false)
+	if err != nil {
+		t.Fatalf("Error creating client connection: %s", err)
+	}
+	go client.Serve(spdystream.NoOpStreamHandler)
+	return client, server
+}
+
+func TestRun(t *testing.T) {
+	client, server := newExecConnections(t, AllowAll)
+	defer server.Close()
+	defer client.Close()
+
+	var stdout, stderr bytes.Buffer
+	cmd := Command("sh", "-c", "cat; echo \"$GREETING\" >&2; exit 3")
+	cmd.Env = []string{"GREETING=hello"}
+	cmd.Stdin = strings.NewReader("input")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := Run(context.Background(), client, cmd)
+	exitErr, ok := err.(*ExitError)
+	if !ok || exitErr.Code != 3 {
+		t.Fatalf("Unexpected error:\nActual: %v\nExpected: %v", err, &ExitError{Code: 3})
+	}
+	if stdout.String() != "input" {
+		t.Fatalf("Unexpected stdout:\nActual: %q\nExpected: %q", stdout.String(), "input")
+	}
+	if stderr.String() != "hello\n" {
+		t.Fatalf("Unexpected stderr:\nActual: %q\nExpected: %q", stderr.String(), "hello\n")
+	}
+
+	if err := Run(context.Background(), client, Command("true")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	client, server := newExecConnections(t, func(path string, args []string) bool {
+		return path != "forbidden"
+	})
+	defer server.Close()
+	defer client.Close()
+
+	err := Run(context.Background(), client, Command("spdystream-missing-command"))
+	if _, ok := err.(*RemoteError); !ok {
+		t.Fatalf("Unexpected error:\nActual: %v\nExpected: *RemoteError", err)
+	}
+	if err := Run(context.Background(), client, Command("forbidden")); err != spdystream.ErrReset {
+		t.Fatalf("Unexpected error:\nActual: %v\nExpected: %v", err, spdystream.ErrReset)
+	}
+
+	// the command is killed when the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := Run(ctx, client, Command("sleep", "10")); err == nil {
+		t.Fatal("Expected error running canceled command")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Canceled command not stopped after %s", elapsed)
+	}
+}
+
+func TestHandlerDeniesByDefault(t *testing.T) {
+	client, server := newExecConnections(t, nil)
+	defer server.Close()
+	defer client.Close()
+
+	if err := Run(context.Background(), client, Command("true")); err != spdystream.ErrReset {
+		t.Fatalf("Unexpected error:\nActual: %v\nExpected: %v", err, spdystream.ErrReset)
+	}
+}
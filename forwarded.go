@@ -0,0 +1,71 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// OriginalRemoteAddrHeader carries the address of the client a stream
+// originates from, across proxies relaying the stream.
+const OriginalRemoteAddrHeader = "Spdystream-Original-Remote-Addr"
+
+// originalAddr is an address received in the OriginalRemoteAddrHeader
+// which is not a TCP address.
+type originalAddr string
+
+func (a originalAddr) Network() string { return "unknown" }
+func (a originalAddr) String() string  { return string(a) }
+
+// ForwardRemoteAddr sets the OriginalRemoteAddrHeader of headers, used to
+// create a stream relaying from, to the address of the client from
+// originates from.  With trustFrom, the address from sent in the header,
+// if any, is kept, otherwise the remote address of from is used so a
+// client cannot claim another address.
+func ForwardRemoteAddr(headers http.Header, from *Stream, trustFrom bool) {
+	addr := from.RemoteAddr()
+	if trustFrom {
+		addr = from.OriginalRemoteAddr()
+	}
+	if addr == nil {
+		headers.Del(OriginalRemoteAddrHeader)
+		return
+	}
+	headers.Set(OriginalRemoteAddrHeader, addr.String())
+}
+
+// OriginalRemoteAddr returns the address of the client the stream
+// originates from as sent by the remote in the OriginalRemoteAddrHeader,
+// or the remote address of the connection if there is none.  The header
+// can be set by any remote, it should only be relied on behind proxies
+// setting it with ForwardRemoteAddr.
+func (s *Stream) OriginalRemoteAddr() net.Addr {
+	value := s.headers.Get(OriginalRemoteAddrHeader)
+	if value == "" {
+		return s.RemoteAddr()
+	}
+	if host, port, err := net.SplitHostPort(value); err == nil {
+		ip := net.ParseIP(host)
+		portNum, err := strconv.Atoi(port)
+		if ip != nil && err == nil && portNum >= 0 && portNum <= 0xffff {
+			return &net.TCPAddr{IP: ip, Port: portNum}
+		}
+	}
+	return originalAddr(value)
+}
@@ -0,0 +1,87 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+// FuzzServe feeds arbitrary bytes to a server connection as if sent by
+// the remote peer, exercising frame handling and stream state in
+// isolation from the network.
+func FuzzServe(f *testing.F) {
+	buffer := new(bytes.Buffer)
+	framer, err := spdy.NewFramer(buffer, buffer)
+	if err != nil {
+		f.Fatal("Failed to create new framer:", err)
+	}
+	frames := []spdy.Frame{
+		&spdy.SynStreamFrame{StreamId: 1, Headers: http.Header{"Name": {"value"}}},
+		&spdy.DataFrame{StreamId: 1, Data: []byte("data")},
+		&spdy.HeadersFrame{StreamId: 1, Headers: http.Header{"Name": {"value"}}},
+		&spdy.PingFrame{Id: 1},
+		&spdy.SettingsFrame{FlagIdValues: []spdy.SettingsFlagIdValue{{Id: spdy.SettingsMaxConcurrentStreams, Value: 1}}},
+		&spdy.DataFrame{StreamId: 1, Flags: spdy.DataFlagFin},
+		&spdy.RstStreamFrame{StreamId: 1, Status: spdy.Cancel},
+		&spdy.GoAwayFrame{LastGoodStreamId: 1},
+	}
+	for _, frame := range frames {
+		if err := framer.WriteFrame(frame); err != nil {
+			f.Fatal("WriteFrame:", err)
+		}
+	}
+	f.Add(buffer.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		local, remote := net.Pipe()
+		go io.Copy(ioutil.Discard, remote)
+
+		conn, err := NewConnection(local, true)
+		if err != nil {
+			t.Fatal("Error creating connection:", err)
+		}
+		conn.SetHeaderBlockLimits(1<<16, 0)
+		conn.SetHeaderQueue(4, HeaderOverflowDropOldest)
+		served := make(chan struct{})
+		go func() {
+			conn.Serve(func(stream *Stream) {
+				stream.SendReply(http.Header{}, false)
+				go io.Copy(ioutil.Discard, stream)
+			})
+			close(served)
+		}()
+
+		go func() {
+			remote.Write(data)
+			remote.Close()
+		}()
+		<-served
+		// unblock the write if serving stopped on a bad frame
+		remote.Close()
+		conn.Close()
+	})
+}
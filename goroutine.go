@@ -0,0 +1,158 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"time"
+)
+
+// Goroutines returns the number of goroutines running for the
+// connection, both those serving the connection and those started with
+// Go, which includes the goroutines of the library stream handlers.
+// Serve itself runs in the goroutine of the caller and is not counted.
+func (s *Connection) Goroutines() int {
+	s.goroutineLock.Lock()
+	defer s.goroutineLock.Unlock()
+	return s.goroutines
+}
+
+// SetGoroutineLimit bounds the goroutines started with Go, for work
+// triggered by streams such as resets, context watchers and stream
+// handlers, to bound the scheduler pressure of a connection.  Once
+// limit of them run, further work is queued and run by the next of them
+// finishing, so queued work must not be needed by running work to
+// finish.  The goroutines serving the connection are not limited.  A
+// limit of 0, the default, means no limit.  Must be called before
+// Serve.
+func (s *Connection) SetGoroutineLimit(limit int) {
+	s.goroutineLimit = limit
+}
+
+// Go runs f in a goroutine of the connection, counted by Goroutines and
+// queued beyond the limit set with SetGoroutineLimit.  Stream handlers
+// should use it instead of starting goroutines for streams directly.
+func (s *Connection) Go(f func()) {
+	s.goroutineLock.Lock()
+	if s.goroutineLimit > 0 && s.limitedGoroutines >= s.goroutineLimit {
+		debugMessage("(%p) Goroutine limit reached, queueing", s)
+		s.goroutineQueue = append(s.goroutineQueue, f)
+		s.goroutineLock.Unlock()
+		return
+	}
+	s.goroutines++
+	s.limitedGoroutines++
+	s.goroutineLock.Unlock()
+	go s.runGoroutine(f)
+}
+
+// spawn runs f in a goroutine serving the connection, counted but not
+// limited.
+func (s *Connection) spawn(f func()) {
+	s.goroutineLock.Lock()
+	s.goroutines++
+	s.goroutineLock.Unlock()
+	go func() {
+		f()
+		s.goroutineLock.Lock()
+		s.goroutines--
+		s.signalGoroutines()
+		s.goroutineLock.Unlock()
+	}()
+}
+
+// runGoroutine runs f, then the queued work if any, before releasing its
+// count.
+func (s *Connection) runGoroutine(f func()) {
+	for f != nil {
+		f()
+		s.goroutineLock.Lock()
+		f = nil
+		if len(s.goroutineQueue) > 0 {
+			f = s.goroutineQueue[0]
+			s.goroutineQueue[0] = nil
+			s.goroutineQueue = s.goroutineQueue[1:]
+		} else {
+			s.goroutines--
+			s.limitedGoroutines--
+			s.signalGoroutines()
+		}
+		s.goroutineLock.Unlock()
+	}
+}
+
+// signalGoroutines wakes waitTeardown on a change of the goroutines or
+// of the serving state, with goroutineLock held.
+func (s *Connection) signalGoroutines() {
+	if s.goroutineChanged != nil {
+		close(s.goroutineChanged)
+		s.goroutineChanged = nil
+	}
+}
+
+// startServing records Serve starting, returning false if Serve was
+// already called.
+func (s *Connection) startServing() bool {
+	s.goroutineLock.Lock()
+	defer s.goroutineLock.Unlock()
+	if s.serving || s.served {
+		return false
+	}
+	s.serving = true
+	s.signalGoroutines()
+	return true
+}
+
+// stopServing records Serve returning once it has closed all streams.
+func (s *Connection) stopServing() {
+	s.goroutineLock.Lock()
+	defer s.goroutineLock.Unlock()
+	s.serving = false
+	s.served = true
+	s.signalGoroutines()
+}
+
+// setShutdown records shutdown closing the network connection.
+func (s *Connection) setShutdown() {
+	s.goroutineLock.Lock()
+	defer s.goroutineLock.Unlock()
+	s.shutdownDone = true
+	s.signalGoroutines()
+}
+
+// waitTeardown waits for Serve to return, or for shutdown to finish if
+// Serve was not called, and for all goroutines of the connection to
+// exit.
+func (s *Connection) waitTeardown(timeout <-chan time.Time) error {
+	for {
+		s.goroutineLock.Lock()
+		if !s.serving && s.goroutines == 0 && (s.served || s.shutdownDone) {
+			s.goroutineLock.Unlock()
+			return nil
+		}
+		if s.goroutineChanged == nil {
+			s.goroutineChanged = make(chan struct{})
+		}
+		changed := s.goroutineChanged
+		s.goroutineLock.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout:
+			return ErrTimeout
+		}
+	}
+}
@@ -0,0 +1,133 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"sync"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+// StreamGroup gathers the streams of one logical job, to be torn down
+// together.  The streams may belong to different connections.
+type StreamGroup struct {
+	lock    sync.Mutex
+	streams []*Stream
+	pending int
+	done    chan struct{}
+}
+
+// StreamGroupStats holds the aggregate state of the streams of a group.
+type StreamGroupStats struct {
+	// Streams is the number of streams added to the group.
+	Streams int
+	// Open is the number of streams whose remote side is not closed.
+	Open int
+	// Finished is the number of streams done sending data.
+	Finished int
+	// BufferedRecvBytes is the sum of the bytes held for Read.
+	BufferedRecvBytes int
+}
+
+// NewStreamGroup returns an empty stream group.
+func NewStreamGroup() *StreamGroup {
+	return &StreamGroup{done: make(chan struct{})}
+}
+
+// Add adds stream to the group.
+func (g *StreamGroup) Add(stream *Stream) {
+	g.lock.Lock()
+	g.streams = append(g.streams, stream)
+	g.pending++
+	g.lock.Unlock()
+	go g.watch(stream)
+}
+
+func (g *StreamGroup) watch(stream *Stream) {
+	<-stream.closeChan
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.pending--
+	if g.pending == 0 {
+		select {
+		case <-g.done:
+		default:
+			close(g.done)
+		}
+	}
+}
+
+// Streams returns the streams of the group, in the order added.
+func (g *StreamGroup) Streams() []*Stream {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	streams := make([]*Stream, len(g.streams))
+	copy(streams, g.streams)
+	return streams
+}
+
+// Done returns a channel closed once the remote side of every stream of
+// the group is closed, by the remote finishing the stream, a reset or
+// the connection closing.  The channel of an empty group is not closed,
+// and streams added after it was closed are not waited for.
+func (g *StreamGroup) Done() <-chan struct{} {
+	return g.done
+}
+
+// CloseAll closes every stream of the group, returning the first error.
+func (g *StreamGroup) CloseAll() error {
+	var firstErr error
+	for _, stream := range g.Streams() {
+		if err := stream.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// ResetAll resets every stream of the group with status, returning the
+// first error.
+func (g *StreamGroup) ResetAll(status spdy.RstStreamStatus) error {
+	var firstErr error
+	for _, stream := range g.Streams() {
+		stream.conn.removeStream(stream)
+		if err := stream.resetWithStatus(status); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Stats returns the aggregate state of the streams of the group.
+func (g *StreamGroup) Stats() StreamGroupStats {
+	streams := g.Streams()
+	stats := StreamGroupStats{Streams: len(streams)}
+	for _, stream := range streams {
+		select {
+		case <-stream.closeChan:
+		default:
+			stats.Open++
+		}
+		stream.finishLock.Lock()
+		if stream.finished {
+			stats.Finished++
+		}
+		stream.finishLock.Unlock()
+		stats.BufferedRecvBytes += stream.BufferedRecvBytes()
+	}
+	return stats
+}
@@ -0,0 +1,103 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"time"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+// HalfClosePolicy determines what happens to a stream whose local side is
+// finished while the remote side stays open.
+type HalfClosePolicy int
+
+const (
+	// HalfCloseWait keeps the stream until the remote finishes or resets
+	// it.  This is the default.
+	HalfCloseWait HalfClosePolicy = iota
+	// HalfCloseRemove removes the stream without notifying the remote.
+	HalfCloseRemove
+	// HalfCloseReset removes the stream and resets it with a cancel
+	// status.
+	HalfCloseReset
+)
+
+// SetHalfCloseTimeout sets how long a stream finished locally is kept
+// without receiving any frame from the remote before it is reaped
+// according to policy, for peers which abandon streams instead of
+// finishing them.  Reads pending on a reaped stream return io.EOF.  Must
+// be called before Serve.
+func (s *Connection) SetHalfCloseTimeout(quiet time.Duration, policy HalfClosePolicy) {
+	s.halfCloseTimeout = quiet
+	s.halfClosePolicy = policy
+}
+
+// startHalfCloseTimer starts reaping the stream once the remote has been
+// quiet for the half close timeout, after the local side finished.
+func (s *Stream) startHalfCloseTimer() {
+	timeout := s.conn.halfCloseTimeout
+	if timeout <= 0 || s.conn.halfClosePolicy == HalfCloseWait {
+		return
+	}
+	s.halfCloseLock.Lock()
+	defer s.halfCloseLock.Unlock()
+	select {
+	case <-s.closeChan:
+		// the remote side is already closed
+		return
+	default:
+	}
+	if s.halfCloseTimer == nil {
+		s.halfCloseTimer = time.AfterFunc(timeout, s.reapHalfClosed)
+	}
+}
+
+// touchHalfCloseTimer restarts the quiet period on a frame received from
+// the remote.
+func (s *Stream) touchHalfCloseTimer() {
+	s.halfCloseLock.Lock()
+	defer s.halfCloseLock.Unlock()
+	if s.halfCloseTimer != nil {
+		s.halfCloseTimer.Reset(s.conn.halfCloseTimeout)
+	}
+}
+
+// stopHalfCloseTimer stops the timer once the remote side is closed.
+func (s *Stream) stopHalfCloseTimer() {
+	s.halfCloseLock.Lock()
+	defer s.halfCloseLock.Unlock()
+	if s.halfCloseTimer != nil {
+		s.halfCloseTimer.Stop()
+	}
+}
+
+func (s *Stream) reapHalfClosed() {
+	select {
+	case <-s.closeChan:
+		return
+	default:
+	}
+	debugMessage("(%p) (%d) Remote quiet after local finish, reaping stream", s, s.streamId)
+	s.closeRemoteChannels()
+	s.conn.removeStream(s)
+	if s.conn.halfClosePolicy == HalfCloseReset {
+		if err := s.conn.sendResetFrame(spdy.Cancel, s.streamId); err != nil {
+			debugMessage("(%p) (%d) Error resetting reaped stream: %s", s, s.streamId, err)
+		}
+	}
+}
@@ -28,11 +28,11 @@ func MirrorStreamHandler(stream *Stream) {
 		return
 	}
 
-	go func() {
+	stream.conn.Go(func() {
 		io.Copy(stream, stream)
 		stream.Close()
-	}()
-	go func() {
+	})
+	stream.conn.Go(func() {
 		for {
 			header, receiveErr := stream.ReceiveHeader()
 			if receiveErr != nil {
@@ -43,7 +43,7 @@ func MirrorStreamHandler(stream *Stream) {
 				return
 			}
 		}
-	}()
+	})
 }
 
 // NoopStreamHandler does nothing when stream connects.
@@ -0,0 +1,132 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	// StreamTypeHandshake flags the stream carrying the capabilities of
+	// a peer, see SetHandshake.
+	StreamTypeHandshake = "handshake"
+
+	handshakeVersionHeader  = "Spdystream-Version"
+	handshakeFeaturesHeader = "Spdystream-Features"
+)
+
+var (
+	ErrNoHandshake = errors.New("no handshake received")
+)
+
+// Capabilities describes a peer, exchanged in the handshake.
+type Capabilities struct {
+	// Version is the application version.
+	Version string
+	// Features lists the feature flags supported.
+	Features []string
+}
+
+// HasFeature returns whether feature is in the feature flags.
+func (c Capabilities) HasFeature(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// SetHandshake enables the handshake: once Serve is called, a stream
+// carrying capabilities is sent to the remote, and the capabilities of
+// the remote are received from its handshake stream, see
+// PeerCapabilities.  Handshake streams are handled by the connection and
+// not passed to the stream handler.  Both peers must enable the
+// handshake.  Must be called before Serve.
+func (s *Connection) SetHandshake(capabilities Capabilities) {
+	s.handshake = &capabilities
+	s.peerCapsChan = make(chan struct{})
+}
+
+// PeerCapabilities waits for the handshake of the remote and returns its
+// capabilities.  ErrNoHandshake is returned if the handshake is not
+// enabled or the connection closed before the handshake was received.
+func (s *Connection) PeerCapabilities(ctx context.Context) (Capabilities, error) {
+	if s.peerCapsChan == nil {
+		return Capabilities{}, ErrNoHandshake
+	}
+	select {
+	case <-s.peerCapsChan:
+		return s.peerCaps, nil
+	case <-s.closeChan:
+		select {
+		case <-s.peerCapsChan:
+			return s.peerCaps, nil
+		default:
+		}
+		return Capabilities{}, ErrNoHandshake
+	case <-ctx.Done():
+		return Capabilities{}, ctx.Err()
+	}
+}
+
+func (s *Connection) sendHandshake() {
+	headers := http.Header{}
+	headers.Set(StreamTypeHeader, StreamTypeHandshake)
+	if s.handshake.Version != "" {
+		headers.Set(handshakeVersionHeader, s.handshake.Version)
+	}
+	if len(s.handshake.Features) > 0 {
+		headers.Set(handshakeFeaturesHeader, strings.Join(s.handshake.Features, ","))
+	}
+	if _, err := s.CreateStream(headers, nil, true); err != nil {
+		debugMessage("(%p) Error sending handshake: %s", s, err)
+	}
+}
+
+// isHandshakeStream returns whether stream is the handshake of the
+// remote, to be handled by handleHandshakeStream.
+func (s *Connection) isHandshakeStream(stream *Stream) bool {
+	return s.handshake != nil && stream.parent == nil && stream.headers.Get(StreamTypeHeader) == StreamTypeHandshake
+}
+
+func (s *Connection) handleHandshakeStream(stream *Stream) error {
+	caps := Capabilities{Version: stream.headers.Get(handshakeVersionHeader)}
+	for _, feature := range strings.Split(stream.headers.Get(handshakeFeaturesHeader), ",") {
+		if feature = strings.TrimSpace(feature); feature != "" {
+			caps.Features = append(caps.Features, feature)
+		}
+	}
+
+	s.peerCapsLock.Lock()
+	if s.peerCapsReceived {
+		s.peerCapsLock.Unlock()
+		debugMessage("(%p) Duplicate handshake on stream %d", s, stream.streamId)
+		return stream.Refuse()
+	}
+	s.peerCapsReceived = true
+	s.peerCaps = caps
+	close(s.peerCapsChan)
+	s.peerCapsLock.Unlock()
+
+	err := stream.SendReply(http.Header{}, true)
+	s.removeStream(stream)
+	return err
+}
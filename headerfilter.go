@@ -0,0 +1,139 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+var (
+	ErrHeaderRejected = errors.New("header rejected by filter")
+)
+
+// HeaderFilter strips or rejects headers by name, see SetHeaderFilters.
+type HeaderFilter struct {
+	// Names are the names of the headers filtered, or with Allow the
+	// names of the only headers passing the filter.
+	Names []string
+	// Allow makes Names an allow list.  The headers used by the library,
+	// StreamTypeHeader and the headers prefixed with Spdystream-, always
+	// pass an allow list; they are filtered if named in a deny list.
+	Allow bool
+	// Reject rejects the headers filtered instead of stripping them.
+	Reject bool
+}
+
+// headerFilter is a HeaderFilter with canonical names.
+type headerFilter struct {
+	names  map[string]bool
+	allow  bool
+	reject bool
+}
+
+func newHeaderFilter(filter *HeaderFilter) *headerFilter {
+	if filter == nil {
+		return nil
+	}
+	names := make(map[string]bool, len(filter.Names))
+	for _, name := range filter.Names {
+		names[http.CanonicalHeaderKey(name)] = true
+	}
+	return &headerFilter{names: names, allow: filter.Allow, reject: filter.Reject}
+}
+
+// filtered returns whether the header name is filtered.
+func (f *headerFilter) filtered(name string) bool {
+	if !f.allow {
+		return f.names[name]
+	}
+	if name == StreamTypeHeader || strings.HasPrefix(name, "Spdystream-") {
+		return false
+	}
+	return !f.names[name]
+}
+
+// apply returns headers without the filtered headers, the same map if
+// none is filtered, or ok false if a filtered header is rejected.  If
+// inPlace the headers are stripped in place rather than copied.
+func (f *headerFilter) apply(headers http.Header, inPlace bool) (filtered http.Header, ok bool) {
+	if f == nil {
+		return headers, true
+	}
+	filtered = headers
+	copied := inPlace
+	for name := range headers {
+		if !f.filtered(name) {
+			continue
+		}
+		if f.reject {
+			return nil, false
+		}
+		if !copied {
+			filtered = make(http.Header, len(headers))
+			for name, values := range headers {
+				filtered[name] = values
+			}
+			copied = true
+		}
+		delete(filtered, name)
+	}
+	return filtered, true
+}
+
+// SetHeaderFilters sets the filters of the headers of the SYN_STREAM,
+// SYN_REPLY and HEADERS frames sent and received, such as a filter
+// keeping internal routing headers from leaking to an external peer.  A
+// nil filter filters nothing.  Filtered headers are stripped, or with
+// HeaderFilter.Reject: sending them fails with ErrHeaderRejected, and
+// receiving them resets their stream like a FrameReset verdict of the
+// frame policy, refusing a new stream.  Must be called before Serve.
+func (s *Connection) SetHeaderFilters(send, receive *HeaderFilter) {
+	s.sendHeaderFilter = newHeaderFilter(send)
+	s.receiveHeaderFilter = newHeaderFilter(receive)
+}
+
+// filterSentHeaders returns headers filtered by the send filter, or
+// ErrHeaderRejected.
+func (s *Connection) filterSentHeaders(headers http.Header) (http.Header, error) {
+	filtered, ok := s.sendHeaderFilter.apply(headers, false)
+	if !ok {
+		return nil, ErrHeaderRejected
+	}
+	return filtered, nil
+}
+
+// filterReceivedFrame strips the headers of a received frame filtered by
+// the receive filter, returning false if they are rejected.
+func (s *Connection) filterReceivedFrame(frame spdy.Frame) bool {
+	var headers http.Header
+	switch frame := frame.(type) {
+	case *spdy.SynStreamFrame:
+		headers = frame.Headers
+	case *spdy.SynReplyFrame:
+		headers = frame.Headers
+	case *spdy.HeadersFrame:
+		headers = frame.Headers
+	default:
+		return true
+	}
+	_, ok := s.receiveHeaderFilter.apply(headers, true)
+	return ok
+}
@@ -0,0 +1,106 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHeaderFilters(t *testing.T) {
+	streams := make(chan *Stream, 1)
+	configure := func(conn *Connection) {
+		conn.SetHeaderFilters(
+			&HeaderFilter{Names: []string{"Content-Type"}, Allow: true},
+			&HeaderFilter{Names: []string{"x-forbidden"}, Reject: true},
+		)
+	}
+	client, server := newTestConnections(t, configure, func(stream *Stream) {
+		reply := http.Header{}
+		reply.Set("Content-Type", "text/plain")
+		reply.Set("X-Secret", "secret")
+		stream.SendReply(reply, false)
+		streams <- stream
+	})
+	defer client.Close()
+	defer server.Close()
+	client.SetHeaderFilters(&HeaderFilter{Names: []string{"X-Internal-Route"}}, nil)
+
+	headers := http.Header{}
+	headers.Set("X-Internal-Route", "backend-3")
+	headers.Set("X-Request", "1")
+	stream, err := client.CreateStream(headers, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	if err := stream.WaitTimeout(5 * time.Second); err != nil {
+		t.Fatalf("Error waiting for reply: %v", err)
+	}
+	remote := <-streams
+
+	if remote.Headers().Get("X-Internal-Route") != "" {
+		t.Fatal("Denied header sent")
+	}
+	if remote.Headers().Get("X-Request") != "1" {
+		t.Fatal("Allowed header stripped")
+	}
+	if headers.Get("X-Internal-Route") == "" {
+		t.Fatal("Headers of the caller modified")
+	}
+	reply := stream.ReplyHeaders()
+	if reply.Get("Content-Type") != "text/plain" || reply.Get("X-Secret") != "" {
+		t.Fatalf("Unexpected reply headers: %v", reply)
+	}
+
+	// Rejected headers refuse the stream
+	forbidden := http.Header{}
+	forbidden.Set("X-Forbidden", "1")
+	refused, err := client.CreateStream(forbidden, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	if err := refused.WaitTimeout(5 * time.Second); err != ErrReset {
+		t.Fatalf("Unexpected wait error:\nActual: %v\nExpected: %v", err, ErrReset)
+	}
+}
+
+func TestHeaderFilterRejectSend(t *testing.T) {
+	client, server := newTestConnections(t, nil, func(stream *Stream) {
+		stream.SendReply(http.Header{}, false)
+	})
+	defer client.Close()
+	defer server.Close()
+	client.SetHeaderFilters(&HeaderFilter{Names: []string{"Authorization"}, Reject: true}, nil)
+
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer token")
+	if _, err := client.CreateStream(headers, nil, false); err != ErrHeaderRejected {
+		t.Fatalf("Unexpected create error:\nActual: %v\nExpected: %v", err, ErrHeaderRejected)
+	}
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	if err := stream.WaitTimeout(5 * time.Second); err != nil {
+		t.Fatalf("Error waiting for reply: %v", err)
+	}
+	if err := stream.SendHeader(headers, false); err != ErrHeaderRejected {
+		t.Fatalf("Unexpected send error:\nActual: %v\nExpected: %v", err, ErrHeaderRejected)
+	}
+}
@@ -0,0 +1,209 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const (
+	// ControlTypeHeartbeat is the type of the control messages carrying
+	// a heartbeat, echoed by the remote in a ControlTypeHeartbeatAck
+	// message.  Heartbeats are handled by the control channel and not
+	// passed to the control handler.
+	ControlTypeHeartbeat    = "spdystream.heartbeat"
+	ControlTypeHeartbeatAck = "spdystream.heartbeat-ack"
+
+	// ControlTypeTimedHeartbeat is the type of the heartbeats sent with
+	// SetHeartbeatTimestamps, echoed in ControlTypeTimedHeartbeatAck
+	// messages carrying the time the remote received the heartbeat.
+	ControlTypeTimedHeartbeat    = "spdystream.heartbeat-ts"
+	ControlTypeTimedHeartbeatAck = "spdystream.heartbeat-ts-ack"
+
+	heartbeatSeqSize  = 8
+	heartbeatTimeSize = 8
+)
+
+var (
+	ErrHeartbeatMismatch = errors.New("heartbeat echoed with a different payload")
+)
+
+// heartbeatEcho is an echo received for a heartbeat.
+type heartbeatEcho struct {
+	payload []byte
+	// time the remote received the heartbeat, for timed heartbeats
+	remoteTime time.Time
+}
+
+// SetHeartbeatTimestamps sets whether heartbeats ask the remote for the
+// time it received them, to estimate the one-way delays and the clock
+// offset of the remote reported in Stats.  Must be called before Serve.
+func (s *Connection) SetHeartbeatTimestamps(enabled bool) {
+	s.heartbeatTimestamps = enabled
+}
+
+// Heartbeat sends a heartbeat carrying payload on the control channel and
+// waits for the remote to echo it, returning the round trip time.  Unlike
+// Ping, which the remote connection answers as soon as the frame is read,
+// the echo is sent in turn with the control messages passed to the
+// control handler of the remote, so a stuck handler stops the echoes.
+// ErrHeartbeatMismatch is returned if the echoed payload differs.
+func (c *ControlChannel) Heartbeat(ctx context.Context, payload []byte) (time.Duration, error) {
+	if c == nil {
+		return 0, ErrNoControlChannel
+	}
+	echo := make(chan heartbeatEcho, 1)
+	c.heartbeatLock.Lock()
+	c.heartbeatSeq++
+	seq := c.heartbeatSeq
+	if c.heartbeats == nil {
+		c.heartbeats = make(map[uint64]chan heartbeatEcho)
+	}
+	c.heartbeats[seq] = echo
+	c.heartbeatLock.Unlock()
+	defer func() {
+		c.heartbeatLock.Lock()
+		delete(c.heartbeats, seq)
+		c.heartbeatLock.Unlock()
+	}()
+
+	data := make([]byte, heartbeatSeqSize+len(payload))
+	binary.BigEndian.PutUint64(data, seq)
+	copy(data[heartbeatSeqSize:], payload)
+	msgType := ControlTypeHeartbeat
+	if c.conn.heartbeatTimestamps {
+		msgType = ControlTypeTimedHeartbeat
+	}
+	start := time.Now()
+	if err := c.Send(ctx, ControlMessage{Type: msgType, Payload: data}); err != nil {
+		return 0, err
+	}
+	select {
+	case echoed := <-echo:
+		if !bytes.Equal(echoed.payload, payload) {
+			return 0, ErrHeartbeatMismatch
+		}
+		end := time.Now()
+		c.conn.updateHeartbeatStats(start, end, echoed.remoteTime)
+		return end.Sub(start), nil
+	case <-c.conn.closeChan:
+		return 0, ErrWriteClosedStream
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (c *ControlChannel) echoHeartbeat(msg ControlMessage) {
+	ack := ControlMessage{Type: ControlTypeHeartbeatAck, Payload: msg.Payload}
+	if msg.Type == ControlTypeTimedHeartbeat {
+		if len(msg.Payload) < heartbeatSeqSize {
+			debugMessage("(%p) Invalid heartbeat", c.conn)
+			return
+		}
+		// insert the receive time after the sequence number
+		ack.Type = ControlTypeTimedHeartbeatAck
+		ack.Payload = make([]byte, len(msg.Payload)+heartbeatTimeSize)
+		copy(ack.Payload, msg.Payload[:heartbeatSeqSize])
+		binary.BigEndian.PutUint64(ack.Payload[heartbeatSeqSize:], uint64(time.Now().UnixNano()))
+		copy(ack.Payload[heartbeatSeqSize+heartbeatTimeSize:], msg.Payload[heartbeatSeqSize:])
+	}
+	if err := c.Send(context.Background(), ack); err != nil {
+		debugMessage("(%p) Error echoing heartbeat: %s", c.conn, err)
+	}
+}
+
+func (c *ControlChannel) ackHeartbeat(msg ControlMessage) {
+	headerSize := heartbeatSeqSize
+	if msg.Type == ControlTypeTimedHeartbeatAck {
+		headerSize += heartbeatTimeSize
+	}
+	if len(msg.Payload) < headerSize {
+		debugMessage("(%p) Invalid heartbeat echo", c.conn)
+		return
+	}
+	seq := binary.BigEndian.Uint64(msg.Payload)
+	echoed := heartbeatEcho{payload: msg.Payload[headerSize:]}
+	if msg.Type == ControlTypeTimedHeartbeatAck {
+		echoed.remoteTime = time.Unix(0, int64(binary.BigEndian.Uint64(msg.Payload[heartbeatSeqSize:])))
+	}
+	c.heartbeatLock.Lock()
+	echo, ok := c.heartbeats[seq]
+	c.heartbeatLock.Unlock()
+	if ok {
+		echo <- echoed
+	}
+}
+
+// updateHeartbeatStats records the round trip of a heartbeat sent at
+// start and echoed at end, and the one-way delays and clock offset if the
+// remote sent the time it received the heartbeat.
+func (s *Connection) updateHeartbeatStats(start, end time.Time, remoteTime time.Time) {
+	rtt := end.Sub(start)
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	s.stats.HeartbeatRoundTrip = rtt
+	if remoteTime.IsZero() {
+		return
+	}
+	// wall clock times, the remote time is not monotonic
+	s.stats.OutboundDelay = remoteTime.Sub(start.Round(0))
+	s.stats.InboundDelay = end.Round(0).Sub(remoteTime)
+	if s.minHeartbeatRoundTrip == 0 || rtt <= s.minHeartbeatRoundTrip {
+		// the fastest round trip bounds the error of the estimate best
+		s.minHeartbeatRoundTrip = rtt
+		s.stats.ClockOffset = (s.stats.OutboundDelay - s.stats.InboundDelay) / 2
+	}
+}
+
+// SetHeartbeat sends a heartbeat on the control channel every interval
+// once Serve is called, resetting the streams and closing the connection
+// if the remote does not echo it within timeout.  payload, if not nil, returns the payload of
+// each heartbeat.  The control channel must be enabled with
+// SetControlChannel.  Must be called before Serve.
+func (s *Connection) SetHeartbeat(interval, timeout time.Duration, payload func() []byte) {
+	s.heartbeatInterval = interval
+	s.heartbeatTimeout = timeout
+	s.heartbeatPayload = payload
+}
+
+func (s *Connection) heartbeatLoop() {
+	ticker := time.NewTicker(s.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closeChan:
+			return
+		}
+		var payload []byte
+		if s.heartbeatPayload != nil {
+			payload = s.heartbeatPayload()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), s.heartbeatTimeout)
+		_, err := s.control.Heartbeat(ctx, payload)
+		cancel()
+		if err != nil {
+			debugMessage("(%p) Heartbeat failed, closing connection: %s", s, err)
+			s.resetStreamsAndClose()
+			return
+		}
+	}
+}
@@ -0,0 +1,148 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+// FrameRecord describes a control frame sent or received on a connection.
+type FrameRecord struct {
+	Time     time.Time
+	Sent     bool
+	Type     string
+	StreamId uint32
+	Flags    uint8
+}
+
+func (r FrameRecord) String() string {
+	direction := "recv"
+	if r.Sent {
+		direction = "send"
+	}
+	return fmt.Sprintf("%s %s %s stream=%d flags=0x%02x", r.Time.Format(time.RFC3339Nano), direction, r.Type, r.StreamId, r.Flags)
+}
+
+// frameHistory is a fixed size ring buffer of frame records.
+type frameHistory struct {
+	records []FrameRecord
+	next    int
+	full    bool
+}
+
+func (h *frameHistory) add(record FrameRecord) {
+	h.records[h.next] = record
+	h.next = (h.next + 1) % len(h.records)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+func (h *frameHistory) list() []FrameRecord {
+	if !h.full {
+		return append([]FrameRecord(nil), h.records[:h.next]...)
+	}
+	records := make([]FrameRecord, 0, len(h.records))
+	records = append(records, h.records[h.next:]...)
+	return append(records, h.records[:h.next]...)
+}
+
+// describeFrame returns the type name, stream id and flags of a frame.
+func describeFrame(frame spdy.Frame) (string, uint32, uint8) {
+	switch frame := frame.(type) {
+	case *spdy.SynStreamFrame:
+		return "SYN_STREAM", uint32(frame.StreamId), uint8(frame.CFHeader.Flags)
+	case *spdy.SynReplyFrame:
+		return "SYN_REPLY", uint32(frame.StreamId), uint8(frame.CFHeader.Flags)
+	case *spdy.RstStreamFrame:
+		return "RST_STREAM", uint32(frame.StreamId), uint8(frame.CFHeader.Flags)
+	case *spdy.SettingsFrame:
+		return "SETTINGS", 0, uint8(frame.CFHeader.Flags)
+	case *spdy.PingFrame:
+		return "PING", 0, uint8(frame.CFHeader.Flags)
+	case *spdy.GoAwayFrame:
+		return "GOAWAY", uint32(frame.LastGoodStreamId), uint8(frame.CFHeader.Flags)
+	case *spdy.HeadersFrame:
+		return "HEADERS", uint32(frame.StreamId), uint8(frame.CFHeader.Flags)
+	case *spdy.WindowUpdateFrame:
+		return "WINDOW_UPDATE", uint32(frame.StreamId), uint8(frame.CFHeader.Flags)
+	case *spdy.DataFrame:
+		return "DATA", uint32(frame.StreamId), uint8(frame.Flags)
+	}
+	return fmt.Sprintf("%T", frame), 0, 0
+}
+
+// SetFrameHistory keeps the last n control frames sent and received on
+// the connection.  When the connection ends without a go away frame
+// being sent or received, the history is written to the standard
+// logger to help explain the failure.  Setting n to 0 disables the
+// history, which is the default.
+func (s *Connection) SetFrameHistory(n int) {
+	s.historyLock.Lock()
+	defer s.historyLock.Unlock()
+	if n <= 0 {
+		s.history = nil
+		return
+	}
+	s.history = &frameHistory{records: make([]FrameRecord, n)}
+}
+
+// FrameHistory returns the recorded control frames, oldest first.
+func (s *Connection) FrameHistory() []FrameRecord {
+	s.historyLock.Lock()
+	defer s.historyLock.Unlock()
+	if s.history == nil {
+		return nil
+	}
+	return s.history.list()
+}
+
+func (s *Connection) recordFrame(frame spdy.Frame, sent bool) {
+	if _, ok := frame.(*spdy.DataFrame); ok {
+		return
+	}
+	s.historyLock.Lock()
+	defer s.historyLock.Unlock()
+	if s.history == nil {
+		return
+	}
+	frameType, streamId, flags := describeFrame(frame)
+	s.history.add(FrameRecord{
+		Time:     time.Now(),
+		Sent:     sent,
+		Type:     frameType,
+		StreamId: streamId,
+		Flags:    flags,
+	})
+}
+
+// dumpFrameHistory logs the frame history after the connection ended
+// with readErr.
+func (s *Connection) dumpFrameHistory(readErr error) {
+	records := s.FrameHistory()
+	if records == nil {
+		return
+	}
+	log.Printf("spdystream: connection %s ended unexpectedly: %v, last %d control frames:", s.conn.RemoteAddr(), readErr, len(records))
+	for _, record := range records {
+		log.Printf("spdystream:   %s", record)
+	}
+}
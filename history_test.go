@@ -0,0 +1,91 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFrameHistory(t *testing.T) {
+	client, server := newTestConnections(t, nil, NoOpStreamHandler)
+	client.SetFrameHistory(3)
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	if _, err := stream.Write([]byte("data frames are not recorded")); err != nil {
+		t.Fatalf("Error writing to stream: %s", err)
+	}
+	if _, err := client.Ping(); err != nil {
+		t.Fatalf("Error pinging: %s", err)
+	}
+
+	expected := []string{"recv SYN_REPLY", "send PING", "recv PING"}
+	records := client.FrameHistory()
+	if len(records) != len(expected) {
+		t.Fatalf("Unexpected number of records:\nActual: %d\nExpected: %d", len(records), len(expected))
+	}
+	for i, record := range records {
+		if !strings.Contains(record.String(), expected[i]) {
+			t.Fatalf("Unexpected record %d:\nActual: %s\nExpected: %s", i, record, expected[i])
+		}
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	// drop the connection without going away
+	server.conn.Close()
+	select {
+	case <-client.CloseChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for connection closure")
+	}
+	if !strings.Contains(logs.String(), "ended unexpectedly") || !strings.Contains(logs.String(), "recv PING") {
+		t.Fatalf("Frame history not dumped:\n%s", logs.String())
+	}
+}
+
+func TestFrameHistoryNotDumpedOnGoAway(t *testing.T) {
+	client, server := newTestConnections(t, nil, NoOpStreamHandler)
+	client.SetFrameHistory(3)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	server.Close()
+	select {
+	case <-client.CloseChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for connection closure")
+	}
+	if logs.Len() != 0 {
+		t.Fatalf("Unexpected frame history dump:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,151 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+)
+
+// StreamTypeHTTP flags the streams created by DialHTTP, which carry
+// plain HTTP/1.1 exchanges, so handlers shared with other streams can
+// route them to HTTPStreamHandler.
+const StreamTypeHTTP = "http"
+
+var errStreamListenerDone = errors.New("stream listener done")
+
+// DialHTTP creates a stream flagged with StreamTypeHTTP and waits for its
+// reply, returning the stream as a net.Conn carrying plain HTTP/1.1.  The
+// network and address are ignored, so it can be used as the DialContext
+// of an http.Transport, see NewHTTPTransport.  When ctx is done before the
+// reply the stream is reset; once returned the stream is not tied to ctx.
+func (s *Connection) DialHTTP(ctx context.Context, network, addr string) (net.Conn, error) {
+	stream, err := s.dialStream(ctx, StreamTypeHTTP)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// dialStream creates a stream flagged with streamType and waits for its
+// reply, resetting the stream when ctx is done first.
+func (s *Connection) dialStream(ctx context.Context, streamType string) (*Stream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	headers := http.Header{}
+	headers.Set(StreamTypeHeader, streamType)
+	stream, err := s.CreateStream(headers, nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	replied := make(chan error, 1)
+	s.Go(func() {
+		replied <- stream.Wait()
+	})
+	select {
+	case err := <-replied:
+		if err != nil {
+			stream.Reset()
+			return nil, err
+		}
+		return stream, nil
+	case <-ctx.Done():
+		stream.Reset()
+		return nil, ctx.Err()
+	}
+}
+
+// NewHTTPTransport returns an http.Transport sending requests as plain
+// HTTP/1.1 over streams of conn, each stream standing for one network
+// connection of the transport.  The remote serves them with
+// HTTPStreamHandler.  Idle streams are kept open as keep-alive
+// connections, CloseIdleConnections closes them.
+func NewHTTPTransport(conn *Connection) *http.Transport {
+	return &http.Transport{
+		DialContext: conn.DialHTTP,
+	}
+}
+
+// NewHTTPReverseProxy returns a reverse proxy forwarding requests to
+// target, a URL of the HTTP server behind the remote of conn, over
+// streams of conn as done by NewHTTPTransport.
+func NewHTTPReverseProxy(conn *Connection, target *url.URL) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = NewHTTPTransport(conn)
+	return proxy
+}
+
+// RoundTripHTTP writes req to the stream as a plain HTTP/1.1 request and
+// reads the response, for exchanges on a single stream without an
+// http.Transport.  The response body is read from the stream and must be
+// read and closed before another request is sent on it.
+func (s *Stream) RoundTripHTTP(req *http.Request) (*http.Response, error) {
+	if err := req.Write(s); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(bufio.NewReader(s), req)
+}
+
+// HTTPStreamHandler returns a stream handler replying to every stream and
+// serving the HTTP/1.1 requests sent on it with handler, the stream
+// standing for the network connection of the request.  Requests are
+// served in their own goroutine until the stream is closed.
+func HTTPStreamHandler(handler http.Handler) StreamHandler {
+	srv := &http.Server{Handler: handler}
+	return func(stream *Stream) {
+		if err := stream.SendReply(http.Header{}, false); err != nil {
+			return
+		}
+		// Serve returns once the stream is accepted, the stream is then
+		// served by the goroutine started by the server
+		srv.Serve(&streamListener{stream: stream, addr: stream.LocalAddr()})
+	}
+}
+
+// streamListener is a net.Listener accepting a single stream.
+type streamListener struct {
+	lock   sync.Mutex
+	stream *Stream
+	addr   net.Addr
+}
+
+func (l *streamListener) Accept() (net.Conn, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.stream == nil {
+		return nil, errStreamListenerDone
+	}
+	stream := l.stream
+	l.stream = nil
+	return stream, nil
+}
+
+func (l *streamListener) Close() error {
+	return nil
+}
+
+func (l *streamListener) Addr() net.Addr {
+	return l.addr
+}
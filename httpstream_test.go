@@ -0,0 +1,126 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHTTPTransport(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, body)
+	})
+	client, server := newTestConnections(t, nil, HTTPStreamHandler(handler))
+	defer server.Close()
+	defer client.Close()
+
+	transport := NewHTTPTransport(client)
+	defer transport.CloseIdleConnections()
+	httpClient := &http.Client{Transport: transport}
+	for i := 0; i < 3; i++ {
+		resp, err := httpClient.Post("http://remote/echo", "text/plain", strings.NewReader(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatalf("Error sending request: %s", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Error reading response: %s", err)
+		}
+		if expected := fmt.Sprintf("POST /echo %d", i); string(body) != expected {
+			t.Fatalf("Unexpected response:\nActual: %s\nExpected: %s", body, expected)
+		}
+	}
+	// requests reuse the stream kept alive by the transport
+	if streams := server.NumActiveStreams(); streams != 1 {
+		t.Fatalf("Unexpected active streams:\nActual: %d\nExpected: 1", streams)
+	}
+}
+
+func TestHTTPReverseProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "backend %s", r.URL.Path)
+	}))
+	defer backend.Close()
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatalf("Error parsing backend url: %s", err)
+	}
+
+	// the server forwards the requests it receives to the backend
+	client, server := newTestConnections(t, nil, HTTPStreamHandler(httputil.NewSingleHostReverseProxy(backendURL)))
+	defer server.Close()
+	defer client.Close()
+	proxy := httptest.NewServer(NewHTTPReverseProxy(client, &url.URL{Scheme: "http", Host: "remote"}))
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL + "/path")
+	if err != nil {
+		t.Fatalf("Error sending request: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Error reading response: %s", err)
+	}
+	if expected := "backend /path"; string(body) != expected {
+		t.Fatalf("Unexpected response:\nActual: %s\nExpected: %s", body, expected)
+	}
+}
+
+func TestStreamRoundTripHTTP(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Served", r.Host)
+		w.WriteHeader(http.StatusTeapot)
+	})
+	client, server := newTestConnections(t, nil, HTTPStreamHandler(handler))
+	defer server.Close()
+
+	headers := http.Header{}
+	headers.Set(StreamTypeHeader, StreamTypeHTTP)
+	stream, err := client.CreateStream(headers, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	req, err := http.NewRequest("GET", "http://remote/", nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %s", err)
+	}
+	resp, err := stream.RoundTripHTTP(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTeapot {
+		t.Fatalf("Unexpected status:\nActual: %d\nExpected: %d", resp.StatusCode, http.StatusTeapot)
+	}
+	if served := resp.Header.Get("Served"); served != "remote" {
+		t.Fatalf("Unexpected host:\nActual: %s\nExpected: remote", served)
+	}
+	stream.Reset()
+}
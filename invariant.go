@@ -0,0 +1,77 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"fmt"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+// Strictness determines how a connection handles the violation of one of
+// its internal invariants, which is a bug of the library rather than of
+// the remote.
+type Strictness int
+
+const (
+	// StrictnessResilient resets the affected stream with an internal
+	// error, or closes the connection with an internal error when no
+	// stream is affected, and counts the violation in
+	// ConnectionStats.InvariantViolations.  This is the default, for
+	// production services which must outlive a bug.
+	StrictnessResilient Strictness = iota
+	// StrictnessStrict panics with an *InvariantError, for tests and
+	// fuzzing which must not miss a bug.
+	StrictnessStrict
+)
+
+// InvariantError describes the violation of an internal invariant.  It
+// is the value of the panic under StrictnessStrict, and the cause of the
+// reads and writes failing on a stream reset under StrictnessResilient.
+type InvariantError struct {
+	Message string
+}
+
+func (e *InvariantError) Error() string {
+	return "spdystream: invariant violated: " + e.Message
+}
+
+// SetStrictness sets how internal invariant violations are handled,
+// StrictnessResilient by default.  Must be called before Serve.
+func (s *Connection) SetStrictness(strictness Strictness) {
+	s.strictness = strictness
+}
+
+// invariantViolated handles the violation of an internal invariant
+// affecting stream, or the whole connection if stream is nil.
+func (s *Connection) invariantViolated(stream *Stream, format string, args ...interface{}) {
+	err := &InvariantError{Message: fmt.Sprintf(format, args...)}
+	if s.strictness == StrictnessStrict {
+		panic(err)
+	}
+	debugMessage("(%p) %s", s, err)
+	s.statsLock.Lock()
+	s.stats.InvariantViolations++
+	s.statsLock.Unlock()
+	if stream != nil {
+		if resetErr := stream.abortWithStatus(err, spdy.InternalError); resetErr != nil {
+			debugMessage("(%p) (%d) reset error: %s", s, stream.streamId, resetErr)
+		}
+		return
+	}
+	s.closeWithError(spdy.GoAwayInternalError)
+}
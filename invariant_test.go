@@ -0,0 +1,158 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+func TestInvariantResilient(t *testing.T) {
+	client, server := newTestConnections(t, nil, func(stream *Stream) {
+		stream.SendReply(http.Header{}, false)
+	})
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for reply: %v", err)
+	}
+
+	// Adding a stream under a used id violates the stream table invariant
+	duplicate := &Stream{
+		streamId:   stream.streamId,
+		conn:       client,
+		startChan:  make(chan error, 1),
+		dataChan:   make(chan []byte),
+		headerChan: make(chan http.Header),
+		closeChan:  make(chan bool),
+	}
+	client.addStream(duplicate)
+
+	_, err = stream.Read(make([]byte, 1))
+	var invariantErr *InvariantError
+	if !errors.As(err, &invariantErr) {
+		t.Fatalf("Unexpected read error on displaced stream: %v", err)
+	}
+	if actual, _ := client.getStream(stream.streamId); actual != duplicate {
+		t.Fatal("Duplicate stream not kept in the stream table")
+	}
+	if violations := client.Stats().InvariantViolations; violations != 1 {
+		t.Fatalf("Unexpected violation count:\nActual: %d\nExpected: %d", violations, 1)
+	}
+}
+
+func TestInvariantStrict(t *testing.T) {
+	client, server := newTestConnections(t, nil, NoOpStreamHandler)
+	defer client.Close()
+	defer server.Close()
+	client.SetStrictness(StrictnessStrict)
+
+	defer func() {
+		if _, ok := recover().(*InvariantError); !ok {
+			t.Fatal("Expected invariant panic")
+		}
+	}()
+	client.invariantViolated(nil, "test violation")
+}
+
+func TestInvariantStreamResetWhileQueued(t *testing.T) {
+	clientConn, serverConn := Loopback(0)
+	server, err := NewConnection(serverConn, true)
+	if err != nil {
+		t.Fatalf("Error creating server connection: %s", err)
+	}
+	server.SetStrictness(StrictnessStrict)
+	server.SetFramePolicy(DataRateLimit(0))
+	release := make(chan struct{})
+	accepted := make(chan string, 3)
+	go server.Serve(func(stream *Stream) {
+		name := stream.Headers().Get("Name")
+		if name == "busy" {
+			<-release
+		}
+		accepted <- name
+	})
+	defer server.Close()
+
+	framer, err := spdy.NewFramer(clientConn, clientConn)
+	if err != nil {
+		t.Fatalf("Error creating framer: %s", err)
+	}
+	received := make(chan spdy.Frame, 16)
+	go func() {
+		for {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			received <- frame
+		}
+	}()
+
+	// streams 1, 11 and 21 share a frame worker, kept busy by stream 1
+	// while the data frame of stream 11 gets it reset by the policy
+	frames := []spdy.Frame{
+		&spdy.SynStreamFrame{StreamId: 1, Headers: http.Header{"Name": []string{"busy"}}},
+		&spdy.SynStreamFrame{StreamId: 11, Headers: http.Header{"Name": []string{"reset"}}},
+		&spdy.DataFrame{StreamId: 11, Data: []byte("rejected")},
+	}
+	for _, frame := range frames {
+		if err := framer.WriteFrame(frame); err != nil {
+			t.Fatalf("Error writing frame: %s", err)
+		}
+	}
+	select {
+	case frame := <-received:
+		if rst, ok := frame.(*spdy.RstStreamFrame); !ok || rst.StreamId != 11 {
+			t.Fatalf("Unexpected frame: %#v", frame)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for reset")
+	}
+	close(release)
+
+	if err := framer.WriteFrame(&spdy.SynStreamFrame{StreamId: 21, Headers: http.Header{"Name": []string{"after"}}}); err != nil {
+		t.Fatalf("Error writing frame: %s", err)
+	}
+	for _, expected := range []string{"busy", "after"} {
+		select {
+		case name := <-accepted:
+			if name != expected {
+				t.Fatalf("Unexpected accepted stream:\nActual: %s\nExpected: %s", name, expected)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for stream %s", expected)
+		}
+	}
+	select {
+	case frame := <-received:
+		t.Fatalf("Unexpected frame: %#v", frame)
+	default:
+	}
+	if violations := server.Stats().InvariantViolations; violations != 0 {
+		t.Fatalf("Unexpected violation count:\nActual: %d\nExpected: %d", violations, 0)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"time"
+)
+
+// LatencyBuckets is the number of buckets of a LatencyHistogram.
+const LatencyBuckets = 21
+
+// LatencyBucketBounds are the upper bounds of the buckets of a
+// LatencyHistogram, doubling from 10µs to about 5s; the last bucket
+// counts the longer durations.
+var LatencyBucketBounds = latencyBucketBounds()
+
+func latencyBucketBounds() [LatencyBuckets - 1]time.Duration {
+	var bounds [LatencyBuckets - 1]time.Duration
+	bound := 10 * time.Microsecond
+	for i := range bounds {
+		bounds[i] = bound
+		bound *= 2
+	}
+	return bounds
+}
+
+// LatencyHistogram counts durations in the buckets bounded by
+// LatencyBucketBounds.
+type LatencyHistogram struct {
+	// Buckets counts the durations up to the bound of each bucket and
+	// above the bound of the bucket before.
+	Buckets [LatencyBuckets]uint64
+	// Count is the number of durations, Sum their total and Max the
+	// longest.
+	Count uint64
+	Sum   time.Duration
+	Max   time.Duration
+}
+
+func (h *LatencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(LatencyBucketBounds) && d > LatencyBucketBounds[i] {
+		i++
+	}
+	h.Buckets[i]++
+	h.Count++
+	h.Sum += d
+	if d > h.Max {
+		h.Max = d
+	}
+}
+
+// Mean returns the mean of the durations, 0 without durations.
+func (h LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Quantile returns an upper bound of the q quantile of the durations,
+// for q between 0 and 1: the bound of the bucket holding it, or Max for
+// the last bucket.  It returns 0 without durations.
+func (h LatencyHistogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.Count))
+	if rank >= h.Count {
+		rank = h.Count - 1
+	}
+	var seen uint64
+	for i, n := range h.Buckets {
+		seen += n
+		if seen > rank {
+			if i < len(LatencyBucketBounds) && LatencyBucketBounds[i] < h.Max {
+				return LatencyBucketBounds[i]
+			}
+			return h.Max
+		}
+	}
+	return h.Max
+}
+
+func (s *Connection) observeQueueDelay(d time.Duration) {
+	s.statsLock.Lock()
+	s.stats.QueueDelay.observe(d)
+	s.statsLock.Unlock()
+}
+
+func (s *Connection) observeDeliveryDelay(d time.Duration) {
+	s.statsLock.Lock()
+	s.stats.DeliveryDelay.observe(d)
+	s.statsLock.Unlock()
+}
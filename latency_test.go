@@ -0,0 +1,102 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h LatencyHistogram
+	for i := 0; i < 90; i++ {
+		h.observe(5 * time.Microsecond)
+	}
+	for i := 0; i < 10; i++ {
+		h.observe(3 * time.Millisecond)
+	}
+	h.observe(time.Minute)
+
+	if h.Count != 101 {
+		t.Fatalf("Unexpected count:\nActual: %d\nExpected: %d", h.Count, 101)
+	}
+	if h.Buckets[0] != 90 || h.Buckets[LatencyBuckets-1] != 1 {
+		t.Fatalf("Unexpected buckets: %v", h.Buckets)
+	}
+	if q := h.Quantile(0.5); q != LatencyBucketBounds[0] {
+		t.Fatalf("Unexpected median:\nActual: %v\nExpected: %v", q, LatencyBucketBounds[0])
+	}
+	if q := h.Quantile(0.95); q != 5120*time.Microsecond {
+		t.Fatalf("Unexpected 95th percentile:\nActual: %v\nExpected: %v", q, 5120*time.Microsecond)
+	}
+	if q := h.Quantile(1); q != time.Minute {
+		t.Fatalf("Unexpected maximum:\nActual: %v\nExpected: %v", q, time.Minute)
+	}
+}
+
+func TestDeliveryDelay(t *testing.T) {
+	streams := make(chan *Stream, 1)
+	client, server := newTestConnections(t, nil, func(stream *Stream) {
+		stream.SendReply(http.Header{}, false)
+		streams <- stream
+	})
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for reply: %v", err)
+	}
+	remote := <-streams
+
+	for i := 0; i < 2; i++ {
+		if _, err := stream.Write([]byte("slow")); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+	}
+	// The second frame waits behind the first one the application is
+	// slow to read
+	for i := 0; i < 2; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if _, err := remote.ReadData(); err != nil {
+			t.Fatalf("Error reading: %v", err)
+		}
+	}
+
+	// The delivery is recorded by the frame worker once the data is read
+	stats := server.Stats()
+	for i := 0; i < 100 && stats.DeliveryDelay.Count < 2; i++ {
+		time.Sleep(time.Millisecond)
+		stats = server.Stats()
+	}
+	if stats.DeliveryDelay.Count != 2 {
+		t.Fatalf("Unexpected delivery count:\nActual: %d\nExpected: %d", stats.DeliveryDelay.Count, 2)
+	}
+	if stats.DeliveryDelay.Max < 30*time.Millisecond {
+		t.Fatalf("Delivery delay too short: %v", stats.DeliveryDelay.Max)
+	}
+	if stats.QueueDelay.Count < 3 {
+		t.Fatalf("Unexpected queue delay count: %d", stats.QueueDelay.Count)
+	}
+	if stats.QueueDelay.Max < 10*time.Millisecond {
+		t.Fatalf("Queue delay too short: %v", stats.QueueDelay.Max)
+	}
+}
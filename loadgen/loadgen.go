@@ -0,0 +1,265 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package loadgen generates stream traffic against a spdy connection for
+// soak testing and capacity planning.
+//
+// A Config describes a weighted mix of stream profiles, each writing a
+// number of bytes at a priority, opened at a rate with bounded
+// concurrency.  Each stream is created, written, closed and read until
+// the remote closes it; Run reports the latency percentiles of these
+// round trips and the errors per profile.
+package loadgen
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/moby/spdystream"
+)
+
+var (
+	ErrNoProfiles = errors.New("no stream profiles")
+)
+
+// Profile describes a kind of stream of the mix.
+type Profile struct {
+	// Name identifies the profile in the report.
+	Name string
+	// Weight is the share of the streams using the profile relative to
+	// the other profiles.  Zero counts as one.
+	Weight int
+	// Size is the number of bytes written to each stream.
+	Size int
+	// Priority of the streams, 0 through 7, see ContextPriority.
+	Priority uint8
+	// Headers sent when creating the streams.
+	Headers http.Header
+}
+
+// Config describes the traffic to generate.
+type Config struct {
+	// Profiles is the mix of streams.
+	Profiles []Profile
+	// Rate is the number of streams opened per second, zero opens
+	// streams as fast as Concurrency allows.
+	Rate float64
+	// Concurrency bounds the streams in progress, zero means one.
+	Concurrency int
+	// Duration stops opening streams after the duration, if set.
+	Duration time.Duration
+	// Streams stops opening streams after that many, if set.  Without
+	// Duration or Streams, streams are opened until the context is done.
+	Streams int
+	// Seed seeds the choice of profiles.
+	Seed int64
+}
+
+// ProfileReport holds the results of the streams of a profile.
+type ProfileReport struct {
+	Streams int
+	Errors  int
+	// Bytes is the number of bytes written.
+	Bytes int64
+	// Latency percentiles of the successful streams, from creating the
+	// stream to the remote closing it.
+	P50, P90, P99, Max time.Duration
+
+	latencies []time.Duration
+}
+
+// ErrorRate returns the share of the streams which failed.
+func (r *ProfileReport) ErrorRate() float64 {
+	if r.Streams == 0 {
+		return 0
+	}
+	return float64(r.Errors) / float64(r.Streams)
+}
+
+// Report holds the results of Run.
+type Report struct {
+	Elapsed  time.Duration
+	Profiles map[string]*ProfileReport
+}
+
+type contextKey struct{}
+
+// ContextPriority returns the priority of the streams opened by Run, to
+// be passed to SetContextPriority of the connection so the priorities of
+// the profiles are sent to the remote.
+func ContextPriority(ctx context.Context) (uint8, bool) {
+	priority, ok := ctx.Value(contextKey{}).(uint8)
+	return priority, ok
+}
+
+// Run generates the traffic described by config on conn until the
+// duration or stream count of config is reached or ctx is done, then
+// waits for the streams in progress and returns the report.
+func Run(ctx context.Context, conn *spdystream.Connection, config Config) (*Report, error) {
+	if len(config.Profiles) == 0 {
+		return nil, ErrNoProfiles
+	}
+	var totalWeight int
+	for _, profile := range config.Profiles {
+		totalWeight += weight(profile)
+	}
+	concurrency := config.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if config.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Duration)
+		defer cancel()
+	}
+	var tick <-chan time.Time
+	if config.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / config.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	report := &Report{Profiles: make(map[string]*ProfileReport)}
+	for _, profile := range config.Profiles {
+		report.Profiles[profile.Name] = &ProfileReport{}
+	}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+	random := rand.New(rand.NewSource(config.Seed))
+	start := time.Now()
+
+Loop:
+	for opened := 0; config.Streams == 0 || opened < config.Streams; opened++ {
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				break Loop
+			}
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			break Loop
+		}
+		profile := pick(config.Profiles, totalWeight, random)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			latency, err := runStream(conn, profile)
+			<-slots
+
+			lock.Lock()
+			defer lock.Unlock()
+			r := report.Profiles[profile.Name]
+			r.Streams++
+			if err != nil {
+				r.Errors++
+				return
+			}
+			r.Bytes += int64(profile.Size)
+			r.latencies = append(r.latencies, latency)
+		}()
+	}
+	wg.Wait()
+	report.Elapsed = time.Since(start)
+
+	for _, r := range report.Profiles {
+		sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+		r.P50 = percentile(r.latencies, 0.50)
+		r.P90 = percentile(r.latencies, 0.90)
+		r.P99 = percentile(r.latencies, 0.99)
+		r.Max = percentile(r.latencies, 1)
+	}
+	return report, nil
+}
+
+func weight(profile Profile) int {
+	if profile.Weight < 1 {
+		return 1
+	}
+	return profile.Weight
+}
+
+// pick returns a profile chosen at random according to the weights.
+func pick(profiles []Profile, totalWeight int, random *rand.Rand) Profile {
+	n := random.Intn(totalWeight)
+	for _, profile := range profiles {
+		if n -= weight(profile); n < 0 {
+			return profile
+		}
+	}
+	return profiles[len(profiles)-1]
+}
+
+// runStream creates a stream, writes the profile size, closes it and
+// reads until the remote closes it, returning the elapsed time.
+func runStream(conn *spdystream.Connection, profile Profile) (time.Duration, error) {
+	start := time.Now()
+	headers := http.Header{}
+	for name, values := range profile.Headers {
+		headers[name] = values
+	}
+	ctx := context.WithValue(context.Background(), contextKey{}, profile.Priority)
+	stream, err := conn.CreateStreamContext(ctx, headers, nil, false)
+	if err != nil {
+		return 0, err
+	}
+	if err := stream.Wait(); err != nil {
+		stream.Reset()
+		return 0, err
+	}
+	chunk := make([]byte, 32*1024)
+	for remaining := profile.Size; remaining > 0; remaining -= len(chunk) {
+		if remaining < len(chunk) {
+			chunk = chunk[:remaining]
+		}
+		if _, err := stream.Write(chunk); err != nil {
+			stream.Reset()
+			return 0, err
+		}
+	}
+	if err := stream.Close(); err != nil {
+		stream.Reset()
+		return 0, err
+	}
+	// fails if the remote resets the stream rather than finishing it
+	if _, err := stream.DiscardRemaining(); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// percentile returns the p-th percentile of the sorted latencies.
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(latencies))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(latencies) {
+		i = len(latencies) - 1
+	}
+	return latencies[i]
+}
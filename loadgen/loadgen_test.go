@@ -0,0 +1,90 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package loadgen
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/moby/spdystream"
+)
+
+func TestRun(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	client, err := spdystream.NewConnection(clientConn, false)
+	if err != nil {
+		t.Fatalf("Error creating client connection: %s", err)
+	}
+	server, err := spdystream.NewConnection(serverConn, true)
+	if err != nil {
+		t.Fatalf("Error creating server connection: %s", err)
+	}
+	client.SetContextPriority(ContextPriority)
+	var lock sync.Mutex
+	kinds := map[string]int{}
+	go client.Serve(spdystream.NoOpStreamHandler)
+	go server.Serve(func(stream *spdystream.Stream) {
+		lock.Lock()
+		kinds[stream.Headers().Get("Kind")]++
+		lock.Unlock()
+		spdystream.MirrorStreamHandler(stream)
+	})
+	defer server.Close()
+	defer client.Close()
+
+	report, err := Run(context.Background(), client, Config{
+		Profiles: []Profile{
+			{Name: "small", Weight: 3, Size: 100, Headers: http.Header{"Kind": {"small"}}},
+			{Name: "large", Weight: 1, Size: 100000, Priority: 7, Headers: http.Header{"Kind": {"large"}}},
+		},
+		Concurrency: 4,
+		Streams:     40,
+	})
+	if err != nil {
+		t.Fatalf("Error running load: %s", err)
+	}
+
+	small, large := report.Profiles["small"], report.Profiles["large"]
+	if small.Streams+large.Streams != 40 || small.Streams == 0 || large.Streams == 0 {
+		t.Fatalf("Unexpected stream counts: small %d, large %d", small.Streams, large.Streams)
+	}
+	if small.Errors != 0 || large.Errors != 0 || small.ErrorRate() != 0 {
+		t.Fatalf("Unexpected errors: small %d, large %d", small.Errors, large.Errors)
+	}
+	if large.Bytes != int64(large.Streams)*100000 {
+		t.Fatalf("Unexpected large bytes:\nActual: %d\nExpected: %d", large.Bytes, large.Streams*100000)
+	}
+	for name, r := range report.Profiles {
+		if r.P50 <= 0 || r.P50 > r.P90 || r.P90 > r.P99 || r.P99 > r.Max {
+			t.Fatalf("Unexpected %s latencies: %+v", name, r)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if kinds["small"] != small.Streams || kinds["large"] != large.Streams {
+		t.Fatalf("Unexpected streams received: %v", kinds)
+	}
+}
+
+func TestRunNoProfiles(t *testing.T) {
+	if _, err := Run(context.Background(), nil, Config{}); err != ErrNoProfiles {
+		t.Fatalf("Unexpected error:\nActual: %v\nExpected: %v", err, ErrNoProfiles)
+	}
+}
@@ -0,0 +1,254 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLoopbackClosed = errors.New("loopback listener closed")
+)
+
+// DefaultLoopbackBufferSize is the buffer size used by loopback
+// connections created with a buffer size of 0.
+const DefaultLoopbackBufferSize = 64 * 1024
+
+// loopbackAddr is the address of both ends of a loopback connection.
+type loopbackAddr struct{}
+
+func (loopbackAddr) Network() string { return "loopback" }
+func (loopbackAddr) String() string  { return "loopback" }
+
+// loopbackBuffer is a ring buffer carrying one direction of a loopback
+// connection.  changed is closed and replaced on every state change.
+type loopbackBuffer struct {
+	lock         sync.Mutex
+	data         []byte
+	start        int
+	length       int
+	writerClosed bool
+	readerClosed bool
+	changed      chan struct{}
+}
+
+func newLoopbackBuffer(size int) *loopbackBuffer {
+	return &loopbackBuffer{data: make([]byte, size), changed: make(chan struct{})}
+}
+
+// signal wakes the operations waiting for a change, with the lock held.
+func (b *loopbackBuffer) signal() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// loopbackConn is one end of a loopback connection, reading from rb and
+// writing to wb.
+type loopbackConn struct {
+	rb, wb        *loopbackBuffer
+	readDeadline  ioDeadline
+	writeDeadline ioDeadline
+}
+
+// Loopback returns the two ends of an in-process connection, for
+// running spdy between components of the same process without system
+// calls.  Each direction buffers up to bufferSize bytes, so unlike with
+// net.Pipe writes complete without waiting for a matching read while
+// buffer space is left.  A bufferSize of 0 means
+// DefaultLoopbackBufferSize.
+func Loopback(bufferSize int) (net.Conn, net.Conn) {
+	if bufferSize <= 0 {
+		bufferSize = DefaultLoopbackBufferSize
+	}
+	a, b := newLoopbackBuffer(bufferSize), newLoopbackBuffer(bufferSize)
+	return &loopbackConn{rb: a, wb: b}, &loopbackConn{rb: b, wb: a}
+}
+
+func (c *loopbackConn) Read(p []byte) (int, error) {
+	for {
+		if c.readDeadline.exceeded() {
+			return 0, timeoutError{}
+		}
+		b := c.rb
+		b.lock.Lock()
+		if b.readerClosed {
+			b.lock.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if b.length > 0 {
+			n := 0
+			for n < len(p) && b.length > 0 {
+				end := b.start + b.length
+				if end > len(b.data) {
+					end = len(b.data)
+				}
+				copied := copy(p[n:], b.data[b.start:end])
+				n += copied
+				b.start = (b.start + copied) % len(b.data)
+				b.length -= copied
+			}
+			b.signal()
+			b.lock.Unlock()
+			return n, nil
+		}
+		if b.writerClosed {
+			b.lock.Unlock()
+			return 0, io.EOF
+		}
+		changed := b.changed
+		b.lock.Unlock()
+		if err := c.readDeadline.wait(changed); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *loopbackConn) Write(p []byte) (int, error) {
+	n := 0
+	for {
+		if c.writeDeadline.exceeded() {
+			return n, timeoutError{}
+		}
+		b := c.wb
+		b.lock.Lock()
+		if b.writerClosed || b.readerClosed {
+			b.lock.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		for n < len(p) && b.length < len(b.data) {
+			end := (b.start + b.length) % len(b.data)
+			limit := len(b.data)
+			if end < b.start {
+				limit = b.start
+			}
+			copied := copy(b.data[end:limit], p[n:])
+			n += copied
+			b.length += copied
+		}
+		b.signal()
+		if n == len(p) {
+			b.lock.Unlock()
+			return n, nil
+		}
+		changed := b.changed
+		b.lock.Unlock()
+		if err := c.writeDeadline.wait(changed); err != nil {
+			return n, err
+		}
+	}
+}
+
+// Close closes both directions: pending and further reads and writes
+// on this end fail, the other end reads the buffered data then io.EOF.
+func (c *loopbackConn) Close() error {
+	c.rb.lock.Lock()
+	c.rb.readerClosed = true
+	c.rb.signal()
+	c.rb.lock.Unlock()
+
+	c.wb.lock.Lock()
+	c.wb.writerClosed = true
+	c.wb.signal()
+	c.wb.lock.Unlock()
+	return nil
+}
+
+func (c *loopbackConn) LocalAddr() net.Addr  { return loopbackAddr{} }
+func (c *loopbackConn) RemoteAddr() net.Addr { return loopbackAddr{} }
+
+func (c *loopbackConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *loopbackConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *loopbackConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// LoopbackListener is a net.Listener accepting in-process connections
+// created with Dial, for serving a Server, or an http.Server running
+// Upgrade, to components of the same process.
+type LoopbackListener struct {
+	// BufferSize is the buffer size of the connections, see Loopback.
+	BufferSize int
+
+	once   sync.Once
+	conns  chan net.Conn
+	done   chan struct{}
+	closer sync.Once
+}
+
+func (l *LoopbackListener) init() {
+	l.once.Do(func() {
+		l.conns = make(chan net.Conn)
+		l.done = make(chan struct{})
+	})
+}
+
+// Accept waits for a connection dialed with Dial.
+func (l *LoopbackListener) Accept() (net.Conn, error) {
+	l.init()
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrLoopbackClosed
+	}
+}
+
+// Dial connects to the listener, waiting for the connection to be
+// accepted.  The network and address are ignored, it can be used as
+// Dialer.NetDial.
+func (l *LoopbackListener) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	l.init()
+	local, remote := Loopback(l.BufferSize)
+	select {
+	case l.conns <- remote:
+		return local, nil
+	case <-l.done:
+		return nil, ErrLoopbackClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops accepting connections, connections already accepted are
+// left open.
+func (l *LoopbackListener) Close() error {
+	l.init()
+	l.closer.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+// Addr returns the address of the listener.
+func (l *LoopbackListener) Addr() net.Addr {
+	return loopbackAddr{}
+}
@@ -0,0 +1,88 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLoopback(t *testing.T) {
+	a, b := Loopback(16)
+
+	// writes larger than the buffer complete as the data is read
+	payload := bytes.Repeat([]byte("0123456789"), 100)
+	go func() {
+		if _, err := a.Write(payload); err != nil {
+			t.Errorf("Error writing: %s", err)
+		}
+		a.Close()
+	}()
+	data, err := ioutil.ReadAll(b)
+	if err != nil {
+		t.Fatalf("Error reading: %s", err)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Fatalf("Unexpected data:\nActual: %q\nExpected: %q", data, payload)
+	}
+	if _, err := b.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("Unexpected write error:\nActual: %v\nExpected: %v", err, io.ErrClosedPipe)
+	}
+
+	a, b = Loopback(0)
+	defer a.Close()
+	defer b.Close()
+	if _, err := a.Write([]byte("buffered")); err != nil {
+		t.Fatalf("Error writing: %s", err)
+	}
+	b.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := b.Read(make([]byte, 64)); err != nil || n != len("buffered") {
+		t.Fatalf("Unexpected read: %d, %v", n, err)
+	}
+	_, err = b.Read(make([]byte, 64))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("Unexpected read error:\nActual: %v\nExpected: timeout", err)
+	}
+}
+
+func TestLoopbackListener(t *testing.T) {
+	listener := &LoopbackListener{}
+	srv := &Server{Handler: MirrorStreamHandler}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(listener)
+	}()
+
+	conn, err := listener.Dial(context.Background(), "", "")
+	if err != nil {
+		t.Fatalf("Error dialing: %s", err)
+	}
+	testServerEcho(t, conn)
+
+	srv.Close()
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("Unexpected serve error:\nActual: %v\nExpected: %v", err, ErrServerClosed)
+	}
+	if _, err := listener.Dial(context.Background(), "", ""); err != ErrLoopbackClosed {
+		t.Fatalf("Unexpected dial error:\nActual: %v\nExpected: %v", err, ErrLoopbackClosed)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"net/http"
+	"unsafe"
+)
+
+// MemoryUsage is an estimate of the memory held by a connection, by
+// subsystem.  Sizes are in bytes and count the data held, not the
+// allocator overhead.
+type MemoryUsage struct {
+	// StreamBytes is the size of the stream structures.
+	StreamBytes uint64
+	// ReceiveBufferBytes is the data received and held for Read,
+	// including the data frames queued, see SetDataQueue.
+	ReceiveBufferBytes uint64
+	// HeaderBlockBytes is the size of the headers of the streams.
+	HeaderBlockBytes uint64
+	// FrameQueueBytes is the length of the frames received and queued
+	// for the frame workers.
+	FrameQueueBytes uint64
+	// SendQueueBytes is the data queued for sending, always zero since
+	// writes are not queued: they block until the frame is written.
+	SendQueueBytes uint64
+	// Streams holds the usage of each stream, attributed from the
+	// totals above.
+	Streams []StreamMemoryUsage
+}
+
+// StreamMemoryUsage is an estimate of the memory held by a stream.
+type StreamMemoryUsage struct {
+	StreamId           uint32
+	StreamBytes        uint64
+	ReceiveBufferBytes uint64
+	HeaderBlockBytes   uint64
+}
+
+// Total returns the sum of the subsystem usages.
+func (m MemoryUsage) Total() uint64 {
+	return m.StreamBytes + m.ReceiveBufferBytes + m.HeaderBlockBytes + m.FrameQueueBytes + m.SendQueueBytes
+}
+
+// MemoryUsage returns an estimate of the memory currently held by the
+// connection, per subsystem and per stream, to find what holds memory in
+// a process with many connections.  Computing it walks every stream, it
+// is meant for debug endpoints rather than frequent polling.
+func (s *Connection) MemoryUsage() MemoryUsage {
+	var usage MemoryUsage
+	streams := s.streamsSnapshot()
+	usage.Streams = make([]StreamMemoryUsage, 0, len(streams))
+	for _, stream := range streams {
+		streamUsage := StreamMemoryUsage{
+			StreamId:           uint32(stream.streamId),
+			StreamBytes:        uint64(unsafe.Sizeof(*stream)),
+			ReceiveBufferBytes: uint64(stream.BufferedRecvBytes()),
+		}
+		stream.closeLock.Lock()
+		streamUsage.HeaderBlockBytes = headerBytes(stream.headers)
+		stream.closeLock.Unlock()
+		usage.StreamBytes += streamUsage.StreamBytes
+		usage.ReceiveBufferBytes += streamUsage.ReceiveBufferBytes
+		usage.HeaderBlockBytes += streamUsage.HeaderBlockBytes
+		usage.Streams = append(usage.Streams, streamUsage)
+	}
+
+	s.statsLock.Lock()
+	frameQueues := s.frameQueues
+	s.statsLock.Unlock()
+	for _, frameQueue := range frameQueues {
+		usage.FrameQueueBytes += frameQueue.queuedBytes()
+	}
+	return usage
+}
+
+// headerBytes returns the size of the names and values of headers.
+func headerBytes(headers http.Header) uint64 {
+	var n uint64
+	for name, values := range headers {
+		n += uint64(len(name))
+		for _, value := range values {
+			n += uint64(len(value))
+		}
+	}
+	return n
+}
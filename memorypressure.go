@@ -0,0 +1,124 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// memoryPressureInterval is how long HeapLimitPressure reuses a heap
+// reading, as reading it stops the world.
+const memoryPressureInterval = 100 * time.Millisecond
+
+// MemoryPressureFunc reports whether the process is under memory
+// pressure.  It is called for every stream opened by the remote and every
+// data frame consumed, so it must be cheap.
+type MemoryPressureFunc func() bool
+
+// SetMemoryPressure makes the connection shed load while pressure
+// reports memory pressure: streams opened by the remote are refused, and
+// window updates of the WindowUpdateEager and WindowUpdateThreshold
+// policies are held back, shrinking the receive windows of the remote.
+// Pressure is checked again every 100ms while updates are held back;
+// once it is over the data consumed meanwhile is acknowledged, even if
+// the remote stopped sending on exhausted windows.  WindowUpdateManual
+// updates are left to the application.  Streams refused this way may be
+// retried by the remote, see Pool.CreateStreamRetry.  HeapLimitPressure
+// gives a pressure signal from the heap size.  Must be called before
+// Serve.
+func (s *Connection) SetMemoryPressure(pressure MemoryPressureFunc) {
+	s.memoryPressure = pressure
+}
+
+// underMemoryPressure reports whether the connection is to shed load.
+func (s *Connection) underMemoryPressure() bool {
+	return s.memoryPressure != nil && s.memoryPressure()
+}
+
+// holdWindowUpdate records that stream holds back a window update under
+// memory pressure, arming the check releasing it.
+func (s *Connection) holdWindowUpdate(stream *Stream) {
+	s.pressureLock.Lock()
+	defer s.pressureLock.Unlock()
+	if s.heldWindowUpdates == nil {
+		s.heldWindowUpdates = make(map[*Stream]struct{})
+	}
+	s.heldWindowUpdates[stream] = struct{}{}
+	if s.pressureTimer == nil {
+		s.pressureTimer = time.AfterFunc(memoryPressureInterval, s.releaseWindowUpdates)
+	}
+}
+
+// releaseWindowUpdates sends the window updates held back once the
+// memory pressure is over, checking again later otherwise.
+func (s *Connection) releaseWindowUpdates() {
+	closed := s.closedError() != nil
+	s.pressureLock.Lock()
+	if !closed && s.underMemoryPressure() {
+		s.pressureTimer.Reset(memoryPressureInterval)
+		s.pressureLock.Unlock()
+		return
+	}
+	streams := s.heldWindowUpdates
+	s.heldWindowUpdates = nil
+	s.pressureTimer = nil
+	s.pressureLock.Unlock()
+	if closed {
+		return
+	}
+
+	if s.windowUpdatePolicy == WindowUpdateManual {
+		return
+	}
+	debugMessage("(%p) Memory pressure over, releasing %d window updates", s, len(streams))
+	for stream := range streams {
+		if err := stream.UpdateWindow(); err != nil {
+			debugMessage("(%p) (%d) Error sending window update: %s", s, stream.streamId, err)
+		}
+	}
+}
+
+// HeapLimitPressure returns a MemoryPressureFunc reporting pressure when
+// the heap in use exceeds fraction of limit, such as the soft memory
+// limit of the runtime given by debug.SetMemoryLimit(-1) on Go 1.19 and
+// later.  fraction defaults to 0.9 if not between 0 and 1.  The heap is
+// read at most every 100ms, the pressure reported in between is that of
+// the last reading.
+func HeapLimitPressure(limit uint64, fraction float64) MemoryPressureFunc {
+	if fraction <= 0 || fraction > 1 {
+		fraction = 0.9
+	}
+	threshold := uint64(fraction * float64(limit))
+	var (
+		lock     sync.Mutex
+		read     time.Time
+		pressure bool
+	)
+	return func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		if now := time.Now(); now.Sub(read) >= memoryPressureInterval {
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			pressure = stats.HeapAlloc > threshold
+			read = now
+		}
+		return pressure
+	}
+}
@@ -0,0 +1,203 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+func TestMemoryPressure(t *testing.T) {
+	var pressure int32
+	streams := make(chan *Stream, 1)
+	configure := func(conn *Connection) {
+		conn.SetWindowUpdatePolicy(WindowUpdateEager, 0)
+		conn.SetMemoryPressure(func() bool {
+			return atomic.LoadInt32(&pressure) == 1
+		})
+	}
+	client, server := newTestConnections(t, configure, func(stream *Stream) {
+		stream.SendReply(http.Header{}, false)
+		streams <- stream
+	})
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for reply: %v", err)
+	}
+	remote := <-streams
+
+	atomic.StoreInt32(&pressure, 1)
+	refused, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	if err := refused.WaitTimeout(5 * time.Second); err != ErrReset {
+		t.Fatalf("Unexpected wait error:\nActual: %v\nExpected: %v", err, ErrReset)
+	}
+	if refused.resetStatus != spdy.RefusedStream {
+		t.Fatalf("Unexpected reset status:\nActual: %v\nExpected: %v", refused.resetStatus, spdy.RefusedStream)
+	}
+
+	// Window updates are held back under pressure
+	go stream.Write([]byte("held"))
+	if _, err := remote.ReadData(); err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	remote.windowLock.Lock()
+	consumed := remote.consumedBytes
+	remote.windowLock.Unlock()
+	if consumed != 4 {
+		t.Fatalf("Unexpected held back window:\nActual: %d\nExpected: %d", consumed, 4)
+	}
+
+	atomic.StoreInt32(&pressure, 0)
+	go stream.Write([]byte("sent"))
+	if _, err := remote.ReadData(); err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	remote.windowLock.Lock()
+	consumed = remote.consumedBytes
+	remote.windowLock.Unlock()
+	if consumed != 0 {
+		t.Fatalf("Unexpected held back window:\nActual: %d\nExpected: %d", consumed, 0)
+	}
+
+	accepted, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	if err := accepted.WaitTimeout(5 * time.Second); err != nil {
+		t.Fatalf("Error waiting for reply: %v", err)
+	}
+}
+
+func TestMemoryPressureRelease(t *testing.T) {
+	t.Run("Eager", func(t *testing.T) {
+		testMemoryPressureRelease(t, WindowUpdateEager)
+	})
+	// window updates are only sent when asked for by the application
+	t.Run("Manual", func(t *testing.T) {
+		testMemoryPressureRelease(t, WindowUpdateManual)
+	})
+}
+
+func testMemoryPressureRelease(t *testing.T, policy WindowUpdatePolicy) {
+	clientConn, serverConn := Loopback(0)
+	server, err := NewConnection(serverConn, true)
+	if err != nil {
+		t.Fatalf("Error creating server connection: %v", err)
+	}
+	var pressure int32
+	server.SetWindowUpdatePolicy(policy, 0)
+	server.SetMemoryPressure(func() bool {
+		return atomic.LoadInt32(&pressure) == 1
+	})
+	consumed := make(chan int, 1)
+	go server.Serve(func(stream *Stream) {
+		// under pressure once the stream is accepted
+		atomic.StoreInt32(&pressure, 1)
+		stream.SendReply(http.Header{}, false)
+		go func() {
+			n := 0
+			for n < DefaultReceiveWindow {
+				data, err := stream.ReadData()
+				if err != nil {
+					return
+				}
+				n += len(data)
+			}
+			consumed <- n
+		}()
+	})
+	defer server.Close()
+
+	framer, err := spdy.NewFramer(clientConn, clientConn)
+	if err != nil {
+		t.Fatalf("Error creating framer: %v", err)
+	}
+	updates := make(chan uint32, 8)
+	go func() {
+		for {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			if update, ok := frame.(*spdy.WindowUpdateFrame); ok {
+				updates <- update.DeltaWindowSize
+			}
+		}
+	}()
+
+	// the remote exhausts the window of the stream under pressure, then
+	// sends nothing more
+	if err := framer.WriteFrame(&spdy.SynStreamFrame{StreamId: 1, Headers: http.Header{}}); err != nil {
+		t.Fatalf("Error writing stream frame: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		frame := &spdy.DataFrame{StreamId: 1, Data: make([]byte, DefaultReceiveWindow/4)}
+		if err := framer.WriteFrame(frame); err != nil {
+			t.Fatalf("Error writing data frame: %v", err)
+		}
+	}
+	select {
+	case <-consumed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for data to be consumed")
+	}
+	select {
+	case delta := <-updates:
+		t.Fatalf("Unexpected window update of %d under pressure", delta)
+	case <-time.After(2 * memoryPressureInterval):
+	}
+
+	atomic.StoreInt32(&pressure, 0)
+	if policy == WindowUpdateManual {
+		select {
+		case delta := <-updates:
+			t.Fatalf("Unexpected window update of %d after pressure", delta)
+		case <-time.After(3 * memoryPressureInterval):
+		}
+		return
+	}
+	select {
+	case delta := <-updates:
+		if delta != DefaultReceiveWindow {
+			t.Fatalf("Unexpected window update:\nActual: %d\nExpected: %d", delta, DefaultReceiveWindow)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the held back window update")
+	}
+}
+
+func TestHeapLimitPressure(t *testing.T) {
+	if !HeapLimitPressure(1, 0.9)() {
+		t.Fatal("Expected pressure above a tiny limit")
+	}
+	if HeapLimitPressure(1<<62, 0.9)() {
+		t.Fatal("Unexpected pressure below a huge limit")
+	}
+}
@@ -0,0 +1,206 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// ResumeTokenHeader carries the token identifying a migratable stream,
+// sent again on the stream reopened by Migrate so the server can resume
+// the logical stream, see Stream.ResumeToken.
+const ResumeTokenHeader = "Spdystream-Resume-Token"
+
+var (
+	ErrStreamNotIdle = errors.New("stream has unread data")
+)
+
+// MigratableStream is a logical stream of a pool which can be moved to
+// another connection of the pool, for example off a connection being
+// drained.  Reads and writes go to the current stream, moved by Migrate.
+//
+// Migration is experimental: the server must recognise the resume token
+// to tie the reopened stream to the logical one, and the caller must only
+// migrate when its protocol is idle, with no data in flight in either
+// direction, as data sent on the previous stream after the migration is
+// lost.
+type MigratableStream struct {
+	pool    *Pool
+	headers http.Header
+
+	migrateLock sync.Mutex
+
+	lock   sync.Mutex
+	stream *Stream
+	gen    uint64
+}
+
+// CreateMigratableStream creates a stream like CreateStream, carrying a
+// new resume token in its headers, and waits for its reply.
+func (p *Pool) CreateMigratableStream(ctx context.Context, headers http.Header) (*MigratableStream, error) {
+	withToken := make(http.Header, len(headers)+1)
+	for name, values := range headers {
+		withToken[name] = values
+	}
+	withToken.Set(ResumeTokenHeader, newTraceID())
+
+	m := &MigratableStream{pool: p, headers: withToken}
+	conn, err := p.pick(ctx, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := m.open(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	m.stream = stream
+	return m, nil
+}
+
+// open opens the logical stream on conn and waits for its reply.
+func (m *MigratableStream) open(ctx context.Context, conn *Connection) (*Stream, error) {
+	stream, err := conn.CreateStream(m.headers, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	replied := make(chan error, 1)
+	conn.Go(func() {
+		replied <- stream.Wait()
+	})
+	select {
+	case err := <-replied:
+		if err != nil {
+			return nil, err
+		}
+		return stream, nil
+	case <-ctx.Done():
+		stream.Reset()
+		return nil, ctx.Err()
+	}
+}
+
+// Stream returns the current stream.
+func (m *MigratableStream) Stream() *Stream {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.stream
+}
+
+// current returns the current stream and its generation, which changes
+// with every migration.
+func (m *MigratableStream) current() (*Stream, uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.stream, m.gen
+}
+
+func (m *MigratableStream) migrated(gen uint64) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.gen != gen
+}
+
+// ResumeToken returns the resume token of the logical stream.
+func (m *MigratableStream) ResumeToken() string {
+	return m.headers.Get(ResumeTokenHeader)
+}
+
+// Read reads from the current stream, a read interrupted by a migration
+// continues on the new stream.
+func (m *MigratableStream) Read(p []byte) (int, error) {
+	for {
+		stream, gen := m.current()
+		n, err := stream.Read(p)
+		if err != nil && m.migrated(gen) {
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// Write writes to the current stream, a write failed by a migration is
+// retried on the new stream.
+func (m *MigratableStream) Write(p []byte) (int, error) {
+	for {
+		stream, gen := m.current()
+		n, err := stream.Write(p)
+		if err != nil && m.migrated(gen) {
+			continue
+		}
+		return n, err
+	}
+}
+
+// Close closes the current stream.
+func (m *MigratableStream) Close() error {
+	m.migrateLock.Lock()
+	defer m.migrateLock.Unlock()
+	return m.Stream().Close()
+}
+
+// Migrate reopens the logical stream on another connection of the pool
+// with the same headers and resume token, then resets the previous
+// stream, the reads pending on it continuing on the new one.
+// ErrStreamNotIdle is returned, leaving the stream in place, if data
+// received on the current stream is still unread, including a data
+// frame being delivered to it.
+func (m *MigratableStream) Migrate(ctx context.Context) error {
+	m.migrateLock.Lock()
+	defer m.migrateLock.Unlock()
+
+	old := m.Stream()
+	if old.BufferedRecvBytes() > 0 {
+		return ErrStreamNotIdle
+	}
+	conn, err := m.pool.pick(ctx, "", map[*Connection]bool{old.conn: true})
+	if err != nil {
+		return err
+	}
+	stream, err := m.open(ctx, conn)
+	if err != nil {
+		return err
+	}
+	// data may have arrived while the new stream was opened
+	if old.BufferedRecvBytes() > 0 {
+		stream.Reset()
+		return ErrStreamNotIdle
+	}
+	debugMessage("(%p) Migrating stream %d to stream %d on %p", m, old.streamId, stream.streamId, conn)
+
+	m.lock.Lock()
+	m.stream = stream
+	m.gen++
+	m.lock.Unlock()
+
+	// the reads pending on the previous stream end with the reset and
+	// continue on the new stream
+	old.Reset()
+	return nil
+}
+
+// ResumeToken returns the resume token of a stream created by a
+// MigratableStream, the same on the stream reopened by a migration, or
+// an empty string.
+func (s *Stream) ResumeToken() string {
+	return s.headers.Get(ResumeTokenHeader)
+}
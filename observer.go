@@ -0,0 +1,102 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"github.com/moby/spdystream/spdy"
+)
+
+// FrameInfo describes a frame sent or received on a connection.
+type FrameInfo struct {
+	Sent     bool
+	Type     string
+	StreamId uint32
+	Flags    uint8
+	// Length is the length of the frame excluding its 8 byte header.
+	Length uint32
+	// Frame is the frame itself, only set when requested with
+	// SetFrameObserver.  It must not be modified.
+	Frame spdy.Frame
+}
+
+// FrameObserver is called with every frame sent or received on a
+// connection.  Received frames are observed by the reading goroutine
+// before they are handled; an error rejects the frame and closes the
+// connection with a protocol error.  Sent frames are observed once
+// written, by the writing goroutine, and errors are ignored.  The
+// observer must not block.
+type FrameObserver func(info FrameInfo) error
+
+// SetFrameObserver sets the observer called with every frame, including
+// the frames in FrameInfo when frames is true.  Must be called before
+// Serve.
+func (s *Connection) SetFrameObserver(observer FrameObserver, frames bool) {
+	s.frameObserver = observer
+	s.observeFrames = frames
+}
+
+// observeFrame passes frame to the frame observer, if any.
+func (s *Connection) observeFrame(frame spdy.Frame, sent bool) error {
+	if s.frameObserver == nil {
+		return nil
+	}
+	info := newFrameInfo(frame, sent)
+	if !s.observeFrames {
+		info.Frame = nil
+	}
+	return s.frameObserver(info)
+}
+
+func newFrameInfo(frame spdy.Frame, sent bool) FrameInfo {
+	frameType, streamId, flags := describeFrame(frame)
+	return FrameInfo{
+		Sent:     sent,
+		Type:     frameType,
+		StreamId: streamId,
+		Flags:    flags,
+		Length:   frameLength(frame),
+		Frame:    frame,
+	}
+}
+
+// frameLength returns the length of a frame read or written, excluding
+// its header.
+func frameLength(frame spdy.Frame) uint32 {
+	switch frame := frame.(type) {
+	case *spdy.DataFrame:
+		return uint32(len(frame.Data))
+	case *spdy.SynStreamFrame:
+		return frame.CFHeader.Length()
+	case *spdy.SynReplyFrame:
+		return frame.CFHeader.Length()
+	case *spdy.RstStreamFrame:
+		return frame.CFHeader.Length()
+	case *spdy.SettingsFrame:
+		return frame.CFHeader.Length()
+	case *spdy.PingFrame:
+		return frame.CFHeader.Length()
+	case *spdy.GoAwayFrame:
+		return frame.CFHeader.Length()
+	case *spdy.HeadersFrame:
+		return frame.CFHeader.Length()
+	case *spdy.WindowUpdateFrame:
+		return frame.CFHeader.Length()
+	case *spdy.UnknownControlFrame:
+		return frame.CFHeader.Length()
+	}
+	return 0
+}
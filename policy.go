@@ -0,0 +1,176 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+var (
+	ErrFrameRejected = errors.New("frame rejected by policy")
+)
+
+// FrameVerdict is the decision of a FramePolicy on a received frame.
+type FrameVerdict int
+
+const (
+	// FrameAllow handles the frame as usual.
+	FrameAllow FrameVerdict = iota
+	// FrameReset discards the frame and resets its stream, refusing a
+	// new stream.  Reads and writes on the stream then return
+	// ErrFrameRejected, data received earlier but not read yet may be
+	// discarded.  Frames not belonging to a stream are discarded.
+	FrameReset
+	// FrameGoAway discards the frame and closes the connection with a
+	// protocol error.
+	FrameGoAway
+)
+
+// FramePolicy vetoes received frames.  CheckFrame is called by the
+// reading goroutine with every received frame, FrameInfo.Frame always
+// set, before the frame is handled; it must not block.
+type FramePolicy interface {
+	CheckFrame(info FrameInfo) FrameVerdict
+}
+
+// FramePolicyFunc adapts a function to a FramePolicy.
+type FramePolicyFunc func(info FrameInfo) FrameVerdict
+
+func (f FramePolicyFunc) CheckFrame(info FrameInfo) FrameVerdict {
+	return f(info)
+}
+
+// FramePolicies combines policies, returning the most severe verdict.
+func FramePolicies(policies ...FramePolicy) FramePolicy {
+	return FramePolicyFunc(func(info FrameInfo) FrameVerdict {
+		verdict := FrameAllow
+		for _, policy := range policies {
+			if v := policy.CheckFrame(info); v > verdict {
+				verdict = v
+			}
+		}
+		return verdict
+	})
+}
+
+// ForbidStreamHeaders returns a policy refusing new streams carrying any
+// of the headers names.
+func ForbidStreamHeaders(names ...string) FramePolicy {
+	canonical := make([]string, len(names))
+	for i, name := range names {
+		canonical[i] = http.CanonicalHeaderKey(name)
+	}
+	return FramePolicyFunc(func(info FrameInfo) FrameVerdict {
+		frame, ok := info.Frame.(*spdy.SynStreamFrame)
+		if !ok {
+			return FrameAllow
+		}
+		for _, name := range canonical {
+			if _, ok := frame.Headers[name]; ok {
+				return FrameReset
+			}
+		}
+		return FrameAllow
+	})
+}
+
+// dataRateLimit counts the data frames received per stream in the
+// current one second window.
+type dataRateLimit struct {
+	limit int
+
+	lock   sync.Mutex
+	window time.Time
+	counts map[uint32]int
+}
+
+// DataRateLimit returns a policy resetting streams receiving more than
+// perSecond data frames within a second.
+func DataRateLimit(perSecond int) FramePolicy {
+	return &dataRateLimit{limit: perSecond, counts: make(map[uint32]int)}
+}
+
+func (l *dataRateLimit) CheckFrame(info FrameInfo) FrameVerdict {
+	if _, ok := info.Frame.(*spdy.DataFrame); !ok {
+		return FrameAllow
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if now := time.Now(); now.Sub(l.window) >= time.Second {
+		l.window = now
+		l.counts = make(map[uint32]int)
+	}
+	l.counts[info.StreamId]++
+	if l.counts[info.StreamId] > l.limit {
+		return FrameReset
+	}
+	return FrameAllow
+}
+
+// SetFramePolicy sets the policy enforced on received frames.  Must be
+// called before Serve.
+func (s *Connection) SetFramePolicy(policy FramePolicy) {
+	s.framePolicy = policy
+}
+
+// resetRejectedFrame resets the stream of a frame rejected by the frame
+// policy.
+func (s *Connection) resetRejectedFrame(frame spdy.Frame) {
+	var streamId spdy.StreamId
+	switch frame := frame.(type) {
+	case *spdy.SynStreamFrame:
+		if s.checkStreamFrame(frame) {
+			s.Go(func() {
+				if err := s.sendResetFrame(spdy.RefusedStream, frame.StreamId); err != nil {
+					debugMessage("reset error: %s", err)
+				}
+			})
+		}
+		return
+	case *spdy.SynReplyFrame:
+		streamId = frame.StreamId
+	case *spdy.HeadersFrame:
+		streamId = frame.StreamId
+	case *spdy.DataFrame:
+		streamId = frame.StreamId
+	case *spdy.WindowUpdateFrame:
+		streamId = frame.StreamId
+	default:
+		return
+	}
+
+	stream, ok := s.getStream(streamId)
+	if !ok {
+		return
+	}
+	stream.closeLock.Lock()
+	if stream.abortErr == nil {
+		stream.abortErr = ErrFrameRejected
+	}
+	stream.closeLock.Unlock()
+	s.removeStream(stream)
+	s.Go(func() {
+		if err := stream.resetWithStatus(spdy.ProtocolError); err != nil {
+			debugMessage("reset error: %s", err)
+		}
+	})
+}
@@ -0,0 +1,568 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrPoolClosed  = errors.New("spdy pool closed")
+	ErrNoEndpoints = errors.New("no endpoints to connect to")
+	ErrBreakerOpen = errors.New("circuit breakers of all endpoints open")
+)
+
+// Pool maintains client connections to the endpoints serving a URL, one
+// connection per endpoint, and places new streams on them.
+type Pool struct {
+	// URL is the http or https URL of the spdy server.
+	URL string
+
+	// Header is sent with every upgrade request.
+	Header http.Header
+
+	// Dialer is used to connect to the endpoints. If nil,
+	// DefaultDialer is used. The Addrs field of the dialer is ignored.
+	Dialer *Dialer
+
+	// Handler serves streams opened by the servers. If nil,
+	// NoOpStreamHandler is used.
+	Handler StreamHandler
+
+	// LookupAddrs returns the network addresses of the endpoints. If
+	// nil, the addresses the URL host resolves to are used.
+	LookupAddrs func(ctx context.Context) ([]string, error)
+
+	// ResolveInterval is the interval at which the endpoints are looked
+	// up again. Connections are set up to new endpoints and closed
+	// gracefully for endpoints which disappeared. Zero disables periodic
+	// lookups, leaving the endpoints found on first use.
+	ResolveInterval time.Duration
+
+	// Balancer places new streams on the endpoints. If nil,
+	// LeastStreamsBalancer is used.
+	Balancer Balancer
+
+	// PingInterval is the interval at which connections are pinged to
+	// measure their round trip time. Zero disables pinging.
+	PingInterval time.Duration
+
+	// BreakerThreshold is the number of consecutive connection or ping
+	// failures after which the circuit breaker of an endpoint opens,
+	// excluding it from stream placement for BreakerCooldown. Zero
+	// disables the breakers.
+	BreakerThreshold int
+
+	// BreakerCooldown is the time an endpoint breaker stays open before
+	// a trial connection is allowed. Zero means 30 seconds.
+	BreakerCooldown time.Duration
+
+	initOnce  sync.Once
+	lock      sync.Mutex
+	endpoints map[string]*poolEndpoint
+	affinity  map[string]*Connection
+	resolved  bool
+	closed    bool
+	closeChan chan struct{}
+}
+
+// poolEndpoint holds the connection to one endpoint of the pool.
+type poolEndpoint struct {
+	addr     string
+	dialLock sync.Mutex
+	// guarded by the pool lock
+	conn      *Connection
+	rtt       time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func (p *Pool) init() {
+	p.initOnce.Do(func() {
+		p.endpoints = make(map[string]*poolEndpoint)
+		p.affinity = make(map[string]*Connection)
+		p.closeChan = make(chan struct{})
+		if p.ResolveInterval > 0 {
+			go p.resolveLoop()
+		}
+		if p.PingInterval > 0 {
+			go p.pingLoop()
+		}
+	})
+}
+
+// CreateStream creates a stream on the connection chosen by the
+// balancer, connecting to an endpoint if needed.
+func (p *Pool) CreateStream(headers http.Header, fin bool) (*Stream, error) {
+	return p.CreateStreamKey("", headers, fin)
+}
+
+// CreateStreamKey is like CreateStream but passes key to the balancer,
+// see ConsistentHashBalancer.
+func (p *Pool) CreateStreamKey(key string, headers http.Header, fin bool) (*Stream, error) {
+	conn, err := p.ConnKey(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	return conn.CreateStream(headers, nil, fin)
+}
+
+// CreateStreamAffinity creates a stream on the connection previously used
+// for the affinity key, so related streams share a connection.  The first
+// stream for a key, or the first after its connection closed, is placed by
+// the balancer with key as the stream key and pins the key to the chosen
+// connection.
+func (p *Pool) CreateStreamAffinity(key string, headers http.Header, fin bool) (*Stream, error) {
+	p.init()
+
+	p.lock.Lock()
+	conn := p.affinity[key]
+	p.lock.Unlock()
+	if conn == nil {
+		var err error
+		if conn, err = p.ConnKey(context.Background(), key); err != nil {
+			return nil, err
+		}
+		p.lock.Lock()
+		if pinned := p.affinity[key]; pinned != nil {
+			// raced with another stream for the same key
+			conn = pinned
+		} else if p.isPoolConn(conn) {
+			p.affinity[key] = conn
+		}
+		p.lock.Unlock()
+	}
+	return conn.CreateStream(headers, nil, fin)
+}
+
+// ReleaseAffinity forgets the connection pinned for the affinity key.
+func (p *Pool) ReleaseAffinity(key string) {
+	p.init()
+
+	p.lock.Lock()
+	delete(p.affinity, key)
+	p.lock.Unlock()
+}
+
+// isPoolConn reports whether conn is a current connection of the pool,
+// called with the pool lock held.
+func (p *Pool) isPoolConn(conn *Connection) bool {
+	for _, endpoint := range p.endpoints {
+		if endpoint.conn == conn {
+			return true
+		}
+	}
+	return false
+}
+
+// unpin forgets all affinity keys pinned to conn, called with the pool
+// lock held.
+func (p *Pool) unpin(conn *Connection) {
+	for key, pinned := range p.affinity {
+		if pinned == conn {
+			delete(p.affinity, key)
+		}
+	}
+}
+
+// Conn returns the connection chosen by the balancer, connecting to an
+// endpoint if needed.
+func (p *Pool) Conn(ctx context.Context) (*Connection, error) {
+	return p.ConnKey(ctx, "")
+}
+
+// ConnKey is like Conn but passes key to the balancer.
+func (p *Pool) ConnKey(ctx context.Context, key string) (*Connection, error) {
+	return p.pick(ctx, key, nil)
+}
+
+// pick returns the connection chosen by the balancer for key, ignoring
+// the connections in exclude.
+func (p *Pool) pick(ctx context.Context, key string, exclude map[*Connection]bool) (*Connection, error) {
+	p.init()
+
+	p.lock.Lock()
+	resolved := p.resolved
+	p.lock.Unlock()
+	if !resolved {
+		if err := p.Resolve(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil, ErrPoolClosed
+	}
+	now := time.Now()
+	endpoints := make([]*poolEndpoint, 0, len(p.endpoints))
+	breakersOpen := len(p.endpoints) > 0
+	for _, endpoint := range p.endpoints {
+		if p.breakerState(endpoint, now) == BreakerOpen {
+			continue
+		}
+		breakersOpen = false
+		if endpoint.conn != nil && exclude[endpoint.conn] {
+			continue
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].addr < endpoints[j].addr
+	})
+	conns := make([]PoolConn, len(endpoints))
+	for i, endpoint := range endpoints {
+		conns[i] = PoolConn{Addr: endpoint.addr, Conn: endpoint.conn, RTT: endpoint.rtt}
+	}
+	p.lock.Unlock()
+	if breakersOpen {
+		return nil, ErrBreakerOpen
+	}
+	if len(conns) == 0 {
+		return nil, ErrNoEndpoints
+	}
+
+	balancer := p.Balancer
+	if balancer == nil {
+		balancer = LeastStreamsBalancer
+	}
+	picked := balancer.Pick(conns, key)
+	if picked < 0 || picked >= len(conns) {
+		picked = 0
+	}
+	if conns[picked].Conn != nil {
+		return conns[picked].Conn, nil
+	}
+
+	// connect to the picked endpoint, falling back to any other
+	conn, err := p.dial(ctx, endpoints[picked])
+	if err == nil {
+		return conn, nil
+	}
+	debugMessage("(%p) Error connecting to %s: %s", p, endpoints[picked].addr, err)
+	for i, endpoint := range endpoints {
+		if i == picked {
+			continue
+		}
+		if conns[i].Conn != nil {
+			return conns[i].Conn, nil
+		}
+		var dialErr error
+		if conn, dialErr = p.dial(ctx, endpoint); dialErr == nil {
+			return conn, nil
+		}
+		debugMessage("(%p) Error connecting to %s: %s", p, endpoint.addr, dialErr)
+	}
+	return nil, err
+}
+
+// Prewarm connects to up to n endpoints in parallel and waits for a ping
+// round trip on each new connection, so the first streams do not wait for
+// connection setup.  Endpoints already connected count towards n.  The
+// first error of a failed connection attempt is returned.
+func (p *Pool) Prewarm(ctx context.Context, n int) error {
+	p.init()
+
+	p.lock.Lock()
+	resolved := p.resolved
+	p.lock.Unlock()
+	if !resolved {
+		if err := p.Resolve(ctx); err != nil {
+			return err
+		}
+	}
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return ErrPoolClosed
+	}
+	var (
+		connected int
+		pending   []*poolEndpoint
+		now       = time.Now()
+	)
+	for _, endpoint := range p.endpoints {
+		if endpoint.conn != nil {
+			connected++
+		} else if p.breakerState(endpoint, now) != BreakerOpen {
+			pending = append(pending, endpoint)
+		}
+	}
+	p.lock.Unlock()
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].addr < pending[j].addr
+	})
+
+	errs := make(chan error, len(pending))
+	started := 0
+	for _, endpoint := range pending {
+		if connected+started >= n {
+			break
+		}
+		started++
+		go func(endpoint *poolEndpoint) {
+			conn, err := p.dial(ctx, endpoint)
+			if err == nil {
+				if _, err = conn.Ping(); err != nil {
+					p.recordFailure(endpoint)
+				}
+			}
+			errs <- err
+		}(endpoint)
+	}
+
+	var firstErr error
+	for i := 0; i < started; i++ {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// dial returns the connection to endpoint, connecting if needed.
+func (p *Pool) dial(ctx context.Context, endpoint *poolEndpoint) (*Connection, error) {
+	endpoint.dialLock.Lock()
+	defer endpoint.dialLock.Unlock()
+
+	p.lock.Lock()
+	conn := endpoint.conn
+	p.lock.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+
+	dialer := DefaultDialer
+	if p.Dialer != nil {
+		dialer = p.Dialer
+	}
+	d := *dialer
+	d.Addrs = []string{endpoint.addr}
+	handler := p.Handler
+	if handler == nil {
+		handler = NoOpStreamHandler
+	}
+	conn, _, err := d.DialContext(ctx, p.URL, p.Header, handler)
+	if err != nil {
+		p.recordFailure(endpoint)
+		return nil, err
+	}
+	p.recordSuccess(endpoint)
+
+	p.lock.Lock()
+	if p.closed || p.endpoints[endpoint.addr] != endpoint {
+		// the pool was closed or the endpoint removed while dialing
+		p.lock.Unlock()
+		conn.Close()
+		return nil, ErrPoolClosed
+	}
+	endpoint.conn = conn
+	p.lock.Unlock()
+
+	go func() {
+		<-conn.CloseChan()
+		p.lock.Lock()
+		if endpoint.conn == conn {
+			endpoint.conn = nil
+			endpoint.rtt = 0
+		}
+		p.unpin(conn)
+		p.lock.Unlock()
+	}()
+	if p.PingInterval > 0 {
+		go p.ping(endpoint, conn)
+	}
+	return conn, nil
+}
+
+// ping measures the round trip time of the connection to endpoint.
+func (p *Pool) ping(endpoint *poolEndpoint, conn *Connection) {
+	rtt, err := conn.Ping()
+	if err != nil {
+		debugMessage("(%p) Error pinging %s: %s", p, endpoint.addr, err)
+		p.recordFailure(endpoint)
+		return
+	}
+	p.recordSuccess(endpoint)
+	p.lock.Lock()
+	if endpoint.conn == conn {
+		endpoint.rtt = rtt
+	}
+	p.lock.Unlock()
+}
+
+func (p *Pool) pingLoop() {
+	ticker := time.NewTicker(p.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.lock.Lock()
+			for _, endpoint := range p.endpoints {
+				if endpoint.conn != nil {
+					go p.ping(endpoint, endpoint.conn)
+				}
+			}
+			p.lock.Unlock()
+		case <-p.closeChan:
+			return
+		}
+	}
+}
+
+// Resolve looks up the endpoints of the pool, connecting to new endpoints
+// in the background and gracefully closing connections to endpoints which
+// are no longer found.
+func (p *Pool) Resolve(ctx context.Context) error {
+	p.init()
+
+	lookup := p.LookupAddrs
+	if lookup == nil {
+		lookup = p.lookupURLAddrs
+	}
+	addrs, err := lookup(ctx)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return ErrNoEndpoints
+	}
+
+	found := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		found[addr] = true
+	}
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return ErrPoolClosed
+	}
+	var added []*poolEndpoint
+	for addr := range found {
+		if _, ok := p.endpoints[addr]; !ok {
+			endpoint := &poolEndpoint{addr: addr}
+			p.endpoints[addr] = endpoint
+			added = append(added, endpoint)
+		}
+	}
+	var removed []*Connection
+	for addr, endpoint := range p.endpoints {
+		if !found[addr] {
+			delete(p.endpoints, addr)
+			if endpoint.conn != nil {
+				removed = append(removed, endpoint.conn)
+				p.unpin(endpoint.conn)
+			}
+		}
+	}
+	initial := !p.resolved
+	p.resolved = true
+	p.lock.Unlock()
+
+	// drain connections to endpoints which disappeared, streams in
+	// progress are allowed to finish
+	for _, conn := range removed {
+		go conn.Close()
+	}
+	if !initial {
+		for _, endpoint := range added {
+			go func(endpoint *poolEndpoint) {
+				if _, err := p.dial(context.Background(), endpoint); err != nil {
+					debugMessage("(%p) Error connecting to %s: %s", p, endpoint.addr, err)
+				}
+			}(endpoint)
+		}
+	}
+	return nil
+}
+
+// lookupURLAddrs resolves the host of the pool URL.
+func (p *Pool) lookupURLAddrs(ctx context.Context) ([]string, error) {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(hostPort(u))
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{net.JoinHostPort(host, port)}, nil
+	}
+	hosts, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(hosts))
+	for i, h := range hosts {
+		addrs[i] = net.JoinHostPort(h, port)
+	}
+	return addrs, nil
+}
+
+func (p *Pool) resolveLoop() {
+	ticker := time.NewTicker(p.ResolveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.Resolve(context.Background()); err != nil {
+				debugMessage("(%p) Error resolving endpoints: %s", p, err)
+			}
+		case <-p.closeChan:
+			return
+		}
+	}
+}
+
+// Close closes all connections of the pool.
+func (p *Pool) Close() error {
+	p.init()
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.closeChan)
+	var conns []*Connection
+	for _, endpoint := range p.endpoints {
+		if endpoint.conn != nil {
+			conns = append(conns, endpoint.conn)
+		}
+	}
+	p.lock.Unlock()
+
+	var err error
+	for _, conn := range conns {
+		if cerr := conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,524 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// poolTestServer is an upgrade server reporting its spdy connections.
+type poolTestServer struct {
+	*httptest.Server
+	conns chan *Connection
+}
+
+func newPoolTestServer(t *testing.T) *poolTestServer {
+	server := &poolTestServer{conns: make(chan *Connection, 16)}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := Upgrade(w, req, MirrorStreamHandler)
+		if err != nil {
+			t.Errorf("Error upgrading connection: %s", err)
+			return
+		}
+		server.conns <- conn
+	}))
+	return server
+}
+
+func (s *poolTestServer) addr(t *testing.T) string {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Host
+}
+
+// staticAddrs returns a Pool.LookupAddrs function returning addrs.
+func staticAddrs(addrs ...string) func(ctx context.Context) ([]string, error) {
+	return func(ctx context.Context) ([]string, error) {
+		return addrs, nil
+	}
+}
+
+func testPoolEcho(t *testing.T, pool *Pool) {
+	stream, err := pool.CreateStream(http.Header{}, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatalf("Error writing to stream: %s", err)
+	}
+	data, err := stream.ReadData()
+	if err != nil {
+		t.Fatalf("Error reading from stream: %s", err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Unexpected data:\nActual: %q\nExpected: %q", data, "hello")
+	}
+	stream.Close()
+}
+
+func TestPoolResolve(t *testing.T) {
+	serverA := newPoolTestServer(t)
+	defer serverA.Close()
+	serverB := newPoolTestServer(t)
+	defer serverB.Close()
+
+	var lock sync.Mutex
+	addrs := []string{serverA.addr(t)}
+	pool := &Pool{
+		URL: "http://spdy.invalid",
+		LookupAddrs: func(ctx context.Context) ([]string, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			return addrs, nil
+		},
+	}
+	defer pool.Close()
+
+	testPoolEcho(t, pool)
+	var connA *Connection
+	select {
+	case connA = <-serverA.conns:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for connection to first endpoint")
+	}
+
+	// the endpoint moves, new streams follow it
+	lock.Lock()
+	addrs = []string{serverB.addr(t)}
+	lock.Unlock()
+	if err := pool.Resolve(context.Background()); err != nil {
+		t.Fatalf("Error resolving: %s", err)
+	}
+	select {
+	case <-serverB.conns:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for connection to new endpoint")
+	}
+	select {
+	case <-connA.CloseChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for connection to old endpoint to drain")
+	}
+	testPoolEcho(t, pool)
+	select {
+	case <-serverA.conns:
+		t.Fatal("Unexpected connection to removed endpoint")
+	default:
+	}
+
+	if err := pool.Close(); err != nil {
+		t.Fatalf("Error closing pool: %s", err)
+	}
+	if _, err := pool.CreateStream(http.Header{}, false); err != ErrPoolClosed {
+		t.Fatalf("Unexpected error after close:\nActual: %v\nExpected: %v", err, ErrPoolClosed)
+	}
+}
+
+func TestPoolResolveInterval(t *testing.T) {
+	server := newPoolTestServer(t)
+	defer server.Close()
+
+	lookups := make(chan struct{}, 16)
+	pool := &Pool{
+		URL:             server.URL,
+		ResolveInterval: 10 * time.Millisecond,
+		LookupAddrs: func(ctx context.Context) ([]string, error) {
+			select {
+			case lookups <- struct{}{}:
+			default:
+			}
+			return []string{server.addr(t)}, nil
+		},
+	}
+	defer pool.Close()
+
+	testPoolEcho(t, pool)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-lookups:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for periodic lookup")
+		}
+	}
+}
+
+func TestPoolAffinity(t *testing.T) {
+	serverA := newPoolTestServer(t)
+	defer serverA.Close()
+	serverB := newPoolTestServer(t)
+	defer serverB.Close()
+
+	pool := &Pool{
+		URL:         "http://spdy.invalid",
+		Balancer:    NewRoundRobinBalancer(),
+		LookupAddrs: staticAddrs(serverA.addr(t), serverB.addr(t)),
+	}
+	defer pool.Close()
+
+	var pinned *Connection
+	for i := 0; i < 3; i++ {
+		stream, err := pool.CreateStreamAffinity("session", http.Header{}, false)
+		if err != nil {
+			t.Fatalf("Error creating stream: %s", err)
+		}
+		if err := stream.Wait(); err != nil {
+			t.Fatalf("Error waiting for stream: %s", err)
+		}
+		if pinned == nil {
+			pinned = stream.conn
+		} else if stream.conn != pinned {
+			t.Fatal("Stream with affinity key placed on another connection")
+		}
+		stream.Close()
+		// other streams keep being balanced
+		if _, err := pool.CreateStream(http.Header{}, false); err != nil {
+			t.Fatalf("Error creating stream: %s", err)
+		}
+	}
+
+	// the pinned connection dies, the key moves on
+	pinned.conn.Close()
+	select {
+	case <-pinned.CloseChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for connection to close")
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		pool.lock.Lock()
+		_, ok := pool.affinity["session"]
+		pool.lock.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for affinity key to be released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stream, err := pool.CreateStreamAffinity("session", http.Header{}, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	if stream.conn == pinned {
+		t.Fatal("Stream placed on closed connection")
+	}
+}
+
+func TestPoolPrewarm(t *testing.T) {
+	serverA := newPoolTestServer(t)
+	defer serverA.Close()
+	serverB := newPoolTestServer(t)
+	defer serverB.Close()
+	serverC := newPoolTestServer(t)
+	defer serverC.Close()
+
+	pool := &Pool{
+		URL:         "http://spdy.invalid",
+		LookupAddrs: staticAddrs(serverA.addr(t), serverB.addr(t), serverC.addr(t)),
+	}
+	defer pool.Close()
+
+	if err := pool.Prewarm(context.Background(), 2); err != nil {
+		t.Fatalf("Error prewarming pool: %s", err)
+	}
+	connected := func() int {
+		n := 0
+		for _, server := range []*poolTestServer{serverA, serverB, serverC} {
+			select {
+			case <-server.conns:
+				n++
+			default:
+			}
+		}
+		return n
+	}
+	if n := connected(); n != 2 {
+		t.Fatalf("Unexpected number of connections:\nActual: %d\nExpected: 2", n)
+	}
+
+	// already connected endpoints count towards n
+	if err := pool.Prewarm(context.Background(), 2); err != nil {
+		t.Fatalf("Error prewarming pool: %s", err)
+	}
+	if n := connected(); n != 0 {
+		t.Fatalf("Unexpected number of new connections:\nActual: %d\nExpected: 0", n)
+	}
+	if err := pool.Prewarm(context.Background(), 5); err != nil {
+		t.Fatalf("Error prewarming pool: %s", err)
+	}
+	if n := connected(); n != 1 {
+		t.Fatalf("Unexpected number of new connections:\nActual: %d\nExpected: 1", n)
+	}
+
+	serverD := newPoolTestServer(t)
+	serverD.Close()
+	pool = &Pool{
+		URL:         "http://spdy.invalid",
+		LookupAddrs: staticAddrs(serverD.addr(t)),
+	}
+	defer pool.Close()
+	if err := pool.Prewarm(context.Background(), 1); err == nil {
+		t.Fatal("Expected error prewarming unreachable endpoint")
+	}
+}
+
+func TestPoolBreaker(t *testing.T) {
+	server := newPoolTestServer(t)
+	defer server.Close()
+	down := newPoolTestServer(t)
+	down.Close()
+
+	pool := &Pool{
+		URL:              "http://spdy.invalid",
+		LookupAddrs:      staticAddrs(down.addr(t)),
+		BreakerThreshold: 2,
+		BreakerCooldown:  100 * time.Millisecond,
+	}
+	defer pool.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := pool.CreateStream(http.Header{}, false); err == nil || err == ErrBreakerOpen {
+			t.Fatalf("Unexpected error connecting to unreachable endpoint: %v", err)
+		}
+	}
+	if _, err := pool.CreateStream(http.Header{}, false); err != ErrBreakerOpen {
+		t.Fatalf("Unexpected error with open breaker:\nActual: %v\nExpected: %v", err, ErrBreakerOpen)
+	}
+	stats := pool.Stats()
+	if len(stats.Endpoints) != 1 || stats.Endpoints[0].Breaker != BreakerOpen || stats.Endpoints[0].Failures != 2 {
+		t.Fatalf("Unexpected pool stats: %+v", stats)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if state := pool.Stats().Endpoints[0].Breaker; state != BreakerHalfOpen {
+		t.Fatalf("Unexpected breaker state:\nActual: %s\nExpected: %s", state, BreakerHalfOpen)
+	}
+	// a failed trial opens the breaker again
+	if _, err := pool.CreateStream(http.Header{}, false); err == nil || err == ErrBreakerOpen {
+		t.Fatalf("Unexpected error on trial connection: %v", err)
+	}
+	if state := pool.Stats().Endpoints[0].Breaker; state != BreakerOpen {
+		t.Fatalf("Unexpected breaker state:\nActual: %s\nExpected: %s", state, BreakerOpen)
+	}
+
+	// streams avoid endpoints with open breakers
+	pool.LookupAddrs = staticAddrs(down.addr(t), server.addr(t))
+	if err := pool.Resolve(context.Background()); err != nil {
+		t.Fatalf("Error resolving: %s", err)
+	}
+	testPoolEcho(t, pool)
+}
+
+func TestPoolCreateStreamRetry(t *testing.T) {
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, err := Upgrade(w, req, func(stream *Stream) { stream.Refuse() }); err != nil {
+			t.Errorf("Error upgrading connection: %s", err)
+		}
+	}))
+	defer refusing.Close()
+	refusingURL, err := url.Parse(refusing.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newPoolTestServer(t)
+	defer server.Close()
+
+	pool := &Pool{
+		URL:         "http://spdy.invalid",
+		LookupAddrs: staticAddrs(refusingURL.Host, server.addr(t)),
+	}
+	defer pool.Close()
+	policy := RetryPolicy{Attempts: 3, Backoff: 10 * time.Millisecond}
+	for i := 0; i < 4; i++ {
+		stream, err := pool.CreateStreamRetry(context.Background(), policy, http.Header{}, false)
+		if err != nil {
+			t.Fatalf("Error creating stream: %s", err)
+		}
+		stream.Close()
+	}
+
+	// refused everywhere, the attempts are exhausted
+	pool.LookupAddrs = staticAddrs(refusingURL.Host)
+	if err := pool.Resolve(context.Background()); err != nil {
+		t.Fatalf("Error resolving: %s", err)
+	}
+	_, err = pool.CreateStreamRetry(context.Background(), policy, http.Header{}, false)
+	retryErr, ok := err.(*RetryError)
+	if !ok {
+		t.Fatalf("Unexpected error:\nActual: %v\nExpected: *RetryError", err)
+	}
+	if len(retryErr.Errors) != 3 {
+		t.Fatalf("Unexpected attempt count:\nActual: %d\nExpected: %d", len(retryErr.Errors), 3)
+	}
+	for _, err := range retryErr.Errors {
+		if err != ErrReset {
+			t.Fatalf("Unexpected attempt error:\nActual: %v\nExpected: %v", err, ErrReset)
+		}
+	}
+}
+
+func TestCreateStreamAfterGoAway(t *testing.T) {
+	server := newPoolTestServer(t)
+	defer server.Close()
+	pool := &Pool{
+		URL:         "http://spdy.invalid",
+		LookupAddrs: staticAddrs(server.addr(t)),
+	}
+	defer pool.Close()
+
+	conn, err := pool.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	var serverConn *Connection
+	select {
+	case serverConn = <-server.conns:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for connection")
+	}
+	stream, err := conn.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+
+	// the open stream keeps the connection up after the GOAWAY
+	go serverConn.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		stream, err := conn.CreateStream(http.Header{}, nil, false)
+		if err == ErrGoAway {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error creating stream:\nActual: %v\nExpected: %v", err, ErrGoAway)
+		}
+		stream.Reset()
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for GOAWAY")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stream.Close()
+}
+
+func TestMigratableStream(t *testing.T) {
+	serverA := newPoolTestServer(t)
+	defer serverA.Close()
+	serverB := newPoolTestServer(t)
+	defer serverB.Close()
+	pool := &Pool{
+		URL:         "http://spdy.invalid",
+		LookupAddrs: staticAddrs(serverA.addr(t), serverB.addr(t)),
+	}
+	defer pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	m, err := pool.CreateMigratableStream(ctx, http.Header{"Name": []string{"logical"}})
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	first := m.Stream()
+	if token := first.ResumeToken(); token == "" || token != m.ResumeToken() {
+		t.Fatalf("Unexpected resume token:\nActual: %q\nExpected: %q", token, m.ResumeToken())
+	}
+
+	// partially read data holds back the migration
+	if _, err := m.Write([]byte("hello")); err != nil {
+		t.Fatalf("Error writing: %s", err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(m, buf); err != nil {
+		t.Fatalf("Error reading: %s", err)
+	}
+	if err := m.Migrate(ctx); err != ErrStreamNotIdle {
+		t.Fatalf("Unexpected error:\nActual: %v\nExpected: %v", err, ErrStreamNotIdle)
+	}
+	buf = make([]byte, 3)
+	if _, err := io.ReadFull(m, buf); err != nil {
+		t.Fatalf("Error reading: %s", err)
+	}
+
+	// so does data being delivered and not read yet
+	if _, err := m.Write([]byte("more")); err != nil {
+		t.Fatalf("Error writing: %s", err)
+	}
+	for i := 0; i < 500 && first.BufferedRecvBytes() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := m.Migrate(ctx); err != ErrStreamNotIdle {
+		t.Fatalf("Unexpected error with data being delivered:\nActual: %v\nExpected: %v", err, ErrStreamNotIdle)
+	}
+	buf = make([]byte, 4)
+	if _, err := io.ReadFull(m, buf); err != nil || string(buf) != "more" {
+		t.Fatalf("Unexpected read: %q, %v", buf, err)
+	}
+
+	// a pending read continues on the new stream
+	read := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 5)
+		n, err := m.Read(buf)
+		if err != nil {
+			t.Errorf("Error reading: %s", err)
+		}
+		read <- string(buf[:n])
+	}()
+	if err := m.Migrate(ctx); err != nil {
+		t.Fatalf("Error migrating: %s", err)
+	}
+	second := m.Stream()
+	if second.conn == first.conn {
+		t.Fatal("Stream not migrated to another connection")
+	}
+	if second.ResumeToken() != m.ResumeToken() || second.Headers().Get("Name") != "logical" {
+		t.Fatalf("Unexpected headers on migrated stream: %v", second.Headers())
+	}
+	if _, err := m.Write([]byte("after")); err != nil {
+		t.Fatalf("Error writing: %s", err)
+	}
+	select {
+	case data := <-read:
+		if data != "after" {
+			t.Fatalf("Unexpected data:\nActual: %q\nExpected: %q", data, "after")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for pending read")
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("Error closing: %s", err)
+	}
+}
@@ -19,6 +19,7 @@ package spdystream
 import (
 	"container/heap"
 	"sync"
+	"time"
 
 	"github.com/moby/spdystream/spdy"
 )
@@ -27,6 +28,8 @@ type prioritizedFrame struct {
 	frame    spdy.Frame
 	priority uint8
 	insertId uint64
+	// time the frame was read from the transport
+	received time.Time
 }
 
 type frameQueue []*prioritizedFrame
@@ -77,6 +80,11 @@ func NewPriorityFrameQueue(size int) *PriorityFrameQueue {
 }
 
 func (q *PriorityFrameQueue) Push(frame spdy.Frame, priority uint8) {
+	q.pushReceived(frame, priority, time.Now())
+}
+
+// pushReceived pushes a frame read from the transport at received.
+func (q *PriorityFrameQueue) pushReceived(frame spdy.Frame, priority uint8, received time.Time) {
 	q.c.L.Lock()
 	defer q.c.L.Unlock()
 	for q.queue.Len() >= q.size {
@@ -86,6 +94,7 @@ func (q *PriorityFrameQueue) Push(frame spdy.Frame, priority uint8) {
 		frame:    frame,
 		priority: priority,
 		insertId: q.nextInsertId,
+		received: received,
 	}
 	q.nextInsertId = q.nextInsertId + 1
 	heap.Push(q.queue, pFrame)
@@ -93,17 +102,23 @@ func (q *PriorityFrameQueue) Push(frame spdy.Frame, priority uint8) {
 }
 
 func (q *PriorityFrameQueue) Pop() spdy.Frame {
+	frame, _ := q.popReceived()
+	return frame
+}
+
+// popReceived pops a frame along with the time it was received.
+func (q *PriorityFrameQueue) popReceived() (spdy.Frame, time.Time) {
 	q.c.L.Lock()
 	defer q.c.L.Unlock()
 	for q.queue.Len() == 0 {
 		if q.drain {
-			return nil
+			return nil, time.Time{}
 		}
 		q.c.Wait()
 	}
-	frame := heap.Pop(q.queue).(*prioritizedFrame).frame
+	pFrame := heap.Pop(q.queue).(*prioritizedFrame)
 	q.c.Signal()
-	return frame
+	return pFrame.frame, pFrame.received
 }
 
 func (q *PriorityFrameQueue) Drain() {
@@ -112,3 +127,14 @@ func (q *PriorityFrameQueue) Drain() {
 	q.drain = true
 	q.c.Broadcast()
 }
+
+// queuedBytes returns the length of the frames in the queue.
+func (q *PriorityFrameQueue) queuedBytes() uint64 {
+	q.c.L.Lock()
+	defer q.c.L.Unlock()
+	var n uint64
+	for _, pFrame := range *q.queue {
+		n += uint64(frameLength(pFrame.frame))
+	}
+	return n
+}
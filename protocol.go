@@ -0,0 +1,116 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	// ProtocolsHeader lists the sub-protocols offered by the creator of
+	// a stream, in order of preference.
+	ProtocolsHeader = "Spdystream-Protocols"
+
+	// ProtocolHeader carries the sub-protocol selected by the acceptor
+	// of a stream in its reply.
+	ProtocolHeader = "Spdystream-Protocol"
+)
+
+var (
+	ErrProtocolNotOffered = errors.New("protocol not offered")
+)
+
+// CreateStreamProtocols is like CreateStream but offers protocols, in
+// order of preference, to the remote.  Once the reply is received, the
+// protocol selected by the remote is returned by Protocol.
+func (s *Connection) CreateStreamProtocols(headers http.Header, parent *Stream, fin bool, protocols ...string) (*Stream, error) {
+	offer := make(http.Header, len(headers)+1)
+	for name, values := range headers {
+		offer[name] = values
+	}
+	offer.Del(ProtocolsHeader)
+	for _, protocol := range protocols {
+		offer.Add(ProtocolsHeader, protocol)
+	}
+	return s.CreateStream(offer, parent, fin)
+}
+
+// OfferedProtocols returns the sub-protocols offered by the creator of
+// the stream, in order of preference.
+func (s *Stream) OfferedProtocols() []string {
+	var protocols []string
+	for _, value := range s.headers[http.CanonicalHeaderKey(ProtocolsHeader)] {
+		for _, protocol := range strings.Split(value, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
+
+// SelectProtocol returns the first offered sub-protocol that is also in
+// supported, or the empty string if there is none.
+func (s *Stream) SelectProtocol(supported ...string) string {
+	for _, offered := range s.OfferedProtocols() {
+		for _, protocol := range supported {
+			if offered == protocol {
+				return protocol
+			}
+		}
+	}
+	return ""
+}
+
+// SendReplyProtocol is like SendReply but tells the creator of the
+// stream that protocol was selected.  An empty protocol selects none.
+// ErrProtocolNotOffered is returned, and no reply sent, if protocol was
+// not offered.
+func (s *Stream) SendReplyProtocol(protocol string, headers http.Header, fin bool) error {
+	reply := make(http.Header, len(headers)+1)
+	for name, values := range headers {
+		reply[name] = values
+	}
+	reply.Del(ProtocolHeader)
+	if protocol != "" {
+		if s.SelectProtocol(protocol) == "" {
+			return ErrProtocolNotOffered
+		}
+		reply.Set(ProtocolHeader, protocol)
+	}
+	if err := s.SendReply(reply, fin); err != nil {
+		return err
+	}
+	s.replyCond.L.Lock()
+	s.protocol = protocol
+	s.replyCond.L.Unlock()
+	return nil
+}
+
+// Protocol returns the sub-protocol agreed on for the stream: for a
+// created stream the one selected by the remote in its reply, valid once
+// Wait returned, for an accepted stream the one selected with
+// SendReplyProtocol.  The empty string means none was selected.
+func (s *Stream) Protocol() string {
+	if s.replyCond != nil {
+		s.replyCond.L.Lock()
+		defer s.replyCond.L.Unlock()
+	}
+	return s.protocol
+}
@@ -0,0 +1,178 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var errInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyV2Signature starts a PROXY protocol version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLength is the maximum length of a version 1 header line.
+const proxyV1MaxLength = 107
+
+// proxyConn is a connection accepted from a proxy, reporting the
+// addresses of the proxied connection sent in the PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader reads a PROXY protocol version 1 or 2 header from conn
+// and returns the connection reporting its addresses.  Headers without
+// addresses, such as for health checks by the proxy, keep the addresses
+// of conn.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	r := bufio.NewReader(conn)
+	pc := &proxyConn{Conn: conn, r: r}
+	signature, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(signature, proxyV2Signature) {
+		pc.remoteAddr, pc.localAddr, err = readProxyV2Header(r)
+	} else {
+		pc.remoteAddr, pc.localAddr, err = readProxyV1Header(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+func readProxyV1Header(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errInvalidProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, nil, errInvalidProxyHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, errInvalidProxyHeader
+	}
+	if len(fields) != 6 {
+		return nil, nil, errInvalidProxyHeader
+	}
+	srcAddr, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dstAddr, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return srcAddr, dstAddr, nil
+}
+
+func parseProxyV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, errInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(portNum)}, nil
+}
+
+func readProxyV2Header(r *bufio.Reader) (src, dst net.Addr, err error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	verCmd, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:]))
+	if verCmd>>4 != 2 {
+		return nil, nil, errInvalidProxyHeader
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	switch verCmd & 0x0f {
+	case 0x0:
+		// LOCAL, sent by the proxy itself
+		return nil, nil, nil
+	case 0x1:
+	default:
+		return nil, nil, errInvalidProxyHeader
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		// other transports keep the addresses of the connection
+		return nil, nil, nil
+	}
+	if length < 2*ipLen+4 {
+		return nil, nil, errInvalidProxyHeader
+	}
+	src = &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	dst = &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
@@ -0,0 +1,163 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrQuotaExceeded = errors.New("Stream quota exceeded")
+)
+
+// QuotaViolation identifies the limit of a StreamQuota which was
+// exceeded.
+type QuotaViolation int
+
+const (
+	QuotaBytesIn QuotaViolation = iota
+	QuotaBytesOut
+	QuotaLifetime
+)
+
+func (v QuotaViolation) String() string {
+	switch v {
+	case QuotaBytesIn:
+		return "bytes in"
+	case QuotaBytesOut:
+		return "bytes out"
+	case QuotaLifetime:
+		return "lifetime"
+	}
+	return "unknown"
+}
+
+// StreamQuota limits the data and lifetime of a stream.  Zero values
+// mean no limit.
+type StreamQuota struct {
+	// MaxBytesIn limits the data received on the stream.
+	MaxBytesIn int64
+	// MaxBytesOut limits the data written to the stream.
+	MaxBytesOut int64
+	// MaxLifetime limits how long the stream stays open, from the time
+	// the quota is set.
+	MaxLifetime time.Duration
+}
+
+// QuotaHandler is called once a stream exceeds its quota, after the
+// stream was reset.  It must not block.
+type QuotaHandler func(stream *Stream, violation QuotaViolation)
+
+// QuotaError is the error of a stream reset for exceeding its quota.  It
+// matches ErrQuotaExceeded with errors.Is.
+type QuotaError struct {
+	Violation QuotaViolation
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrQuotaExceeded, e.Violation)
+}
+
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// SetStreamQuota sets the quota of every stream accepted from the
+// remote, set before the stream handler is called, and the handler
+// called on violations, which may be nil.  Must be called before Serve.
+func (s *Connection) SetStreamQuota(quota StreamQuota, handler QuotaHandler) {
+	s.streamQuota = &quota
+	s.quotaHandler = handler
+}
+
+// SetQuota sets the quota of the stream, replacing the quota set by
+// Connection.SetStreamQuota, and the handler called on violation, which
+// may be nil.  A stream exceeding its quota is aborted with a
+// *QuotaError: the data frame exceeding MaxBytesIn is dropped and the
+// write exceeding MaxBytesOut fails without writing.
+func (s *Stream) SetQuota(quota StreamQuota, handler QuotaHandler) {
+	s.quotaLock.Lock()
+	defer s.quotaLock.Unlock()
+	s.quota = quota
+	s.quotaHandler = handler
+	if s.quotaTimer != nil {
+		s.quotaTimer.Stop()
+		s.quotaTimer = nil
+	}
+	if quota.MaxLifetime > 0 {
+		s.quotaTimer = time.AfterFunc(quota.MaxLifetime, func() {
+			if _, ok := s.conn.getStream(s.streamId); ok {
+				s.exceedQuota(QuotaLifetime)
+			}
+		})
+	}
+}
+
+// chargeQuota adds n bytes received, or written when out is set, and
+// returns false after aborting the stream if the quota is exceeded.
+func (s *Stream) chargeQuota(n int, out bool) bool {
+	s.quotaLock.Lock()
+	var exceeded bool
+	var violation QuotaViolation
+	if out {
+		s.quotaBytesOut += int64(n)
+		exceeded = s.quota.MaxBytesOut > 0 && s.quotaBytesOut > s.quota.MaxBytesOut
+		violation = QuotaBytesOut
+	} else {
+		s.quotaBytesIn += int64(n)
+		exceeded = s.quota.MaxBytesIn > 0 && s.quotaBytesIn > s.quota.MaxBytesIn
+		violation = QuotaBytesIn
+	}
+	s.quotaLock.Unlock()
+	if exceeded {
+		s.exceedQuota(violation)
+	}
+	return !exceeded
+}
+
+// exceedQuota aborts the stream and calls the quota handler, once.
+func (s *Stream) exceedQuota(violation QuotaViolation) {
+	s.quotaLock.Lock()
+	if s.quotaExceeded {
+		s.quotaLock.Unlock()
+		return
+	}
+	s.quotaExceeded = true
+	handler := s.quotaHandler
+	if s.quotaTimer != nil {
+		s.quotaTimer.Stop()
+	}
+	s.quotaLock.Unlock()
+
+	debugMessage("(%p) (%d) Stream quota exceeded: %s", s, s.streamId, violation)
+	s.Abort(&QuotaError{Violation: violation})
+	if handler != nil {
+		handler(s, violation)
+	}
+}
+
+// stopQuota releases the lifetime timer of a stream removed from its
+// connection.
+func (s *Stream) stopQuota() {
+	s.quotaLock.Lock()
+	defer s.quotaLock.Unlock()
+	if s.quotaTimer != nil {
+		s.quotaTimer.Stop()
+	}
+}
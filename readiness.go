@@ -0,0 +1,136 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+// OnReadable arms fn to be called once the stream is readable, that is
+// when Read or ReadData would return without waiting: a data frame is
+// being delivered to the stream or queued, data is left unread by a
+// previous Read, or the remote side is closed.  The callback is called
+// once and must be armed again for the next event, it may be armed from
+// the callback.  Arming a callback replaces the one armed before.
+//
+// The callback is called from the frame worker delivering the frame, or
+// from the goroutine closing the stream, before the frame is handed to
+// the stream: it must not block nor read the stream itself, but hand the
+// stream to the goroutine reading it.  When the stream is readable
+// already, fn is called from a new goroutine.
+func (s *Stream) OnReadable(fn func(*Stream)) {
+	s.readyLock.Lock()
+	ready := s.dataOffered || s.BufferedRecvBytes() > 0
+	if !ready {
+		select {
+		case <-s.closeChan:
+			ready = true
+		default:
+		}
+	}
+	if !ready {
+		s.onReadable = fn
+		s.readyLock.Unlock()
+		return
+	}
+	s.onReadable = nil
+	s.readyLock.Unlock()
+	s.conn.Go(func() {
+		fn(s)
+	})
+}
+
+// OnWritable arms fn to be called once the stream is writable, that is
+// when a write to the stream would not wait for the writes in progress
+// on the connection, or would fail at once as the stream or connection
+// is closed.  Like OnReadable the callback is called once.  It is called
+// from the goroutine completing the last write in progress and must not
+// block; when the stream is writable already, fn is called from a new
+// goroutine.
+func (s *Stream) OnWritable(fn func(*Stream)) {
+	framer := s.conn.framer
+	framer.writableLock.Lock()
+	if framer.writers > 0 && s.writeClosedError() == nil && s.conn.closedError() == nil {
+		framer.writableWaiters = append(framer.writableWaiters, func() {
+			fn(s)
+		})
+		framer.writableLock.Unlock()
+		return
+	}
+	framer.writableLock.Unlock()
+	s.conn.Go(func() {
+		fn(s)
+	})
+}
+
+// offerData marks a data frame as being delivered to the stream and
+// calls the callback armed with OnReadable.
+func (s *Stream) offerData() {
+	s.readyLock.Lock()
+	s.dataOffered = true
+	fn := s.onReadable
+	s.onReadable = nil
+	s.readyLock.Unlock()
+	if fn != nil {
+		fn(s)
+	}
+}
+
+// dataDelivered marks the data frame offered as delivered.
+func (s *Stream) dataDelivered() {
+	s.readyLock.Lock()
+	s.dataOffered = false
+	s.readyLock.Unlock()
+}
+
+// notifyClosed calls the callback armed with OnReadable once the remote
+// side of the stream is closed.
+func (s *Stream) notifyClosed() {
+	s.readyLock.Lock()
+	fn := s.onReadable
+	s.onReadable = nil
+	s.readyLock.Unlock()
+	if fn != nil {
+		fn(s)
+	}
+}
+
+// startWrite counts a write in progress on the connection.
+func (i *idleAwareFramer) startWrite() {
+	i.writableLock.Lock()
+	i.writers++
+	i.writableLock.Unlock()
+}
+
+// finishWrite counts the end of a write, calling the callbacks armed
+// with OnWritable once no write is left in progress.
+func (i *idleAwareFramer) finishWrite() {
+	i.writableLock.Lock()
+	i.writers--
+	unbalanced := i.writers < 0
+	if unbalanced {
+		i.writers = 0
+	}
+	var waiters []func()
+	if i.writers == 0 {
+		waiters = i.writableWaiters
+		i.writableWaiters = nil
+	}
+	i.writableLock.Unlock()
+	for _, waiter := range waiters {
+		waiter()
+	}
+	if unbalanced {
+		i.conn.invariantViolated(nil, "write finished without being started")
+	}
+}
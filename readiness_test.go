@@ -0,0 +1,171 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOnReadable(t *testing.T) {
+	readable := make(chan *Stream, 1)
+	handler := func(stream *Stream) {
+		stream.SendReply(http.Header{}, false)
+		stream.OnReadable(func(s *Stream) {
+			readable <- s
+		})
+	}
+	client, server := newTestConnections(t, nil, handler)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for reply: %v", err)
+	}
+	messages := []string{"one", "two", "three"}
+	go func() {
+		for _, message := range messages {
+			stream.Write([]byte(message))
+		}
+		stream.Close()
+	}()
+
+	var received []string
+	for {
+		var remote *Stream
+		select {
+		case remote = <-readable:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for readable stream")
+		}
+		// Readable streams are read without waiting
+		data, err := remote.ReadData()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Error reading data: %v", err)
+		}
+		received = append(received, string(data))
+		remote.OnReadable(func(s *Stream) {
+			readable <- s
+		})
+	}
+	if actual, expected := strings.Join(received, ","), strings.Join(messages, ","); actual != expected {
+		t.Fatalf("Unexpected data:\nActual: %s\nExpected: %s", actual, expected)
+	}
+}
+
+func TestOnReadableRemoteFinish(t *testing.T) {
+	armed := make(chan struct{})
+	readable := make(chan *Stream, 1)
+	handler := func(stream *Stream) {
+		stream.SendReply(http.Header{}, false)
+		stream.OnReadable(func(s *Stream) {
+			readable <- s
+		})
+		close(armed)
+	}
+	client, server := newTestConnections(t, nil, handler)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for reply: %v", err)
+	}
+	// the finish arrives once the callback is armed
+	<-armed
+	if err := stream.Close(); err != nil {
+		t.Fatalf("Error closing stream: %v", err)
+	}
+
+	select {
+	case remote := <-readable:
+		if _, err := remote.ReadData(); err != io.EOF {
+			t.Fatalf("Unexpected read error:\nActual: %v\nExpected: %v", err, io.EOF)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for readable stream")
+	}
+}
+
+func TestOnWritable(t *testing.T) {
+	client, server := newTestConnections(t, nil, func(stream *Stream) {
+		stream.SendReply(http.Header{}, false)
+		go io.Copy(ioutil.Discard, stream)
+	})
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for reply: %v", err)
+	}
+
+	writable := make(chan struct{}, 1)
+	stream.OnWritable(func(*Stream) {
+		writable <- struct{}{}
+	})
+	select {
+	case <-writable:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for idle stream to be writable")
+	}
+
+	// Hold the transport so the next write stays in progress
+	framer := client.framer
+	framer.writeLock.Lock()
+	go stream.Write([]byte("held"))
+	for {
+		framer.writableLock.Lock()
+		writers := framer.writers
+		framer.writableLock.Unlock()
+		if writers > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stream.OnWritable(func(*Stream) {
+		writable <- struct{}{}
+	})
+	select {
+	case <-writable:
+		framer.writeLock.Unlock()
+		t.Fatal("Stream writable while a write is in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	framer.writeLock.Unlock()
+	select {
+	case <-writable:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for stream to be writable")
+	}
+}
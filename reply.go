@@ -0,0 +1,73 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"net/http"
+)
+
+// ReplyHeaderFunc computes headers to add to the reply of a stream
+// accepted from the remote, from the headers of the stream.
+type ReplyHeaderFunc func(request http.Header) http.Header
+
+// SetReplyHeaderEcho sets the names of headers copied from the headers
+// of streams accepted from the remote into their replies, such as
+// request or correlation ids.  Headers set by the reply itself are kept.
+// Must be called before Serve.
+func (s *Connection) SetReplyHeaderEcho(names ...string) {
+	s.replyEcho = make([]string, len(names))
+	for i, name := range names {
+		s.replyEcho[i] = http.CanonicalHeaderKey(name)
+	}
+}
+
+// SetReplyHeaderFunc sets a function computing headers added to the
+// replies of streams accepted from the remote, after the echoed headers.
+// Headers set by the reply itself are kept.  Must be called before
+// Serve.
+func (s *Connection) SetReplyHeaderFunc(f ReplyHeaderFunc) {
+	s.replyHeaderFunc = f
+}
+
+// replyHeaders returns the headers of the reply to stream, including
+// the echoed and computed headers missing from headers.
+func (s *Connection) replyHeaders(headers http.Header, stream *Stream) http.Header {
+	if len(s.replyEcho) == 0 && s.replyHeaderFunc == nil {
+		return headers
+	}
+	reply := make(http.Header, len(headers))
+	for name, values := range headers {
+		reply[name] = values
+	}
+	for _, name := range s.replyEcho {
+		if _, ok := reply[name]; ok {
+			continue
+		}
+		if values, ok := stream.headers[name]; ok {
+			reply[name] = values
+		}
+	}
+	if s.replyHeaderFunc != nil {
+		for name, values := range s.replyHeaderFunc(stream.headers) {
+			name = http.CanonicalHeaderKey(name)
+			if _, ok := reply[name]; !ok {
+				reply[name] = values
+			}
+		}
+	}
+	return reply
+}
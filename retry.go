@@ -0,0 +1,136 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+// RetryPolicy bounds the retries of Pool.CreateStreamRetry.
+type RetryPolicy struct {
+	// Attempts is the maximum number of stream creation attempts,
+	// including the first.  Values below 1 mean a single attempt.
+	Attempts int
+
+	// Backoff is waited before retrying once every connection of the pool
+	// has refused the stream, and doubles after each wait.
+	Backoff time.Duration
+}
+
+// RetryError is returned by Pool.CreateStreamRetry when no attempt
+// succeeded, holding the error of each attempt in order.
+type RetryError struct {
+	Errors []error
+}
+
+func (e *RetryError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("stream creation failed after %d attempts: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the error of the last attempt.
+func (e *RetryError) Unwrap() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e.Errors[len(e.Errors)-1]
+}
+
+// CreateStreamRetry creates a stream and waits for its reply, retrying on
+// another pooled connection when the stream is refused or the connection is
+// going away.  When every connection has failed the stream, the next attempt
+// waits for the policy backoff and may reuse any connection.  Errors other
+// than a refusal or a GOAWAY are returned immediately; otherwise a
+// *RetryError is returned once the attempts are exhausted.
+func (p *Pool) CreateStreamRetry(ctx context.Context, policy RetryPolicy, headers http.Header, fin bool) (*Stream, error) {
+	attempts := policy.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := policy.Backoff
+	failed := map[*Connection]bool{}
+	var errs []error
+	for len(errs) < attempts {
+		conn, err := p.pick(ctx, "", failed)
+		if err == ErrNoEndpoints && len(failed) > 0 {
+			// every connection failed this stream, back off and start over
+			if backoff > 0 {
+				timer := time.NewTimer(backoff)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return nil, ctx.Err()
+				}
+				backoff *= 2
+			}
+			failed = map[*Connection]bool{}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		stream, err := conn.CreateStream(headers, nil, fin)
+		if err == nil {
+			if err = waitStreamReply(ctx, stream); err == nil {
+				return stream, nil
+			}
+		}
+		if err != ErrGoAway && !(err == ErrReset && stream.resetStatus == spdy.RefusedStream) {
+			return nil, err
+		}
+		debugMessage("(%p) Stream creation on %p failed, retrying: %s", p, conn, err)
+		failed[conn] = true
+		errs = append(errs, err)
+	}
+	return nil, &RetryError{Errors: errs}
+}
+
+// waitStreamReply waits until stream is replied to or reset.  A stream
+// closed without either because the remote went away yields ErrGoAway.
+func waitStreamReply(ctx context.Context, stream *Stream) error {
+	select {
+	case err := <-stream.startChan:
+		return err
+	case <-stream.closeChan:
+		select {
+		case err := <-stream.startChan:
+			return err
+		default:
+		}
+		stream.conn.receiveIdLock.Lock()
+		remoteGoneAway := stream.conn.remoteGoneAway
+		stream.conn.receiveIdLock.Unlock()
+		if remoteGoneAway {
+			return ErrGoAway
+		}
+		return ErrReset
+	case <-ctx.Done():
+		stream.Reset()
+		return ctx.Err()
+	}
+}
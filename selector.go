@@ -0,0 +1,159 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// Selector waits for data across many streams from a single goroutine,
+// for applications aggregating streams mostly idle that would otherwise
+// run one reading goroutine per stream.  The streams added to a selector
+// are to be read only through Select.
+type Selector struct {
+	lock    sync.Mutex
+	streams []*Stream
+	// closed and replaced when the streams change, waking Select
+	changed chan struct{}
+}
+
+// NewSelector returns a selector without streams.
+func NewSelector() *Selector {
+	return &Selector{changed: make(chan struct{})}
+}
+
+// Add adds stream to the streams waited for by Select.
+func (s *Selector) Add(stream *Stream) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, added := range s.streams {
+		if added == stream {
+			return
+		}
+	}
+	s.streams = append(s.streams, stream)
+	s.signal()
+}
+
+// Remove removes stream from the streams waited for by Select.
+func (s *Selector) Remove(stream *Stream) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.remove(stream)
+}
+
+// Len returns the number of streams waited for by Select.
+func (s *Selector) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.streams)
+}
+
+// remove removes stream with the lock held.
+func (s *Selector) remove(stream *Stream) {
+	for i, added := range s.streams {
+		if added == stream {
+			s.streams = append(s.streams[:i], s.streams[i+1:]...)
+			s.signal()
+			return
+		}
+	}
+}
+
+// signal wakes a pending Select, with the lock held.
+func (s *Selector) signal() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Select waits for a data frame on any of the streams, returning the
+// stream and the data of the frame; data left unread by a previous Read
+// of the stream is returned first.  Streams paused with PauseReading are
+// skipped until resumed.  When the remote side of a stream is closed,
+// the stream is removed from the selector and returned with a nil frame
+// and the error Read would return, io.EOF once the remote finished.
+// Streams added or removed while Select is pending are taken into
+// account.  When ctx is done first, its error is returned with a nil
+// stream.
+//
+// Each stream takes two cases of a reflect.Select, so a selector is
+// limited to about 32000 streams.
+func (s *Selector) Select(ctx context.Context) (*Stream, []byte, error) {
+	for {
+		s.lock.Lock()
+		streams := append([]*Stream(nil), s.streams...)
+		changed := s.changed
+		s.lock.Unlock()
+
+		// each stream has a case receiving its data, or waiting for it
+		// to be resumed when paused, followed by a case waiting for it
+		// to be closed
+		cases := make([]reflect.SelectCase, 2, 2+2*len(streams))
+		cases[0] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}
+		cases[1] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(changed)}
+		paused := make([]bool, len(streams))
+		for i, stream := range streams {
+			if stream.unread != nil {
+				data := stream.unread
+				stream.unread = nil
+				atomic.StoreInt32(&stream.unreadBytes, 0)
+				return stream, data, nil
+			}
+			resumeChan := stream.pauseChan()
+			if resumeChan != nil {
+				paused[i] = true
+				cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(resumeChan)})
+			} else {
+				cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(stream.dataChan)})
+			}
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(stream.closeChan)})
+		}
+
+		chosen, value, ok := reflect.Select(cases)
+		switch {
+		case chosen == 0:
+			return nil, nil, ctx.Err()
+		case chosen == 1:
+			continue
+		}
+		i := (chosen - 2) / 2
+		stream := streams[i]
+		if (chosen-2)%2 == 1 {
+			if !paused[i] {
+				if data, ok := stream.takeQueued(stream.dataChan); ok {
+					return stream, data, nil
+				}
+			}
+			s.Remove(stream)
+			return stream, nil, stream.readClosedError()
+		}
+		if !paused[i] {
+			if !ok {
+				s.Remove(stream)
+				return stream, nil, io.EOF
+			}
+			data := value.Bytes()
+			stream.received(data)
+			return stream, data, nil
+		}
+		// a paused stream was resumed
+	}
+}
@@ -0,0 +1,118 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSelector(t *testing.T) {
+	selector := NewSelector()
+	handler := func(stream *Stream) {
+		stream.SendReply(http.Header{}, false)
+		selector.Add(stream)
+	}
+	client, server := newTestConnections(t, nil, handler)
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	streamCount := 50
+	streams := make([]*Stream, streamCount)
+	for i := range streams {
+		stream, err := client.CreateStream(http.Header{}, nil, false)
+		if err != nil {
+			t.Fatalf("Error creating stream: %v", err)
+		}
+		if err := stream.Wait(); err != nil {
+			t.Fatalf("Error waiting for reply: %v", err)
+		}
+		streams[i] = stream
+	}
+	for selector.Len() < streamCount {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Writes are done from their own goroutine, the frame worker
+	// waiting for the data to be selected
+	for _, i := range []int{3, 17, 42} {
+		go streams[i].Write([]byte(fmt.Sprintf("stream %d", i)))
+	}
+	received := map[uint32]string{}
+	for len(received) < 3 {
+		stream, data, err := selector.Select(ctx)
+		if err != nil {
+			t.Fatalf("Error selecting: %v", err)
+		}
+		received[stream.Identifier()] = string(data)
+	}
+	for _, i := range []int{3, 17, 42} {
+		expected := fmt.Sprintf("stream %d", i)
+		if actual := received[streams[i].Identifier()]; actual != expected {
+			t.Fatalf("Unexpected data:\nActual: %q\nExpected: %q", actual, expected)
+		}
+	}
+
+	streams[7].Close()
+	stream, data, err := selector.Select(ctx)
+	if err != io.EOF {
+		t.Fatalf("Unexpected select error:\nActual: %v\nExpected: %v", err, io.EOF)
+	}
+	if stream.Identifier() != streams[7].Identifier() || data != nil {
+		t.Fatalf("Unexpected closed stream %d with data %q", stream.Identifier(), data)
+	}
+	if selector.Len() != streamCount-1 {
+		t.Fatalf("Unexpected selector length:\nActual: %d\nExpected: %d", selector.Len(), streamCount-1)
+	}
+
+	// A stream added during Select is waited for
+	added, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	go func() {
+		added.Wait()
+		added.Write([]byte("added"))
+	}()
+	stream, data, err = selector.Select(ctx)
+	if err != nil {
+		t.Fatalf("Error selecting: %v", err)
+	}
+	if stream.Identifier() != added.Identifier() || string(data) != "added" {
+		t.Fatalf("Unexpected selected data:\nActual: %d %q\nExpected: %d %q", stream.Identifier(), data, added.Identifier(), "added")
+	}
+}
+
+func TestSelectorCancel(t *testing.T) {
+	selector := NewSelector()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	stream, data, err := selector.Select(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Unexpected select error:\nActual: %v\nExpected: %v", err, context.DeadlineExceeded)
+	}
+	if stream != nil || data != nil {
+		t.Fatalf("Unexpected selected stream %v with data %q", stream, data)
+	}
+}
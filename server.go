@@ -0,0 +1,242 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrServerClosed = errors.New("spdy server closed")
+)
+
+// Server accepts network connections and serves spdy connections on
+// them.  The zero value serves plain connections with NoOpStreamHandler.
+type Server struct {
+	// Handler is the handler for streams opened by the remote peers.
+	// If Handler is nil, NoOpStreamHandler is used.
+	Handler StreamHandler
+
+	// TLSConfig, if set, is used to run a TLS handshake on every
+	// accepted connection before it is passed to AcceptConn.
+	TLSConfig *tls.Config
+
+	// HandshakeTimeout bounds reading the PROXY protocol header and the
+	// TLS handshake.  Zero means no timeout.
+	HandshakeTimeout time.Duration
+
+	// ProxyProtocol requires a PROXY protocol version 1 or 2 header,
+	// sent by a load balancer ahead of the TLS handshake, on every
+	// accepted connection.  The addresses in the header are reported as
+	// the addresses of the connection; connections without a valid
+	// header are closed.  Only enable it behind load balancers sending
+	// the header, as clients could otherwise claim any address.
+	ProxyProtocol bool
+
+	// AcceptConn, if set, is called with the remote address and, for TLS
+	// connections, the TLS state before the spdy connection is set up.
+	// Returning an error closes the network connection without
+	// starting a session.
+	AcceptConn func(remoteAddr net.Addr, state *tls.ConnectionState) error
+
+	// ConfigureConn, if set, is called with every new connection before
+	// it starts serving streams, to apply connection options.
+	ConfigureConn func(conn *Connection)
+
+	lock      sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*Connection]struct{}
+	closed    bool
+}
+
+// ListenAndServe listens on the TCP network address addr, or on the Unix
+// domain socket path for addresses of the form unix:///path, and calls
+// Serve.
+func (srv *Server) ListenAndServe(addr string) error {
+	network, address := splitAddr(addr)
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(l)
+}
+
+// Serve accepts connections on l, serving each in its own goroutine.
+// It returns when accepting fails, closing l, and returns
+// ErrServerClosed after Close was called.
+func (srv *Server) Serve(l net.Listener) error {
+	if !srv.trackListener(l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer srv.trackListener(l, false)
+	defer l.Close()
+
+	var tempDelay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// back off as net/http does on temporary errors
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+				debugMessage("(%p) Accept error: %s, retrying in %s", srv, err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+		go srv.serveConn(conn)
+	}
+}
+
+func (srv *Server) serveConn(conn net.Conn) {
+	if srv.ProxyProtocol {
+		if srv.HandshakeTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(srv.HandshakeTimeout))
+		}
+		proxied, err := readProxyHeader(conn)
+		if err != nil {
+			debugMessage("(%p) PROXY protocol error from %s: %s", srv, conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		conn = proxied
+	}
+
+	var state *tls.ConnectionState
+	if srv.TLSConfig != nil {
+		tlsConn := tls.Server(conn, srv.TLSConfig)
+		if srv.HandshakeTimeout > 0 {
+			tlsConn.SetDeadline(time.Now().Add(srv.HandshakeTimeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			debugMessage("(%p) TLS handshake error from %s: %s", srv, conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		tlsState := tlsConn.ConnectionState()
+		state = &tlsState
+		conn = tlsConn
+	}
+
+	if srv.AcceptConn != nil {
+		if err := srv.AcceptConn(conn.RemoteAddr(), state); err != nil {
+			debugMessage("(%p) Rejected connection from %s: %s", srv, conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+
+	spdyConn, err := NewConnection(conn, true)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if srv.ConfigureConn != nil {
+		srv.ConfigureConn(spdyConn)
+	}
+	if !srv.trackConn(spdyConn, true) {
+		conn.Close()
+		return
+	}
+	defer srv.trackConn(spdyConn, false)
+
+	handler := srv.Handler
+	if handler == nil {
+		handler = NoOpStreamHandler
+	}
+	spdyConn.Serve(handler)
+}
+
+// Close stops all listeners and closes all connections served by srv.
+func (srv *Server) Close() error {
+	srv.lock.Lock()
+	srv.closed = true
+	var err error
+	for l := range srv.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	conns := make([]*Connection, 0, len(srv.conns))
+	for conn := range srv.conns {
+		conns = append(conns, conn)
+	}
+	srv.lock.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return err
+}
+
+func (srv *Server) isClosed() bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return srv.closed
+}
+
+func (srv *Server) trackListener(l net.Listener, add bool) bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if add {
+		if srv.closed {
+			return false
+		}
+		if srv.listeners == nil {
+			srv.listeners = make(map[net.Listener]struct{})
+		}
+		srv.listeners[l] = struct{}{}
+	} else {
+		delete(srv.listeners, l)
+	}
+	return true
+}
+
+func (srv *Server) trackConn(conn *Connection, add bool) bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if add {
+		if srv.closed {
+			return false
+		}
+		if srv.conns == nil {
+			srv.conns = make(map[*Connection]struct{})
+		}
+		srv.conns[conn] = struct{}{}
+	} else {
+		delete(srv.conns, conn)
+	}
+	return true
+}
@@ -0,0 +1,240 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testServerEcho(t *testing.T, conn net.Conn) {
+	spdyConn, err := NewConnection(conn, false)
+	if err != nil {
+		t.Fatalf("Error creating spdy connection: %s", err)
+	}
+	defer spdyConn.Close()
+	go spdyConn.Serve(NoOpStreamHandler)
+
+	stream, err := spdyConn.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatalf("Error writing to stream: %s", err)
+	}
+	data, err := stream.ReadData()
+	if err != nil {
+		t.Fatalf("Error reading from stream: %s", err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Unexpected data:\nActual: %q\nExpected: %q", data, "hello")
+	}
+	stream.Close()
+}
+
+func TestServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	configured := make(chan *Connection, 1)
+	srv := &Server{
+		Handler: MirrorStreamHandler,
+		ConfigureConn: func(conn *Connection) {
+			configured <- conn
+		},
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(listener)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	testServerEcho(t, conn)
+	serverConn := <-configured
+
+	if err := srv.Close(); err != nil {
+		t.Fatalf("Error closing server: %s", err)
+	}
+	select {
+	case err := <-served:
+		if err != ErrServerClosed {
+			t.Fatalf("Unexpected serve error:\nActual: %v\nExpected: %v", err, ErrServerClosed)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for Serve to return")
+	}
+	select {
+	case <-serverConn.CloseChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for server connection to close")
+	}
+	if err := srv.Serve(listener); err != ErrServerClosed {
+		t.Fatalf("Unexpected serve error after close:\nActual: %v\nExpected: %v", err, ErrServerClosed)
+	}
+}
+
+func TestServerAcceptConn(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	srv := &Server{
+		Handler: MirrorStreamHandler,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{newTestCertificate(t, "server")},
+			ClientAuth:   tls.RequireAnyClientCert,
+		},
+		HandshakeTimeout: 10 * time.Second,
+		AcceptConn: func(remoteAddr net.Addr, state *tls.ConnectionState) error {
+			if state == nil || len(state.PeerCertificates) == 0 {
+				return errors.New("missing client certificate")
+			}
+			if state.PeerCertificates[0].Subject.CommonName != "trusted" {
+				return errors.New("untrusted client")
+			}
+			return nil
+		},
+	}
+	defer srv.Close()
+	go srv.Serve(listener)
+
+	dial := func(clientName string) net.Conn {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			Certificates:       []tls.Certificate{newTestCertificate(t, clientName)},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Fatalf("Error dialing server: %s", err)
+		}
+		return conn
+	}
+
+	testServerEcho(t, dial("trusted"))
+
+	spdyConn, err := NewConnection(dial("untrusted"), false)
+	if err != nil {
+		t.Fatalf("Error creating spdy connection: %s", err)
+	}
+	go spdyConn.Serve(NoOpStreamHandler)
+	select {
+	case <-spdyConn.CloseChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for rejected connection to close")
+	}
+}
+
+func TestServerProxyProtocol(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	remoteAddrs := make(chan string, 3)
+	srv := &Server{
+		Handler:          MirrorStreamHandler,
+		HandshakeTimeout: 10 * time.Second,
+		ProxyProtocol:    true,
+		AcceptConn: func(remoteAddr net.Addr, state *tls.ConnectionState) error {
+			remoteAddrs <- remoteAddr.String()
+			return nil
+		},
+	}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	v2 := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x21, 0x00, 0x24)
+	v2 = append(v2, net.ParseIP("2001:db8::1")...)
+	v2 = append(v2, net.ParseIP("2001:db8::2")...)
+	v2 = append(v2, 0x1f, 0x90, 0x01, 0xbb)
+	for _, test := range []struct {
+		header   []byte
+		expected string
+	}{
+		{[]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"), "192.0.2.1:56324"},
+		{v2, "[2001:db8::1]:8080"},
+	} {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Error dialing server: %s", err)
+		}
+		if _, err := conn.Write(test.header); err != nil {
+			t.Fatalf("Error writing PROXY header: %s", err)
+		}
+		testServerEcho(t, conn)
+		if addr := <-remoteAddrs; addr != test.expected {
+			t.Fatalf("Unexpected remote address:\nActual: %s\nExpected: %s", addr, test.expected)
+		}
+	}
+
+	// connections without a header are closed
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Unexpected read error:\nActual: %v\nExpected: %v", err, io.EOF)
+	}
+}
+
+func TestServerListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spdystream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spdy.sock")
+
+	srv := &Server{Handler: MirrorStreamHandler}
+	defer srv.Close()
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServe("unix://" + path)
+	}()
+
+	var conn net.Conn
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		}
+		select {
+		case err := <-served:
+			t.Skipf("Unix domain sockets unsupported: %s", err)
+		default:
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("Error dialing server: %s", err)
+		}
+	}
+	testServerEcho(t, conn)
+}
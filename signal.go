@@ -0,0 +1,105 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+// StreamTypeSignal flags the header only streams sent by SendSignal.
+const StreamTypeSignal = "signal"
+
+var (
+	ErrSignalRefused = errors.New("signal refused")
+)
+
+// SignalHandler handles a signal received from the remote, returning the
+// headers of the reply.
+type SignalHandler func(headers http.Header) http.Header
+
+// OnSignal sets the handler of the signals sent by the remote with
+// SendSignal.  The handler is called from the frame worker of the
+// stream, so it must not block.  Signals are refused while no handler is
+// set.  Must be called before Serve.
+func (s *Connection) OnSignal(handler SignalHandler) {
+	s.signalHandler = handler
+}
+
+// SendSignal sends headers to the remote on a header only stream, a
+// finished stream answered by a finished reply, and returns the headers
+// of the reply.  Signals are a lightweight request and response without
+// data: neither side allocates data channels for them, and the stream is
+// done once the reply is received.  ErrSignalRefused is returned if the
+// remote has no signal handler or refused the stream.  When ctx is done
+// before the reply the stream is reset.
+func (s *Connection) SendSignal(ctx context.Context, headers http.Header) (http.Header, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	signalHeaders := make(http.Header, len(headers)+1)
+	for name, values := range headers {
+		signalHeaders[name] = values
+	}
+	signalHeaders.Set(StreamTypeHeader, StreamTypeSignal)
+	stream, err := s.CreateStream(signalHeaders, nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	replied := make(chan error, 1)
+	s.Go(func() {
+		replied <- stream.Wait()
+	})
+	select {
+	case err := <-replied:
+		if err == ErrReset && stream.resetStatus == spdy.RefusedStream {
+			return nil, ErrSignalRefused
+		} else if err != nil {
+			return nil, err
+		}
+		return stream.ReplyHeaders(), nil
+	case <-ctx.Done():
+		stream.Reset()
+		return nil, ctx.Err()
+	}
+}
+
+// isSignalStream returns whether stream is a signal sent by the remote.
+func isSignalStream(stream *Stream) bool {
+	return stream.dataChan == nil && stream.headers.Get(StreamTypeHeader) == StreamTypeSignal
+}
+
+// handleSignal replies to a signal with the headers returned by the
+// signal handler.
+func (s *Connection) handleSignal(stream *Stream) error {
+	if s.signalHandler == nil {
+		debugMessage("(%p) Signal %d refused without handler", s, stream.streamId)
+		return stream.Refuse()
+	}
+	reply := s.signalHandler(stream.Headers())
+	if reply == nil {
+		reply = http.Header{}
+	}
+	// the signal is finished by the remote, so it is done once replied
+	err := stream.ReplyAndClose(reply)
+	s.removeStream(stream)
+	return err
+}
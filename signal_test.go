@@ -0,0 +1,92 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSignal(t *testing.T) {
+	received := make(chan http.Header, 1)
+	configure := func(conn *Connection) {
+		conn.OnSignal(func(headers http.Header) http.Header {
+			received <- headers
+			reply := http.Header{}
+			reply.Set("Signal-Ack", headers.Get("Signal-Name"))
+			return reply
+		})
+	}
+	client, server := newTestConnections(t, configure, func(stream *Stream) {
+		t.Errorf("Unexpected stream passed to the handler: %v", stream.Headers())
+		stream.Refuse()
+	})
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	headers := http.Header{}
+	headers.Set("Signal-Name", "reload")
+	reply, err := client.SendSignal(ctx, headers)
+	if err != nil {
+		t.Fatalf("Error sending signal: %v", err)
+	}
+	if ack := reply.Get("Signal-Ack"); ack != "reload" {
+		t.Fatalf("Unexpected reply:\nActual: %q\nExpected: %q", ack, "reload")
+	}
+	if name := (<-received).Get("Signal-Name"); name != "reload" {
+		t.Fatalf("Unexpected signal:\nActual: %q\nExpected: %q", name, "reload")
+	}
+
+	// Signals leave no streams behind on either side
+	for i := 0; i < 100 && (client.NumActiveStreams() > 0 || server.NumActiveStreams() > 0); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if client.NumActiveStreams() != 0 || server.NumActiveStreams() != 0 {
+		t.Fatalf("Unexpected active streams: client %d, server %d", client.NumActiveStreams(), server.NumActiveStreams())
+	}
+
+	// Signals are refused without a handler
+	_, err = server.SendSignal(ctx, headers)
+	if err != ErrSignalRefused {
+		t.Fatalf("Unexpected error:\nActual: %v\nExpected: %v", err, ErrSignalRefused)
+	}
+}
+
+func TestHeaderOnlyStreamReply(t *testing.T) {
+	replied := make(chan error, 1)
+	client, server := newTestConnections(t, nil, func(stream *Stream) {
+		replied <- stream.SendReply(http.Header{}, true)
+	})
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.CreateStream(http.Header{}, nil, true)
+	if err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	if err := <-replied; err != nil {
+		t.Fatalf("Error replying to header only stream: %v", err)
+	}
+	if err := stream.WaitTimeout(5 * time.Second); err != nil {
+		t.Fatalf("Error waiting for reply: %v", err)
+	}
+}
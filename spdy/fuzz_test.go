@@ -0,0 +1,98 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// fuzzSeedFrames returns one encoded frame of every type, written with a
+// shared compression context.
+func fuzzSeedFrames(f *testing.F) [][]byte {
+	frames := []Frame{
+		&SynStreamFrame{StreamId: 1, Priority: 3, Headers: HeadersFixture},
+		&SynReplyFrame{StreamId: 1, Headers: HeadersFixture},
+		&RstStreamFrame{StreamId: 1, Status: Cancel},
+		&SettingsFrame{FlagIdValues: []SettingsFlagIdValue{{FlagSettingsPersistValue, SettingsMaxConcurrentStreams, 100}}},
+		&PingFrame{Id: 1},
+		&GoAwayFrame{LastGoodStreamId: 1, Status: GoAwayOK},
+		&HeadersFrame{StreamId: 1, Headers: http.Header{"Name": {"value"}}},
+		&WindowUpdateFrame{StreamId: 1, DeltaWindowSize: 1024},
+		&DataFrame{StreamId: 1, Flags: DataFlagFin, Data: []byte("data")},
+		&UnknownControlFrame{Type: 0xf0, Data: []byte("ext")},
+	}
+	buffer := new(bytes.Buffer)
+	framer, err := NewFramer(buffer, buffer)
+	if err != nil {
+		f.Fatal("Failed to create new framer:", err)
+	}
+	var seeds [][]byte
+	for _, frame := range frames {
+		if err := framer.WriteFrame(frame); err != nil {
+			f.Fatal("WriteFrame:", err)
+		}
+		seeds = append(seeds, append([]byte(nil), buffer.Bytes()...))
+		buffer.Reset()
+	}
+	return seeds
+}
+
+func FuzzParseFrame(f *testing.F) {
+	for _, seed := range fuzzSeedFrames(f) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frame, err := ParseFrame(data)
+		if err != nil {
+			return
+		}
+		// anything parsed must be writable again
+		framer, err := NewFramer(ioutil.Discard, nil)
+		if err != nil {
+			t.Fatal("Failed to create new framer:", err)
+		}
+		if err := framer.WriteFrame(frame); err != nil {
+			t.Fatalf("Error writing parsed frame %#v: %s", frame, err)
+		}
+	})
+}
+
+func FuzzReadFrames(f *testing.F) {
+	seeds := fuzzSeedFrames(f)
+	f.Add(bytes.Join(seeds, nil))
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		framer, err := NewFramer(ioutil.Discard, bytes.NewReader(data))
+		if err != nil {
+			t.Fatal("Failed to create new framer:", err)
+		}
+		framer.SetHeaderBlockLimits(1<<16, 0)
+		for {
+			if _, err := framer.ReadFrame(); err != nil {
+				return
+			}
+		}
+	})
+}
@@ -21,9 +21,11 @@
 package spdy
 
 import (
+	"bytes"
 	"compress/zlib"
 	"encoding/binary"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
 )
@@ -59,6 +61,9 @@ func (frame *SettingsFrame) read(h ControlFrameHeader, f *Framer) error {
 	if err := binary.Read(f.r, binary.BigEndian, &numSettings); err != nil {
 		return err
 	}
+	if h.length < 4 || uint64(numSettings)*8 > uint64(h.length-4) {
+		return &Error{InvalidControlFrame, 0}
+	}
 	frame.FlagIdValues = make([]SettingsFlagIdValue, numSettings)
 	for i := uint32(0); i < numSettings; i++ {
 		if err := binary.Read(f.r, binary.BigEndian, &frame.FlagIdValues[i].Id); err != nil {
@@ -125,6 +130,16 @@ func (frame *WindowUpdateFrame) read(h ControlFrameHeader, f *Framer) error {
 	return nil
 }
 
+func (frame *UnknownControlFrame) read(h ControlFrameHeader, f *Framer) error {
+	frame.CFHeader = h
+	frame.Type = h.frameType
+	frame.Data = make([]byte, h.length)
+	if _, err := io.ReadFull(f.r, frame.Data); err != nil {
+		return err
+	}
+	return nil
+}
+
 func newControlFrame(frameType ControlFrameType) (controlFrame, error) {
 	ctor, ok := cframeCtor[frameType]
 	if !ok {
@@ -158,6 +173,17 @@ func (f *Framer) uncorkHeaderDecompressor(payloadSize int64) error {
 	return nil
 }
 
+// ParseFrame parses the first frame in data using a fresh header
+// decompression context, as for the first frame read on a connection.
+// Bytes following the frame are ignored.
+func ParseFrame(data []byte) (Frame, error) {
+	framer, err := NewFramer(ioutil.Discard, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return framer.ReadFrame()
+}
+
 // ReadFrame reads SPDY encoded data and returns a decompressed Frame.
 func (f *Framer) ReadFrame() (Frame, error) {
 	var firstWord uint32
@@ -179,10 +205,15 @@ func (f *Framer) parseControlFrame(version uint16, frameType ControlFrameType) (
 	}
 	flags := ControlFlags((length & 0xff000000) >> 24)
 	length &= 0xffffff
+	if f.maxFrameSize != 0 && length > f.maxFrameSize {
+		return nil, &Error{FrameLengthExceeded, 0}
+	}
 	header := ControlFrameHeader{version, frameType, flags, length}
 	cframe, err := newControlFrame(frameType)
 	if err != nil {
-		return nil, err
+		// Frames of unknown types are read in full, leaving it to the
+		// caller to decide whether to ignore them.
+		cframe = new(UnknownControlFrame)
 	}
 	if err = cframe.read(header, f); err != nil {
 		return nil, err
@@ -190,20 +221,128 @@ func (f *Framer) parseControlFrame(version uint16, frameType ControlFrameType) (
 	return cframe, nil
 }
 
+// readHeaderBlock reads and decompresses the header block of length bytes
+// following the fixed fields of a frame, enforcing the header block limits.
+func (f *Framer) readHeaderBlock(length int64, streamId StreamId) (http.Header, error) {
+	var reader io.Reader = f.r
+	if !f.headerCompressionDisabled {
+		if err := f.uncorkHeaderDecompressor(length); err != nil {
+			return nil, err
+		}
+		reader = f.headerDecompressor
+	}
+	block := &headerBlockReader{r: reader, n: f.headerBlockLimit(length), streamId: streamId}
+	headers, err := parseHeaderValueBlock(block, streamId)
+	f.headerStats.CompressedBytes += uint64(length)
+	f.headerStats.DecompressedBytes += uint64(block.read)
+	if e, ok := err.(*Error); ok && e.Err == HeaderBlockTooLarge {
+		f.headerStats.RejectedBlocks++
+		return nil, err
+	}
+	if !f.headerCompressionDisabled && (err == io.EOF && f.headerReader.N == 0 || f.headerReader.N != 0) {
+		err = &Error{WrongCompressedPayloadSize, 0}
+	}
+	return headers, err
+}
+
+// headerBlockLimit returns the number of bytes a header block of length
+// bytes may decompress to, or -1 if it is unbounded.
+func (f *Framer) headerBlockLimit(length int64) int64 {
+	limit := int64(-1)
+	if f.maxHeaderBlockSize > 0 {
+		limit = f.maxHeaderBlockSize
+	}
+	if f.maxHeaderBlockRatio > 0 {
+		if ratioLimit := length * f.maxHeaderBlockRatio; limit < 0 || ratioLimit < limit {
+			limit = ratioLimit
+		}
+	}
+	return limit
+}
+
+// headerBlockReader counts the bytes read from a header block, failing
+// with HeaderBlockTooLarge once more than n bytes are read.
+type headerBlockReader struct {
+	r        io.Reader
+	n        int64 // remaining bytes, negative if unbounded
+	read     int64
+	streamId StreamId
+}
+
+func (r *headerBlockReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, &Error{HeaderBlockTooLarge, r.streamId}
+	}
+	if r.n > 0 && int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	if r.n > 0 {
+		r.n -= int64(n)
+	}
+	return n, err
+}
+
+// checkHeaderLength fails when a header block read through r is limited to
+// fewer than length more bytes, before length bytes are allocated.
+func checkHeaderLength(r io.Reader, length uint64, streamId StreamId) error {
+	if block, ok := r.(*headerBlockReader); ok && block.n >= 0 && length > uint64(block.n) {
+		return &Error{HeaderBlockTooLarge, streamId}
+	}
+	return nil
+}
+
+// maxHeaderCountHint bounds the map size preallocated for a header block.
+const maxHeaderCountHint = 64
+
+// readHeaderBytes reads a name or value of the given length.  Large lengths
+// are read incrementally so a bogus length fails with an unexpected EOF
+// instead of allocating the declared length up front.
+func readHeaderBytes(r io.Reader, length uint32) ([]byte, error) {
+	if length <= 4096 {
+		b := make([]byte, length)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func parseHeaderValueBlock(r io.Reader, streamId StreamId) (http.Header, error) {
 	var numHeaders uint32
 	if err := binary.Read(r, binary.BigEndian, &numHeaders); err != nil {
 		return nil, err
 	}
+	// every header takes at least 8 bytes for its name and value lengths
+	if err := checkHeaderLength(r, uint64(numHeaders)*8, streamId); err != nil {
+		return nil, err
+	}
+	// numHeaders is only a hint, it is not known how much data follows
+	hint := int(numHeaders)
+	if hint > maxHeaderCountHint {
+		hint = maxHeaderCountHint
+	}
 	var e error
-	h := make(http.Header, int(numHeaders))
+	h := make(http.Header, hint)
 	for i := 0; i < int(numHeaders); i++ {
 		var length uint32
 		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
 			return nil, err
 		}
-		nameBytes := make([]byte, length)
-		if _, err := io.ReadFull(r, nameBytes); err != nil {
+		if err := checkHeaderLength(r, uint64(length), streamId); err != nil {
+			return nil, err
+		}
+		nameBytes, err := readHeaderBytes(r, length)
+		if err != nil {
 			return nil, err
 		}
 		name := string(nameBytes)
@@ -217,8 +356,11 @@ func parseHeaderValueBlock(r io.Reader, streamId StreamId) (http.Header, error)
 		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
 			return nil, err
 		}
-		value := make([]byte, length)
-		if _, err := io.ReadFull(r, value); err != nil {
+		if err := checkHeaderLength(r, uint64(length), streamId); err != nil {
+			return nil, err
+		}
+		value, err := readHeaderBytes(r, length)
+		if err != nil {
 			return nil, err
 		}
 		valueList := strings.Split(string(value), headerValueSeparator)
@@ -248,18 +390,7 @@ func (f *Framer) readSynStreamFrame(h ControlFrameHeader, frame *SynStreamFrame)
 	if err = binary.Read(f.r, binary.BigEndian, &frame.Slot); err != nil {
 		return err
 	}
-	reader := f.r
-	if !f.headerCompressionDisabled {
-		err := f.uncorkHeaderDecompressor(int64(h.length - 10))
-		if err != nil {
-			return err
-		}
-		reader = f.headerDecompressor
-	}
-	frame.Headers, err = parseHeaderValueBlock(reader, frame.StreamId)
-	if !f.headerCompressionDisabled && (err == io.EOF && f.headerReader.N == 0 || f.headerReader.N != 0) {
-		err = &Error{WrongCompressedPayloadSize, 0}
-	}
+	frame.Headers, err = f.readHeaderBlock(int64(h.length-10), frame.StreamId)
 	if err != nil {
 		return err
 	}
@@ -280,18 +411,7 @@ func (f *Framer) readSynReplyFrame(h ControlFrameHeader, frame *SynReplyFrame) e
 	if err = binary.Read(f.r, binary.BigEndian, &frame.StreamId); err != nil {
 		return err
 	}
-	reader := f.r
-	if !f.headerCompressionDisabled {
-		err := f.uncorkHeaderDecompressor(int64(h.length - 4))
-		if err != nil {
-			return err
-		}
-		reader = f.headerDecompressor
-	}
-	frame.Headers, err = parseHeaderValueBlock(reader, frame.StreamId)
-	if !f.headerCompressionDisabled && (err == io.EOF && f.headerReader.N == 0 || f.headerReader.N != 0) {
-		err = &Error{WrongCompressedPayloadSize, 0}
-	}
+	frame.Headers, err = f.readHeaderBlock(int64(h.length-4), frame.StreamId)
 	if err != nil {
 		return err
 	}
@@ -312,18 +432,7 @@ func (f *Framer) readHeadersFrame(h ControlFrameHeader, frame *HeadersFrame) err
 	if err = binary.Read(f.r, binary.BigEndian, &frame.StreamId); err != nil {
 		return err
 	}
-	reader := f.r
-	if !f.headerCompressionDisabled {
-		err := f.uncorkHeaderDecompressor(int64(h.length - 4))
-		if err != nil {
-			return err
-		}
-		reader = f.headerDecompressor
-	}
-	frame.Headers, err = parseHeaderValueBlock(reader, frame.StreamId)
-	if !f.headerCompressionDisabled && (err == io.EOF && f.headerReader.N == 0 || f.headerReader.N != 0) {
-		err = &Error{WrongCompressedPayloadSize, 0}
-	}
+	frame.Headers, err = f.readHeaderBlock(int64(h.length-4), frame.StreamId)
 	if err != nil {
 		return err
 	}
@@ -353,6 +462,9 @@ func (f *Framer) parseDataFrame(streamId StreamId) (*DataFrame, error) {
 	frame.StreamId = streamId
 	frame.Flags = DataFlags(length >> 24)
 	length &= 0xffffff
+	if f.maxFrameSize != 0 && length > f.maxFrameSize {
+		return nil, &Error{FrameLengthExceeded, streamId}
+	}
 	frame.Data = make([]byte, length)
 	if _, err := io.ReadFull(f.r, frame.Data); err != nil {
 		return nil, err
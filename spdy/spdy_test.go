@@ -28,6 +28,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -445,6 +446,163 @@ func TestCreateParseDataFrame(t *testing.T) {
 	}
 }
 
+func TestCreateParseUnknownControlFrame(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	framer, err := NewFramer(buffer, buffer)
+	if err != nil {
+		t.Fatal("Failed to create new framer:", err)
+	}
+	unknownFrame := UnknownControlFrame{
+		CFHeader: ControlFrameHeader{
+			Flags: 0x04,
+		},
+		Type: 0x00f0,
+		Data: []byte{'e', 'x', 't'},
+	}
+	if err := framer.WriteFrame(&unknownFrame); err != nil {
+		t.Fatal("WriteFrame:", err)
+	}
+	pingFrame := PingFrame{Id: 31337}
+	if err := framer.WriteFrame(&pingFrame); err != nil {
+		t.Fatal("WriteFrame:", err)
+	}
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatal("ReadFrame:", err)
+	}
+	parsedUnknownFrame, ok := frame.(*UnknownControlFrame)
+	if !ok {
+		t.Fatal("Parsed incorrect frame type:", frame)
+	}
+	if !reflect.DeepEqual(unknownFrame, *parsedUnknownFrame) {
+		t.Fatal("got: ", *parsedUnknownFrame, "\nwant: ", unknownFrame)
+	}
+	// the frame following the unknown frame is still parsed
+	frame, err = framer.ReadFrame()
+	if err != nil {
+		t.Fatal("ReadFrame:", err)
+	}
+	if _, ok := frame.(*PingFrame); !ok {
+		t.Fatal("Parsed incorrect frame type:", frame)
+	}
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	framer, err := NewFramer(buffer, buffer)
+	if err != nil {
+		t.Fatal("Failed to create new framer:", err)
+	}
+	framer.SetMaxFrameSize(4)
+	dataFrame := DataFrame{
+		StreamId: 1,
+		Data:     []byte{'h', 'e', 'l', 'l', 'o'},
+	}
+	if err := framer.WriteFrame(&dataFrame); err != nil {
+		t.Fatal("WriteFrame:", err)
+	}
+	_, err = framer.ReadFrame()
+	if spdyErr, ok := err.(*Error); !ok || spdyErr.Err != FrameLengthExceeded {
+		t.Fatal("Unexpected ReadFrame error:", err)
+	}
+
+	// declared lengths are checked before reading the payload
+	buffer.Reset()
+	buffer.Write([]byte{0x80, 0x03, 0x00, 0x04, 0x00, 0xff, 0xff, 0xff})
+	_, err = framer.ReadFrame()
+	if spdyErr, ok := err.(*Error); !ok || spdyErr.Err != FrameLengthExceeded {
+		t.Fatal("Unexpected ReadFrame error:", err)
+	}
+}
+
+func TestSettingsFrameCountExceedsLength(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	framer, err := NewFramer(buffer, buffer)
+	if err != nil {
+		t.Fatal("Failed to create new framer:", err)
+	}
+	// settings frame of length 4 claiming 2^32-1 entries
+	buffer.Write([]byte{0x80, 0x03, 0x00, 0x04, 0x00, 0x00, 0x00, 0x04, 0xff, 0xff, 0xff, 0xff})
+	_, err = framer.ReadFrame()
+	if spdyErr, ok := err.(*Error); !ok || spdyErr.Err != InvalidControlFrame {
+		t.Fatal("Unexpected ReadFrame error:", err)
+	}
+}
+
+func TestSentHeaderStats(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	framer, err := NewFramer(buffer, buffer)
+	if err != nil {
+		t.Fatal("Failed to create new framer:", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := framer.WriteFrame(&HeadersFrame{StreamId: 1, Headers: HeadersFixture}); err != nil {
+			t.Fatal("WriteFrame:", err)
+		}
+		if _, err := framer.ReadFrame(); err != nil {
+			t.Fatal("ReadFrame:", err)
+		}
+	}
+	sent, received := framer.SentHeaderStats(), framer.HeaderStats()
+	if sent != received {
+		t.Fatalf("Unexpected sent header stats:\nActual: %+v\nExpected: %+v", sent, received)
+	}
+}
+
+func TestHeaderBlockLimits(t *testing.T) {
+	headers := http.Header{
+		"Bomb": []string{strings.Repeat("a", 4096)},
+	}
+
+	buffer := new(bytes.Buffer)
+	framer, err := NewFramer(buffer, buffer)
+	if err != nil {
+		t.Fatal("Failed to create new framer:", err)
+	}
+	framer.SetHeaderBlockLimits(8192, 0)
+	if err := framer.WriteFrame(&HeadersFrame{StreamId: 1, Headers: headers}); err != nil {
+		t.Fatal("WriteFrame:", err)
+	}
+	if _, err := framer.ReadFrame(); err != nil {
+		t.Fatal("ReadFrame:", err)
+	}
+	stats := framer.HeaderStats()
+	if stats.DecompressedBytes <= 4096 || stats.CompressedBytes >= stats.DecompressedBytes {
+		t.Fatalf("Unexpected header stats: %+v", stats)
+	}
+
+	// the repeated value compresses well beyond a ratio of 10
+	framer, err = NewFramer(buffer, buffer)
+	if err != nil {
+		t.Fatal("Failed to create new framer:", err)
+	}
+	framer.SetHeaderBlockLimits(0, 10)
+	if err := framer.WriteFrame(&HeadersFrame{StreamId: 1, Headers: headers}); err != nil {
+		t.Fatal("WriteFrame:", err)
+	}
+	_, err = framer.ReadFrame()
+	if spdyErr, ok := err.(*Error); !ok || spdyErr.Err != HeaderBlockTooLarge {
+		t.Fatal("Unexpected ReadFrame error:", err)
+	}
+	if stats := framer.HeaderStats(); stats.RejectedBlocks != 1 {
+		t.Fatalf("Unexpected rejected blocks: %d", stats.RejectedBlocks)
+	}
+
+	buffer.Reset()
+	framer, err = NewFramer(buffer, buffer)
+	if err != nil {
+		t.Fatal("Failed to create new framer:", err)
+	}
+	framer.SetHeaderBlockLimits(1024, 0)
+	if err := framer.WriteFrame(&HeadersFrame{StreamId: 1, Headers: headers}); err != nil {
+		t.Fatal("WriteFrame:", err)
+	}
+	_, err = framer.ReadFrame()
+	if spdyErr, ok := err.(*Error); !ok || spdyErr.Err != HeaderBlockTooLarge {
+		t.Fatal("Unexpected ReadFrame error:", err)
+	}
+}
+
 func TestCompressionContextAcrossFrames(t *testing.T) {
 	buffer := new(bytes.Buffer)
 	framer, err := NewFramer(buffer, buffer)
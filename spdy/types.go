@@ -84,6 +84,12 @@ type ControlFrameHeader struct {
 	length    uint32 // length of data field
 }
 
+// Length returns the length of the data field of a control frame read or
+// written by a Framer.
+func (h ControlFrameHeader) Length() uint32 {
+	return h.length
+}
+
 type controlFrame interface {
 	Frame
 	read(h ControlFrameHeader, f *Framer) error
@@ -209,6 +215,15 @@ type WindowUpdateFrame struct {
 	DeltaWindowSize uint32 // additional number of bytes to existing window size
 }
 
+// UnknownControlFrame is the unpacked, in-memory representation of a
+// control frame of a type not implemented by this package.  Its payload
+// is read in full so that following frames can still be parsed.
+type UnknownControlFrame struct {
+	CFHeader ControlFrameHeader
+	Type     ControlFrameType
+	Data     []byte // raw payload of this frame
+}
+
 // TODO: Implement credential frame and related methods.
 
 // DataFrame is the unpacked, in-memory representation of a DATA frame.
@@ -231,6 +246,8 @@ const (
 	InvalidDataFrame           ErrorCode = "invalid data frame"
 	InvalidHeaderPresent       ErrorCode = "frame contained invalid header"
 	ZeroStreamId               ErrorCode = "stream id zero is disallowed"
+	FrameLengthExceeded        ErrorCode = "frame exceeds maximum size"
+	HeaderBlockTooLarge        ErrorCode = "decompressed header block exceeds limit"
 )
 
 // Error contains both the type of error and additional values. StreamId is 0
@@ -269,6 +286,18 @@ type Framer struct {
 	r                         io.Reader
 	headerReader              io.LimitedReader
 	headerDecompressor        io.ReadCloser
+	maxFrameSize              uint32
+	maxHeaderBlockSize        int64
+	maxHeaderBlockRatio       int64
+	headerStats               HeaderStats
+	sentHeaderStats           HeaderStats
+}
+
+// HeaderStats counts the header block bytes read or written by a Framer.
+type HeaderStats struct {
+	CompressedBytes   uint64 // header block bytes as sent on the wire
+	DecompressedBytes uint64 // header block bytes before compression
+	RejectedBlocks    uint64 // header blocks exceeding the limits
 }
 
 // NewFramer allocates a new Framer for a given SPDY connection, represented by
@@ -289,3 +318,35 @@ func NewFramer(w io.Writer, r io.Reader) (*Framer, error) {
 	}
 	return framer, nil
 }
+
+// SetHeaderBlockLimits bounds the size of a header block after
+// decompression, both absolutely by maxSize bytes and relative to the
+// received block size by maxRatio.  A header block exceeding either limit
+// is rejected with a HeaderBlockTooLarge error, after which the framer is
+// no longer usable as its decompression context is lost.  Zero disables
+// the respective limit, which is the default.
+func (f *Framer) SetHeaderBlockLimits(maxSize int64, maxRatio int) {
+	f.maxHeaderBlockSize = maxSize
+	f.maxHeaderBlockRatio = int64(maxRatio)
+}
+
+// HeaderStats returns the counters of the header blocks read by the
+// framer.  It must not be called concurrently with ReadFrame.
+func (f *Framer) HeaderStats() HeaderStats {
+	return f.headerStats
+}
+
+// SentHeaderStats returns the counters of the header blocks written by
+// the framer, RejectedBlocks is always zero.  It must not be called
+// concurrently with WriteFrame.
+func (f *Framer) SentHeaderStats() HeaderStats {
+	return f.sentHeaderStats
+}
+
+// SetMaxFrameSize limits the length of frames read by the framer.  Frames
+// declaring a longer length are rejected with a FrameLengthExceeded error before
+// their payload is read, after which the framer is no longer usable.  A
+// size of 0 restores the default of MaxDataLength.
+func (f *Framer) SetMaxFrameSize(size uint32) {
+	f.maxFrameSize = size
+}
@@ -145,6 +145,24 @@ func (frame *WindowUpdateFrame) write(f *Framer) (err error) {
 	return nil
 }
 
+func (frame *UnknownControlFrame) write(f *Framer) (err error) {
+	if len(frame.Data) > MaxDataLength {
+		return &Error{InvalidControlFrame, 0}
+	}
+	frame.CFHeader.version = Version
+	frame.CFHeader.frameType = frame.Type
+	frame.CFHeader.length = uint32(len(frame.Data))
+
+	// Serialize frame to Writer.
+	if err = writeControlFrameHeader(f.w, frame.CFHeader); err != nil {
+		return
+	}
+	if _, err = f.w.Write(frame.Data); err != nil {
+		return
+	}
+	return nil
+}
+
 func (frame *DataFrame) write(f *Framer) error {
 	return f.writeDataFrame(frame)
 }
@@ -168,17 +186,36 @@ func writeControlFrameHeader(w io.Writer, h ControlFrameHeader) error {
 	return nil
 }
 
+// marshalHeaderBlock writes the header block for h, compressed unless
+// compression is disabled, to the header buffer.
+func (f *Framer) marshalHeaderBlock(h http.Header) error {
+	var writer io.Writer = f.headerBuf
+	if !f.headerCompressionDisabled {
+		writer = f.headerCompressor
+	}
+	n, err := writeHeaderValueBlock(writer, h)
+	if err != nil {
+		return err
+	}
+	if !f.headerCompressionDisabled {
+		f.headerCompressor.Flush()
+	}
+	f.sentHeaderStats.DecompressedBytes += uint64(n)
+	f.sentHeaderStats.CompressedBytes += uint64(f.headerBuf.Len())
+	return nil
+}
+
 func writeHeaderValueBlock(w io.Writer, h http.Header) (n int, err error) {
 	n = 0
 	if err = binary.Write(w, binary.BigEndian, uint32(len(h))); err != nil {
 		return
 	}
-	n += 2
+	n += 4
 	for name, values := range h {
 		if err = binary.Write(w, binary.BigEndian, uint32(len(name))); err != nil {
 			return
 		}
-		n += 2
+		n += 4
 		name = strings.ToLower(name)
 		if _, err = io.WriteString(w, name); err != nil {
 			return
@@ -188,7 +225,7 @@ func writeHeaderValueBlock(w io.Writer, h http.Header) (n int, err error) {
 		if err = binary.Write(w, binary.BigEndian, uint32(len(v))); err != nil {
 			return
 		}
-		n += 2
+		n += 4
 		if _, err = io.WriteString(w, v); err != nil {
 			return
 		}
@@ -202,16 +239,9 @@ func (f *Framer) writeSynStreamFrame(frame *SynStreamFrame) (err error) {
 		return &Error{ZeroStreamId, 0}
 	}
 	// Marshal the headers.
-	var writer io.Writer = f.headerBuf
-	if !f.headerCompressionDisabled {
-		writer = f.headerCompressor
-	}
-	if _, err = writeHeaderValueBlock(writer, frame.Headers); err != nil {
+	if err = f.marshalHeaderBlock(frame.Headers); err != nil {
 		return
 	}
-	if !f.headerCompressionDisabled {
-		f.headerCompressor.Flush()
-	}
 
 	// Set ControlFrameHeader.
 	frame.CFHeader.version = Version
@@ -246,16 +276,9 @@ func (f *Framer) writeSynReplyFrame(frame *SynReplyFrame) (err error) {
 		return &Error{ZeroStreamId, 0}
 	}
 	// Marshal the headers.
-	var writer io.Writer = f.headerBuf
-	if !f.headerCompressionDisabled {
-		writer = f.headerCompressor
-	}
-	if _, err = writeHeaderValueBlock(writer, frame.Headers); err != nil {
+	if err = f.marshalHeaderBlock(frame.Headers); err != nil {
 		return
 	}
-	if !f.headerCompressionDisabled {
-		f.headerCompressor.Flush()
-	}
 
 	// Set ControlFrameHeader.
 	frame.CFHeader.version = Version
@@ -281,16 +304,9 @@ func (f *Framer) writeHeadersFrame(frame *HeadersFrame) (err error) {
 		return &Error{ZeroStreamId, 0}
 	}
 	// Marshal the headers.
-	var writer io.Writer = f.headerBuf
-	if !f.headerCompressionDisabled {
-		writer = f.headerCompressor
-	}
-	if _, err = writeHeaderValueBlock(writer, frame.Headers); err != nil {
+	if err = f.marshalHeaderBlock(frame.Headers); err != nil {
 		return
 	}
-	if !f.headerCompressionDisabled {
-		f.headerCompressor.Flush()
-	}
 
 	// Set ControlFrameHeader.
 	frame.CFHeader.version = Version
@@ -19,8 +19,10 @@ package spdystream
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"runtime"
 	"sync"
 	"testing"
 )
@@ -127,3 +129,166 @@ func benchmarkStreamWithDataAndSize(size uint64, b *testing.B) {
 func BenchmarkStreamWith1Byte10000(b *testing.B)     { benchmarkStreamWithDataAndSize(1, b) }
 func BenchmarkStreamWith1KiloByte10000(b *testing.B) { benchmarkStreamWithDataAndSize(1024, b) }
 func BenchmarkStreamWith1Megabyte10000(b *testing.B) { benchmarkStreamWithDataAndSize(1024*1024, b) }
+
+// benchConnections returns a client connection to a server over TCP
+// loopback, the server serving streams with handler.  The benchmarks
+// below share this harness so their results are comparable across
+// changes, see scripts/bench.
+func benchConnections(b *testing.B, handler StreamHandler) (client *Connection, cleanup func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("Error listening: %s", err)
+	}
+	accepted := make(chan *Connection, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		server, err := NewConnection(conn, true)
+		if err != nil {
+			close(accepted)
+			return
+		}
+		go server.Serve(handler)
+		accepted <- server
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatalf("Error dialing server: %s", err)
+	}
+	client, err = NewConnection(conn, false)
+	if err != nil {
+		b.Fatalf("Error creating client connection: %s", err)
+	}
+	go client.Serve(NoOpStreamHandler)
+	server, ok := <-accepted
+	if !ok {
+		b.Fatal("Error accepting server connection")
+	}
+	return client, func() {
+		client.Close()
+		server.Close()
+		listener.Close()
+	}
+}
+
+// discardStreamHandler replies to streams and drops their data.
+func discardStreamHandler(stream *Stream) {
+	stream.SendReply(http.Header{}, false)
+	go func() {
+		io.Copy(ioutil.Discard, stream)
+		stream.Close()
+	}()
+}
+
+func BenchmarkStreamOpenClose(b *testing.B) {
+	client, cleanup := benchConnections(b, func(stream *Stream) {
+		stream.SendReply(http.Header{}, true)
+	})
+	defer cleanup()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stream, err := client.CreateStream(http.Header{}, nil, true)
+		if err != nil {
+			b.Fatalf("Error creating stream: %s", err)
+		}
+		if err := stream.Wait(); err != nil {
+			b.Fatalf("Error waiting for stream: %s", err)
+		}
+	}
+}
+
+func BenchmarkSmallMessageRoundTrip(b *testing.B) {
+	client, cleanup := benchConnections(b, MirrorStreamHandler)
+	defer cleanup()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		b.Fatalf("Error creating stream: %s", err)
+	}
+	message := make([]byte, 64)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := stream.Write(message); err != nil {
+			b.Fatalf("Error writing to stream: %s", err)
+		}
+		if _, err := stream.ReadData(); err != nil {
+			b.Fatalf("Error reading from stream: %s", err)
+		}
+	}
+}
+
+func BenchmarkBulkThroughput(b *testing.B) {
+	client, cleanup := benchConnections(b, discardStreamHandler)
+	defer cleanup()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		b.Fatalf("Error creating stream: %s", err)
+	}
+	chunk := make([]byte, 32*1024)
+
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := stream.Write(chunk); err != nil {
+			b.Fatalf("Error writing to stream: %s", err)
+		}
+	}
+}
+
+func BenchmarkFanout10000(b *testing.B) {
+	client, cleanup := benchConnections(b, discardStreamHandler)
+	defer cleanup()
+
+	streams := make([]*Stream, 10000)
+	for i := range streams {
+		stream, err := client.CreateStream(http.Header{}, nil, false)
+		if err != nil {
+			b.Fatalf("Error creating stream: %s", err)
+		}
+		streams[i] = stream
+	}
+	message := make([]byte, 64)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := Broadcast(streams, message); err != nil {
+			b.Fatalf("Error broadcasting: %s", err)
+		}
+	}
+}
+
+func BenchmarkIdleStreamMemory(b *testing.B) {
+	client, cleanup := benchConnections(b, func(stream *Stream) {
+		stream.SendReply(http.Header{}, false)
+	})
+	defer cleanup()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	streams := make([]*Stream, b.N)
+	for i := range streams {
+		stream, err := client.CreateStream(http.Header{}, nil, false)
+		if err != nil {
+			b.Fatalf("Error creating stream: %s", err)
+		}
+		streams[i] = stream
+	}
+	b.StopTimer()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(b.N), "B/stream")
+	runtime.KeepAlive(streams)
+}
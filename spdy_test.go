@@ -19,13 +19,18 @@ package spdystream
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -1153,6 +1158,2938 @@ func TestStreamReadUnblocksAfterCloseThenReset(t *testing.T) {
 	}
 }
 
+func TestErrorStream(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	listen := listener.Addr().String()
+
+	errorStreams := make(chan *Stream, 1)
+	go func() {
+		conn, connErr := listener.Accept()
+		if connErr != nil {
+			t.Error(connErr)
+		}
+		serverSpdyConn, err := NewConnection(conn, true)
+		if err != nil {
+			t.Errorf("Error creating server connection: %v", err)
+		}
+		go serverSpdyConn.Serve(func(s *Stream) {
+			s.SendReply(http.Header{}, false)
+			if parent := s.Parent(); parent != nil && parent.ErrorStream() == s {
+				errorStreams <- s
+			}
+		})
+	}()
+
+	conn, dialErr := net.Dial("tcp", listen)
+	if dialErr != nil {
+		t.Fatalf("Error dialing server: %s", dialErr)
+	}
+
+	spdyConn, spdyErr := NewConnection(conn, false)
+	if spdyErr != nil {
+		t.Fatalf("Error creating spdy connection: %s", spdyErr)
+	}
+	go spdyConn.Serve(NoOpStreamHandler)
+
+	stream, err := spdyConn.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %v", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %v", err)
+	}
+
+	errorStream, err := stream.CreateErrorStream(false)
+	if err != nil {
+		t.Fatalf("Error creating error stream: %v", err)
+	}
+	if stream.ErrorStream() != errorStream {
+		t.Fatalf("Error stream not linked to parent")
+	}
+	if _, err := stream.CreateErrorStream(false); err != ErrErrorStreamExists {
+		t.Fatalf("Unexpected error creating second error stream: %v", err)
+	}
+	if err := errorStream.Wait(); err != nil {
+		t.Fatalf("Error waiting for error stream: %v", err)
+	}
+	if _, err := errorStream.Write([]byte("oops")); err != nil {
+		t.Fatalf("Error writing to error stream: %v", err)
+	}
+
+	var remoteErrorStream *Stream
+	select {
+	case remoteErrorStream = <-errorStreams:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for remote error stream")
+	}
+	data, err := remoteErrorStream.ReadData()
+	if err != nil {
+		t.Fatalf("Error reading from error stream: %v", err)
+	}
+	if string(data) != "oops" {
+		t.Fatalf("Unexpected data:\nActual: %q\nExpected: %q", data, "oops")
+	}
+
+	spdyConn.Close()
+}
+
+func TestReadFrames(t *testing.T) {
+	var wg sync.WaitGroup
+	server, listen, serverErr := runServer(&wg)
+	if serverErr != nil {
+		t.Fatalf("Error initializing server: %s", serverErr)
+	}
+
+	conn, dialErr := net.Dial("tcp", listen)
+	if dialErr != nil {
+		t.Fatalf("Error dialing server: %s", dialErr)
+	}
+
+	spdyConn, spdyErr := NewConnection(conn, false)
+	if spdyErr != nil {
+		t.Fatalf("Error creating spdy connection: %s", spdyErr)
+	}
+	go spdyConn.Serve(NoOpStreamHandler)
+
+	authenticated = true
+	stream, streamErr := spdyConn.CreateStream(http.Header{}, nil, false)
+	if streamErr != nil {
+		t.Fatalf("Error creating stream: %s", streamErr)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+
+	messages := []string{"one", "two", "three"}
+	for _, message := range messages {
+		if _, err := stream.Write([]byte(message)); err != nil {
+			t.Fatalf("Error writing to stream: %s", err)
+		}
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatalf("Error closing stream: %s", err)
+	}
+
+	var received []string
+	for {
+		frames, err := stream.ReadFrames(2)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading frames: %s", err)
+		}
+		if len(frames) == 0 || len(frames) > 2 {
+			t.Fatalf("Unexpected number of frames: %d", len(frames))
+		}
+		for _, frame := range frames {
+			received = append(received, string(frame))
+		}
+	}
+	if fmt.Sprint(received) != fmt.Sprint(messages) {
+		t.Fatalf("Unexpected frames:\nActual: %v\nExpected: %v", received, messages)
+	}
+
+	closeErr := server.Close()
+	if closeErr != nil {
+		t.Fatalf("Error shutting down server: %s", closeErr)
+	}
+	wg.Wait()
+}
+
+func TestReadFramesQueued(t *testing.T) {
+	streams := make(chan *Stream, 1)
+	client, server := newTestConnections(t, func(c *Connection) {
+		c.SetDataQueue(8)
+	}, func(s *Stream) {
+		s.SendReply(http.Header{}, false)
+		streams <- s
+	})
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	remote := <-streams
+
+	const frames = 8
+	for i := 0; i < frames; i++ {
+		if _, err := stream.Write([]byte(fmt.Sprintf("frame%d", i))); err != nil {
+			t.Fatalf("Error writing to stream: %s", err)
+		}
+	}
+	// frames are queued on the stream without being read
+	for i := 0; i < 100 && remote.BufferedRecvBytes() < frames*len("frame0"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if buffered := remote.BufferedRecvBytes(); buffered != frames*len("frame0") {
+		t.Fatalf("Unexpected buffered bytes:\nActual: %d\nExpected: %d", buffered, frames*len("frame0"))
+	}
+
+	calls, received := 0, 0
+	for received < frames {
+		read, err := remote.ReadFrames(frames)
+		if err != nil {
+			t.Fatalf("Error reading frames: %s", err)
+		}
+		calls++
+		received += len(read)
+	}
+	if calls >= frames {
+		t.Fatalf("Frames not batched: %d frames read in %d calls", frames, calls)
+	}
+	if buffered := remote.BufferedRecvBytes(); buffered != 0 {
+		t.Fatalf("Unexpected buffered bytes after reading:\nActual: %d\nExpected: %d", buffered, 0)
+	}
+
+	// frames queued ahead of the finish are read before io.EOF
+	for i := 0; i < frames; i++ {
+		if _, err := stream.Write([]byte("last")); err != nil {
+			t.Fatalf("Error writing to stream: %s", err)
+		}
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatalf("Error closing stream: %s", err)
+	}
+	select {
+	case <-remote.closeChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the finish")
+	}
+	received = 0
+	for {
+		read, err := remote.ReadFrames(frames)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading frames: %s", err)
+		}
+		received += len(read)
+	}
+	if received != frames {
+		t.Fatalf("Unexpected frames read before the finish:\nActual: %d\nExpected: %d", received, frames)
+	}
+}
+
+func TestHeaderOverflowPolicy(t *testing.T) {
+	tt := []struct {
+		policy   HeaderOverflowPolicy
+		expected []string
+		reset    bool
+	}{
+		{policy: HeaderOverflowDropOldest, expected: []string{"3"}},
+		{policy: HeaderOverflowCoalesce, expected: []string{"1", "2", "3"}},
+		{policy: HeaderOverflowReset, reset: true},
+	}
+	// a queue size of 0 is raised to 1 for the policies other than
+	// HeaderOverflowBlock, which need a queue to apply to
+	for i := 0; i < 2*len(tt); i++ {
+		tc, size := tt[i%len(tt)], i/len(tt)
+		streamCh := make(chan *Stream, 1)
+		client, server := newTestConnections(t, func(c *Connection) {
+			c.SetHeaderQueue(size, tc.policy)
+		}, func(s *Stream) {
+			s.SendReply(http.Header{}, false)
+			streamCh <- s
+		})
+
+		stream, err := client.CreateStream(http.Header{}, nil, false)
+		if err != nil {
+			t.Fatalf("Error creating stream: %s", err)
+		}
+		if err := stream.Wait(); err != nil {
+			t.Fatalf("Error waiting for stream: %s", err)
+		}
+		remote := <-streamCh
+
+		for _, v := range []string{"1", "2", "3"} {
+			if err := stream.SendHeader(http.Header{"Seq": {v}}, false); err != nil {
+				t.Fatalf("Error sending header: %s", err)
+			}
+		}
+		// frames of a stream are handled in order, once the data
+		// frame is read all headers have been queued
+		if _, err := stream.Write([]byte("sync")); err != nil {
+			t.Fatalf("Error writing to stream: %s", err)
+		}
+
+		if tc.reset {
+			b := make([]byte, 4)
+			if _, err := stream.Read(b); err != io.EOF {
+				t.Fatalf("Expected EOF reading reset stream, got %v", err)
+			}
+		} else {
+			if _, err := remote.ReadData(); err != nil {
+				t.Fatalf("Error reading from stream: %s", err)
+			}
+			header, err := remote.ReceiveHeader()
+			if err != nil {
+				t.Fatalf("Error receiving header: %s", err)
+			}
+			if fmt.Sprint(header["Seq"]) != fmt.Sprint(tc.expected) {
+				t.Fatalf("Unexpected header values:\nActual: %v\nExpected: %v", header["Seq"], tc.expected)
+			}
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestWriteBeforeReply(t *testing.T) {
+	replyErrs := make(chan error, 3)
+	streamCh := make(chan *Stream, 1)
+	client, server := newTestConnections(t, nil, func(s *Stream) {
+		_, writeErr := s.Write([]byte("early"))
+		headerErr := s.SendHeader(http.Header{}, false)
+		replyErrs <- writeErr
+		replyErrs <- headerErr
+		replyErrs <- s.SendReply(http.Header{}, false)
+		streamCh <- s
+	})
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	// the creator may write before the reply is received
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatalf("Error writing before reply: %s", err)
+	}
+
+	if err := <-replyErrs; err != ErrReplyPending {
+		t.Fatalf("Unexpected error writing before reply: %v", err)
+	}
+	if err := <-replyErrs; err != ErrReplyPending {
+		t.Fatalf("Unexpected error sending header before reply: %v", err)
+	}
+	if err := <-replyErrs; err != nil {
+		t.Fatalf("Error sending reply: %s", err)
+	}
+	remote := <-streamCh
+	if _, err := remote.Write([]byte("late")); err != nil {
+		t.Fatalf("Error writing after reply: %s", err)
+	}
+
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	data, err := stream.ReadData()
+	if err != nil {
+		t.Fatalf("Error reading from stream: %s", err)
+	}
+	if string(data) != "late" {
+		t.Fatalf("Unexpected data:\nActual: %q\nExpected: %q", data, "late")
+	}
+	data, err = remote.ReadData()
+	if err != nil {
+		t.Fatalf("Error reading from stream: %s", err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Unexpected data:\nActual: %q\nExpected: %q", data, "hello")
+	}
+}
+
+func TestStreamAbort(t *testing.T) {
+	streamCh := make(chan *Stream, 1)
+	client, server := newTestConnections(t, nil, func(s *Stream) {
+		s.SendReply(http.Header{}, false)
+		streamCh <- s
+	})
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	remote := <-streamCh
+
+	readErrs := make(chan error, 1)
+	go func() {
+		b := make([]byte, 10)
+		_, err := stream.Read(b)
+		readErrs <- err
+	}()
+
+	cause := errors.New("backend unavailable")
+	if err := stream.Abort(cause); err != nil {
+		t.Fatalf("Error aborting stream: %s", err)
+	}
+
+	select {
+	case err := <-readErrs:
+		if !errors.Is(err, cause) {
+			t.Fatalf("Unexpected read error: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for pending read")
+	}
+	if _, err := stream.Write([]byte("hello")); !errors.Is(err, cause) {
+		t.Fatalf("Unexpected write error: %v", err)
+	}
+	if _, err := stream.ReadData(); !errors.Is(err, cause) {
+		t.Fatalf("Unexpected read error: %v", err)
+	}
+
+	if _, err := remote.ReadData(); err != io.EOF {
+		t.Fatalf("Expected EOF on remote stream, got %v", err)
+	}
+}
+
+func TestStreamCounts(t *testing.T) {
+	streamCh := make(chan *Stream, 2)
+	client, server := newTestConnections(t, nil, func(s *Stream) {
+		if s.Headers().Get("Reply") != "" {
+			s.SendReply(http.Header{}, false)
+		}
+		streamCh <- s
+	})
+	defer server.Close()
+	defer client.Close()
+
+	if capacity := client.RemainingStreamCapacity(); capacity != 0x40000000 {
+		t.Fatalf("Unexpected stream capacity:\nActual: %d\nExpected: %d", capacity, 0x40000000)
+	}
+
+	if _, err := client.CreateStream(http.Header{"Reply": {"yes"}}, nil, false); err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if _, err := client.CreateStream(http.Header{}, nil, false); err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	<-streamCh
+	<-streamCh
+
+	if n := server.NumActiveStreams(); n != 2 {
+		t.Fatalf("Unexpected active streams:\nActual: %d\nExpected: 2", n)
+	}
+	if n := server.NumPendingAccepts(); n != 1 {
+		t.Fatalf("Unexpected pending accepts:\nActual: %d\nExpected: 1", n)
+	}
+	if n := client.NumActiveStreams(); n != 2 {
+		t.Fatalf("Unexpected active streams:\nActual: %d\nExpected: 2", n)
+	}
+	if capacity := client.RemainingStreamCapacity(); capacity != 0x40000000-2 {
+		t.Fatalf("Unexpected stream capacity:\nActual: %d\nExpected: %d", capacity, 0x40000000-2)
+	}
+
+	settings := &spdy.SettingsFrame{
+		FlagIdValues: []spdy.SettingsFlagIdValue{
+			{Id: spdy.SettingsMaxConcurrentStreams, Value: 3},
+		},
+	}
+	if err := server.framer.WriteFrame(settings); err != nil {
+		t.Fatalf("Error writing settings: %s", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for client.RemainingStreamCapacity() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Unexpected stream capacity:\nActual: %d\nExpected: 1", client.RemainingStreamCapacity())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStreamIdExhaustion(t *testing.T) {
+	client, server := newTestConnections(t, nil, NoOpStreamHandler)
+	defer server.Close()
+
+	// leave three stream ids for the client
+	client.nextIdLock.Lock()
+	client.nextStreamId = 0x7ffffffb
+	client.nextIdLock.Unlock()
+
+	low := make(chan uint32, 1)
+	client.NotifyStreamIdsLow(low, 1, true)
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.CreateStream(http.Header{}, nil, false); err != nil {
+			t.Fatalf("Error creating stream: %s", err)
+		}
+	}
+	select {
+	case remaining := <-low:
+		if remaining != 1 {
+			t.Fatalf("Unexpected remaining stream ids:\nActual: %d\nExpected: 1", remaining)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for stream ids low notification")
+	}
+
+	// the go away sent on low stream ids closes the remote
+	select {
+	case <-server.CloseChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for go away")
+	}
+
+	if _, err := client.CreateStream(http.Header{}, nil, false); err != nil {
+		t.Fatalf("Error creating last stream: %s", err)
+	}
+	if _, err := client.CreateStream(http.Header{}, nil, false); err != ErrStreamIdExhausted {
+		t.Fatalf("Unexpected error creating stream: %v", err)
+	}
+	if capacity := client.RemainingStreamCapacity(); capacity != 0 {
+		t.Fatalf("Unexpected stream capacity:\nActual: %d\nExpected: 0", capacity)
+	}
+}
+
+func TestUnknownControlFrame(t *testing.T) {
+	unknownFrame := &spdy.UnknownControlFrame{Type: 0x00f0, Data: []byte("ext")}
+
+	received := make(chan uint16, 1)
+	client, server := newTestConnections(t, func(conn *Connection) {
+		conn.SetUnknownFramePolicy(UnknownFrameCallback, func(frame *spdy.UnknownControlFrame) {
+			received <- uint16(frame.Type)
+		})
+	}, NoOpStreamHandler)
+	if err := client.framer.WriteFrame(unknownFrame); err != nil {
+		t.Fatalf("Error writing unknown frame: %s", err)
+	}
+	select {
+	case frameType := <-received:
+		if frameType != 0x00f0 {
+			t.Fatalf("Unexpected frame type:\nActual: %#x\nExpected: %#x", frameType, 0x00f0)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for unknown frame callback")
+	}
+	// the connection remains usable after an ignored frame
+	if _, err := client.Ping(); err != nil {
+		t.Fatalf("Error pinging after unknown frame: %s", err)
+	}
+	client.Close()
+	server.Close()
+
+	client, server = newTestConnections(t, func(conn *Connection) {
+		conn.SetUnknownFramePolicy(UnknownFrameFail, nil)
+	}, NoOpStreamHandler)
+	if err := client.framer.WriteFrame(unknownFrame); err != nil {
+		t.Fatalf("Error writing unknown frame: %s", err)
+	}
+	select {
+	case <-client.CloseChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for go away")
+	}
+	select {
+	case <-server.CloseChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for server to close")
+	}
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	client, server := newTestConnections(t, func(conn *Connection) {
+		conn.SetMaxFrameSize(1024)
+	}, MirrorStreamHandler)
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	if _, err := stream.Write(make([]byte, 1024)); err != nil {
+		t.Fatalf("Error writing to stream: %s", err)
+	}
+	if _, err := stream.ReadData(); err != nil {
+		t.Fatalf("Error reading from stream: %s", err)
+	}
+
+	if _, err := stream.Write(make([]byte, 1025)); err != nil {
+		t.Fatalf("Error writing to stream: %s", err)
+	}
+	select {
+	case <-client.CloseChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for go away")
+	}
+	select {
+	case <-server.CloseChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for server to close")
+	}
+}
+
+func TestHeaderBlockLimits(t *testing.T) {
+	client, server := newTestConnections(t, func(conn *Connection) {
+		conn.SetHeaderBlockLimits(1<<16, 0)
+	}, MirrorStreamHandler)
+
+	stream, err := client.CreateStream(http.Header{"Name": {"value"}}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	if err := stream.SendHeader(http.Header{"Bomb": {strings.Repeat("a", 1<<17)}}, false); err != nil {
+		t.Fatalf("Error sending header: %s", err)
+	}
+	select {
+	case <-client.CloseChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for go away")
+	}
+	select {
+	case <-server.CloseChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for server to close")
+	}
+
+	stats := server.Stats()
+	if stats.HeaderBlocksRejected != 1 {
+		t.Fatalf("Unexpected rejected header blocks:\nActual: %d\nExpected: 1", stats.HeaderBlocksRejected)
+	}
+	if stats.HeaderBytesDecompressed == 0 || stats.HeaderBytesCompressed == 0 {
+		t.Fatalf("Missing header byte counts: %+v", stats)
+	}
+	stats = client.Stats()
+	if stats.SentHeaderBytesUncompressed <= 1<<17 || stats.SentHeaderBytesCompressed >= stats.SentHeaderBytesUncompressed {
+		t.Fatalf("Unexpected sent header byte counts: %+v", stats)
+	}
+}
+
+func TestCreateStreamContextDeadline(t *testing.T) {
+	streamCh := make(chan *Stream, 2)
+	client, server := newTestConnections(t, nil, func(s *Stream) {
+		s.SendReply(http.Header{}, false)
+		streamCh <- s
+	})
+	defer server.Close()
+	defer client.Close()
+	client.SetDeadlinePropagation(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	stream, err := client.CreateStreamContext(ctx, http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	remote := <-streamCh
+	deadline, ok := remote.Deadline()
+	if !ok {
+		t.Fatal("Expected deadline on accepted stream")
+	}
+	if expected, _ := ctx.Deadline(); deadline.After(expected.Add(time.Second)) || deadline.Before(expected.Add(-10*time.Second)) {
+		t.Fatalf("Unexpected deadline:\nActual: %s\nExpected: %s", deadline, expected)
+	}
+
+	// cancelling the context resets the stream
+	cancel()
+	if _, err := remote.ReadData(); err != io.EOF {
+		t.Fatalf("Expected EOF on remote stream, got %v", err)
+	}
+	if _, err := client.CreateStreamContext(ctx, http.Header{}, nil, false); err != context.Canceled {
+		t.Fatalf("Unexpected error:\nActual: %v\nExpected: %v", err, context.Canceled)
+	}
+
+	// without a deadline no header is sent
+	stream, err = client.CreateStreamContext(context.Background(), http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	if _, ok := (<-streamCh).Deadline(); ok {
+		t.Fatal("Unexpected deadline on accepted stream")
+	}
+	stream.Close()
+}
+
+func TestCancelWithReason(t *testing.T) {
+	streamCh := make(chan *Stream, 1)
+	client, server := newTestConnections(t, nil, func(s *Stream) {
+		s.SendReply(http.Header{}, false)
+		streamCh <- s
+	})
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	remote := <-streamCh
+
+	if err := stream.CancelWithReason("client gave up"); err != nil {
+		t.Fatalf("Error canceling stream: %s", err)
+	}
+	_, err = remote.ReadData()
+	cancelErr, ok := err.(*CancelError)
+	if !ok {
+		t.Fatalf("Unexpected read error:\nActual: %v\nExpected: *CancelError", err)
+	}
+	if cancelErr.Reason != "client gave up" {
+		t.Fatalf("Unexpected cancel reason:\nActual: %q\nExpected: %q", cancelErr.Reason, "client gave up")
+	}
+	if _, err := remote.Write([]byte("hello")); !errors.Is(err, ErrReset) {
+		t.Fatalf("Unexpected write error: %v", err)
+	}
+}
+
+func TestCloseAndWaitAck(t *testing.T) {
+	streamCh := make(chan *Stream, 2)
+	client, server := newTestConnections(t, nil, func(s *Stream) {
+		s.SendReply(http.Header{}, false)
+		streamCh <- s
+	})
+	defer server.Close()
+	defer client.Close()
+
+	for _, expected := range []CloseAck{CloseAckFin, CloseAckReset, CloseAckTimeout} {
+		stream, err := client.CreateStream(http.Header{}, nil, false)
+		if err != nil {
+			t.Fatalf("Error creating stream: %s", err)
+		}
+		if err := stream.Wait(); err != nil {
+			t.Fatalf("Error waiting for stream: %s", err)
+		}
+		remote := <-streamCh
+		go func() {
+			if _, err := remote.ReadData(); err != io.EOF {
+				t.Errorf("Expected EOF on remote stream, got %v", err)
+			}
+			switch expected {
+			case CloseAckFin:
+				remote.Close()
+			case CloseAckReset:
+				remote.Reset()
+			}
+		}()
+
+		ack, err := stream.CloseAndWaitAck(100 * time.Millisecond)
+		if err != nil {
+			t.Fatalf("Error closing stream: %s", err)
+		}
+		if ack != expected {
+			t.Fatalf("Unexpected close acknowledgement:\nActual: %s\nExpected: %s", ack, expected)
+		}
+		stream.Reset()
+	}
+}
+
+func TestCloseFlushesWrites(t *testing.T) {
+	client, server := newTestConnections(t, nil, MirrorStreamHandler)
+	defer server.Close()
+
+	// a frame write in progress delays closing the network connection
+	client.framer.writeLock.Lock()
+	writeDone := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(writeDone)
+		client.framer.writeLock.Unlock()
+	}()
+	if err := client.closeConn(); err != nil {
+		t.Fatalf("Error closing connection: %s", err)
+	}
+	select {
+	case <-writeDone:
+	default:
+		t.Fatal("Connection closed before pending write completed")
+	}
+
+	// a stuck write does not delay it past the flush timeout
+	client, server2 := newTestConnections(t, nil, MirrorStreamHandler)
+	defer server2.Close()
+	client.SetCloseFlushTimeout(20 * time.Millisecond)
+	client.framer.writeLock.Lock()
+	start := time.Now()
+	if err := client.closeConn(); err != nil {
+		t.Fatalf("Error closing connection: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Close waited too long for stuck write: %s", elapsed)
+	}
+	client.framer.writeLock.Unlock()
+}
+
+func TestDiscardRemaining(t *testing.T) {
+	streamCh := make(chan *Stream, 2)
+	client, server := newTestConnections(t, nil, func(s *Stream) {
+		s.SendReply(http.Header{}, false)
+		streamCh <- s
+	})
+	defer server.Close()
+	defer client.Close()
+
+	for _, reset := range []bool{false, true} {
+		stream, err := client.CreateStream(http.Header{}, nil, false)
+		if err != nil {
+			t.Fatalf("Error creating stream: %s", err)
+		}
+		if err := stream.Wait(); err != nil {
+			t.Fatalf("Error waiting for stream: %s", err)
+		}
+		remote := <-streamCh
+
+		go func() {
+			for i := 0; i < 4; i++ {
+				if _, err := stream.Write(make([]byte, 1000)); err != nil {
+					t.Errorf("Error writing to stream: %s", err)
+					return
+				}
+			}
+			if reset {
+				stream.Reset()
+			} else {
+				stream.Close()
+			}
+		}()
+
+		b := make([]byte, 10)
+		if _, err := io.ReadFull(remote, b); err != nil {
+			t.Fatalf("Error reading from stream: %s", err)
+		}
+		n, err := remote.DiscardRemaining()
+		if reset {
+			if err != ErrReset {
+				t.Fatalf("Unexpected discard error:\nActual: %v\nExpected: %v", err, ErrReset)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Error discarding stream data: %s", err)
+		}
+		if n != 3990 {
+			t.Fatalf("Unexpected discarded bytes:\nActual: %d\nExpected: %d", n, 3990)
+		}
+		remote.Close()
+	}
+}
+
+func TestBufferedRecvBytes(t *testing.T) {
+	client, server := newTestConnections(t, nil, MirrorStreamHandler)
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	if _, err := stream.Write([]byte("hello world")); err != nil {
+		t.Fatalf("Error writing to stream: %s", err)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(stream, b); err != nil {
+		t.Fatalf("Error reading from stream: %s", err)
+	}
+	if n := stream.BufferedRecvBytes(); n != 6 {
+		t.Fatalf("Unexpected buffered bytes:\nActual: %d\nExpected: %d", n, 6)
+	}
+	if _, err := io.ReadFull(stream, make([]byte, 6)); err != nil {
+		t.Fatalf("Error reading from stream: %s", err)
+	}
+	if n := stream.BufferedRecvBytes(); n != 0 {
+		t.Fatalf("Unexpected buffered bytes:\nActual: %d\nExpected: %d", n, 0)
+	}
+	stream.Close()
+}
+
+func TestStreamProtocol(t *testing.T) {
+	streamCh := make(chan *Stream, 1)
+	client, server := newTestConnections(t, nil, func(s *Stream) {
+		protocol := s.SelectProtocol("echo/1", "echo/2")
+		if err := s.SendReplyProtocol("chat/1", http.Header{}, false); err != ErrProtocolNotOffered {
+			t.Errorf("Unexpected error:\nActual: %v\nExpected: %v", err, ErrProtocolNotOffered)
+		}
+		if err := s.SendReplyProtocol(protocol, http.Header{}, false); err != nil {
+			t.Errorf("Error replying: %s", err)
+		}
+		streamCh <- s
+	})
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.CreateStreamProtocols(http.Header{}, nil, false, "echo/3", "echo/2", "echo/1")
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	if protocol := stream.Protocol(); protocol != "echo/2" {
+		t.Fatalf("Unexpected protocol:\nActual: %q\nExpected: %q", protocol, "echo/2")
+	}
+	remote := <-streamCh
+	if protocol := remote.Protocol(); protocol != "echo/2" {
+		t.Fatalf("Unexpected remote protocol:\nActual: %q\nExpected: %q", protocol, "echo/2")
+	}
+	if offered := remote.OfferedProtocols(); len(offered) != 3 || offered[0] != "echo/3" {
+		t.Fatalf("Unexpected offered protocols: %v", offered)
+	}
+	stream.Close()
+}
+
+func TestHandshake(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	client, err := NewConnection(clientConn, false)
+	if err != nil {
+		t.Fatalf("Error creating client connection: %s", err)
+	}
+	server, err := NewConnection(serverConn, true)
+	if err != nil {
+		t.Fatalf("Error creating server connection: %s", err)
+	}
+	client.SetHandshake(Capabilities{Version: "client/1", Features: []string{"tracing"}})
+	server.SetHandshake(Capabilities{Version: "server/2", Features: []string{"compression", "resume"}})
+	handled := make(chan *Stream, 2)
+	go client.Serve(NoOpStreamHandler)
+	go server.Serve(func(s *Stream) {
+		handled <- s
+		MirrorStreamHandler(s)
+	})
+	defer server.Close()
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	caps, err := client.PeerCapabilities(ctx)
+	if err != nil {
+		t.Fatalf("Error waiting for peer capabilities: %s", err)
+	}
+	if caps.Version != "server/2" || !caps.HasFeature("resume") || caps.HasFeature("tracing") {
+		t.Fatalf("Unexpected peer capabilities: %+v", caps)
+	}
+	caps, err = server.PeerCapabilities(ctx)
+	if err != nil {
+		t.Fatalf("Error waiting for peer capabilities: %s", err)
+	}
+	if caps.Version != "client/1" || !caps.HasFeature("tracing") {
+		t.Fatalf("Unexpected peer capabilities: %+v", caps)
+	}
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	if remote := <-handled; remote.Identifier() != stream.Identifier() {
+		t.Fatalf("Unexpected stream passed to handler:\nActual: %d\nExpected: %d", remote.Identifier(), stream.Identifier())
+	}
+	stream.Close()
+}
+
+func TestDataChecksums(t *testing.T) {
+	readErrs := make(chan error, 1)
+	for _, clientChecksums := range []bool{true, false} {
+		client, server := newTestConnections(t, func(conn *Connection) {
+			conn.SetDataChecksums(true)
+		}, func(s *Stream) {
+			s.SendReply(http.Header{}, false)
+			go func() {
+				data, err := s.ReadData()
+				if err == nil {
+					_, err = s.Write(data)
+				}
+				readErrs <- err
+			}()
+		})
+		client.SetDataChecksums(clientChecksums)
+
+		stream, err := client.CreateStream(http.Header{}, nil, false)
+		if err != nil {
+			t.Fatalf("Error creating stream: %s", err)
+		}
+		if err := stream.Wait(); err != nil {
+			t.Fatalf("Error waiting for stream: %s", err)
+		}
+		if _, err := stream.Write([]byte("hello world")); err != nil {
+			t.Fatalf("Error writing to stream: %s", err)
+		}
+		err = <-readErrs
+		if !clientChecksums {
+			// the last bytes of the data are taken as checksum
+			if err != ErrChecksumMismatch {
+				t.Fatalf("Unexpected read error:\nActual: %v\nExpected: %v", err, ErrChecksumMismatch)
+			}
+			if stats := server.Stats(); stats.DataFramesCorrupt != 1 {
+				t.Fatalf("Unexpected stats: %+v", stats)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("Error echoing data: %s", err)
+			}
+			data, err := stream.ReadData()
+			if err != nil {
+				t.Fatalf("Error reading from stream: %s", err)
+			}
+			if string(data) != "hello world" {
+				t.Fatalf("Unexpected data:\nActual: %q\nExpected: %q", data, "hello world")
+			}
+			if stats := server.Stats(); stats.DataFramesVerified != 1 || stats.DataFramesCorrupt != 0 {
+				t.Fatalf("Unexpected stats: %+v", stats)
+			}
+		}
+		stream.Reset()
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestFrameObserver(t *testing.T) {
+	var lock sync.Mutex
+	var observed []FrameInfo
+	client, server := newTestConnections(t, func(conn *Connection) {
+		conn.SetFrameObserver(func(info FrameInfo) error {
+			if !info.Sent && info.Type == "HEADERS" {
+				return errors.New("headers not allowed")
+			}
+			lock.Lock()
+			observed = append(observed, info)
+			lock.Unlock()
+			return nil
+		}, false)
+	}, MirrorStreamHandler)
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.CreateStream(http.Header{"Name": {"value"}}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatalf("Error writing to stream: %s", err)
+	}
+	if _, err := stream.ReadData(); err != nil {
+		t.Fatalf("Error reading from stream: %s", err)
+	}
+
+	lock.Lock()
+	expected := []struct {
+		sent      bool
+		frameType string
+	}{{false, "SYN_STREAM"}, {true, "SYN_REPLY"}, {false, "DATA"}, {true, "DATA"}}
+	if len(observed) != len(expected) {
+		t.Fatalf("Unexpected observed frames: %+v", observed)
+	}
+	for i, info := range observed {
+		if info.Sent != expected[i].sent || info.Type != expected[i].frameType || info.StreamId != stream.Identifier() || info.Length == 0 || info.Frame != nil {
+			t.Fatalf("Unexpected observed frame %d: %+v", i, info)
+		}
+	}
+	if observed[2].Length != 5 {
+		t.Fatalf("Unexpected data frame length:\nActual: %d\nExpected: %d", observed[2].Length, 5)
+	}
+	lock.Unlock()
+
+	// a rejected frame closes the connection
+	if err := stream.SendHeader(http.Header{"Name": {"value"}}, false); err != nil {
+		t.Fatalf("Error sending header: %s", err)
+	}
+	select {
+	case <-client.CloseChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for connection to close")
+	}
+}
+
+func TestFramePolicy(t *testing.T) {
+	streamCh := make(chan *Stream, 1)
+	client, server := newTestConnections(t, func(conn *Connection) {
+		conn.SetFramePolicy(FramePolicies(
+			ForbidStreamHeaders("x-forbidden"),
+			DataRateLimit(2),
+			FramePolicyFunc(func(info FrameInfo) FrameVerdict {
+				if info.Type == "PING" {
+					return FrameGoAway
+				}
+				return FrameAllow
+			}),
+		))
+	}, func(s *Stream) {
+		s.SendReply(http.Header{}, false)
+		streamCh <- s
+	})
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.CreateStream(http.Header{"X-Forbidden": {"1"}}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != ErrReset {
+		t.Fatalf("Unexpected error waiting for forbidden stream:\nActual: %v\nExpected: %v", err, ErrReset)
+	}
+
+	stream, err = client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	remote := <-streamCh
+	for i := 0; i < 3; i++ {
+		if _, err := stream.Write([]byte("hello")); err != nil {
+			t.Fatalf("Error writing to stream: %s", err)
+		}
+	}
+	// data not read yet may be discarded by the reset
+	for {
+		_, err := remote.ReadData()
+		if err == nil {
+			continue
+		}
+		if err != ErrFrameRejected {
+			t.Fatalf("Unexpected read error:\nActual: %v\nExpected: %v", err, ErrFrameRejected)
+		}
+		break
+	}
+
+	go client.Ping()
+	select {
+	case <-client.CloseChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for connection to close")
+	}
+}
+
+func TestOriginalRemoteAddr(t *testing.T) {
+	streamCh := make(chan *Stream, 2)
+	client, server := newTestConnections(t, nil, func(s *Stream) {
+		s.SendReply(http.Header{}, false)
+		streamCh <- s
+	})
+	defer server.Close()
+	defer client.Close()
+
+	for _, header := range []string{"", "203.0.113.7:4242"} {
+		headers := http.Header{}
+		if header != "" {
+			headers.Set(OriginalRemoteAddrHeader, header)
+		}
+		stream, err := client.CreateStream(headers, nil, false)
+		if err != nil {
+			t.Fatalf("Error creating stream: %s", err)
+		}
+		if err := stream.Wait(); err != nil {
+			t.Fatalf("Error waiting for stream: %s", err)
+		}
+		remote := <-streamCh
+
+		expected := remote.RemoteAddr().String()
+		if header != "" {
+			expected = header
+		}
+		addr := remote.OriginalRemoteAddr()
+		if addr.String() != expected {
+			t.Fatalf("Unexpected original address:\nActual: %s\nExpected: %s", addr, expected)
+		}
+		if _, ok := addr.(*net.TCPAddr); !ok {
+			t.Fatalf("Unexpected original address type: %T", addr)
+		}
+
+		// an untrusted remote cannot claim another address
+		forwarded := http.Header{}
+		ForwardRemoteAddr(forwarded, remote, false)
+		if value := forwarded.Get(OriginalRemoteAddrHeader); value != remote.RemoteAddr().String() {
+			t.Fatalf("Unexpected forwarded address:\nActual: %s\nExpected: %s", value, remote.RemoteAddr())
+		}
+		ForwardRemoteAddr(forwarded, remote, true)
+		if value := forwarded.Get(OriginalRemoteAddrHeader); value != expected {
+			t.Fatalf("Unexpected forwarded address:\nActual: %s\nExpected: %s", value, expected)
+		}
+		stream.Close()
+	}
+}
+
+func TestNestedConnection(t *testing.T) {
+	innerServers := make(chan *Connection, 1)
+	client, server := newTestConnections(t, nil, func(s *Stream) {
+		s.SendReply(http.Header{}, false)
+		inner, err := NewConnection(s, true)
+		if err != nil {
+			t.Errorf("Error creating nested connection: %s", err)
+			return
+		}
+		innerServers <- inner
+		go inner.Serve(MirrorStreamHandler)
+	})
+	defer server.Close()
+	defer client.Close()
+
+	tunnel, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := tunnel.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	inner, err := NewConnection(tunnel, false)
+	if err != nil {
+		t.Fatalf("Error creating nested connection: %s", err)
+	}
+	go inner.Serve(NoOpStreamHandler)
+
+	for i := 0; i < 2; i++ {
+		stream, err := inner.CreateStream(http.Header{}, nil, false)
+		if err != nil {
+			t.Fatalf("Error creating nested stream: %s", err)
+		}
+		if err := stream.Wait(); err != nil {
+			t.Fatalf("Error waiting for nested stream: %s", err)
+		}
+		if _, err := stream.Write([]byte("hello")); err != nil {
+			t.Fatalf("Error writing to nested stream: %s", err)
+		}
+		data, err := stream.ReadData()
+		if err != nil {
+			t.Fatalf("Error reading from nested stream: %s", err)
+		}
+		if string(data) != "hello" {
+			t.Fatalf("Unexpected data:\nActual: %q\nExpected: %q", data, "hello")
+		}
+		stream.Close()
+	}
+
+	innerServer := <-innerServers
+	if err := inner.Close(); err != nil {
+		t.Fatalf("Error closing nested connection: %s", err)
+	}
+	select {
+	case <-innerServer.CloseChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for nested connection to close")
+	}
+	// the outer connection is still usable
+	if _, err := client.Ping(); err != nil {
+		t.Fatalf("Error pinging outer connection: %s", err)
+	}
+}
+
+func TestControlChannel(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	client, err := NewConnection(clientConn, false)
+	if err != nil {
+		t.Fatalf("Error creating client connection: %s", err)
+	}
+	server, err := NewConnection(serverConn, true)
+	if err != nil {
+		t.Fatalf("Error creating server connection: %s", err)
+	}
+	clientReceived := make(chan ControlMessage, 1)
+	serverReceived := make(chan ControlMessage, 2)
+	client.SetControlChannel(func(msg ControlMessage) {
+		clientReceived <- msg
+	})
+	server.SetControlChannel(func(msg ControlMessage) {
+		serverReceived <- msg
+	})
+	handled := make(chan *Stream, 2)
+	go client.Serve(NoOpStreamHandler)
+	go server.Serve(func(s *Stream) {
+		handled <- s
+		MirrorStreamHandler(s)
+	})
+	defer server.Close()
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.ControlChannel().Send(ctx, ControlMessage{Type: "rekey", Payload: []byte{1, 2}}); err != nil {
+		t.Fatalf("Error sending control message: %s", err)
+	}
+	if err := client.ControlChannel().Send(ctx, ControlMessage{Type: "stats"}); err != nil {
+		t.Fatalf("Error sending control message: %s", err)
+	}
+	if err := server.ControlChannel().Send(ctx, ControlMessage{Type: "config", Payload: []byte("a=b")}); err != nil {
+		t.Fatalf("Error sending control message: %s", err)
+	}
+
+	for _, expected := range []ControlMessage{{Type: "rekey", Payload: []byte{1, 2}}, {Type: "stats"}} {
+		select {
+		case msg := <-serverReceived:
+			if msg.Type != expected.Type || !bytes.Equal(msg.Payload, expected.Payload) {
+				t.Fatalf("Unexpected control message:\nActual: %+v\nExpected: %+v", msg, expected)
+			}
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for control message")
+		}
+	}
+	select {
+	case msg := <-clientReceived:
+		if msg.Type != "config" || string(msg.Payload) != "a=b" {
+			t.Fatalf("Unexpected control message: %+v", msg)
+		}
+	case <-ctx.Done():
+		t.Fatal("Timed out waiting for control message")
+	}
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	if s := <-handled; s.Headers().Get(StreamTypeHeader) == StreamTypeControl {
+		t.Fatal("Control stream passed to stream handler")
+	}
+
+	noneConn, _ := net.Pipe()
+	none, err := NewConnection(noneConn, false)
+	if err != nil {
+		t.Fatalf("Error creating connection: %s", err)
+	}
+	if err := none.ControlChannel().Send(ctx, ControlMessage{Type: "rekey"}); err != ErrNoControlChannel {
+		t.Fatalf("Unexpected error:\nActual: %v\nExpected: %v", err, ErrNoControlChannel)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	received := make(chan string, 3)
+	client, server := newTestConnections(t, nil, func(s *Stream) {
+		s.SendReply(http.Header{}, false)
+		go func() {
+			data, err := s.ReadData()
+			if err == nil {
+				received <- string(data)
+			}
+		}()
+	})
+	defer server.Close()
+	defer client.Close()
+
+	var streams []*Stream
+	for i := 0; i < 3; i++ {
+		stream, err := client.CreateStream(http.Header{}, nil, false)
+		if err != nil {
+			t.Fatalf("Error creating stream: %s", err)
+		}
+		if err := stream.Wait(); err != nil {
+			t.Fatalf("Error waiting for stream: %s", err)
+		}
+		streams = append(streams, stream)
+	}
+	if err := streams[2].Abort(nil); err != nil {
+		t.Fatalf("Error aborting stream: %s", err)
+	}
+
+	err := Broadcast(streams, []byte("news"))
+	broadcastErr, ok := err.(*BroadcastError)
+	if !ok {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(broadcastErr.Errors) != 1 || !errors.Is(broadcastErr.Errors[streams[2]], ErrReset) {
+		t.Fatalf("Unexpected broadcast errors: %v", broadcastErr.Errors)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case data := <-received:
+			if data != "news" {
+				t.Fatalf("Unexpected data:\nActual: %q\nExpected: %q", data, "news")
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for broadcast data")
+		}
+	}
+
+	if err := Broadcast(streams[:2], []byte("more")); err != nil {
+		t.Fatalf("Error broadcasting: %s", err)
+	}
+}
+
+func TestStreamGroup(t *testing.T) {
+	resets := make(chan *Stream, 2)
+	client, server := newTestConnections(t, nil, func(s *Stream) {
+		MirrorStreamHandler(s)
+		if s.Headers().Get("Group") == "reset" {
+			go func() {
+				<-s.closeChan
+				resets <- s
+			}()
+		}
+	})
+	defer server.Close()
+	defer client.Close()
+
+	newGroup := func(name string) *StreamGroup {
+		group := NewStreamGroup()
+		for i := 0; i < 2; i++ {
+			stream, err := client.CreateStream(http.Header{"Group": {name}}, nil, false)
+			if err != nil {
+				t.Fatalf("Error creating stream: %s", err)
+			}
+			if err := stream.Wait(); err != nil {
+				t.Fatalf("Error waiting for stream: %s", err)
+			}
+			group.Add(stream)
+		}
+		return group
+	}
+
+	closed := newGroup("close")
+	if stats := closed.Stats(); stats != (StreamGroupStats{Streams: 2, Open: 2}) {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+	if err := closed.CloseAll(); err != nil {
+		t.Fatalf("Error closing group: %s", err)
+	}
+	select {
+	case <-closed.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for closed group")
+	}
+	if stats := closed.Stats(); stats != (StreamGroupStats{Streams: 2, Open: 0, Finished: 2}) {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+
+	reset := newGroup("reset")
+	if err := reset.ResetAll(spdy.Cancel); err != nil {
+		t.Fatalf("Error resetting group: %s", err)
+	}
+	select {
+	case <-reset.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for reset group")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-resets:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for remote reset")
+		}
+	}
+}
+
+func TestPauseReading(t *testing.T) {
+	client, server := newTestConnections(t, nil, MirrorStreamHandler)
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+
+	stream.PauseReading()
+	if _, err := stream.Write([]byte("paused")); err != nil {
+		t.Fatalf("Error writing to stream: %s", err)
+	}
+	read := make(chan []byte)
+	go func() {
+		data, err := stream.ReadData()
+		if err != nil {
+			t.Errorf("Error reading from stream: %s", err)
+		}
+		read <- data
+	}()
+	select {
+	case data := <-read:
+		t.Fatalf("Read while paused: %q", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	stream.ResumeReading()
+	select {
+	case data := <-read:
+		if string(data) != "paused" {
+			t.Fatalf("Unexpected data:\nActual: %q\nExpected: %q", data, "paused")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for resumed read")
+	}
+
+	stream.PauseReading()
+	go func() {
+		_, err := stream.ReadData()
+		read <- []byte(fmt.Sprint(err))
+	}()
+	if err := stream.Reset(); err != nil {
+		t.Fatalf("Error resetting stream: %s", err)
+	}
+	select {
+	case data := <-read:
+		if string(data) != io.EOF.Error() {
+			t.Fatalf("Unexpected error:\nActual: %s\nExpected: %s", data, io.EOF)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for paused read to fail")
+	}
+}
+
+func TestPauseReadingDiscard(t *testing.T) {
+	streams := make(chan *Stream, 1)
+	client, server := newTestConnections(t, func(c *Connection) {
+		c.SetDataQueue(4)
+	}, func(s *Stream) {
+		s.SendReply(http.Header{}, false)
+		streams <- s
+	})
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	remote := <-streams
+
+	remote.PauseReading()
+	for _, message := range []string{"one", "two"} {
+		if _, err := stream.Write([]byte(message)); err != nil {
+			t.Fatalf("Error writing to stream: %s", err)
+		}
+	}
+	for i := 0; i < 100 && remote.BufferedRecvBytes() < 6; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// queued frames are not discarded while paused
+	discarded := make(chan int64, 1)
+	go func() {
+		n, err := remote.DiscardRemaining()
+		if err != nil {
+			t.Errorf("Error discarding: %s", err)
+		}
+		discarded <- n
+	}()
+	select {
+	case n := <-discarded:
+		t.Fatalf("Discarded %d bytes while paused", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if buffered := remote.BufferedRecvBytes(); buffered != 6 {
+		t.Fatalf("Unexpected buffered bytes while paused:\nActual: %d\nExpected: %d", buffered, 6)
+	}
+
+	remote.ResumeReading()
+	if err := stream.Close(); err != nil {
+		t.Fatalf("Error closing stream: %s", err)
+	}
+	select {
+	case n := <-discarded:
+		if n != 6 {
+			t.Fatalf("Unexpected discarded bytes:\nActual: %d\nExpected: %d", n, 6)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for discard")
+	}
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	client, server := newTestConnections(t, nil, MirrorStreamHandler)
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	other, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+
+	stream.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = stream.Read(make([]byte, 16))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Unexpected read error:\nActual: %v\nExpected: timeout", err)
+	}
+
+	if _, err := other.Write([]byte("other")); err != nil {
+		t.Fatalf("Error writing to other stream: %s", err)
+	}
+	data, err := other.ReadData()
+	if err != nil {
+		t.Fatalf("Error reading from other stream: %s", err)
+	}
+	if string(data) != "other" {
+		t.Fatalf("Unexpected data:\nActual: %q\nExpected: %q", data, "other")
+	}
+
+	stream.SetReadDeadline(time.Now().Add(time.Hour))
+	read := make(chan error)
+	go func() {
+		_, err := stream.ReadData()
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		t.Fatalf("Read returned before deadline: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	stream.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	select {
+	case err := <-read:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("Unexpected read error:\nActual: %v\nExpected: timeout", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for shortened deadline")
+	}
+
+	stream.SetReadDeadline(time.Time{})
+	if _, err := stream.Write([]byte("late")); err != nil {
+		t.Fatalf("Error writing to stream: %s", err)
+	}
+	data, err = stream.ReadData()
+	if err != nil {
+		t.Fatalf("Error reading after deadline reset: %s", err)
+	}
+	if string(data) != "late" {
+		t.Fatalf("Unexpected data:\nActual: %q\nExpected: %q", data, "late")
+	}
+}
+
+func TestWriteAfterConnectionClosed(t *testing.T) {
+	client, server := newTestConnections(t, nil, MirrorStreamHandler)
+	defer client.Close()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+
+	server.conn.Close()
+	select {
+	case <-client.CloseChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for connection to close")
+	}
+
+	for i := 0; i < 2; i++ {
+		err := stream.WriteData([]byte("dead"), false)
+		if !errors.Is(err, ErrConnectionClosed) {
+			t.Fatalf("Unexpected write error:\nActual: %v\nExpected: %v", err, ErrConnectionClosed)
+		}
+		if !errors.Is(err, io.EOF) {
+			t.Fatalf("Unexpected transport error:\nActual: %v\nExpected: %v", errors.Unwrap(err), io.EOF)
+		}
+	}
+}
+
+func TestHalfCloseTimeout(t *testing.T) {
+	for _, policy := range []HalfClosePolicy{HalfCloseRemove, HalfCloseReset} {
+		serverStreams := make(chan *Stream, 1)
+		client, server := newTestConnections(t, func(conn *Connection) {
+			conn.SetHalfCloseTimeout(50*time.Millisecond, policy)
+		}, func(stream *Stream) {
+			stream.SendReply(http.Header{}, false)
+			stream.Close()
+			serverStreams <- stream
+		})
+
+		stream, err := client.CreateStream(http.Header{}, nil, false)
+		if err != nil {
+			t.Fatalf("Error creating stream: %s", err)
+		}
+		if err := stream.Wait(); err != nil {
+			t.Fatalf("Error waiting for stream: %s", err)
+		}
+		serverStream := <-serverStreams
+
+		// the client never finishes its side
+		select {
+		case <-serverStream.closeChan:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for stream to be reaped with policy %d", policy)
+		}
+		if server.FindStream(uint32(serverStream.streamId)) != nil {
+			t.Fatalf("Reaped stream still tracked with policy %d", policy)
+		}
+
+		// a reset removes the stream half open on the client
+		var reset bool
+		for i := 0; i < 10 && !reset; i++ {
+			time.Sleep(10 * time.Millisecond)
+			reset = client.FindStream(uint32(stream.streamId)) == nil
+		}
+		if reset != (policy == HalfCloseReset) {
+			t.Fatalf("Unexpected remote reset with policy %d:\nActual: %t\nExpected: %t", policy, reset, policy == HalfCloseReset)
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestWindowUpdatePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy    WindowUpdatePolicy
+		threshold float64
+		frames    int
+		size      int
+		expected  []uint32
+	}{
+		{WindowUpdateNone, 0, 3, 100, nil},
+		{WindowUpdateEager, 0, 3, 100, []uint32{100, 100, 100}},
+		{WindowUpdateThreshold, 0.5, 10, 8192, []uint32{32768, 32768}},
+		{WindowUpdateManual, 0, 3, 100, []uint32{300}},
+	} {
+		updates := make(chan uint32, 10)
+		done := make(chan struct{})
+		client, server := newTestConnections(t, func(conn *Connection) {
+			conn.SetWindowUpdatePolicy(tc.policy, tc.threshold)
+			conn.SetFrameObserver(func(info FrameInfo) error {
+				if frame, ok := info.Frame.(*spdy.WindowUpdateFrame); ok && info.Sent {
+					updates <- frame.DeltaWindowSize
+				}
+				return nil
+			}, true)
+		}, func(stream *Stream) {
+			stream.SendReply(http.Header{}, false)
+			go func() {
+				defer close(done)
+				for i := 0; i < tc.frames; i++ {
+					if _, err := stream.ReadData(); err != nil {
+						t.Errorf("Error reading from stream: %s", err)
+						return
+					}
+				}
+				if tc.policy == WindowUpdateManual {
+					if err := stream.UpdateWindow(); err != nil {
+						t.Errorf("Error updating window: %s", err)
+					}
+				}
+			}()
+		})
+
+		stream, err := client.CreateStream(http.Header{}, nil, false)
+		if err != nil {
+			t.Fatalf("Error creating stream: %s", err)
+		}
+		for i := 0; i < tc.frames; i++ {
+			if err := stream.WriteData(make([]byte, tc.size), false); err != nil {
+				t.Fatalf("Error writing to stream: %s", err)
+			}
+		}
+		<-done
+
+		var deltas []uint32
+	Collect:
+		for {
+			select {
+			case delta := <-updates:
+				deltas = append(deltas, delta)
+			case <-time.After(50 * time.Millisecond):
+				break Collect
+			}
+		}
+		if !reflect.DeepEqual(deltas, tc.expected) {
+			t.Fatalf("Unexpected window updates with policy %d:\nActual: %v\nExpected: %v", tc.policy, deltas, tc.expected)
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestGrantCredit(t *testing.T) {
+	updates := make(chan uint32, 10)
+	done := make(chan struct{})
+	client, server := newTestConnections(t, func(conn *Connection) {
+		conn.SetWindowUpdatePolicy(WindowUpdateCredit, 0)
+		conn.SetFrameObserver(func(info FrameInfo) error {
+			if frame, ok := info.Frame.(*spdy.WindowUpdateFrame); ok && info.Sent {
+				updates <- frame.DeltaWindowSize
+			}
+			return nil
+		}, true)
+	}, func(stream *Stream) {
+		stream.SendReply(http.Header{}, false)
+		go func() {
+			defer close(done)
+			for i := 0; i < 2; i++ {
+				if _, err := stream.ReadData(); err != nil {
+					t.Errorf("Error reading from stream: %s", err)
+					return
+				}
+			}
+			if window := stream.ReceiveWindow(); window != DefaultReceiveWindow-200 {
+				t.Errorf("Unexpected window:\nActual: %d\nExpected: %d", window, DefaultReceiveWindow-200)
+			}
+			if err := stream.GrantCredit(300); err != nil {
+				t.Errorf("Error granting credit: %s", err)
+			}
+			if window := stream.ReceiveWindow(); window != DefaultReceiveWindow+100 {
+				t.Errorf("Unexpected window:\nActual: %d\nExpected: %d", window, DefaultReceiveWindow+100)
+			}
+			if err := stream.GrantCredit(maxReceiveWindow); err != ErrInvalidCredit {
+				t.Errorf("Unexpected grant error:\nActual: %v\nExpected: %v", err, ErrInvalidCredit)
+			}
+		}()
+	})
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := stream.WriteData(make([]byte, 100), false); err != nil {
+			t.Fatalf("Error writing to stream: %s", err)
+		}
+	}
+	<-done
+
+	select {
+	case delta := <-updates:
+		if delta != 300 {
+			t.Fatalf("Unexpected window update:\nActual: %d\nExpected: %d", delta, 300)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for window update")
+	}
+	select {
+	case delta := <-updates:
+		t.Fatalf("Unexpected extra window update: %d", delta)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := stream.GrantCredit(100); err != ErrInvalidCredit {
+		t.Fatalf("Unexpected grant error without credit mode:\nActual: %v\nExpected: %v", err, ErrInvalidCredit)
+	}
+}
+
+func TestReplyHeaders(t *testing.T) {
+	client, server := newTestConnections(t, func(conn *Connection) {
+		conn.SetReplyHeaderEcho("x-request-id")
+		conn.SetReplyHeaderFunc(func(request http.Header) http.Header {
+			return http.Header{
+				"X-Served-By":     {"hook"},
+				"X-Request-Other": {request.Get("X-Other")},
+			}
+		})
+	}, func(stream *Stream) {
+		stream.SendReply(http.Header{"X-Served-By": {"handler"}}, false)
+	})
+	defer server.Close()
+	defer client.Close()
+
+	headers := http.Header{}
+	headers.Set("X-Request-Id", "abc")
+	headers.Set("X-Other", "other")
+	stream, err := client.CreateStream(headers, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+
+	reply := stream.ReplyHeaders()
+	for name, expected := range map[string]string{
+		"X-Request-Id":    "abc",
+		"X-Served-By":     "handler",
+		"X-Request-Other": "other",
+		"X-Other":         "",
+	} {
+		if actual := reply.Get(name); actual != expected {
+			t.Fatalf("Unexpected reply header %s:\nActual: %q\nExpected: %q", name, actual, expected)
+		}
+	}
+}
+
+func TestTraceID(t *testing.T) {
+	accepted := make(chan string, 2)
+	client, server := newTestConnections(t, func(conn *Connection) {
+		conn.SetTraceIDs(true)
+	}, func(stream *Stream) {
+		accepted <- stream.TraceID()
+		stream.SendReply(http.Header{}, false)
+	})
+	defer server.Close()
+	defer client.Close()
+
+	headers := http.Header{}
+	headers.Set(TraceIDHeader, "abc")
+	stream, err := client.CreateStream(headers, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if id := stream.TraceID(); id != "abc" {
+		t.Fatalf("Unexpected trace id:\nActual: %q\nExpected: %q", id, "abc")
+	}
+	if id := <-accepted; id != "abc" {
+		t.Fatalf("Unexpected accepted trace id:\nActual: %q\nExpected: %q", id, "abc")
+	}
+	stream.Abort(nil)
+	if _, err := stream.Write([]byte("aborted")); err == nil || !strings.Contains(err.Error(), "abc") {
+		t.Fatalf("Expected error with trace id, got: %v", err)
+	}
+
+	// the client does not generate trace ids, the server does
+	stream, err = client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if id := stream.TraceID(); id != "" {
+		t.Fatalf("Unexpected trace id:\nActual: %q\nExpected: %q", id, "")
+	}
+	if id := <-accepted; len(id) != 16 {
+		t.Fatalf("Unexpected generated trace id: %q", id)
+	}
+
+	generated, err := server.CreateStream(http.Header{}, nil, true)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if id := generated.Headers().Get(TraceIDHeader); id == "" || id != generated.TraceID() {
+		t.Fatalf("Unexpected generated trace id:\nActual: %q\nExpected: %q", id, generated.TraceID())
+	}
+}
+
+func TestStreamQuota(t *testing.T) {
+	violations := make(chan QuotaViolation, 3)
+	writeErrs := make(chan error, 1)
+	onViolation := func(stream *Stream, violation QuotaViolation) {
+		violations <- violation
+	}
+	client, server := newTestConnections(t, func(conn *Connection) {
+		conn.SetStreamQuota(StreamQuota{MaxBytesIn: 10}, onViolation)
+	}, func(stream *Stream) {
+		stream.SendReply(http.Header{}, false)
+		switch stream.Headers().Get("Quota") {
+		case "out":
+			stream.SetQuota(StreamQuota{MaxBytesOut: 5}, onViolation)
+			writeErrs <- stream.WriteData(make([]byte, 10), false)
+		case "lifetime":
+			stream.SetQuota(StreamQuota{MaxLifetime: 50 * time.Millisecond}, onViolation)
+		default:
+			go io.Copy(ioutil.Discard, stream)
+		}
+	})
+	defer server.Close()
+	defer client.Close()
+
+	expectViolation := func(expected QuotaViolation) {
+		select {
+		case violation := <-violations:
+			if violation != expected {
+				t.Fatalf("Unexpected violation:\nActual: %s\nExpected: %s", violation, expected)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for %s violation", expected)
+		}
+	}
+	expectReset := func(stream *Stream) {
+		select {
+		case <-stream.closeChan:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for reset")
+		}
+	}
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := stream.WriteData(make([]byte, 8), false); err != nil {
+			t.Fatalf("Error writing to stream: %s", err)
+		}
+	}
+	expectViolation(QuotaBytesIn)
+	expectReset(stream)
+
+	stream, err = client.CreateStream(http.Header{"Quota": {"out"}}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	expectViolation(QuotaBytesOut)
+	if err := <-writeErrs; !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Unexpected write error:\nActual: %v\nExpected: %v", err, ErrQuotaExceeded)
+	}
+	expectReset(stream)
+
+	stream, err = client.CreateStream(http.Header{"Quota": {"lifetime"}}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	expectViolation(QuotaLifetime)
+	expectReset(stream)
+}
+
+func TestAcceptPriority(t *testing.T) {
+	release := make(chan struct{})
+	accepted := make(chan uint32, 16)
+	client, server := newTestConnections(t, func(conn *Connection) {
+		conn.SetAcceptPriority(HeaderAcceptPriority("Accept-Priority"))
+	}, func(stream *Stream) {
+		if stream.Identifier() == 1 {
+			// hold the frame worker of the streams with ids 1, 11, 21
+			// and 31 while they are queued
+			<-release
+		}
+		accepted <- stream.Identifier()
+		stream.SendReply(http.Header{}, true)
+	})
+	defer server.Close()
+	defer client.Close()
+
+	priorities := map[uint32]string{11: "7", 21: "3", 31: "0"}
+	for id := uint32(1); id <= 31; id += 2 {
+		headers := http.Header{}
+		if priority, ok := priorities[id]; ok {
+			headers.Set("Accept-Priority", priority)
+		}
+		stream, err := client.CreateStream(headers, nil, true)
+		if err != nil {
+			t.Fatalf("Error creating stream: %s", err)
+		}
+		if stream.Identifier() != id {
+			t.Fatalf("Unexpected stream id:\nActual: %d\nExpected: %d", stream.Identifier(), id)
+		}
+	}
+	for i := 0; server.NumActiveStreams() < 16 && i < 1000; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// let the read loop queue the last stream after adding it
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	var order []uint32
+	for i := 0; i < 16; i++ {
+		select {
+		case id := <-accepted:
+			if id%FRAME_WORKERS == 1 {
+				order = append(order, id)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for streams")
+		}
+	}
+	expected := []uint32{1, 31, 21, 11}
+	if !reflect.DeepEqual(order, expected) {
+		t.Fatalf("Unexpected accept order:\nActual: %v\nExpected: %v", order, expected)
+	}
+}
+
+func TestWriteFairness(t *testing.T) {
+	client, server := newTestConnections(t, nil, func(stream *Stream) {
+		stream.SendReply(http.Header{}, false)
+		go io.Copy(ioutil.Discard, stream)
+	})
+	defer server.Close()
+	defer client.Close()
+
+	bulk, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	small, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+
+	stop := make(chan struct{})
+	var bulkFrames int64
+	bulkDone := make(chan struct{})
+	go func() {
+		defer close(bulkDone)
+		frame := make([]byte, 64*1024)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := bulk.WriteData(frame, false); err != nil {
+				t.Errorf("Error writing bulk frame: %s", err)
+				return
+			}
+			atomic.AddInt64(&bulkFrames, 1)
+		}
+	}()
+
+	// the small writer completes while the bulk writer keeps the
+	// connection busy
+	smallDone := make(chan error, 1)
+	go func() {
+		for i := 0; i < 200; i++ {
+			if err := small.WriteData([]byte{byte(i)}, false); err != nil {
+				smallDone <- err
+				return
+			}
+		}
+		smallDone <- nil
+	}()
+	select {
+	case err := <-smallDone:
+		if err != nil {
+			t.Fatalf("Error writing small frame: %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Small frame writer starved")
+	}
+	close(stop)
+	<-bulkDone
+
+	stats := client.Stats()
+	if expected := uint64(200 + atomic.LoadInt64(&bulkFrames)); stats.FramesWritten < expected {
+		t.Fatalf("Unexpected frames written:\nActual: %d\nExpected: >= %d", stats.FramesWritten, expected)
+	}
+	if stats.WriteWait < stats.MaxWriteWait || stats.MaxWriteWait > time.Second {
+		t.Fatalf("Unexpected write waits: total %s, max %s", stats.WriteWait, stats.MaxWriteWait)
+	}
+}
+
+func TestGoroutineLimit(t *testing.T) {
+	client, server := newTestConnections(t, func(conn *Connection) {
+		conn.SetGoroutineLimit(2)
+	}, MirrorStreamHandler)
+	defer server.Close()
+	defer client.Close()
+
+	base := server.Goroutines()
+	if base == 0 {
+		t.Fatal("Serving goroutines not counted")
+	}
+
+	// each mirrored stream takes two goroutines, the second stream is
+	// queued until the first is done
+	first, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	second, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	for _, stream := range []*Stream{first, second} {
+		if err := stream.Wait(); err != nil {
+			t.Fatalf("Error waiting for stream: %s", err)
+		}
+		if err := stream.WriteData([]byte("mirrored"), false); err != nil {
+			t.Fatalf("Error writing to stream: %s", err)
+		}
+	}
+	if goroutines := server.Goroutines(); goroutines != base+2 {
+		t.Fatalf("Unexpected goroutines:\nActual: %d\nExpected: %d", goroutines, base+2)
+	}
+
+	// the streams are accepted by different frame workers in any order
+	mirrored := make(chan *Stream, 2)
+	for _, stream := range []*Stream{first, second} {
+		go func(stream *Stream) {
+			if data, err := stream.ReadData(); err == nil && string(data) == "mirrored" {
+				mirrored <- stream
+			}
+		}(stream)
+	}
+	var running *Stream
+	select {
+	case running = <-mirrored:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for mirrored stream")
+	}
+	select {
+	case <-mirrored:
+		t.Fatal("Queued stream mirrored")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := running.Reset(); err != nil {
+		t.Fatalf("Error resetting stream: %s", err)
+	}
+	select {
+	case <-mirrored:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for queued stream")
+	}
+}
+
+func TestWaitTeardown(t *testing.T) {
+	client, server := newTestConnections(t, nil, MirrorStreamHandler)
+
+	for i := 0; i < 3; i++ {
+		stream, err := client.CreateStreamContext(context.Background(), http.Header{}, nil, false)
+		if err != nil {
+			t.Fatalf("Error creating stream: %s", err)
+		}
+		if err := stream.Wait(); err != nil {
+			t.Fatalf("Error waiting for stream: %s", err)
+		}
+	}
+	if server.Goroutines() == 0 || client.Goroutines() == 0 {
+		t.Fatal("Goroutines not counted")
+	}
+
+	client.SetCloseTimeout(50 * time.Millisecond)
+	if err := client.Close(); err != nil {
+		t.Fatalf("Error closing client: %s", err)
+	}
+	for _, conn := range []*Connection{client, server} {
+		if err := conn.Wait(10 * time.Second); err != nil {
+			t.Fatalf("Error waiting for teardown: %s", err)
+		}
+		if goroutines := conn.Goroutines(); goroutines != 0 {
+			t.Fatalf("Unexpected goroutines after teardown:\nActual: %d\nExpected: 0", goroutines)
+		}
+		if streams := conn.NumActiveStreams(); streams != 0 {
+			t.Fatalf("Unexpected streams after teardown:\nActual: %d\nExpected: 0", streams)
+		}
+	}
+}
+
+func TestWaitUndrainedNotify(t *testing.T) {
+	// nothing ever receives from notified
+	notified := make(chan *Stream)
+	client, server := newTestConnections(t, func(conn *Connection) {
+		conn.NotifyClose(notified, 0)
+	}, NoOpStreamHandler)
+
+	client.SetCloseTimeout(50 * time.Millisecond)
+	if err := client.Close(); err != nil {
+		t.Fatalf("Error closing client: %s", err)
+	}
+	if err := server.Wait(2 * time.Second); err != nil {
+		t.Fatalf("Error waiting for teardown:\nActual: %v\nExpected: %v", err, nil)
+	}
+	if goroutines := server.Goroutines(); goroutines != 0 {
+		t.Fatalf("Unexpected goroutines after teardown:\nActual: %d\nExpected: 0", goroutines)
+	}
+}
+
+func TestPostCloseErrors(t *testing.T) {
+	remoteReset := make(chan struct{})
+	client, server := newTestConnections(t, nil, func(stream *Stream) {
+		stream.SendReply(http.Header{}, false)
+		if stream.Headers().Get("Reset") != "" {
+			stream.Reset()
+			close(remoteReset)
+		}
+	})
+	defer server.Close()
+
+	create := func(headers http.Header) *Stream {
+		stream, err := client.CreateStream(headers, nil, false)
+		if err != nil {
+			t.Fatalf("Error creating stream: %s", err)
+		}
+		if err := stream.Wait(); err != nil {
+			t.Fatalf("Error waiting for stream: %s", err)
+		}
+		return stream
+	}
+
+	closed := create(http.Header{})
+	if err := closed.Close(); err != nil {
+		t.Fatalf("Error closing stream: %s", err)
+	}
+	reset := create(http.Header{})
+	if err := reset.Reset(); err != nil {
+		t.Fatalf("Error resetting stream: %s", err)
+	}
+	remote := create(http.Header{"Reset": []string{"1"}})
+	<-remoteReset
+	select {
+	case <-remote.closeChan:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for remote reset")
+	}
+
+	for _, tc := range []struct {
+		name     string
+		stream   *Stream
+		expected error
+	}{
+		{"closed", closed, ErrWriteClosedStream},
+		{"reset", reset, ErrReset},
+		{"remote reset", remote, ErrReset},
+	} {
+		for i := 0; i < 2; i++ {
+			if err := tc.stream.WriteData([]byte("late"), false); err != tc.expected {
+				t.Fatalf("Unexpected %s write error:\nActual: %v\nExpected: %v", tc.name, err, tc.expected)
+			}
+			if err := tc.stream.SendHeader(http.Header{}, false); err != tc.expected {
+				t.Fatalf("Unexpected %s header error:\nActual: %v\nExpected: %v", tc.name, err, tc.expected)
+			}
+			if err := tc.stream.Close(); err != tc.expected {
+				t.Fatalf("Unexpected %s close error:\nActual: %v\nExpected: %v", tc.name, err, tc.expected)
+			}
+		}
+	}
+	for _, stream := range []*Stream{closed, reset, remote} {
+		for i := 0; i < 2; i++ {
+			if err := stream.Reset(); err != nil {
+				t.Fatalf("Unexpected reset error:\nActual: %v\nExpected: <nil>", err)
+			}
+		}
+	}
+	for _, stream := range []*Stream{reset, remote} {
+		if _, err := stream.CreateSubStream(http.Header{}, false); err != ErrReset {
+			t.Fatalf("Unexpected sub stream error:\nActual: %v\nExpected: %v", err, ErrReset)
+		}
+		if _, err := stream.CreateErrorStream(false); err != ErrReset {
+			t.Fatalf("Unexpected error stream error:\nActual: %v\nExpected: %v", err, ErrReset)
+		}
+	}
+	if err := closed.SendReply(http.Header{}, false); err != ErrReplyOnLocalStream {
+		t.Fatalf("Unexpected reply error:\nActual: %v\nExpected: %v", err, ErrReplyOnLocalStream)
+	}
+
+	open := create(http.Header{})
+	if err := client.Close(); err != nil {
+		t.Fatalf("Error closing connection: %s", err)
+	}
+	select {
+	case <-client.CloseChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for connection to close")
+	}
+	for i := 0; i < 2; i++ {
+		if err := open.WriteData([]byte("late"), false); !errors.Is(err, ErrConnectionClosed) {
+			t.Fatalf("Unexpected write error:\nActual: %v\nExpected: %v", err, ErrConnectionClosed)
+		}
+		if _, err := client.Ping(); !errors.Is(err, ErrConnectionClosed) {
+			t.Fatalf("Unexpected ping error:\nActual: %v\nExpected: %v", err, ErrConnectionClosed)
+		}
+		if err := client.Close(); err != nil {
+			t.Fatalf("Unexpected close error:\nActual: %v\nExpected: <nil>", err)
+		}
+	}
+
+	// Serve returns at once when called again
+	served := make(chan struct{})
+	go func() {
+		client.Serve(NoOpStreamHandler)
+		close(served)
+	}()
+	select {
+	case <-served:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for second Serve to return")
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	streams := make(chan *Stream, 1)
+	client, server := newTestConnections(t, nil, func(stream *Stream) {
+		stream.SendReply(http.Header{}, false)
+		streams <- stream
+	})
+
+	if _, ok := server.CloseReason(); ok {
+		t.Fatal("Unexpected close reason before close")
+	}
+	reason := CloseReason{Code: CloseCodeMaintenance, Message: "back in 5 minutes"}
+	if err := client.CloseWithReason(reason); err != nil {
+		t.Fatalf("Error closing connection: %s", err)
+	}
+	select {
+	case <-server.CloseChan():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for connection to close")
+	}
+
+	actual, ok := server.CloseReason()
+	if !ok || actual != reason {
+		t.Fatalf("Unexpected close reason:\nActual: %#v\nExpected: %#v", actual, reason)
+	}
+	select {
+	case stream := <-streams:
+		t.Fatalf("Unexpected stream passed to handler: %s", stream.Headers())
+	default:
+	}
+	if _, ok := client.CloseReason(); ok {
+		t.Fatal("Unexpected close reason on the closing side")
+	}
+}
+
+type testPriorityKey struct{}
+
+func TestCreateStreamContextPriority(t *testing.T) {
+	priorities := make(chan uint8, 2)
+	clientConn, serverConn := net.Pipe()
+	client, err := NewConnection(clientConn, false)
+	if err != nil {
+		t.Fatalf("Error creating client connection: %s", err)
+	}
+	server, err := NewConnection(serverConn, true)
+	if err != nil {
+		t.Fatalf("Error creating server connection: %s", err)
+	}
+	client.SetContextPriority(func(ctx context.Context) (uint8, bool) {
+		priority, ok := ctx.Value(testPriorityKey{}).(uint8)
+		return priority, ok
+	})
+	go client.Serve(NoOpStreamHandler)
+	go server.Serve(func(s *Stream) {
+		priorities <- s.priority
+		s.SendReply(http.Header{}, true)
+	})
+	defer server.Close()
+	defer client.Close()
+
+	for _, expected := range []uint8{3, 0} {
+		ctx := context.Background()
+		if expected != 0 {
+			ctx = context.WithValue(ctx, testPriorityKey{}, expected)
+		}
+		stream, err := client.CreateStreamContext(ctx, http.Header{}, nil, true)
+		if err != nil {
+			t.Fatalf("Error creating stream: %s", err)
+		}
+		if stream.priority != expected {
+			t.Fatalf("Unexpected local priority:\nActual: %d\nExpected: %d", stream.priority, expected)
+		}
+		select {
+		case priority := <-priorities:
+			if priority != expected {
+				t.Fatalf("Unexpected remote priority:\nActual: %d\nExpected: %d", priority, expected)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for stream")
+		}
+	}
+}
+
+func TestInvalidRemoteStreamIds(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	server, err := NewConnection(serverConn, true)
+	if err != nil {
+		t.Fatalf("Error creating server connection: %s", err)
+	}
+	accepted := make(chan spdy.StreamId, 5)
+	go server.Serve(func(s *Stream) {
+		accepted <- s.streamId
+	})
+	defer server.Close()
+
+	framer, err := spdy.NewFramer(clientConn, clientConn)
+	if err != nil {
+		t.Fatalf("Error creating framer: %s", err)
+	}
+	resets := make(chan *spdy.RstStreamFrame, 5)
+	go func() {
+		for {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			if reset, ok := frame.(*spdy.RstStreamFrame); ok {
+				resets <- reset
+			}
+		}
+	}()
+
+	// 2 has the parity of the server, the second 1 is a duplicate and 3 is
+	// lower than 5
+	for _, id := range []spdy.StreamId{1, 2, 1, 5, 3} {
+		frame := &spdy.SynStreamFrame{StreamId: id, Headers: http.Header{}}
+		if err := framer.WriteFrame(frame); err != nil {
+			t.Fatalf("Error writing stream frame: %s", err)
+		}
+	}
+
+	rejected := map[spdy.StreamId]int{}
+	for i := 0; i < 3; i++ {
+		select {
+		case reset := <-resets:
+			if reset.Status != spdy.ProtocolError {
+				t.Fatalf("Unexpected reset status:\nActual: %v\nExpected: %v", reset.Status, spdy.ProtocolError)
+			}
+			rejected[reset.StreamId]++
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for reset")
+		}
+	}
+	if rejected[1] != 1 || rejected[2] != 1 || rejected[3] != 1 {
+		t.Fatalf("Unexpected rejected streams: %v", rejected)
+	}
+	// streams are handled by different frame workers, in any order
+	acceptedIds := map[spdy.StreamId]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case id := <-accepted:
+			acceptedIds[id] = true
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for stream")
+		}
+	}
+	if !acceptedIds[1] || !acceptedIds[5] {
+		t.Fatalf("Unexpected accepted streams: %v", acceptedIds)
+	}
+	select {
+	case id := <-accepted:
+		t.Fatalf("Invalid stream %d accepted", id)
+	default:
+	}
+}
+
+func TestStreamTableChurn(t *testing.T) {
+	client, server := newTestConnections(t, nil, func(s *Stream) {
+		s.SendReply(http.Header{}, true)
+	})
+	defer server.Close()
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				stream, err := client.CreateStream(http.Header{}, nil, false)
+				if err != nil {
+					t.Errorf("Error creating stream: %s", err)
+					return
+				}
+				if found := client.FindStream(stream.Identifier()); found != stream && found != nil {
+					t.Errorf("Unexpected stream found for %d", stream.Identifier())
+				}
+				server.FindStream(stream.Identifier())
+				server.NumPendingAccepts()
+				client.NumActiveStreams()
+				client.RemainingStreamCapacity()
+				stream.Reset()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMemoryUsage(t *testing.T) {
+	client, server := newTestConnections(t, nil, MirrorStreamHandler)
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.CreateStream(http.Header{"Name": {"value"}}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	if _, err := stream.Write([]byte("hello world")); err != nil {
+		t.Fatalf("Error writing to stream: %s", err)
+	}
+	if _, err := stream.Read(make([]byte, 5)); err != nil {
+		t.Fatalf("Error reading from stream: %s", err)
+	}
+
+	usage := client.MemoryUsage()
+	if len(usage.Streams) != 1 || usage.Streams[0].StreamId != stream.Identifier() {
+		t.Fatalf("Unexpected stream usages: %+v", usage.Streams)
+	}
+	if usage.ReceiveBufferBytes != 6 {
+		t.Fatalf("Unexpected receive buffer bytes:\nActual: %d\nExpected: %d", usage.ReceiveBufferBytes, 6)
+	}
+	if usage.HeaderBlockBytes != 9 {
+		t.Fatalf("Unexpected header block bytes:\nActual: %d\nExpected: %d", usage.HeaderBlockBytes, 9)
+	}
+	if usage.StreamBytes == 0 || usage.StreamBytes != usage.Streams[0].StreamBytes {
+		t.Fatalf("Unexpected stream bytes: %d", usage.StreamBytes)
+	}
+	if usage.Total() != usage.StreamBytes+15+usage.FrameQueueBytes {
+		t.Fatalf("Unexpected total: %d", usage.Total())
+	}
+
+	stream.Reset()
+	if usage := client.MemoryUsage(); len(usage.Streams) != 0 || usage.ReceiveBufferBytes != 0 {
+		t.Fatalf("Unexpected usage after reset: %+v", usage)
+	}
+}
+
+func TestMemoryUsageQueued(t *testing.T) {
+	streams := make(chan *Stream, 1)
+	client, server := newTestConnections(t, func(c *Connection) {
+		c.SetDataQueue(4)
+	}, func(s *Stream) {
+		s.SendReply(http.Header{}, false)
+		streams <- s
+	})
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	remote := <-streams
+	for _, message := range []string{"abc", "defg"} {
+		if err := stream.WriteData([]byte(message), false); err != nil {
+			t.Fatalf("Error writing to stream: %s", err)
+		}
+	}
+	// the frames are queued on the remote stream, none is read
+	deadline := time.Now().Add(10 * time.Second)
+	for remote.BufferedRecvBytes() != 7 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Unexpected buffered bytes:\nActual: %d\nExpected: %d", remote.BufferedRecvBytes(), 7)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if usage := server.MemoryUsage(); usage.ReceiveBufferBytes != 7 {
+		t.Fatalf("Unexpected receive buffer bytes:\nActual: %d\nExpected: %d", usage.ReceiveBufferBytes, 7)
+	}
+}
+
+func TestGoAwayFailsUnprocessedStreams(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	client, err := NewConnection(clientConn, false)
+	if err != nil {
+		t.Fatalf("Error creating client connection: %s", err)
+	}
+	go client.Serve(NoOpStreamHandler)
+	defer client.Close()
+
+	framer, err := spdy.NewFramer(serverConn, serverConn)
+	if err != nil {
+		t.Fatalf("Error creating framer: %s", err)
+	}
+	received := make(chan spdy.StreamId, 2)
+	go func() {
+		for {
+			frame, err := framer.ReadFrame()
+			if err != nil {
+				return
+			}
+			if synStream, ok := frame.(*spdy.SynStreamFrame); ok {
+				received <- synStream.StreamId
+			}
+		}
+	}()
+
+	var streams []*Stream
+	for i := 0; i < 2; i++ {
+		stream, err := client.CreateStream(http.Header{}, nil, false)
+		if err != nil {
+			t.Fatalf("Error creating stream: %s", err)
+		}
+		streams = append(streams, stream)
+		<-received
+	}
+	// only the first stream was processed by the remote
+	if err := framer.WriteFrame(&spdy.SynReplyFrame{StreamId: streams[0].streamId, Headers: http.Header{}}); err != nil {
+		t.Fatalf("Error writing reply frame: %s", err)
+	}
+	if err := framer.WriteFrame(&spdy.GoAwayFrame{LastGoodStreamId: streams[0].streamId}); err != nil {
+		t.Fatalf("Error writing go away frame: %s", err)
+	}
+
+	if err := streams[0].Wait(); err != nil {
+		t.Fatalf("Error waiting for processed stream: %s", err)
+	}
+	if err := streams[1].WaitTimeout(10 * time.Second); err != ErrGoAway {
+		t.Fatalf("Unexpected error:\nActual: %v\nExpected: %v", err, ErrGoAway)
+	}
+	// later waits end at once with the same error
+	if err := streams[1].Wait(); err != ErrGoAway {
+		t.Fatalf("Unexpected error waiting again:\nActual: %v\nExpected: %v", err, ErrGoAway)
+	}
+	if _, err := streams[1].Write([]byte("data")); err != ErrGoAway {
+		t.Fatalf("Unexpected write error:\nActual: %v\nExpected: %v", err, ErrGoAway)
+	}
+}
+
+// newControlConnections returns connected connections with the control
+// channel enabled, the client configured with configureClient.
+func newControlConnections(t *testing.T, configureClient func(*Connection), serverHandler ControlHandler) (client, server *Connection) {
+	clientConn, serverConn := net.Pipe()
+	client, err := NewConnection(clientConn, false)
+	if err != nil {
+		t.Fatalf("Error creating client connection: %s", err)
+	}
+	server, err = NewConnection(serverConn, true)
+	if err != nil {
+		t.Fatalf("Error creating server connection: %s", err)
+	}
+	client.SetControlChannel(nil)
+	server.SetControlChannel(serverHandler)
+	if configureClient != nil {
+		configureClient(client)
+	}
+	go client.Serve(NoOpStreamHandler)
+	go server.Serve(NoOpStreamHandler)
+	return client, server
+}
+
+func TestRequestCredentials(t *testing.T) {
+	tokens := make(chan string, 3)
+	client, server := newControlConnections(t, func(client *Connection) {
+		client.SetCredentialRefresh(func(ctx context.Context, reason string) ([]byte, error) {
+			if reason != "token expired" {
+				t.Errorf("Unexpected reason: %q", reason)
+			}
+			token := <-tokens
+			if token == "" {
+				return nil, errors.New("no token")
+			}
+			return []byte(token), nil
+		})
+	}, nil)
+	defer server.Close()
+	defer client.Close()
+	verified := make(chan string, 3)
+	server.SetCredentialVerifier(func(credentials []byte) error {
+		verified <- string(credentials)
+		if string(credentials) != "fresh" {
+			return errors.New("invalid token")
+		}
+		return nil
+	})
+
+	// streams opened before the refresh are left open
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tokens <- "fresh"
+	if err := server.ControlChannel().RequestCredentials(ctx, "token expired"); err != nil {
+		t.Fatalf("Error requesting credentials: %s", err)
+	}
+	if token := <-verified; token != "fresh" {
+		t.Fatalf("Unexpected credentials:\nActual: %s\nExpected: fresh", token)
+	}
+
+	tokens <- "stale"
+	err = server.ControlChannel().RequestCredentials(ctx, "token expired")
+	if credErr, ok := err.(*CredentialsError); !ok || credErr.Err.Error() != "invalid token" {
+		t.Fatalf("Unexpected error:\nActual: %v\nExpected: invalid token", err)
+	}
+
+	tokens <- ""
+	err = server.ControlChannel().RequestCredentials(ctx, "token expired")
+	if !errors.Is(err, ErrCredentialsUnavailable) {
+		t.Fatalf("Unexpected error:\nActual: %v\nExpected: %v", err, ErrCredentialsUnavailable)
+	}
+	if credErr, ok := err.(*CredentialsError); !ok || credErr.Message != "no token" {
+		t.Fatalf("Unexpected error message:\nActual: %v\nExpected: no token", err)
+	}
+
+	if err := stream.WriteData([]byte("still open"), false); err != nil {
+		t.Fatalf("Error writing after refresh: %s", err)
+	}
+	if err := client.ControlChannel().RequestCredentials(ctx, "token expired"); err != ErrNoCredentialVerifier {
+		t.Fatalf("Unexpected error:\nActual: %v\nExpected: %v", err, ErrNoCredentialVerifier)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	unblock := make(chan struct{})
+	client, server := newControlConnections(t, nil, func(msg ControlMessage) {
+		if msg.Type == "block" {
+			<-unblock
+		}
+	})
+	defer server.Close()
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rtt, err := client.ControlChannel().Heartbeat(ctx, []byte("alive?"))
+	if err != nil {
+		t.Fatalf("Error sending heartbeat: %s", err)
+	}
+	if rtt <= 0 {
+		t.Fatalf("Unexpected round trip time: %s", rtt)
+	}
+
+	// a stuck control handler stops the echoes
+	if err := client.ControlChannel().Send(ctx, ControlMessage{Type: "block"}); err != nil {
+		t.Fatalf("Error sending control message: %s", err)
+	}
+	blockedCtx, blockedCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer blockedCancel()
+	if _, err := client.ControlChannel().Heartbeat(blockedCtx, nil); err != context.DeadlineExceeded {
+		t.Fatalf("Unexpected error:\nActual: %v\nExpected: %v", err, context.DeadlineExceeded)
+	}
+	close(unblock)
+	if _, err := client.ControlChannel().Heartbeat(ctx, nil); err != nil {
+		t.Fatalf("Error sending heartbeat: %s", err)
+	}
+
+	// the control streams do not hold back a graceful close
+	closed := make(chan error, 1)
+	go func() {
+		closed <- client.CloseWait()
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("Error closing connection: %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out closing connection with control channel")
+	}
+}
+
+func TestHeartbeatTimeoutClosesConnection(t *testing.T) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+	var payloads int32
+	client, server := newControlConnections(t, func(client *Connection) {
+		client.SetHeartbeat(20*time.Millisecond, 100*time.Millisecond, func() []byte {
+			atomic.AddInt32(&payloads, 1)
+			return []byte("payload")
+		})
+	}, func(msg ControlMessage) {
+		if msg.Type == "block" {
+			<-unblock
+		}
+	})
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.ControlChannel().Send(ctx, ControlMessage{Type: "block"}); err != nil {
+		t.Fatalf("Error sending control message: %s", err)
+	}
+
+	select {
+	case <-client.CloseChan():
+	case <-ctx.Done():
+		t.Fatal("Timed out waiting for connection to close")
+	}
+	if atomic.LoadInt32(&payloads) == 0 {
+		t.Fatal("No heartbeat sent")
+	}
+	if _, err := stream.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Read succeeded on a stream of a closed connection")
+	}
+}
+
+func TestHeartbeatTimestamps(t *testing.T) {
+	client, server := newControlConnections(t, func(client *Connection) {
+		client.SetHeartbeatTimestamps(true)
+	}, nil)
+	defer server.Close()
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		if _, err := client.ControlChannel().Heartbeat(ctx, []byte("payload")); err != nil {
+			t.Fatalf("Error sending heartbeat: %s", err)
+		}
+	}
+
+	stats := client.Stats()
+	if stats.HeartbeatRoundTrip <= 0 {
+		t.Fatalf("Unexpected round trip: %s", stats.HeartbeatRoundTrip)
+	}
+	// both peers share the clock
+	if stats.OutboundDelay < 0 || stats.InboundDelay < 0 {
+		t.Fatalf("Unexpected one-way delays: %s, %s", stats.OutboundDelay, stats.InboundDelay)
+	}
+	if sum := stats.OutboundDelay + stats.InboundDelay; sum > stats.HeartbeatRoundTrip+time.Millisecond {
+		t.Fatalf("One-way delays %s exceed round trip %s", sum, stats.HeartbeatRoundTrip)
+	}
+	if offset := stats.ClockOffset; offset > stats.HeartbeatRoundTrip || offset < -stats.HeartbeatRoundTrip {
+		t.Fatalf("Unexpected clock offset: %s", offset)
+	}
+
+	// heartbeats without timestamps only measure the round trip
+	if _, err := server.ControlChannel().Heartbeat(ctx, nil); err != nil {
+		t.Fatalf("Error sending heartbeat: %s", err)
+	}
+	if stats := server.Stats(); stats.HeartbeatRoundTrip <= 0 || stats.OutboundDelay != 0 || stats.InboundDelay != 0 {
+		t.Fatalf("Unexpected stats without timestamps: %+v", stats)
+	}
+}
+
+func TestReplyAndClose(t *testing.T) {
+	replied := make(chan *Stream, 1)
+	client, server := newTestConnections(t, nil, func(stream *Stream) {
+		if err := stream.ReplyAndClose(http.Header{"Status": []string{"204"}}); err != nil {
+			t.Errorf("Error replying: %s", err)
+		}
+		replied <- stream
+	})
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.WaitTimeout(5 * time.Second); err != nil {
+		t.Fatalf("Error waiting for reply: %s", err)
+	}
+	if status := stream.ReplyHeaders().Get("Status"); status != "204" {
+		t.Fatalf("Unexpected reply header:\nActual: %q\nExpected: %q", status, "204")
+	}
+	if _, err := stream.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Unexpected read error:\nActual: %v\nExpected: %v", err, io.EOF)
+	}
+
+	remote := <-replied
+	if _, err := remote.Write([]byte("late")); err != ErrWriteClosedStream {
+		t.Fatalf("Unexpected write error:\nActual: %v\nExpected: %v", err, ErrWriteClosedStream)
+	}
+	if err := remote.ReplyAndClose(http.Header{}); err != ErrWriteClosedStream {
+		t.Fatalf("Unexpected error replying twice:\nActual: %v\nExpected: %v", err, ErrWriteClosedStream)
+	}
+
+	// once the client finishes, the stream is removed from both sides
+	if err := stream.Close(); err != nil {
+		t.Fatalf("Error closing stream: %s", err)
+	}
+	for i := 0; i < 100 && (client.NumActiveStreams() > 0 || server.NumActiveStreams() > 0); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if client.NumActiveStreams() != 0 || server.NumActiveStreams() != 0 {
+		t.Fatalf("Unexpected active streams: client %d, server %d", client.NumActiveStreams(), server.NumActiveStreams())
+	}
+
+	local, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := local.ReplyAndClose(http.Header{}); err != ErrReplyOnLocalStream {
+		t.Fatalf("Unexpected error replying on local stream:\nActual: %v\nExpected: %v", err, ErrReplyOnLocalStream)
+	}
+}
+
 var authenticated bool
 
 func authStreamHandler(stream *Stream) {
@@ -1184,3 +4121,51 @@ func runServer(wg *sync.WaitGroup) (io.Closer, string, error) {
 	}()
 	return listener, listener.Addr().String(), nil
 }
+
+// newTestConnections returns a connected client and server connection.
+// The server connection is passed to configure before it starts serving
+// streams with handler.
+func newTestConnections(t *testing.T, configure func(*Connection), handler StreamHandler) (*Connection, *Connection) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer listener.Close()
+
+	serverConns := make(chan *Connection, 1)
+	go func() {
+		conn, connErr := listener.Accept()
+		if connErr != nil {
+			t.Error(connErr)
+			close(serverConns)
+			return
+		}
+		serverSpdyConn, err := NewConnection(conn, true)
+		if err != nil {
+			t.Errorf("Error creating server connection: %v", err)
+			close(serverConns)
+			return
+		}
+		if configure != nil {
+			configure(serverSpdyConn)
+		}
+		go serverSpdyConn.Serve(handler)
+		serverConns <- serverSpdyConn
+	}()
+
+	conn, dialErr := net.Dial("tcp", listener.Addr().String())
+	if dialErr != nil {
+		t.Fatalf("Error dialing server: %s", dialErr)
+	}
+	spdyConn, spdyErr := NewConnection(conn, false)
+	if spdyErr != nil {
+		t.Fatalf("Error creating spdy connection: %s", spdyErr)
+	}
+	go spdyConn.Serve(NoOpStreamHandler)
+
+	serverConn, ok := <-serverConns
+	if !ok {
+		t.FailNow()
+	}
+	return spdyConn, serverConn
+}
@@ -0,0 +1,317 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystreamtest
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/moby/spdystream"
+	"github.com/moby/spdystream/spdy"
+)
+
+// Peer is a scripted fake remote for unit testing stream handlers at
+// the frame level: it speaks raw frames to a real connection serving the
+// handler under test, sending the frames of the script and expecting the
+// frames written by the handler, without a second real connection.  The
+// peer is the client, so it opens streams with odd ids.
+type Peer struct {
+	// Conn is the connection under test, serving the handler.
+	Conn *spdystream.Connection
+
+	t      *testing.T
+	local  net.Conn
+	framer *spdy.Framer
+	frames chan spdy.Frame
+	// frames read but not yet expected, in order
+	pending []spdy.Frame
+
+	lock    sync.Mutex
+	records map[spdy.StreamId]*RecordedStream
+}
+
+// RecordedStream records the frames written by the connection under test
+// on a stream.
+type RecordedStream struct {
+	// Reply holds the headers of the reply, nil until received.
+	Reply http.Header
+	// Headers holds the headers of the HEADERS frames.
+	Headers []http.Header
+	// Data is the data written, concatenated.
+	Data []byte
+	// Frames counts the data frames.
+	Frames int
+	// Finished is set once the stream is finished by a fin flag.
+	Finished bool
+	// Reset is set once the stream is reset, with ResetStatus.
+	Reset       bool
+	ResetStatus spdy.RstStreamStatus
+}
+
+// NewPeer returns a peer connected to a new connection serving handler.
+// The peer must be closed with Close.
+func NewPeer(t *testing.T, handler spdystream.StreamHandler) *Peer {
+	local, remote := spdystream.Loopback(0)
+	conn, err := spdystream.NewConnection(remote, true)
+	if err != nil {
+		t.Fatalf("Error creating connection: %s", err)
+	}
+	framer, err := spdy.NewFramer(local, local)
+	if err != nil {
+		t.Fatalf("Error creating framer: %s", err)
+	}
+	p := &Peer{
+		Conn:    conn,
+		t:       t,
+		local:   local,
+		framer:  framer,
+		frames:  make(chan spdy.Frame, 1024),
+		records: make(map[spdy.StreamId]*RecordedStream),
+	}
+	go conn.Serve(handler)
+	go p.read()
+	return p
+}
+
+// read reads the frames written by the connection, recording them.
+func (p *Peer) read() {
+	defer close(p.frames)
+	for {
+		frame, err := p.framer.ReadFrame()
+		if err != nil {
+			return
+		}
+		p.record(frame)
+		p.frames <- frame
+	}
+}
+
+func (p *Peer) record(frame spdy.Frame) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	switch frame := frame.(type) {
+	case *spdy.SynReplyFrame:
+		r := p.recordLocked(frame.StreamId)
+		r.Reply = frame.Headers
+		r.Finished = r.Finished || frame.CFHeader.Flags&spdy.ControlFlagFin != 0
+	case *spdy.SynStreamFrame:
+		r := p.recordLocked(frame.StreamId)
+		r.Finished = frame.CFHeader.Flags&spdy.ControlFlagFin != 0
+	case *spdy.HeadersFrame:
+		r := p.recordLocked(frame.StreamId)
+		r.Headers = append(r.Headers, frame.Headers)
+		r.Finished = r.Finished || frame.CFHeader.Flags&spdy.ControlFlagFin != 0
+	case *spdy.DataFrame:
+		r := p.recordLocked(frame.StreamId)
+		r.Data = append(r.Data, frame.Data...)
+		r.Frames++
+		r.Finished = r.Finished || frame.Flags&spdy.DataFlagFin != 0
+	case *spdy.RstStreamFrame:
+		r := p.recordLocked(frame.StreamId)
+		r.Reset = true
+		r.ResetStatus = frame.Status
+	}
+}
+
+func (p *Peer) recordLocked(id spdy.StreamId) *RecordedStream {
+	r, ok := p.records[id]
+	if !ok {
+		r = &RecordedStream{}
+		p.records[id] = r
+	}
+	return r
+}
+
+// Record returns a copy of what the connection under test wrote on the
+// stream so far.
+func (p *Peer) Record(id spdy.StreamId) RecordedStream {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	r, ok := p.records[id]
+	if !ok {
+		return RecordedStream{}
+	}
+	record := *r
+	record.Headers = append([]http.Header(nil), r.Headers...)
+	record.Data = append([]byte(nil), r.Data...)
+	return record
+}
+
+// Send sends frame to the connection under test.
+func (p *Peer) Send(frame spdy.Frame) {
+	p.t.Helper()
+	if err := p.framer.WriteFrame(frame); err != nil {
+		p.t.Fatalf("Error sending frame: %s", err)
+	}
+}
+
+// OpenStream opens the stream id with headers.
+func (p *Peer) OpenStream(id spdy.StreamId, headers http.Header, fin bool) {
+	p.t.Helper()
+	var flags spdy.ControlFlags
+	if fin {
+		flags = spdy.ControlFlagFin
+	}
+	p.Send(&spdy.SynStreamFrame{StreamId: id, Headers: headers, CFHeader: spdy.ControlFrameHeader{Flags: flags}})
+}
+
+// Reply replies to the stream id opened by the connection under test.
+func (p *Peer) Reply(id spdy.StreamId, headers http.Header, fin bool) {
+	p.t.Helper()
+	var flags spdy.ControlFlags
+	if fin {
+		flags = spdy.ControlFlagFin
+	}
+	p.Send(&spdy.SynReplyFrame{StreamId: id, Headers: headers, CFHeader: spdy.ControlFrameHeader{Flags: flags}})
+}
+
+// SendData sends data on the stream id.
+func (p *Peer) SendData(id spdy.StreamId, data []byte, fin bool) {
+	p.t.Helper()
+	var flags spdy.DataFlags
+	if fin {
+		flags = spdy.DataFlagFin
+	}
+	p.Send(&spdy.DataFrame{StreamId: id, Data: data, Flags: flags})
+}
+
+// Reset resets the stream id with status.
+func (p *Peer) Reset(id spdy.StreamId, status spdy.RstStreamStatus) {
+	p.t.Helper()
+	p.Send(&spdy.RstStreamFrame{StreamId: id, Status: status})
+}
+
+// Expect waits for the next frame written by the connection under test
+// matching match, failing the test after Timeout.  Frames not matching
+// are kept for later expectations.
+func (p *Peer) Expect(what string, match func(spdy.Frame) bool) spdy.Frame {
+	p.t.Helper()
+	for i, frame := range p.pending {
+		if match(frame) {
+			p.pending = append(p.pending[:i], p.pending[i+1:]...)
+			return frame
+		}
+	}
+	timeout := time.After(Timeout)
+	for {
+		select {
+		case frame, ok := <-p.frames:
+			if !ok {
+				p.t.Fatalf("Connection closed expecting %s", what)
+			}
+			if match(frame) {
+				return frame
+			}
+			p.pending = append(p.pending, frame)
+		case <-timeout:
+			p.t.Fatalf("Timed out expecting %s", what)
+		}
+	}
+}
+
+// ExpectReply expects the reply to the stream id and returns its
+// headers.
+func (p *Peer) ExpectReply(id spdy.StreamId) http.Header {
+	p.t.Helper()
+	frame := p.Expect("reply", func(frame spdy.Frame) bool {
+		reply, ok := frame.(*spdy.SynReplyFrame)
+		return ok && reply.StreamId == id
+	})
+	return frame.(*spdy.SynReplyFrame).Headers
+}
+
+// ExpectStream expects the connection under test to open a stream and
+// returns its frame.
+func (p *Peer) ExpectStream() *spdy.SynStreamFrame {
+	p.t.Helper()
+	frame := p.Expect("stream", func(frame spdy.Frame) bool {
+		_, ok := frame.(*spdy.SynStreamFrame)
+		return ok
+	})
+	return frame.(*spdy.SynStreamFrame)
+}
+
+// ExpectData expects a data frame with data on the stream id.
+func (p *Peer) ExpectData(id spdy.StreamId, data []byte) {
+	p.t.Helper()
+	frame := p.Expect("data", func(frame spdy.Frame) bool {
+		dataFrame, ok := frame.(*spdy.DataFrame)
+		return ok && dataFrame.StreamId == id
+	}).(*spdy.DataFrame)
+	if !bytes.Equal(frame.Data, data) {
+		p.t.Fatalf("Unexpected data:\nActual: %q\nExpected: %q", frame.Data, data)
+	}
+}
+
+// ExpectFin expects the stream id to be finished, by a data, reply or
+// HEADERS frame with the fin flag, skipping the data frames before it.
+func (p *Peer) ExpectFin(id spdy.StreamId) {
+	p.t.Helper()
+	p.Expect("fin", func(frame spdy.Frame) bool {
+		switch frame := frame.(type) {
+		case *spdy.DataFrame:
+			return frame.StreamId == id && frame.Flags&spdy.DataFlagFin != 0
+		case *spdy.SynReplyFrame:
+			return frame.StreamId == id && frame.CFHeader.Flags&spdy.ControlFlagFin != 0
+		case *spdy.HeadersFrame:
+			return frame.StreamId == id && frame.CFHeader.Flags&spdy.ControlFlagFin != 0
+		}
+		return false
+	})
+}
+
+// ExpectReset expects a reset of the stream id and returns its status.
+func (p *Peer) ExpectReset(id spdy.StreamId) spdy.RstStreamStatus {
+	p.t.Helper()
+	frame := p.Expect("reset", func(frame spdy.Frame) bool {
+		reset, ok := frame.(*spdy.RstStreamFrame)
+		return ok && reset.StreamId == id
+	})
+	return frame.(*spdy.RstStreamFrame).Status
+}
+
+// Step is a step of a script, see Run.
+type Step func(p *Peer)
+
+// Send returns a step sending frame.
+func Send(frame spdy.Frame) Step {
+	return func(p *Peer) { p.Send(frame) }
+}
+
+// Expect returns a step expecting a frame matching match.
+func Expect(what string, match func(spdy.Frame) bool) Step {
+	return func(p *Peer) { p.Expect(what, match) }
+}
+
+// Run runs the steps of a script in order.
+func (p *Peer) Run(steps ...Step) {
+	p.t.Helper()
+	for _, step := range steps {
+		step(p)
+	}
+}
+
+// Close closes the connection under test and the transport.
+func (p *Peer) Close() error {
+	err := p.Conn.Close()
+	p.local.Close()
+	return err
+}
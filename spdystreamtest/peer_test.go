@@ -0,0 +1,87 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystreamtest
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/moby/spdystream"
+	"github.com/moby/spdystream/spdy"
+)
+
+func TestPeerMirror(t *testing.T) {
+	peer := NewPeer(t, spdystream.MirrorStreamHandler)
+	defer peer.Close()
+
+	peer.OpenStream(1, http.Header{"Key": {"value"}}, false)
+	if reply := peer.ExpectReply(1); reply == nil {
+		t.Fatal("Missing reply headers")
+	}
+	peer.SendData(1, []byte("hello"), false)
+	peer.ExpectData(1, []byte("hello"))
+	peer.SendData(1, []byte("world"), true)
+	peer.ExpectFin(1)
+
+	record := peer.Record(1)
+	if string(record.Data) != "helloworld" {
+		t.Fatalf("Unexpected recorded data:\nActual: %q\nExpected: %q", record.Data, "helloworld")
+	}
+	if !record.Finished || record.Reset {
+		t.Fatalf("Unexpected recorded state: finished %t, reset %t", record.Finished, record.Reset)
+	}
+}
+
+func TestPeerScript(t *testing.T) {
+	peer := NewPeer(t, func(stream *spdystream.Stream) {
+		stream.Refuse()
+	})
+	defer peer.Close()
+
+	peer.Run(
+		Send(&spdy.SynStreamFrame{StreamId: 1, Headers: http.Header{}}),
+		Expect("refusal", func(frame spdy.Frame) bool {
+			reset, ok := frame.(*spdy.RstStreamFrame)
+			return ok && reset.StreamId == 1 && reset.Status == spdy.RefusedStream
+		}),
+	)
+	if record := peer.Record(1); !record.Reset || record.ResetStatus != spdy.RefusedStream {
+		t.Fatalf("Unexpected recorded reset: %t %v", record.Reset, record.ResetStatus)
+	}
+}
+
+func TestPeerAcceptsStreams(t *testing.T) {
+	peer := NewPeer(t, spdystream.NoOpStreamHandler)
+	defer peer.Close()
+
+	stream, err := peer.Conn.CreateStream(http.Header{"Key": {"value"}}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	frame := peer.ExpectStream()
+	if frame.Headers.Get("Key") != "value" {
+		t.Fatalf("Unexpected stream headers: %v", frame.Headers)
+	}
+	peer.Reply(frame.StreamId, http.Header{}, false)
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for reply: %s", err)
+	}
+	stream.Reset()
+	if status := peer.ExpectReset(frame.StreamId); status != spdy.Cancel {
+		t.Fatalf("Unexpected reset status:\nActual: %v\nExpected: %v", status, spdy.Cancel)
+	}
+}
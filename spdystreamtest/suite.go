@@ -0,0 +1,408 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package spdystreamtest provides a conformance suite exercising
+// spdystream connections over arbitrary transports, and a scripted fake
+// peer for unit testing stream handlers at the frame level.
+package spdystreamtest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/moby/spdystream"
+	"github.com/moby/spdystream/spdy"
+)
+
+// Timeout bounds every blocking step of the suite.
+var Timeout = 10 * time.Second
+
+// PairFunc returns the two ends of a connected transport.
+type PairFunc func() (client, server net.Conn, err error)
+
+// TCPPair returns a connected pair of loopback TCP connections.
+func TCPPair() (net.Conn, net.Conn, error) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer listener.Close()
+
+	type accepted struct {
+		conn net.Conn
+		err  error
+	}
+	acceptChan := make(chan accepted, 1)
+	go func() {
+		conn, err := listener.Accept()
+		acceptChan <- accepted{conn, err}
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	a := <-acceptChan
+	if a.err != nil {
+		client.Close()
+		return nil, nil, a.err
+	}
+	return client, a.conn, nil
+}
+
+// PipePair returns the two ends of a synchronous in-memory net.Pipe.
+func PipePair() (net.Conn, net.Conn, error) {
+	client, server := net.Pipe()
+	return client, server, nil
+}
+
+type scenario struct {
+	name    string
+	handler spdystream.StreamHandler
+	run     func(t *testing.T, client, server *spdystream.Connection, accepted <-chan *spdystream.Stream)
+	// configure, if set, is called before the connections are served.
+	configure func(client, server *spdystream.Connection)
+}
+
+// scenarios returns the scenarios of the suite, built for every run as
+// some keep state between configure and run.
+func scenarios() []scenario {
+	return []scenario{
+		{name: "Echo", handler: spdystream.MirrorStreamHandler, run: testEcho},
+		{name: "Headers", handler: spdystream.MirrorStreamHandler, run: testHeaders},
+		{name: "HalfClose", handler: spdystream.MirrorStreamHandler, run: testHalfClose},
+		{name: "Interleaving", handler: spdystream.MirrorStreamHandler, run: testInterleaving},
+		{name: "Refuse", handler: refuseHandler, run: testRefuse},
+		{name: "ResetByCreator", handler: replyHandler, run: testResetByCreator},
+		{name: "ResetByAcceptor", handler: replyHandler, run: testResetByAcceptor},
+		{name: "GoAway", handler: replyHandler, run: testGoAway},
+		flowControlScenario(),
+	}
+}
+
+// Run runs the conformance suite, establishing a client and server
+// *spdystream.Connection over a new transport from newPair for every
+// scenario, and tearing both down once the scenario is done.  Only the
+// transport is pluggable: the suite checks that spdystream behaves over
+// it, not alternative implementations of the connection.
+func Run(t *testing.T, newPair PairFunc) {
+	for _, sc := range scenarios() {
+		sc := sc
+		t.Run(sc.name, func(t *testing.T) {
+			clientConn, serverConn, err := newPair()
+			if err != nil {
+				t.Fatalf("Error creating transport: %s", err)
+			}
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			client, err := spdystream.NewConnection(clientConn, false)
+			if err != nil {
+				t.Fatalf("Error creating client connection: %s", err)
+			}
+			server, err := spdystream.NewConnection(serverConn, true)
+			if err != nil {
+				t.Fatalf("Error creating server connection: %s", err)
+			}
+
+			if sc.configure != nil {
+				sc.configure(client, server)
+			}
+
+			accepted := make(chan *spdystream.Stream, 16)
+			go client.Serve(spdystream.NoOpStreamHandler)
+			go server.Serve(func(stream *spdystream.Stream) {
+				sc.handler(stream)
+				accepted <- stream
+			})
+
+			sc.run(t, client, server, accepted)
+
+			// closing the transport ends the streams left open
+			client.Close()
+			server.Close()
+			clientConn.Close()
+			serverConn.Close()
+			for _, conn := range []*spdystream.Connection{client, server} {
+				if err := conn.Wait(Timeout); err == spdystream.ErrTimeout {
+					t.Errorf("Timed out waiting for connection teardown, %d goroutines left", conn.Goroutines())
+				}
+			}
+		})
+	}
+}
+
+func replyHandler(stream *spdystream.Stream) {
+	stream.SendReply(http.Header{}, false)
+}
+
+func refuseHandler(stream *spdystream.Stream) {
+	stream.Refuse()
+}
+
+// within runs fn and fails the test if it does not return in Timeout.
+func within(t *testing.T, what string, fn func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+	case <-time.After(Timeout):
+		t.Fatalf("Timed out: %s", what)
+	}
+}
+
+func openStream(t *testing.T, client *spdystream.Connection) *spdystream.Stream {
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	var waitErr error
+	within(t, "waiting for reply", func() {
+		waitErr = stream.Wait()
+	})
+	if waitErr != nil {
+		t.Fatalf("Error waiting for stream: %s", waitErr)
+	}
+	return stream
+}
+
+func acceptStream(t *testing.T, accepted <-chan *spdystream.Stream) *spdystream.Stream {
+	select {
+	case stream := <-accepted:
+		return stream
+	case <-time.After(Timeout):
+		t.Fatal("Timed out waiting for accepted stream")
+	}
+	return nil
+}
+
+func expectData(t *testing.T, stream *spdystream.Stream, expected []byte) {
+	var (
+		data []byte
+		err  error
+	)
+	within(t, "reading data", func() {
+		data, err = stream.ReadData()
+	})
+	if err != nil {
+		t.Fatalf("Error reading from stream: %s", err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("Unexpected data:\nActual: %q\nExpected: %q", data, expected)
+	}
+}
+
+func expectEOF(t *testing.T, stream *spdystream.Stream) {
+	var err error
+	within(t, "reading EOF", func() {
+		_, err = stream.ReadData()
+	})
+	if err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+}
+
+func testEcho(t *testing.T, client, server *spdystream.Connection, accepted <-chan *spdystream.Stream) {
+	stream := openStream(t, client)
+	for i := 0; i < 10; i++ {
+		message := []byte(fmt.Sprintf("message %d", i))
+		if err := stream.WriteData(message, false); err != nil {
+			t.Fatalf("Error writing to stream: %s", err)
+		}
+		expectData(t, stream, message)
+	}
+	stream.Close()
+	expectEOF(t, stream)
+}
+
+func testHeaders(t *testing.T, client, server *spdystream.Connection, accepted <-chan *spdystream.Stream) {
+	stream := openStream(t, client)
+	if err := stream.SendHeader(http.Header{"Key": {"value"}}, false); err != nil {
+		t.Fatalf("Error sending header: %s", err)
+	}
+	var (
+		header http.Header
+		err    error
+	)
+	within(t, "receiving header", func() {
+		header, err = stream.ReceiveHeader()
+	})
+	if err != nil {
+		t.Fatalf("Error receiving header: %s", err)
+	}
+	if v := header.Get("Key"); v != "value" {
+		t.Fatalf("Unexpected header value:\nActual: %q\nExpected: %q", v, "value")
+	}
+	stream.Reset()
+}
+
+func testHalfClose(t *testing.T, client, server *spdystream.Connection, accepted <-chan *spdystream.Stream) {
+	stream := openStream(t, client)
+	message := []byte("written before close")
+	if err := stream.WriteData(message, true); err != nil {
+		t.Fatalf("Error writing to stream: %s", err)
+	}
+	expectData(t, stream, message)
+	expectEOF(t, stream)
+	if err := stream.Close(); err != spdystream.ErrWriteClosedStream {
+		t.Fatalf("Unexpected error closing finished stream: %v", err)
+	}
+}
+
+func testInterleaving(t *testing.T, client, server *spdystream.Connection, accepted <-chan *spdystream.Stream) {
+	const streams = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, streams)
+	for i := 0; i < streams; i++ {
+		stream := openStream(t, client)
+		wg.Add(1)
+		go func(i int, stream *spdystream.Stream) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				message := []byte(fmt.Sprintf("stream %d message %d", i, j))
+				if err := stream.WriteData(message, false); err != nil {
+					errs <- err
+					return
+				}
+				data, err := stream.ReadData()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(data, message) {
+					errs <- fmt.Errorf("unexpected data on stream %d: %q", i, data)
+					return
+				}
+			}
+			stream.Close()
+		}(i, stream)
+	}
+	within(t, "interleaved streams", wg.Wait)
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func testRefuse(t *testing.T, client, server *spdystream.Connection, accepted <-chan *spdystream.Stream) {
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	var waitErr error
+	within(t, "waiting for refusal", func() {
+		waitErr = stream.Wait()
+	})
+	if waitErr != spdystream.ErrReset {
+		t.Fatalf("Unexpected error waiting for refused stream: %v", waitErr)
+	}
+}
+
+func testResetByCreator(t *testing.T, client, server *spdystream.Connection, accepted <-chan *spdystream.Stream) {
+	stream := openStream(t, client)
+	remote := acceptStream(t, accepted)
+	if err := stream.Reset(); err != nil {
+		t.Fatalf("Error resetting stream: %s", err)
+	}
+	expectEOF(t, remote)
+}
+
+func testResetByAcceptor(t *testing.T, client, server *spdystream.Connection, accepted <-chan *spdystream.Stream) {
+	stream := openStream(t, client)
+	remote := acceptStream(t, accepted)
+	if err := remote.Reset(); err != nil {
+		t.Fatalf("Error resetting stream: %s", err)
+	}
+	expectEOF(t, stream)
+}
+
+func testGoAway(t *testing.T, client, server *spdystream.Connection, accepted <-chan *spdystream.Stream) {
+	if err := server.Close(); err != nil {
+		t.Fatalf("Error closing server connection: %s", err)
+	}
+	select {
+	case <-client.CloseChan():
+	case <-time.After(Timeout):
+		t.Fatal("Timed out waiting for go away")
+	}
+}
+
+// flowControlScenario checks the receive window of a stream under
+// WindowUpdateCredit: consumed data uses up the window, and granted
+// credit restores it with a window update seen by the client.
+func flowControlScenario() scenario {
+	updates := make(chan *spdy.WindowUpdateFrame, 16)
+	return scenario{
+		name:    "FlowControl",
+		handler: replyHandler,
+		configure: func(client, server *spdystream.Connection) {
+			server.SetWindowUpdatePolicy(spdystream.WindowUpdateCredit, 0)
+			client.SetFrameObserver(func(info spdystream.FrameInfo) error {
+				if frame, ok := info.Frame.(*spdy.WindowUpdateFrame); ok && !info.Sent {
+					updates <- frame
+				}
+				return nil
+			}, true)
+		},
+		run: func(t *testing.T, client, server *spdystream.Connection, accepted <-chan *spdystream.Stream) {
+			testFlowControl(t, client, accepted, updates)
+		},
+	}
+}
+
+func testFlowControl(t *testing.T, client *spdystream.Connection, accepted <-chan *spdystream.Stream, updates <-chan *spdy.WindowUpdateFrame) {
+	const size = 1024
+	stream := openStream(t, client)
+	remote := acceptStream(t, accepted)
+	message := bytes.Repeat([]byte("w"), size)
+	for i := 0; i < 3; i++ {
+		if err := stream.WriteData(message, false); err != nil {
+			t.Fatalf("Error writing to stream: %s", err)
+		}
+		expectData(t, remote, message)
+	}
+	if window := remote.ReceiveWindow(); window != spdystream.DefaultReceiveWindow-3*size {
+		t.Fatalf("Unexpected window after reading:\nActual: %d\nExpected: %d", window, spdystream.DefaultReceiveWindow-3*size)
+	}
+
+	if err := remote.GrantCredit(3 * size); err != nil {
+		t.Fatalf("Error granting credit: %s", err)
+	}
+	select {
+	case frame := <-updates:
+		if uint32(frame.StreamId) != stream.Identifier() || frame.DeltaWindowSize != 3*size {
+			t.Fatalf("Unexpected window update:\nActual: stream %d delta %d\nExpected: stream %d delta %d", frame.StreamId, frame.DeltaWindowSize, stream.Identifier(), 3*size)
+		}
+	case <-time.After(Timeout):
+		t.Fatal("Timed out waiting for window update")
+	}
+	if window := remote.ReceiveWindow(); window != spdystream.DefaultReceiveWindow {
+		t.Fatalf("Unexpected window after granting credit:\nActual: %d\nExpected: %d", window, spdystream.DefaultReceiveWindow)
+	}
+	if err := remote.GrantCredit(1<<31 - 1); err != spdystream.ErrInvalidCredit {
+		t.Fatalf("Unexpected error granting excess credit:\nActual: %v\nExpected: %v", err, spdystream.ErrInvalidCredit)
+	}
+	stream.Reset()
+}
@@ -0,0 +1,118 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"time"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+// ConnectionStats holds counters of a connection.
+type ConnectionStats struct {
+	// HeaderBytesCompressed is the number of header block bytes received.
+	HeaderBytesCompressed uint64
+	// HeaderBytesDecompressed is the number of header block bytes after
+	// decompression.
+	HeaderBytesDecompressed uint64
+	// HeaderBlocksRejected is the number of header blocks exceeding the
+	// limits set with SetHeaderBlockLimits.
+	HeaderBlocksRejected uint64
+	// SentHeaderBytesUncompressed is the number of header block bytes
+	// sent before compression.
+	SentHeaderBytesUncompressed uint64
+	// SentHeaderBytesCompressed is the number of header block bytes
+	// sent after compression, compared to SentHeaderBytesUncompressed it
+	// shows the effectiveness of header compression.
+	SentHeaderBytesCompressed uint64
+	// DataFramesVerified is the number of data frames received with a
+	// matching checksum, see SetDataChecksums.
+	DataFramesVerified uint64
+	// DataFramesCorrupt is the number of data frames received with a
+	// checksum mismatch.
+	DataFramesCorrupt uint64
+	// HeartbeatRoundTrip is the round trip time of the last heartbeat,
+	// see ControlChannel.Heartbeat.
+	HeartbeatRoundTrip time.Duration
+	// OutboundDelay and InboundDelay are the one-way delays of the last
+	// heartbeat, with SetHeartbeatTimestamps.  They are measured against
+	// the clock of the remote, so they are only accurate if the clocks
+	// are synchronized; their difference still shows changes in the
+	// asymmetry of the path.
+	OutboundDelay time.Duration
+	InboundDelay  time.Duration
+	// ClockOffset hints at how far the clock of the remote is ahead of
+	// the local clock, estimated from the heartbeat with the fastest
+	// round trip assuming a symmetric path.
+	ClockOffset time.Duration
+	// FramesWritten is the number of frames written.
+	FramesWritten uint64
+	// WriteWait is the total time writes waited for the frames of other
+	// writes to be written, and MaxWriteWait the longest wait of a
+	// single write.  Frames are written whole, in the order their writes
+	// take the write lock of the connection; a write waiting longer than
+	// a millisecond is handed the lock ahead of later writes, so a
+	// stream writing small frames is not starved by streams writing large
+	// frames, and MaxWriteWait stays around a millisecond plus the time
+	// to write the frames queued ahead.
+	WriteWait    time.Duration
+	MaxWriteWait time.Duration
+	// QueueDelay is the histogram of the time received frames waited in
+	// the queue of their frame worker, growing when frames are held
+	// behind the frames of other streams.  DeliveryDelay is the histogram
+	// of the time from receiving a data frame to its data being read by
+	// the stream, growing as well when the application is slow to read.
+	QueueDelay    LatencyHistogram
+	DeliveryDelay LatencyHistogram
+	// InvariantViolations is the number of internal invariant violations
+	// handled under StrictnessResilient, see SetStrictness.
+	InvariantViolations uint64
+}
+
+// Stats returns a snapshot of the connection counters.
+func (s *Connection) Stats() ConnectionStats {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	return s.stats
+}
+
+func (s *Connection) updateHeaderStats(headerStats spdy.HeaderStats) {
+	s.statsLock.Lock()
+	s.stats.HeaderBytesCompressed = headerStats.CompressedBytes
+	s.stats.HeaderBytesDecompressed = headerStats.DecompressedBytes
+	s.stats.HeaderBlocksRejected = headerStats.RejectedBlocks
+	s.statsLock.Unlock()
+}
+
+func (s *Connection) updateSentHeaderStats(headerStats spdy.HeaderStats) {
+	s.statsLock.Lock()
+	s.stats.SentHeaderBytesUncompressed = headerStats.DecompressedBytes
+	s.stats.SentHeaderBytesCompressed = headerStats.CompressedBytes
+	s.statsLock.Unlock()
+}
+
+func (s *Connection) updateWriteStats(wait time.Duration, written bool) {
+	s.statsLock.Lock()
+	if written {
+		s.stats.FramesWritten++
+	}
+	s.stats.WriteWait += wait
+	if wait > s.stats.MaxWriteWait {
+		s.stats.MaxWriteWait = wait
+	}
+	s.statsLock.Unlock()
+}
@@ -17,45 +17,155 @@
 package spdystream
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/moby/spdystream/spdy"
 )
 
 var (
-	ErrUnreadPartialData = errors.New("unread partial data")
+	ErrUnreadPartialData  = errors.New("unread partial data")
+	ErrErrorStreamExists  = errors.New("error stream already created")
+	ErrReplyOnLocalStream = errors.New("cannot reply on initiated stream")
 )
 
+const (
+	// StreamTypeHeader is the header used to flag auxiliary streams
+	// linked to their parent stream.
+	StreamTypeHeader = "Streamtype"
+
+	// StreamTypeError flags a stream as the error stream of its parent.
+	StreamTypeError = "error"
+
+	// CancelReasonHeader carries the reason sent by CancelWithReason
+	// ahead of the reset.
+	CancelReasonHeader = "Spdystream-Cancel-Reason"
+)
+
+// CancelError is returned by reads and writes on a stream the remote
+// canceled with CancelWithReason.  It unwraps to ErrReset.
+type CancelError struct {
+	Reason string
+}
+
+func (e *CancelError) Error() string {
+	return "stream canceled by remote: " + e.Reason
+}
+
+func (e *CancelError) Unwrap() error {
+	return ErrReset
+}
+
 type Stream struct {
 	streamId  spdy.StreamId
 	parent    *Stream
 	conn      *Connection
 	startChan chan error
+	// status of a reset received before the reply, set before
+	// ErrReset is sent on startChan
+	resetStatus spdy.RstStreamStatus
 
 	dataLock sync.RWMutex
 	dataChan chan []byte
 	unread   []byte
+	// length of unread and of the data frames queued in dataChan, for
+	// BufferedRecvBytes
+	unreadBytes int32
+	queuedBytes int32
+	// open while reading is paused
+	pauseLock  sync.Mutex
+	resumeChan chan struct{}
+	// callback armed with OnReadable, and whether a data frame is
+	// being delivered
+	readyLock   sync.Mutex
+	onReadable  func(*Stream)
+	dataOffered bool
+	// set by SetReadDeadline, bounds Read and ReadData
+	readDeadline ioDeadline
+	// reaps the stream when the remote stays quiet after the local finish
+	halfCloseLock  sync.Mutex
+	halfCloseTimer *time.Timer
+	// limits set with SetQuota and the data counted against them
+	quotaLock     sync.Mutex
+	quota         StreamQuota
+	quotaHandler  QuotaHandler
+	quotaBytesIn  int64
+	quotaBytesOut int64
+	quotaTimer    *time.Timer
+	quotaExceeded bool
+	// data consumed since the last window update
+	windowLock    sync.Mutex
+	consumedBytes uint32
+	// credit granted less data consumed, for WindowUpdateCredit
+	credit int64
+	// set for streams accepted from the remote, see AcceptedStream
+	arrived        time.Time
+	unidirectional bool
 
 	priority   uint8
+	deadline   time.Time
+	traceID    string
 	headers    http.Header
 	headerChan chan http.Header
 	finishLock sync.Mutex
 	finished   bool
 	replyCond  *sync.Cond
 	replied    bool
-	closeLock  sync.Mutex
-	closeChan  chan bool
+	// headers of the reply to a stream created locally, guarded by
+	// closeLock
+	replyHeaders http.Header
+	protocol     string
+	closeLock    sync.Mutex
+	closeChan    chan bool
+	abortErr     error
+	// reason received ahead of a cancel reset
+	cancelReason string
+	// set when the remote side finished without a reset
+	remoteFinished bool
+	// set while the headers of the stream or of its reply are continued
+	// in HEADERS frames, only used by the frame worker of the stream
+	continuing headerContinuation
+	// frames and bytes of the continued headers, bounded by
+	// MaxHeaderContinuationFrames and maxContinuedHeaderSize
+	continuedFrames int
+	continuedBytes  uint64
+
+	errorLock   sync.Mutex
+	errorStream *Stream
 }
 
-// WriteData writes data to stream, sending a dataframe per call
+// WriteData writes data to stream, sending a dataframe per call.
+// Streams created locally may be written to before the reply is
+// received.  Streams accepted from the remote must be replied to with
+// SendReply first, otherwise ErrReplyPending is returned.  Concurrent
+// writes are written whole, see ConnectionStats.WriteWait.  Writes after
+// the local side is closed return ErrWriteClosedStream, after the stream
+// was reset by either side ErrReset, or the error given to Abort.  Once
+// the connection is closed or its transport failed, writes fail without
+// writing with a *ConnectionClosedError.
 func (s *Stream) WriteData(data []byte, fin bool) error {
-	s.waitWriteReply()
+	if err := s.abortError(); err != nil {
+		return err
+	}
+	if err := s.checkReplied(); err != nil {
+		return err
+	}
+	if err := s.conn.closedError(); err != nil {
+		return err
+	}
+	if err := s.writeClosedError(); err != nil {
+		return err
+	}
+	if !s.chargeQuota(len(data), true) {
+		return s.abortError()
+	}
 	var flags spdy.DataFlags
 
 	if fin {
@@ -69,6 +179,9 @@ func (s *Stream) WriteData(data []byte, fin bool) error {
 		s.finishLock.Unlock()
 	}
 
+	if s.conn.dataChecksums {
+		data = appendChecksum(data)
+	}
 	dataFrame := &spdy.DataFrame{
 		StreamId: s.streamId,
 		Flags:    flags,
@@ -76,7 +189,13 @@ func (s *Stream) WriteData(data []byte, fin bool) error {
 	}
 
 	debugMessage("(%p) (%d) Writing data frame", s, s.streamId)
-	return s.conn.framer.WriteFrame(dataFrame)
+	if err := s.conn.framer.WriteFrame(dataFrame); err != nil {
+		return err
+	}
+	if fin {
+		s.startHalfCloseTimer()
+	}
+	return nil
 }
 
 // Write writes bytes to a stream, calling write data for each call.
@@ -93,15 +212,11 @@ func (s *Stream) Write(data []byte) (n int, err error) {
 // read may get data from the same data frame.
 func (s *Stream) Read(p []byte) (n int, err error) {
 	if s.unread == nil {
-		select {
-		case <-s.closeChan:
-			return 0, io.EOF
-		case read, ok := <-s.dataChan:
-			if !ok {
-				return 0, io.EOF
-			}
-			s.unread = read
+		read, err := s.receive()
+		if err != nil {
+			return 0, err
 		}
+		s.unread = read
 	}
 	n = copy(p, s.unread)
 	if n < len(s.unread) {
@@ -109,9 +224,111 @@ func (s *Stream) Read(p []byte) (n int, err error) {
 	} else {
 		s.unread = nil
 	}
+	atomic.StoreInt32(&s.unreadBytes, int32(len(s.unread)))
 	return
 }
 
+// PauseReading stops delivering the data received on the stream: Read
+// and ReadData block until ResumeReading is called, though data left
+// unread by a previous Read is still returned.  Received data frames are
+// held back from the connection, so the remote is eventually stopped by
+// the transport, and like any unread stream the frames of other streams
+// handled by the same frame worker are delayed.
+func (s *Stream) PauseReading() {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+	if s.resumeChan == nil {
+		s.resumeChan = make(chan struct{})
+	}
+}
+
+// ResumeReading resumes delivering the data received on the stream
+// after PauseReading.
+func (s *Stream) ResumeReading() {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+	if s.resumeChan != nil {
+		close(s.resumeChan)
+		s.resumeChan = nil
+	}
+}
+
+// pauseChan returns the channel closed once reading is resumed, nil if
+// reading is not paused.
+func (s *Stream) pauseChan() chan struct{} {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+	return s.resumeChan
+}
+
+// receive waits for the next data frame while reading is not paused,
+// for the remote side of the stream to be closed or for the read
+// deadline to pass.  Changes of the pause state and of the deadline
+// apply to a pending receive.
+func (s *Stream) receive() ([]byte, error) {
+	for {
+		timeout, changed, stop, err := s.readDeadline.arm()
+		if err != nil {
+			return nil, err
+		}
+		resumeChan := s.pauseChan()
+		dataChan := s.dataChan
+		if resumeChan != nil {
+			dataChan = nil
+		}
+
+		select {
+		case <-s.closeChan:
+			stop()
+			if read, ok := s.takeQueued(dataChan); ok {
+				return read, nil
+			}
+			return nil, s.readClosedError()
+		case read, ok := <-dataChan:
+			stop()
+			if !ok {
+				return nil, io.EOF
+			}
+			s.received(read)
+			return read, nil
+		case <-timeout:
+			return nil, timeoutError{}
+		case <-resumeChan:
+		case <-changed:
+		}
+		stop()
+	}
+}
+
+// BufferedRecvBytes returns the number of bytes received on the stream
+// and held for Read, that is the rest of a data frame only partially
+// read and the data frames queued, see Connection.SetDataQueue, or
+// being handed to the stream.  Further data frames are not buffered by
+// the stream, they are held back from the connection until read.
+func (s *Stream) BufferedRecvBytes() int {
+	return int(atomic.LoadInt32(&s.unreadBytes) + atomic.LoadInt32(&s.queuedBytes))
+}
+
+// takeQueued takes a data frame left queued in dataChan once the stream
+// is closed, so that the frames received ahead of the finish are read.
+func (s *Stream) takeQueued(dataChan chan []byte) ([]byte, bool) {
+	select {
+	case read, ok := <-dataChan:
+		if ok {
+			s.received(read)
+			return read, true
+		}
+	default:
+	}
+	return nil, false
+}
+
+// received accounts for a data frame taken from dataChan.
+func (s *Stream) received(data []byte) {
+	atomic.AddInt32(&s.queuedBytes, -int32(len(data)))
+	s.consume(len(data))
+}
+
 // ReadData reads an entire data frame and returns the byte array
 // from the data frame.  If there is unread data from the result
 // of a Read call, this function will return an ErrUnreadPartialData.
@@ -120,25 +337,107 @@ func (s *Stream) ReadData() ([]byte, error) {
 	if s.unread != nil {
 		return nil, ErrUnreadPartialData
 	}
-	select {
-	case <-s.closeChan:
-		return nil, io.EOF
-	case read, ok := <-s.dataChan:
-		if !ok {
-			return nil, io.EOF
+	return s.receive()
+}
+
+// ReadFrames reads up to max data frames, blocking until at least one
+// frame is available and then collecting any further frames already
+// pending on the stream without waiting.  Frames are only pending ahead
+// of the read with a data queue, see Connection.SetDataQueue, otherwise
+// a single frame is returned in most cases.  Like ReadData, it returns
+// ErrUnreadPartialData if a previous Read left data unread.
+func (s *Stream) ReadFrames(max int) ([][]byte, error) {
+	if max < 1 {
+		max = 1
+	}
+	first, err := s.ReadData()
+	if err != nil {
+		return nil, err
+	}
+	frames := [][]byte{first}
+	for len(frames) < max {
+		if s.pauseChan() != nil {
+			// paused meanwhile
+			return frames, nil
+		}
+		select {
+		case read, ok := <-s.dataChan:
+			if !ok {
+				return frames, nil
+			}
+			s.received(read)
+			frames = append(frames, read)
+		default:
+			return frames, nil
+		}
+	}
+	return frames, nil
+}
+
+// DiscardRemaining reads and drops the data received on the stream,
+// including data left unread by Read, until the remote side is closed,
+// and returns the number of bytes discarded.  The error is nil if the
+// remote finished the stream; if the stream was reset it is the cause
+// recorded by Abort, a *CancelError, or ErrReset.  While reading is
+// paused it waits for ResumeReading, see PauseReading.
+func (s *Stream) DiscardRemaining() (int64, error) {
+	n := int64(len(s.unread))
+	s.unread = nil
+	atomic.StoreInt32(&s.unreadBytes, 0)
+	for {
+		resumeChan := s.pauseChan()
+		dataChan := s.dataChan
+		if resumeChan != nil {
+			dataChan = nil
+		}
+		select {
+		case <-resumeChan:
+		case <-s.closeChan:
+			if read, ok := s.takeQueued(dataChan); ok {
+				n += int64(len(read))
+				continue
+			}
+			s.closeLock.Lock()
+			defer s.closeLock.Unlock()
+			if s.abortErr != nil {
+				return n, s.abortErr
+			}
+			if !s.remoteFinished {
+				return n, ErrReset
+			}
+			return n, nil
+		case read, ok := <-dataChan:
+			if !ok {
+				return n, nil
+			}
+			s.received(read)
+			n += int64(len(read))
 		}
-		return read, nil
 	}
 }
 
-func (s *Stream) waitWriteReply() {
+// checkReplied returns ErrReplyPending if the stream was accepted from
+// the remote and has not been replied to yet.
+func (s *Stream) checkReplied() error {
 	if s.replyCond != nil {
 		s.replyCond.L.Lock()
-		for !s.replied {
-			s.replyCond.Wait()
+		defer s.replyCond.L.Unlock()
+		if !s.replied {
+			return ErrReplyPending
 		}
-		s.replyCond.L.Unlock()
 	}
+	return nil
+}
+
+// isReplied returns whether the stream was replied to, by the remote for
+// streams created locally or with SendReply for accepted streams, which
+// may be replied to from any goroutine.
+func (s *Stream) isReplied() bool {
+	if s.replyCond != nil {
+		s.replyCond.L.Lock()
+		defer s.replyCond.L.Unlock()
+	}
+	return s.replied
 }
 
 // Wait waits for the stream to receive a reply.
@@ -155,11 +454,14 @@ func (s *Stream) WaitTimeout(timeout time.Duration) error {
 	}
 
 	select {
-	case err := <-s.startChan:
+	case err, ok := <-s.startChan:
 		if err != nil {
 			return err
 		}
-		break
+		if !ok {
+			// the wait already ended, by the error given to Abort if any
+			return s.abortError()
+		}
 	case <-timeoutChan:
 		return ErrTimeout
 	}
@@ -179,6 +481,62 @@ func (s *Stream) Close() error {
 	return s.WriteData([]byte{}, true)
 }
 
+// CloseAck reports how the remote responded to CloseAndWaitAck.
+type CloseAck int
+
+const (
+	// CloseAckFin means the remote finished its side of the stream.
+	CloseAckFin CloseAck = iota
+	// CloseAckReset means the stream was reset, or its connection closed,
+	// before the remote finished its side.
+	CloseAckReset
+	// CloseAckTimeout means the remote side was still open at the timeout.
+	CloseAckTimeout
+)
+
+func (a CloseAck) String() string {
+	switch a {
+	case CloseAckFin:
+		return "fin"
+	case CloseAckReset:
+		return "reset"
+	case CloseAckTimeout:
+		return "timeout"
+	}
+	return "unknown"
+}
+
+// CloseAndWaitAck closes the local side of the stream and waits for the
+// remote to finish its side, for the stream to be reset, or for timeout,
+// reporting which occurred.  A timeout of zero waits indefinitely.  Data
+// still sent by the remote is delivered as usual, so it must be read
+// concurrently for the remote finish to be received.  On timeout the
+// stream is left open, the caller may Reset it.
+func (s *Stream) CloseAndWaitAck(timeout time.Duration) (CloseAck, error) {
+	if err := s.Close(); err != nil && err != ErrWriteClosedStream {
+		return CloseAckReset, err
+	}
+
+	var timeoutChan <-chan time.Time
+	if timeout > time.Duration(0) {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+	select {
+	case <-s.closeChan:
+	case <-timeoutChan:
+		return CloseAckTimeout, nil
+	}
+
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+	if s.remoteFinished {
+		return CloseAckFin, nil
+	}
+	return CloseAckReset, nil
+}
+
 // Reset sends a reset frame, putting the stream into the fully closed state.
 func (s *Stream) Reset() error {
 	s.conn.removeStream(s)
@@ -186,6 +544,10 @@ func (s *Stream) Reset() error {
 }
 
 func (s *Stream) resetStream() error {
+	return s.resetWithStatus(spdy.Cancel)
+}
+
+func (s *Stream) resetWithStatus(status spdy.RstStreamStatus) error {
 	// Always call closeRemoteChannels, even if s.finished is already true.
 	// This makes it so that stream.Close() followed by stream.Reset() allows
 	// stream.Read() to unblock.
@@ -201,26 +563,157 @@ func (s *Stream) resetStream() error {
 
 	resetFrame := &spdy.RstStreamFrame{
 		StreamId: s.streamId,
-		Status:   spdy.Cancel,
+		Status:   status,
 	}
 	return s.conn.framer.WriteFrame(resetFrame)
 }
 
-// CreateSubStream creates a stream using the current as the parent
+// Abort resets the stream and records err as the cause.  Pending and
+// subsequent Read and Write calls on the stream return an error
+// wrapping err, which can be matched using errors.Is.  A nil err is
+// recorded as ErrReset.
+func (s *Stream) Abort(err error) error {
+	return s.abortWithStatus(err, spdy.Cancel)
+}
+
+// abortWithStatus aborts the stream like Abort, sending status in the
+// reset.
+func (s *Stream) abortWithStatus(err error, status spdy.RstStreamStatus) error {
+	if err == nil {
+		err = ErrReset
+	}
+	s.closeLock.Lock()
+	if s.abortErr == nil {
+		if s.traceID != "" {
+			s.abortErr = fmt.Errorf("stream %s aborted: %w", s.traceID, err)
+		} else {
+			s.abortErr = fmt.Errorf("stream aborted: %w", err)
+		}
+	}
+	s.closeLock.Unlock()
+
+	s.conn.removeStream(s)
+	return s.resetWithStatus(status)
+}
+
+// abortError returns the error recorded by Abort, if any.
+func (s *Stream) abortError() error {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+	return s.abortErr
+}
+
+// writeClosedError returns the error for writes on a stream which can no
+// longer be written to: the cause recorded by Abort, ErrReset if the
+// stream was reset by either side, ErrWriteClosedStream if the local side
+// is finished, nil otherwise.
+func (s *Stream) writeClosedError() error {
+	if err := s.abortError(); err != nil {
+		return err
+	}
+	if s.isReset() {
+		return ErrReset
+	}
+	s.finishLock.Lock()
+	defer s.finishLock.Unlock()
+	if s.finished {
+		return ErrWriteClosedStream
+	}
+	return nil
+}
+
+// isReset returns whether the remote side of the stream was closed
+// without being finished by the remote, by a reset or the connection
+// closing.
+func (s *Stream) isReset() bool {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+	select {
+	case <-s.closeChan:
+		return !s.remoteFinished
+	default:
+		return false
+	}
+}
+
+// readClosedError returns the error for reads on a stream whose remote
+// side is closed.
+func (s *Stream) readClosedError() error {
+	if err := s.abortError(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// CreateSubStream creates a stream using the current as the parent.
+// It returns ErrReset if the current stream was reset.
 func (s *Stream) CreateSubStream(headers http.Header, fin bool) (*Stream, error) {
+	if s.isReset() {
+		return nil, ErrReset
+	}
 	return s.conn.CreateStream(headers, s, fin)
 }
 
+// CreateErrorStream creates a sub stream flagged as the error stream of
+// the current stream, to carry error output separately from the data
+// of the stream itself. Only one error stream may be created per stream,
+// and none once the stream was reset.
+func (s *Stream) CreateErrorStream(fin bool) (*Stream, error) {
+	s.errorLock.Lock()
+	defer s.errorLock.Unlock()
+	if s.errorStream != nil {
+		return nil, ErrErrorStreamExists
+	}
+	if s.isReset() {
+		return nil, ErrReset
+	}
+
+	headers := http.Header{}
+	headers.Set(StreamTypeHeader, StreamTypeError)
+	errorStream, err := s.conn.CreateStream(headers, s, fin)
+	if errorStream != nil {
+		s.errorStream = errorStream
+	}
+	return errorStream, err
+}
+
+// ErrorStream returns the error stream linked to this stream, or nil
+// if none has been created or received yet.  On the receiving side the
+// error stream is still passed to the stream handler, which must reply
+// to it like any other stream.
+func (s *Stream) ErrorStream() *Stream {
+	s.errorLock.Lock()
+	defer s.errorLock.Unlock()
+	return s.errorStream
+}
+
+func (s *Stream) setErrorStream(errorStream *Stream) {
+	s.errorLock.Lock()
+	defer s.errorLock.Unlock()
+	if s.errorStream == nil {
+		s.errorStream = errorStream
+	}
+}
+
 // SetPriority sets the stream priority, does not affect the
 // remote priority of this stream after Open has been called.
 // Valid values are 0 through 7, 0 being the highest priority
 // and 7 the lowest.
 func (s *Stream) SetPriority(priority uint8) {
 	s.priority = priority
+	s.conn.updatePriorityMark()
 }
 
-// SendHeader sends a header frame across the stream
+// SendHeader sends a header frame across the stream.  Like WriteData,
+// it returns ErrReplyPending on accepted streams not yet replied to, and
+// ErrWriteClosedStream or ErrReset once the stream is closed or reset.
 func (s *Stream) SendHeader(headers http.Header, fin bool) error {
+	if err := s.checkReplied(); err != nil {
+		return err
+	}
+	if err := s.writeClosedError(); err != nil {
+		return err
+	}
 	return s.conn.sendHeaders(headers, s, fin)
 }
 
@@ -228,13 +721,16 @@ func (s *Stream) SendHeader(headers http.Header, fin bool) error {
 // when handling a new stream
 func (s *Stream) SendReply(headers http.Header, fin bool) error {
 	if s.replyCond == nil {
-		return errors.New("cannot reply on initiated stream")
+		return ErrReplyOnLocalStream
 	}
 	s.replyCond.L.Lock()
 	defer s.replyCond.L.Unlock()
 	if s.replied {
 		return nil
 	}
+	if s.isReset() {
+		return s.writeClosedError()
+	}
 
 	err := s.conn.sendReply(headers, s, fin)
 	if err != nil {
@@ -246,11 +742,57 @@ func (s *Stream) SendReply(headers http.Header, fin bool) error {
 	return nil
 }
 
+// ReplyAndClose sends a reply with the finish flag set, for responses
+// carrying only headers.  Unlike SendReply with fin, the local side is
+// marked finished as Close does, so further writes fail with
+// ErrWriteClosedStream and the stream is removed once the remote side is
+// finished too.  If a reply was already sent the stream is only closed.
+func (s *Stream) ReplyAndClose(headers http.Header) error {
+	if s.replyCond == nil {
+		return ErrReplyOnLocalStream
+	}
+	s.replyCond.L.Lock()
+	if s.replied {
+		s.replyCond.L.Unlock()
+		return s.Close()
+	}
+	if err := s.writeClosedError(); err != nil {
+		s.replyCond.L.Unlock()
+		return err
+	}
+	s.finishLock.Lock()
+	s.finished = true
+	s.finishLock.Unlock()
+
+	err := s.conn.sendReply(headers, s, true)
+	if err == nil {
+		s.replied = true
+		s.replyCond.Broadcast()
+	}
+	s.replyCond.L.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-s.closeChan:
+		// Stream is now fully closed
+		s.conn.removeStream(s)
+	default:
+		s.startHalfCloseTimer()
+	}
+	return nil
+}
+
 // Refuse sends a reset frame with the status refuse, only
 // valid to be called once when handling a new stream.  This
 // may be used to indicate that a stream is not allowed
 // when http status codes are not being used.
 func (s *Stream) Refuse() error {
+	if s.replyCond != nil {
+		s.replyCond.L.Lock()
+		defer s.replyCond.L.Unlock()
+	}
 	if s.replied {
 		return nil
 	}
@@ -265,10 +807,37 @@ func (s *Stream) Cancel() error {
 	return s.conn.sendReset(spdy.Cancel, s)
 }
 
+// CancelWithReason resets the stream with the status canceled, first
+// sending reason in a headers frame so that reads and writes on the
+// remote stream fail with a *CancelError carrying it.  The reason is
+// not sent on accepted streams not replied to yet, which may only be
+// reset.
+func (s *Stream) CancelWithReason(reason string) error {
+	if reason != "" && s.checkReplied() == nil {
+		headers := http.Header{}
+		headers.Set(CancelReasonHeader, reason)
+		if err := s.conn.sendHeaders(headers, s, false); err != nil {
+			debugMessage("(%p) (%p) Error sending cancel reason: %s", s.conn, s, err)
+		}
+	}
+	s.conn.removeStream(s)
+	return s.resetStream()
+}
+
 // ReceiveHeader receives a header sent on the other side
 // of the stream.  This function will block until a header
 // is received or stream is closed.
 func (s *Stream) ReceiveHeader() (http.Header, error) {
+	// Prefer headers already queued over reporting the stream closed
+	select {
+	case header, ok := <-s.headerChan:
+		if !ok {
+			return nil, fmt.Errorf("header chan closed")
+		}
+		return header, nil
+	default:
+	}
+
 	select {
 	case <-s.closeChan:
 		break
@@ -291,6 +860,15 @@ func (s *Stream) Headers() http.Header {
 	return s.headers
 }
 
+// ReplyHeaders returns the headers of the reply received for a stream
+// created locally, nil before the reply is received.  Use Wait to wait
+// for the reply.
+func (s *Stream) ReplyHeaders() http.Header {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+	return s.replyHeaders
+}
+
 // String returns the string version of stream using the
 // streamId to uniquely identify the stream
 func (s *Stream) String() string {
@@ -308,6 +886,12 @@ func (s *Stream) IsFinished() bool {
 	return s.finished
 }
 
+// TLSConnectionState returns the TLS state of the stream's connection,
+// ok is false if the connection does not use TLS.
+func (s *Stream) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+	return s.conn.TLSConnectionState()
+}
+
 // Implement net.Conn interface
 
 func (s *Stream) LocalAddr() net.Addr {
@@ -318,26 +902,38 @@ func (s *Stream) RemoteAddr() net.Addr {
 	return s.conn.conn.RemoteAddr()
 }
 
-// TODO set per stream values instead of connection-wide
-
+// SetDeadline sets the read deadline of the stream and the write
+// deadline of the connection, see SetReadDeadline and SetWriteDeadline.
 func (s *Stream) SetDeadline(t time.Time) error {
-	return s.conn.conn.SetDeadline(t)
+	s.readDeadline.set(t)
+	return s.conn.conn.SetWriteDeadline(t)
 }
 
+// SetReadDeadline sets the deadline for Read and ReadData on the stream,
+// including pending calls; exceeding it returns a net.Error with
+// Timeout true and leaves the stream usable once the deadline is moved.
+// It does not affect the connection or its other streams.  A zero value
+// disables the deadline.
 func (s *Stream) SetReadDeadline(t time.Time) error {
-	return s.conn.conn.SetReadDeadline(t)
+	s.readDeadline.set(t)
+	return nil
 }
 
+// TODO set per stream values instead of connection-wide, a connection
+// nested in the stream must not set write deadlines
+
 func (s *Stream) SetWriteDeadline(t time.Time) error {
 	return s.conn.conn.SetWriteDeadline(t)
 }
 
 func (s *Stream) closeRemoteChannels() {
 	s.closeLock.Lock()
-	defer s.closeLock.Unlock()
 	select {
 	case <-s.closeChan:
 	default:
 		close(s.closeChan)
 	}
+	s.stopHalfCloseTimer()
+	s.closeLock.Unlock()
+	s.notifyClosed()
 }
@@ -0,0 +1,87 @@
+//go:build go1.23
+// +build go1.23
+
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestStreamFrames(t *testing.T) {
+	var wg sync.WaitGroup
+	server, listen, serverErr := runServer(&wg)
+	if serverErr != nil {
+		t.Fatalf("Error initializing server: %s", serverErr)
+	}
+
+	conn, dialErr := net.Dial("tcp", listen)
+	if dialErr != nil {
+		t.Fatalf("Error dialing server: %s", dialErr)
+	}
+
+	spdyConn, spdyErr := NewConnection(conn, false)
+	if spdyErr != nil {
+		t.Fatalf("Error creating spdy connection: %s", spdyErr)
+	}
+	go spdyConn.Serve(NoOpStreamHandler)
+
+	authenticated = true
+	stream, streamErr := spdyConn.CreateStream(http.Header{}, nil, false)
+	if streamErr != nil {
+		t.Fatalf("Error creating stream: %s", streamErr)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+
+	messages := []string{"one", "two", "three"}
+	for _, message := range messages {
+		if _, err := stream.Write([]byte(message)); err != nil {
+			t.Fatalf("Error writing to stream: %s", err)
+		}
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatalf("Error closing stream: %s", err)
+	}
+
+	var received []string
+	for frame, err := range stream.Frames() {
+		if err != nil {
+			t.Fatalf("Error reading frames: %s", err)
+		}
+		received = append(received, string(frame))
+	}
+	if len(received) != len(messages) {
+		t.Fatalf("Unexpected frames:\nActual: %v\nExpected: %v", received, messages)
+	}
+	for i := range messages {
+		if received[i] != messages[i] {
+			t.Fatalf("Unexpected frames:\nActual: %v\nExpected: %v", received, messages)
+		}
+	}
+
+	closeErr := server.Close()
+	if closeErr != nil {
+		t.Fatalf("Error shutting down server: %s", closeErr)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,87 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"net/http"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+// StreamIdAllocator picks the ids of the streams created locally.
+type StreamIdAllocator interface {
+	// AllocateStreamId returns the id of a new stream created with
+	// headers.  Next is the lowest id the stream may use: ids of a side
+	// must keep its parity, odd for clients and even for servers, and
+	// increase with each stream, so the allocator may skip ids but an id
+	// below next is never accepted by the remote.  Returning 0 means no
+	// id is left.  It is called with the stream creation lock held and
+	// must not create streams.
+	AllocateStreamId(next spdy.StreamId, headers http.Header) spdy.StreamId
+}
+
+// StreamIdAllocatorFunc adapts a function to the StreamIdAllocator
+// interface.
+type StreamIdAllocatorFunc func(next spdy.StreamId, headers http.Header) spdy.StreamId
+
+// AllocateStreamId calls f(next, headers).
+func (f StreamIdAllocatorFunc) AllocateStreamId(next spdy.StreamId, headers http.Header) spdy.StreamId {
+	return f(next, headers)
+}
+
+// SequentialStreamIds allocates every stream the next id, the default.
+var SequentialStreamIds StreamIdAllocator = StreamIdAllocatorFunc(sequentialStreamId)
+
+func sequentialStreamId(next spdy.StreamId, headers http.Header) spdy.StreamId {
+	return next
+}
+
+// SetStreamIdAllocator sets the allocator picking the ids of the streams
+// created locally, SequentialStreamIds if nil.  Allocators may force the
+// ids of streams in tests, or keep ranges of ids for classes of streams
+// as long as they are used in increasing order.  The ids skipped are
+// lost, see RemainingStreamCapacity.  It may be called at any time and
+// applies to the streams created afterwards.
+func (s *Connection) SetStreamIdAllocator(allocator StreamIdAllocator) {
+	if allocator == nil {
+		allocator = SequentialStreamIds
+	}
+	s.nextIdLock.Lock()
+	defer s.nextIdLock.Unlock()
+	s.streamIdAllocator = allocator
+}
+
+// getNextStreamId returns the id of a new stream created with headers,
+// ErrStreamIdExhausted once no id is left or ErrInvalidStreamId if the
+// allocator picked an id the remote would reject.  Callers must hold
+// nextIdLock.
+func (s *Connection) getNextStreamId(headers http.Header) (spdy.StreamId, error) {
+	next := s.nextStreamId
+	if next > 0x7fffffff {
+		return 0, ErrStreamIdExhausted
+	}
+	sid := s.streamIdAllocator.AllocateStreamId(next, headers)
+	if sid == 0 {
+		return 0, ErrStreamIdExhausted
+	}
+	if sid < next || sid > 0x7fffffff || sid&0x01 != next&0x01 {
+		debugMessage("(%p) Allocated stream id %d invalid, next is %d", s, sid, next)
+		return 0, ErrInvalidStreamId
+	}
+	s.nextStreamId = sid + 2
+	return sid, nil
+}
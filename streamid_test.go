@@ -0,0 +1,92 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+func TestStreamIdAllocator(t *testing.T) {
+	accepted := make(chan uint32, 10)
+	client, server := newTestConnections(t, nil, func(stream *Stream) {
+		stream.SendReply(http.Header{}, false)
+		accepted <- stream.Identifier()
+	})
+	defer client.Close()
+	defer server.Close()
+
+	var forced spdy.StreamId
+	client.SetStreamIdAllocator(StreamIdAllocatorFunc(func(next spdy.StreamId, headers http.Header) spdy.StreamId {
+		if headers.Get("Class") == "forced" {
+			return forced
+		}
+		return next
+	}))
+	create := func(class string, id spdy.StreamId) (*Stream, error) {
+		forced = id
+		return client.CreateStream(http.Header{"Class": []string{class}}, nil, false)
+	}
+
+	expected := []uint32{1, 21, 23, 0x7fffffff}
+	for i, stream := range []struct {
+		class string
+		id    spdy.StreamId
+	}{{"", 0}, {"forced", 21}, {"", 0}, {"forced", 0x7fffffff}} {
+		created, err := create(stream.class, stream.id)
+		if err != nil {
+			t.Fatalf("Error creating stream: %s", err)
+		}
+		if err := created.WaitTimeout(5 * time.Second); err != nil {
+			t.Fatalf("Error waiting for reply: %s", err)
+		}
+		if created.Identifier() != expected[i] {
+			t.Fatalf("Unexpected stream id:\nActual: %d\nExpected: %d", created.Identifier(), expected[i])
+		}
+		select {
+		case id := <-accepted:
+			if id != expected[i] {
+				t.Fatalf("Unexpected accepted stream id:\nActual: %d\nExpected: %d", id, expected[i])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for stream")
+		}
+		if i == 2 {
+			// ids lower than the next one, or of the parity of the
+			// remote, are not allocated and leave the next id as is
+			for _, id := range []spdy.StreamId{21, 24} {
+				if _, err := create("forced", id); err != ErrInvalidStreamId {
+					t.Fatalf("Unexpected error for id %d:\nActual: %v\nExpected: %v", id, err, ErrInvalidStreamId)
+				}
+			}
+			if next := client.PeekNextStreamId(); next != 25 {
+				t.Fatalf("Unexpected next stream id:\nActual: %d\nExpected: %d", next, 25)
+			}
+		}
+	}
+
+	if _, err := create("", 0); err != ErrStreamIdExhausted {
+		t.Fatalf("Unexpected error after the last id:\nActual: %v\nExpected: %v", err, ErrStreamIdExhausted)
+	}
+	client.SetStreamIdAllocator(nil)
+	if _, err := create("forced", 0); err != ErrStreamIdExhausted {
+		t.Fatalf("Unexpected error with the default allocator:\nActual: %v\nExpected: %v", err, ErrStreamIdExhausted)
+	}
+}
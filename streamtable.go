@@ -0,0 +1,178 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+// streamTableShards is the number of shards of a stream table, each with
+// its own lock, so that frame dispatch, CreateStream and removeStream on
+// different streams do not contend.
+const streamTableShards = 16
+
+type streamShard struct {
+	lock    sync.RWMutex
+	streams map[spdy.StreamId]*Stream
+}
+
+// streamSnapshot is the streams of a table at a generation.
+type streamSnapshot struct {
+	generation uint32
+	streams    []*Stream
+}
+
+// streamTable holds the active streams of a connection.  Lookups lock
+// the shard of the stream only.  Iterations share a copy-on-write
+// snapshot, built again only once the table changed, so that streams
+// are locked without holding the table.  Waits for changes have a lock
+// of their own, taken by changes only while there are waiters.
+type streamTable struct {
+	shards [streamTableShards]streamShard
+	count  int32
+
+	// generation is bumped after every change, invalidating snapshot
+	generation uint32
+	snapshot   atomic.Value
+
+	waiters    int32
+	changeLock sync.Mutex
+	changed    *sync.Cond
+}
+
+func newStreamTable() *streamTable {
+	t := &streamTable{}
+	for i := range t.shards {
+		t.shards[i].streams = make(map[spdy.StreamId]*Stream)
+	}
+	t.changed = sync.NewCond(&t.changeLock)
+	t.snapshot.Store(streamSnapshot{streams: []*Stream{}})
+	return t
+}
+
+func (t *streamTable) shard(streamId spdy.StreamId) *streamShard {
+	return &t.shards[streamId%streamTableShards]
+}
+
+// add adds stream, returning the stream it displaced under the same id
+// if any.
+func (t *streamTable) add(stream *Stream) *Stream {
+	shard := t.shard(stream.streamId)
+	shard.lock.Lock()
+	displaced := shard.streams[stream.streamId]
+	shard.streams[stream.streamId] = stream
+	shard.lock.Unlock()
+	if displaced == nil {
+		atomic.AddInt32(&t.count, 1)
+	}
+	t.notifyChange()
+	return displaced
+}
+
+// remove removes stream, unless its id is held by another stream.
+func (t *streamTable) remove(stream *Stream) {
+	shard := t.shard(stream.streamId)
+	shard.lock.Lock()
+	removed := shard.streams[stream.streamId] == stream
+	if removed {
+		delete(shard.streams, stream.streamId)
+	}
+	shard.lock.Unlock()
+	if removed {
+		atomic.AddInt32(&t.count, -1)
+	}
+	t.notifyChange()
+}
+
+// removeAll removes every stream, passing each to fn, if not nil, while
+// its shard is locked.
+func (t *streamTable) removeAll(fn func(*Stream)) {
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.lock.Lock()
+		for _, stream := range shard.streams {
+			if fn != nil {
+				fn(stream)
+			}
+		}
+		atomic.AddInt32(&t.count, -int32(len(shard.streams)))
+		shard.streams = make(map[spdy.StreamId]*Stream)
+		shard.lock.Unlock()
+	}
+	t.notifyChange()
+}
+
+func (t *streamTable) get(streamId spdy.StreamId) (*Stream, bool) {
+	shard := t.shard(streamId)
+	shard.lock.RLock()
+	stream, ok := shard.streams[streamId]
+	shard.lock.RUnlock()
+	return stream, ok
+}
+
+func (t *streamTable) len() int {
+	return int(atomic.LoadInt32(&t.count))
+}
+
+// streams returns the streams of the table.  The slice is shared by the
+// callers until the table changes, it must not be modified.
+func (t *streamTable) streams() []*Stream {
+	generation := atomic.LoadUint32(&t.generation)
+	snapshot := t.snapshot.Load().(streamSnapshot)
+	if snapshot.generation == generation {
+		return snapshot.streams
+	}
+	streams := make([]*Stream, 0, t.len())
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.lock.RLock()
+		for _, stream := range shard.streams {
+			streams = append(streams, stream)
+		}
+		shard.lock.RUnlock()
+	}
+	// changes made while building bump the generation past this one
+	t.snapshot.Store(streamSnapshot{generation: generation, streams: streams})
+	return streams
+}
+
+// notifyChange invalidates the snapshot and wakes the waiters, once the
+// change is made.
+func (t *streamTable) notifyChange() {
+	atomic.AddUint32(&t.generation, 1)
+	if atomic.LoadInt32(&t.waiters) == 0 {
+		return
+	}
+	t.changeLock.Lock()
+	t.changed.Broadcast()
+	t.changeLock.Unlock()
+}
+
+// waitFor waits until done returns true, checking it again after every
+// change of the table.
+func (t *streamTable) waitFor(done func() bool) {
+	t.changeLock.Lock()
+	atomic.AddInt32(&t.waiters, 1)
+	for !done() {
+		t.changed.Wait()
+	}
+	atomic.AddInt32(&t.waiters, -1)
+	t.changeLock.Unlock()
+}
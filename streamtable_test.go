@@ -0,0 +1,81 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+func TestStreamTable(t *testing.T) {
+	table := newStreamTable()
+	streams := make([]*Stream, 3)
+	for i := range streams {
+		streams[i] = &Stream{streamId: spdy.StreamId(2*i + 1)}
+		if displaced := table.add(streams[i]); displaced != nil {
+			t.Fatalf("Unexpected displaced stream: %d", displaced.streamId)
+		}
+	}
+
+	snapshot := table.streams()
+	if len(snapshot) != 3 || table.len() != 3 {
+		t.Fatalf("Unexpected streams:\nActual: %d, %d\nExpected: 3", len(snapshot), table.len())
+	}
+	if again := table.streams(); &again[0] != &snapshot[0] {
+		t.Fatal("Snapshot rebuilt without changes")
+	}
+
+	// a stream no longer holding its id is not removed
+	table.remove(&Stream{streamId: streams[0].streamId})
+	if stream, ok := table.get(streams[0].streamId); !ok || stream != streams[0] {
+		t.Fatal("Stream removed by another stream of the same id")
+	}
+	table.remove(streams[0])
+	if _, ok := table.get(streams[0].streamId); ok {
+		t.Fatal("Removed stream found")
+	}
+	if snapshot := table.streams(); len(snapshot) != 2 {
+		t.Fatalf("Unexpected snapshot after removal:\nActual: %d\nExpected: 2", len(snapshot))
+	}
+
+	added := &Stream{streamId: 7}
+	found := make(chan struct{})
+	go func() {
+		table.waitFor(func() bool {
+			_, ok := table.get(added.streamId)
+			return ok
+		})
+		close(found)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	table.add(added)
+	select {
+	case <-found:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for added stream")
+	}
+
+	removed := 0
+	table.removeAll(func(*Stream) {
+		removed++
+	})
+	if removed != 3 || table.len() != 0 || len(table.streams()) != 0 {
+		t.Fatalf("Unexpected streams after removing all:\nActual: %d removed, %d left\nExpected: 3 removed, 0 left", removed, table.len())
+	}
+}
@@ -0,0 +1,172 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newTestCertificate returns a self signed certificate for commonName,
+// usable for both client and server authentication.
+func newTestCertificate(t *testing.T, commonName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %s", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newTLSTestConnections returns a client and server connection over TLS,
+// the client presenting a certificate for clientName.
+func newTLSTestConnections(t *testing.T, clientName string, configure func(*Connection)) (*Connection, *Connection) {
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{newTestCertificate(t, "server")},
+		ClientAuth:   tls.RequireAnyClientCert,
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	defer listener.Close()
+
+	serverConns := make(chan *Connection, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Error(err)
+			close(serverConns)
+			return
+		}
+		spdyConn, err := NewConnection(conn, true)
+		if err != nil {
+			t.Errorf("Error creating server connection: %s", err)
+			close(serverConns)
+			return
+		}
+		configure(spdyConn)
+		go spdyConn.Serve(MirrorStreamHandler)
+		serverConns <- spdyConn
+	}()
+
+	clientConfig := &tls.Config{
+		Certificates:       []tls.Certificate{newTestCertificate(t, clientName)},
+		InsecureSkipVerify: true,
+	}
+	conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatalf("Error dialing: %s", err)
+	}
+	spdyConn, err := NewConnection(conn, false)
+	if err != nil {
+		t.Fatalf("Error creating spdy connection: %s", err)
+	}
+	go spdyConn.Serve(NoOpStreamHandler)
+
+	serverConn, ok := <-serverConns
+	if !ok {
+		t.FailNow()
+	}
+	return spdyConn, serverConn
+}
+
+func TestTLSConnectionState(t *testing.T) {
+	client, server := newTLSTestConnections(t, "client", func(conn *Connection) {})
+	defer client.Close()
+
+	state, ok := client.TLSConnectionState()
+	if !ok {
+		t.Fatal("Missing client TLS connection state")
+	}
+	if len(state.PeerCertificates) == 0 || state.PeerCertificates[0].Subject.CommonName != "server" {
+		t.Fatalf("Unexpected server certificates: %v", state.PeerCertificates)
+	}
+
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	if _, ok := stream.TLSConnectionState(); !ok {
+		t.Fatal("Missing stream TLS connection state")
+	}
+	stream.Close()
+
+	if _, ok := server.TLSConnectionState(); !ok {
+		t.Fatal("Missing server TLS connection state")
+	}
+
+	client, server = newTestConnections(t, nil, NoOpStreamHandler)
+	defer client.Close()
+	if _, ok := server.TLSConnectionState(); ok {
+		t.Fatal("Unexpected TLS connection state on plain connection")
+	}
+}
+
+func TestStreamAuthorizer(t *testing.T) {
+	authorizer := func(stream *Stream, peer *x509.Certificate) bool {
+		return peer != nil && peer.Subject.CommonName == "trusted"
+	}
+	configure := func(conn *Connection) {
+		conn.SetStreamAuthorizer(authorizer)
+	}
+
+	client, _ := newTLSTestConnections(t, "trusted", configure)
+	stream, err := client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for authorized stream: %s", err)
+	}
+	stream.Close()
+	client.Close()
+
+	client, _ = newTLSTestConnections(t, "untrusted", configure)
+	stream, err = client.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != ErrReset {
+		t.Fatalf("Unexpected error waiting for unauthorized stream:\nActual: %v\nExpected: %v", err, ErrReset)
+	}
+	client.Close()
+}
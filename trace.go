@@ -0,0 +1,76 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// TraceIDHeader is the reserved header carrying the correlation id of a
+// stream, see Stream.TraceID.
+const TraceIDHeader = "Spdystream-Trace-Id"
+
+// SetTraceIDs enables generating a random correlation id in the
+// TraceIDHeader of streams created without one, and for streams accepted
+// without one, so every stream can be followed across hops in logs and
+// errors.  Must be called before Serve.
+func (s *Connection) SetTraceIDs(enabled bool) {
+	s.traceIDs = enabled
+}
+
+// TraceID returns the correlation id of the stream, taken from its
+// TraceIDHeader or generated when trace ids are enabled, or "" if it
+// has none.
+func (s *Stream) TraceID() string {
+	return s.traceID
+}
+
+// withTraceID returns headers with a generated trace id if they have
+// none and trace ids are enabled, leaving headers unmodified.
+func (s *Connection) withTraceID(headers http.Header) http.Header {
+	if !s.traceIDs || headers.Get(TraceIDHeader) != "" {
+		return headers
+	}
+	withTraceID := make(http.Header, len(headers)+1)
+	for name, values := range headers {
+		withTraceID[name] = values
+	}
+	withTraceID.Set(TraceIDHeader, newTraceID())
+	return withTraceID
+}
+
+// acceptedTraceID returns the trace id of a stream accepted with
+// headers, generating one when enabled if the remote sent none.
+func (s *Connection) acceptedTraceID(headers http.Header) string {
+	if id := headers.Get(TraceIDHeader); id != "" {
+		return id
+	}
+	if s.traceIDs {
+		return newTraceID()
+	}
+	return ""
+}
+
+func newTraceID() string {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		debugMessage("Error generating trace id: %s", err)
+	}
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,208 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// StreamTypeUDP flags the streams created by DialUDP, which carry UDP
+// datagrams, so handlers shared with other streams can route them to
+// UDPStreamHandler.
+const StreamTypeUDP = "udp"
+
+// maxDatagramSize is the largest UDP payload.
+const maxDatagramSize = 65535
+
+var (
+	ErrInvalidDatagram = errors.New("invalid datagram")
+)
+
+// WriteDatagram sends data as a single data frame prefixed with addr, the
+// destination of the datagram when sent to the relay and its source when
+// sent back by the relay.
+func (s *Stream) WriteDatagram(data []byte, addr *net.UDPAddr) error {
+	ip := addr.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return net.InvalidAddrError("invalid datagram address " + addr.String())
+	}
+	frame := make([]byte, 0, 1+len(ip)+2+len(data))
+	frame = append(frame, byte(len(ip)))
+	frame = append(frame, ip...)
+	frame = append(frame, byte(addr.Port>>8), byte(addr.Port))
+	frame = append(frame, data...)
+	return s.WriteData(frame, false)
+}
+
+// ReadDatagram reads a datagram sent with WriteDatagram, returning its
+// payload and address.  Frames which are not datagrams return
+// ErrInvalidDatagram.
+func (s *Stream) ReadDatagram() ([]byte, *net.UDPAddr, error) {
+	for {
+		frame, err := s.ReadData()
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(frame) == 0 {
+			continue
+		}
+		ipLen := int(frame[0])
+		if (ipLen != net.IPv4len && ipLen != net.IPv6len) || len(frame) < 1+ipLen+2 {
+			return nil, nil, ErrInvalidDatagram
+		}
+		addr := &net.UDPAddr{
+			IP:   net.IP(append([]byte{}, frame[1:1+ipLen]...)),
+			Port: int(binary.BigEndian.Uint16(frame[1+ipLen:])),
+		}
+		return frame[1+ipLen+2:], addr, nil
+	}
+}
+
+// DialUDP creates a stream flagged with StreamTypeUDP and waits for its
+// reply, returning a net.PacketConn whose datagrams are sent from the
+// network of the remote, which relays them with UDPStreamHandler.
+// Datagrams written with WriteTo are sent by the remote to the address
+// given, the datagrams received by the remote are returned by ReadFrom
+// with their source address.  Closing the packet conn closes the stream.
+func (s *Connection) DialUDP(ctx context.Context) (net.PacketConn, error) {
+	stream, err := s.dialStream(ctx, StreamTypeUDP)
+	if err != nil {
+		return nil, err
+	}
+	return &streamPacketConn{stream: stream}, nil
+}
+
+// streamPacketConn is a net.PacketConn sending datagrams over a stream.
+type streamPacketConn struct {
+	stream *Stream
+}
+
+func (c *streamPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	data, addr, err := c.stream.ReadDatagram()
+	if err != nil {
+		return 0, nil, err
+	}
+	// like UDP sockets, datagrams larger than p are truncated
+	return copy(p, data), addr, nil
+}
+
+func (c *streamPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, net.InvalidAddrError("not a UDP address")
+	}
+	if err := c.stream.WriteDatagram(p, udpAddr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *streamPacketConn) Close() error {
+	return c.stream.Close()
+}
+
+func (c *streamPacketConn) LocalAddr() net.Addr {
+	return c.stream.LocalAddr()
+}
+
+func (c *streamPacketConn) SetDeadline(t time.Time) error {
+	return c.stream.SetDeadline(t)
+}
+
+func (c *streamPacketConn) SetReadDeadline(t time.Time) error {
+	return c.stream.SetReadDeadline(t)
+}
+
+func (c *streamPacketConn) SetWriteDeadline(t time.Time) error {
+	return c.stream.SetWriteDeadline(t)
+}
+
+// UDPStreamHandler returns a stream handler relaying the datagrams sent on
+// every stream from a new UDP socket, see RelayUDP.  If allow is set,
+// datagrams are only sent to the addresses it returns true for.  Streams
+// are reset when the socket cannot be opened.
+func UDPStreamHandler(allow func(addr *net.UDPAddr) bool) StreamHandler {
+	return func(stream *Stream) {
+		stream.conn.Go(func() {
+			pc, err := net.ListenUDP("udp", nil)
+			if err != nil {
+				debugMessage("(%p) (%d) Error opening udp socket: %s", stream, stream.streamId, err)
+				stream.Reset()
+				return
+			}
+			if err := stream.SendReply(http.Header{}, false); err != nil {
+				pc.Close()
+				return
+			}
+			if err := RelayUDP(stream, pc, allow); err != nil {
+				debugMessage("(%p) (%d) UDP relay error: %s", stream, stream.streamId, err)
+			}
+		})
+	}
+}
+
+// RelayUDP sends the datagrams read from the stream on pc to their
+// prefixed address, and the datagrams received on pc over the stream
+// prefixed with their source address, until the stream is closed.  If
+// allow is set, datagrams to addresses it returns false for are dropped.
+// pc is closed and the stream closed on return.
+func RelayUDP(stream *Stream, pc net.PacketConn, allow func(addr *net.UDPAddr) bool) error {
+	stream.conn.Go(func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udpAddr, ok := addr.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+			if err := stream.WriteDatagram(buf[:n], udpAddr); err != nil {
+				pc.Close()
+				return
+			}
+		}
+	})
+
+	defer stream.Close()
+	defer pc.Close()
+	for {
+		data, addr, err := stream.ReadDatagram()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if allow != nil && !allow(addr) {
+			debugMessage("(%p) (%d) Dropping datagram to %s", stream, stream.streamId, addr)
+			continue
+		}
+		if _, err := pc.WriteTo(data, addr); err != nil {
+			debugMessage("(%p) (%d) Error relaying datagram to %s: %s", stream, stream.streamId, addr, err)
+		}
+	}
+}
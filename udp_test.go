@@ -0,0 +1,118 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPRelay(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	blocked := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: echoAddr.Port + 1}
+
+	client, server := newTestConnections(t, nil, UDPStreamHandler(func(addr *net.UDPAddr) bool {
+		return addr.Port == echoAddr.Port
+	}))
+	defer server.Close()
+	defer client.Close()
+
+	pc, err := client.DialUDP(context.Background())
+	if err != nil {
+		t.Fatalf("Error dialing: %s", err)
+	}
+	defer pc.Close()
+
+	if _, err := pc.WriteTo([]byte("dropped"), blocked); err != nil {
+		t.Fatalf("Error writing datagram: %s", err)
+	}
+	for _, payload := range []string{"one", "two"} {
+		if _, err := pc.WriteTo([]byte(payload), echoAddr); err != nil {
+			t.Fatalf("Error writing datagram: %s", err)
+		}
+		pc.SetReadDeadline(time.Now().Add(10 * time.Second))
+		buf := make([]byte, 1024)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Error reading datagram: %s", err)
+		}
+		if string(buf[:n]) != payload {
+			t.Fatalf("Unexpected datagram:\nActual: %s\nExpected: %s", buf[:n], payload)
+		}
+		if addr.String() != echoAddr.String() {
+			t.Fatalf("Unexpected source:\nActual: %s\nExpected: %s", addr, echoAddr)
+		}
+	}
+
+	if _, err := pc.WriteTo([]byte("data"), &net.TCPAddr{}); err == nil {
+		t.Fatal("Expected error writing to a tcp address")
+	}
+}
+
+func TestDatagramEncoding(t *testing.T) {
+	client, server := newTestConnections(t, nil, MirrorStreamHandler)
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.CreateStream(nil, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	for _, addr := range []*net.UDPAddr{
+		{IP: net.IPv4(192, 0, 2, 1), Port: 53},
+		{IP: net.ParseIP("2001:db8::1"), Port: 65535},
+	} {
+		if err := stream.WriteDatagram([]byte("payload"), addr); err != nil {
+			t.Fatalf("Error writing datagram: %s", err)
+		}
+		data, actual, err := stream.ReadDatagram()
+		if err != nil {
+			t.Fatalf("Error reading datagram: %s", err)
+		}
+		if string(data) != "payload" || actual.String() != addr.String() {
+			t.Fatalf("Unexpected datagram:\nActual: %s %s\nExpected: payload %s", data, actual, addr)
+		}
+	}
+
+	if err := stream.WriteData([]byte{7, 1}, false); err != nil {
+		t.Fatalf("Error writing data: %s", err)
+	}
+	if _, _, err := stream.ReadDatagram(); err != ErrInvalidDatagram {
+		t.Fatalf("Unexpected error:\nActual: %v\nExpected: %v", err, ErrInvalidDatagram)
+	}
+	stream.Close()
+}
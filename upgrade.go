@@ -0,0 +1,107 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	HeaderConnection = "Connection"
+	HeaderUpgrade    = "Upgrade"
+
+	// UpgradeProtocol is the value of the Upgrade header used to
+	// switch an HTTP/1.1 connection to spdy.
+	UpgradeProtocol = "SPDY/3.1"
+)
+
+var (
+	ErrUpgradeRequired = errors.New("spdy upgrade required")
+	ErrHijackFailed    = errors.New("response writer does not support hijacking")
+)
+
+// Upgrade switches the HTTP/1.1 connection behind w to spdy. The request
+// must carry "Connection: Upgrade" and "Upgrade: SPDY/3.1" headers,
+// otherwise a 400 response is written and ErrUpgradeRequired returned.
+// On success the 101 response is sent, the connection is hijacked and a
+// server side Connection is returned, already serving new streams with
+// newHandler.
+func Upgrade(w http.ResponseWriter, req *http.Request, newHandler StreamHandler) (*Connection, error) {
+	if !headerContainsToken(req.Header, HeaderConnection, "upgrade") ||
+		!headerContainsToken(req.Header, HeaderUpgrade, UpgradeProtocol) {
+		http.Error(w, fmt.Sprintf("unable to upgrade: missing upgrade headers in request: %#v", req.Header), http.StatusBadRequest)
+		return nil, ErrUpgradeRequired
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, ErrHijackFailed.Error(), http.StatusInternalServerError)
+		return nil, ErrHijackFailed
+	}
+
+	w.Header().Set(HeaderConnection, "Upgrade")
+	w.Header().Set(HeaderUpgrade, UpgradeProtocol)
+	w.WriteHeader(http.StatusSwitchingProtocols)
+
+	netConn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	if bufrw != nil && bufrw.Reader.Buffered() > 0 {
+		// The client may have sent frames right behind the request,
+		// keep those bytes in front of the raw connection.
+		netConn = &bufferedConn{Conn: netConn, r: bufrw.Reader}
+	}
+
+	conn, err := NewConnection(netConn, true)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	go conn.Serve(newHandler)
+
+	return conn, nil
+}
+
+// headerContainsToken reports whether the comma separated values of
+// the named header contain token, compared case insensitively.
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bufferedConn reads through a buffered reader which may already hold
+// data read off the underlying connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
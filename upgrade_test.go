@@ -0,0 +1,109 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestUpgrade(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, err := Upgrade(w, req, MirrorStreamHandler); err != nil {
+			t.Errorf("Error upgrading connection: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatalf("Error dialing server: %s", err)
+	}
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(HeaderConnection, "Upgrade")
+	req.Header.Set(HeaderUpgrade, UpgradeProtocol)
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("Error writing request: %s", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("Error reading response: %s", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Unexpected status:\nActual: %d\nExpected: %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	if upgrade := resp.Header.Get(HeaderUpgrade); upgrade != UpgradeProtocol {
+		t.Fatalf("Unexpected upgrade header:\nActual: %q\nExpected: %q", upgrade, UpgradeProtocol)
+	}
+
+	spdyConn, err := NewConnection(conn, false)
+	if err != nil {
+		t.Fatalf("Error creating spdy connection: %s", err)
+	}
+	go spdyConn.Serve(NoOpStreamHandler)
+
+	stream, err := spdyConn.CreateStream(http.Header{}, nil, false)
+	if err != nil {
+		t.Fatalf("Error creating stream: %s", err)
+	}
+	if err := stream.Wait(); err != nil {
+		t.Fatalf("Error waiting for stream: %s", err)
+	}
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatalf("Error writing to stream: %s", err)
+	}
+	data, err := stream.ReadData()
+	if err != nil {
+		t.Fatalf("Error reading from stream: %s", err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Unexpected data:\nActual: %q\nExpected: %q", data, "hello")
+	}
+
+	stream.Reset()
+	spdyConn.Close()
+}
+
+func TestUpgradeMissingHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, err := Upgrade(w, req, MirrorStreamHandler); err != ErrUpgradeRequired {
+			t.Errorf("Unexpected upgrade error: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Error sending request: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Unexpected status:\nActual: %d\nExpected: %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,187 @@
+/*
+   Copyright 2014-2021 Docker Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spdystream
+
+import (
+	"errors"
+
+	"github.com/moby/spdystream/spdy"
+)
+
+var (
+	ErrInvalidCredit = errors.New("Invalid receive window credit")
+)
+
+const (
+	// DefaultReceiveWindow is the initial spdy/3 flow control window of
+	// a stream.
+	DefaultReceiveWindow = 64 * 1024
+
+	// maxReceiveWindow is the largest flow control window allowed by
+	// spdy/3.
+	maxReceiveWindow = 0x7fffffff
+)
+
+// WindowUpdatePolicy determines when WINDOW_UPDATE frames are sent for
+// the data consumed from a stream.  Connections do not enforce flow
+// control windows themselves, updates are only needed by peers which
+// stop sending once the window of a stream is exhausted.
+type WindowUpdatePolicy int
+
+const (
+	// WindowUpdateNone never sends window updates.  This is the
+	// default.
+	WindowUpdateNone WindowUpdatePolicy = iota
+	// WindowUpdateEager sends an update for every data frame consumed,
+	// keeping the window of the peer full at the cost of a control
+	// frame per data frame.
+	WindowUpdateEager
+	// WindowUpdateThreshold sends an update once the data consumed since
+	// the last update reaches the threshold fraction of the window,
+	// suited to bulk streams.
+	WindowUpdateThreshold
+	// WindowUpdateManual only sends updates on calls to
+	// Stream.UpdateWindow.
+	WindowUpdateManual
+	// WindowUpdateCredit leaves the window entirely to the application,
+	// which grants the remote credit with Stream.GrantCredit, for
+	// forwarding stream data into another credit based system with end
+	// to end backpressure.
+	WindowUpdateCredit
+)
+
+// SetWindowUpdatePolicy sets when window updates are sent for the data
+// consumed from streams, which is the data returned by Read, ReadData
+// and ReadFrames or dropped by DiscardRemaining.  threshold is the
+// fraction of DefaultReceiveWindow used by WindowUpdateThreshold, 0.5
+// if not between 0 and 1.  Must be called before Serve.
+func (s *Connection) SetWindowUpdatePolicy(policy WindowUpdatePolicy, threshold float64) {
+	if threshold <= 0 || threshold > 1 {
+		threshold = 0.5
+	}
+	s.windowUpdatePolicy = policy
+	s.windowUpdateThreshold = uint32(threshold * DefaultReceiveWindow)
+	if s.windowUpdateThreshold == 0 {
+		s.windowUpdateThreshold = 1
+	}
+}
+
+// UpdateWindow sends a window update for the data consumed from the
+// stream since the last update, if any.  It is meant for
+// WindowUpdateManual, but may be used with WindowUpdateEager and
+// WindowUpdateThreshold.
+func (s *Stream) UpdateWindow() error {
+	s.windowLock.Lock()
+	delta := s.consumedBytes
+	s.consumedBytes = 0
+	s.windowLock.Unlock()
+	if delta == 0 {
+		return nil
+	}
+	return s.sendWindowUpdate(delta)
+}
+
+// GrantCredit grants the remote n more bytes of receive window on the
+// stream, sending a window update, under WindowUpdateCredit.  The remote
+// starts with DefaultReceiveWindow bytes of credit; credit is used up by
+// the data consumed from the stream.  ErrInvalidCredit is returned if
+// the window would exceed the spdy/3 maximum.
+func (s *Stream) GrantCredit(n uint32) error {
+	if s.conn.windowUpdatePolicy != WindowUpdateCredit {
+		return ErrInvalidCredit
+	}
+	if n == 0 {
+		return nil
+	}
+	s.windowLock.Lock()
+	if DefaultReceiveWindow+s.credit+int64(n) > maxReceiveWindow {
+		s.windowLock.Unlock()
+		return ErrInvalidCredit
+	}
+	s.credit += int64(n)
+	s.windowLock.Unlock()
+	return s.sendWindowUpdate(n)
+}
+
+// ReceiveWindow returns the receive window left to the remote on the
+// stream under WindowUpdateCredit, which may be negative if the remote
+// does not enforce flow control.
+func (s *Stream) ReceiveWindow() int64 {
+	s.windowLock.Lock()
+	defer s.windowLock.Unlock()
+	return DefaultReceiveWindow + s.credit
+}
+
+// consume accounts for n bytes of data consumed from the stream,
+// sending a window update as required by the policy.
+func (s *Stream) consume(n int) {
+	policy := s.conn.windowUpdatePolicy
+	if policy == WindowUpdateNone || n == 0 {
+		return
+	}
+	if s.conn.dataChecksums {
+		n += checksumSize
+	}
+
+	s.windowLock.Lock()
+	if policy == WindowUpdateCredit {
+		s.credit -= int64(n)
+		s.windowLock.Unlock()
+		return
+	}
+	s.consumedBytes += uint32(n)
+	var delta uint32
+	if policy != WindowUpdateManual && s.conn.underMemoryPressure() {
+		// held back until the pressure is over, shrinking the window
+		s.windowLock.Unlock()
+		s.conn.holdWindowUpdate(s)
+		return
+	}
+	switch policy {
+	case WindowUpdateEager:
+		delta = s.consumedBytes
+	case WindowUpdateThreshold:
+		if s.consumedBytes >= s.conn.windowUpdateThreshold {
+			delta = s.consumedBytes
+		}
+	}
+	if delta > 0 {
+		s.consumedBytes = 0
+	}
+	s.windowLock.Unlock()
+
+	if delta > 0 {
+		if err := s.sendWindowUpdate(delta); err != nil {
+			debugMessage("(%p) (%d) Error sending window update: %s", s, s.streamId, err)
+		}
+	}
+}
+
+func (s *Stream) sendWindowUpdate(delta uint32) error {
+	s.closeLock.Lock()
+	remoteFinished := s.remoteFinished
+	s.closeLock.Unlock()
+	if remoteFinished {
+		// the remote sends no more data
+		return nil
+	}
+	frame := &spdy.WindowUpdateFrame{
+		StreamId:        s.streamId,
+		DeltaWindowSize: delta,
+	}
+	return s.conn.framer.WriteFrame(frame)
+}